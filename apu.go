@@ -0,0 +1,629 @@
+package main
+
+var lengthTable = [32]uint8{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+var dutyTable = [4][8]uint8{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+var triangleTable = [32]uint8{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// Non-linear mixer outputs, see the NESdev wiki APU Mixer page
+var pulseMixTable [31]float64
+var tndMixTable [203]float64
+
+func init() {
+	for i := 1; i < len(pulseMixTable); i++ {
+		pulseMixTable[i] = 95.52 / (8128.0/float64(i) + 100)
+	}
+	for i := 1; i < len(tndMixTable); i++ {
+		tndMixTable[i] = 163.67 / (24329.0/float64(i) + 100)
+	}
+}
+
+// Envelope generator shared by the pulse and noise channels
+type Envelope struct {
+	Loop     bool // also halts the length counter
+	Constant bool
+	Volume   uint8 // constant volume, or the divider period
+	Start    bool
+	Divider  uint8
+	Decay    uint8
+}
+
+func (e *Envelope) write(value uint8) {
+	e.Loop = getBit(value, 5)
+	e.Constant = getBit(value, 4)
+	e.Volume = value & 0x0F
+}
+
+func (e *Envelope) clock() {
+	if e.Start {
+		e.Start = false
+		e.Decay = 15
+		e.Divider = e.Volume
+		return
+	}
+	if e.Divider > 0 {
+		e.Divider--
+		return
+	}
+	e.Divider = e.Volume
+	if e.Decay > 0 {
+		e.Decay--
+	} else if e.Loop {
+		e.Decay = 15
+	}
+}
+
+func (e *Envelope) output() uint8 {
+	if e.Constant {
+		return e.Volume
+	}
+	return e.Decay
+}
+
+type Pulse struct {
+	Enabled bool
+	// Pulse 1 negates the sweep with ones' complement, pulse 2 with twos' complement
+	OnesComplement bool
+	// The MMC5 pulses have no sweep unit, so nothing mutes them
+	NoSweep bool
+
+	Duty        uint8
+	DutyStep    uint8
+	Timer       uint16
+	TimerPeriod uint16
+	Length      uint8
+	Envelope    Envelope
+
+	SweepEnabled bool
+	SweepPeriod  uint8
+	SweepNegate  bool
+	SweepShift   uint8
+	SweepReload  bool
+	SweepDivider uint8
+}
+
+func (p *Pulse) write(register uint16, value uint8) {
+	switch register {
+	case 0:
+		p.Duty = value >> 6
+		p.Envelope.write(value)
+	case 1:
+		p.SweepEnabled = getBit(value, 7)
+		p.SweepPeriod = value >> 4 & 7
+		p.SweepNegate = getBit(value, 3)
+		p.SweepShift = value & 7
+		p.SweepReload = true
+	case 2:
+		p.TimerPeriod = p.TimerPeriod&0x700 | uint16(value)
+	case 3:
+		p.TimerPeriod = p.TimerPeriod&0xFF | uint16(value&7)<<8
+		if p.Enabled {
+			p.Length = lengthTable[value>>3]
+		}
+		p.DutyStep = 0
+		p.Envelope.Start = true
+	}
+}
+
+// Clocked every other CPU cycle
+func (p *Pulse) clockTimer() {
+	if p.Timer > 0 {
+		p.Timer--
+		return
+	}
+	p.Timer = p.TimerPeriod
+	p.DutyStep = (p.DutyStep + 1) & 7
+}
+
+func (p *Pulse) sweepTarget() uint16 {
+	change := p.TimerPeriod >> p.SweepShift
+	if !p.SweepNegate {
+		return p.TimerPeriod + change
+	}
+	if p.OnesComplement {
+		change++
+	}
+	if change > p.TimerPeriod {
+		return 0
+	}
+	return p.TimerPeriod - change
+}
+
+// The sweep unit silences the channel whether or not it is enabled
+func (p *Pulse) muted() bool {
+	if p.NoSweep {
+		return false
+	}
+	return p.TimerPeriod < 8 || p.sweepTarget() > 0x7FF
+}
+
+func (p *Pulse) clockSweep() {
+	if p.SweepDivider == 0 && p.SweepEnabled && p.SweepShift > 0 && !p.muted() {
+		p.TimerPeriod = p.sweepTarget()
+	}
+	if p.SweepDivider == 0 || p.SweepReload {
+		p.SweepDivider = p.SweepPeriod
+		p.SweepReload = false
+	} else {
+		p.SweepDivider--
+	}
+}
+
+func (p *Pulse) clockLength() {
+	if !p.Envelope.Loop && p.Length > 0 {
+		p.Length--
+	}
+}
+
+func (p *Pulse) output() uint8 {
+	if p.Length == 0 || p.muted() || dutyTable[p.Duty][p.DutyStep] == 0 {
+		return 0
+	}
+	return p.Envelope.output()
+}
+
+type Triangle struct {
+	Enabled bool
+
+	Control      bool // also halts the length counter
+	LinearReload uint8
+	Linear       uint8
+	ReloadFlag   bool
+	Step         uint8
+	Timer        uint16
+	TimerPeriod  uint16
+	Length       uint8
+}
+
+func (t *Triangle) write(register uint16, value uint8) {
+	switch register {
+	case 0:
+		t.Control = getBit(value, 7)
+		t.LinearReload = value & 0x7F
+	case 2:
+		t.TimerPeriod = t.TimerPeriod&0x700 | uint16(value)
+	case 3:
+		t.TimerPeriod = t.TimerPeriod&0xFF | uint16(value&7)<<8
+		if t.Enabled {
+			t.Length = lengthTable[value>>3]
+		}
+		t.ReloadFlag = true
+	}
+}
+
+// Clocked every CPU cycle. Periods below 2 are ultrasonic and are held instead of stepped
+func (t *Triangle) clockTimer() {
+	if t.Timer > 0 {
+		t.Timer--
+		return
+	}
+	t.Timer = t.TimerPeriod
+	if t.Length > 0 && t.Linear > 0 && t.TimerPeriod >= 2 {
+		t.Step = (t.Step + 1) & 31
+	}
+}
+
+func (t *Triangle) clockLinear() {
+	if t.ReloadFlag {
+		t.Linear = t.LinearReload
+	} else if t.Linear > 0 {
+		t.Linear--
+	}
+	if !t.Control {
+		t.ReloadFlag = false
+	}
+}
+
+func (t *Triangle) clockLength() {
+	if !t.Control && t.Length > 0 {
+		t.Length--
+	}
+}
+
+func (t *Triangle) output() uint8 {
+	return triangleTable[t.Step]
+}
+
+type Noise struct {
+	Enabled bool
+
+	Mode        bool
+	Shift       uint16
+	Timer       uint16
+	TimerPeriod uint16
+	Length      uint8
+	Envelope    Envelope
+}
+
+// periods are the noise timer periods of the region in CPU cycles
+func (n *Noise) write(register uint16, value uint8, periods *[16]uint16) {
+	switch register {
+	case 0:
+		n.Envelope.write(value)
+	case 2:
+		n.Mode = getBit(value, 7)
+		n.TimerPeriod = periods[value&0x0F]
+	case 3:
+		if n.Enabled {
+			n.Length = lengthTable[value>>3]
+		}
+		n.Envelope.Start = true
+	}
+}
+
+// Clocked every CPU cycle
+func (n *Noise) clockTimer() {
+	if n.Timer > 0 {
+		n.Timer--
+		return
+	}
+	n.Timer = n.TimerPeriod - 1
+	tap := uint16(1)
+	if n.Mode {
+		tap = 6
+	}
+	feedback := (n.Shift ^ n.Shift>>tap) & 1
+	n.Shift = n.Shift>>1 | feedback<<14
+}
+
+func (n *Noise) clockLength() {
+	if !n.Envelope.Loop && n.Length > 0 {
+		n.Length--
+	}
+}
+
+func (n *Noise) output() uint8 {
+	if n.Length == 0 || n.Shift&1 == 1 {
+		return 0
+	}
+	return n.Envelope.output()
+}
+
+// DMC plays 1 bit delta encoded samples fetched from $C000-$FFFF
+type DMC struct {
+	IRQEnabled bool
+	IRQ        bool
+	Loop       bool
+
+	Timer       uint16
+	TimerPeriod uint16
+	Level       uint8
+
+	SampleAddress uint16
+	SampleLength  uint16
+	Address       uint16
+	Remaining     uint16
+
+	Buffer      uint8
+	BufferEmpty bool
+	Shift       uint8
+	Bits        uint8
+	Silence     bool
+}
+
+// rates are the DMC timer periods of the region in CPU cycles
+func (d *DMC) write(register uint16, value uint8, rates *[16]uint16) {
+	switch register {
+	case 0:
+		d.IRQEnabled = getBit(value, 7)
+		d.Loop = getBit(value, 6)
+		d.TimerPeriod = rates[value&0x0F]
+		if !d.IRQEnabled {
+			d.IRQ = false
+		}
+	case 1:
+		d.Level = value & 0x7F
+	case 2:
+		d.SampleAddress = 0xC000 | uint16(value)<<6
+	case 3:
+		d.SampleLength = uint16(value)<<4 | 1
+	}
+}
+
+func (d *DMC) restart() {
+	d.Address = d.SampleAddress
+	d.Remaining = d.SampleLength
+}
+
+// Refills the sample buffer through the CPU bus, DMA stalls are not emulated
+func (d *DMC) fetch(cpu *CPU) {
+	if !d.BufferEmpty || d.Remaining == 0 {
+		return
+	}
+	d.Buffer = cpu.read(d.Address)
+	if cpu.CDL != nil {
+		cpu.CDL.logPCM(cpu, d.Address)
+	}
+	d.BufferEmpty = false
+	if d.Address == 0xFFFF {
+		d.Address = 0x8000
+	} else {
+		d.Address++
+	}
+	d.Remaining--
+	if d.Remaining == 0 {
+		if d.Loop {
+			d.restart()
+		} else if d.IRQEnabled {
+			d.IRQ = true
+		}
+	}
+}
+
+// Clocked every CPU cycle
+func (d *DMC) clockTimer(cpu *CPU) {
+	d.fetch(cpu)
+	if d.Timer > 0 {
+		d.Timer--
+		return
+	}
+	d.Timer = d.TimerPeriod - 1
+
+	if !d.Silence {
+		if d.Shift&1 == 1 {
+			if d.Level <= 125 {
+				d.Level += 2
+			}
+		} else if d.Level >= 2 {
+			d.Level -= 2
+		}
+	}
+	d.Shift >>= 1
+
+	if d.Bits > 0 {
+		d.Bits--
+	}
+	if d.Bits == 0 {
+		d.Bits = 8
+		d.Silence = d.BufferEmpty
+		if !d.BufferEmpty {
+			d.Shift = d.Buffer
+			d.BufferEmpty = true
+			d.fetch(cpu)
+		}
+	}
+}
+
+func (d *DMC) output() uint8 {
+	return d.Level
+}
+
+// FrameCounter clocks the envelopes, length counters and sweeps at about 240Hz
+type FrameCounter struct {
+	FiveStep   bool
+	IRQInhibit bool
+	IRQ        bool
+	Cycle      uint16
+	Step       uint8
+}
+
+// Sound chips outside the 2A03, clocked by their mapper and mixed on top of the APU
+type ExpansionAudio interface {
+	// Level in the same 0-1 units as mixAPU
+	output() float64
+}
+
+/*
+APU is the 2A03 sound hardware: two pulse channels, triangle, noise and DMC, driven
+by the frame counter and mixed the way the NES mixes them.
+*/
+type APU struct {
+	Pulse    [2]Pulse
+	Triangle Triangle
+	Noise    Noise
+	DMC      DMC
+	Frame    FrameCounter
+
+	// Cycles since power-on, the pulse timers run on every other one
+	Cycle uint64
+
+	// Optional sound chip of the cartridge or disk system
+	Expansion ExpansionAudio
+
+	cpu    *CPU
+	region *Region
+}
+
+func NewAPU(cpu *CPU, region *Region) *APU {
+	apu := &APU{cpu: cpu, region: region}
+	apu.reset()
+	return apu
+}
+
+// Returns the channels to their power-on state, keeping the region and the expansion chip
+func (apu *APU) reset() {
+	*apu = APU{cpu: apu.cpu, region: apu.region, Expansion: apu.Expansion}
+	apu.Pulse[0].OnesComplement = true
+	apu.Noise.Shift = 1
+	apu.Noise.TimerPeriod = apu.region.NoiseTable[0]
+	apu.DMC.TimerPeriod = apu.region.DMCTable[0]
+	apu.DMC.Bits = 8
+	apu.DMC.BufferEmpty = true
+}
+
+// Handles writes to $4000-$4013, $4015 and $4017
+func (apu *APU) write(address uint16, value uint8) {
+	switch {
+	case address < 0x4004:
+		apu.Pulse[0].write(address&3, value)
+	case address < 0x4008:
+		apu.Pulse[1].write(address&3, value)
+	case address < 0x400C:
+		apu.Triangle.write(address&3, value)
+	case address < 0x4010:
+		apu.Noise.write(address&3, value, &apu.region.NoiseTable)
+	case address < 0x4014:
+		apu.DMC.write(address&3, value, &apu.region.DMCTable)
+	case address == 0x4015:
+		apu.writeStatus(value)
+	case address == 0x4017:
+		apu.Frame.FiveStep = getBit(value, 7)
+		apu.Frame.IRQInhibit = getBit(value, 6)
+		if apu.Frame.IRQInhibit {
+			apu.Frame.IRQ = false
+		}
+		apu.Frame.Cycle = 0
+		apu.Frame.Step = 0
+		if apu.Frame.FiveStep {
+			apu.quarterFrame()
+			apu.halfFrame()
+		}
+	}
+}
+
+func (apu *APU) writeStatus(value uint8) {
+	apu.Pulse[0].Enabled = getBit(value, 0)
+	apu.Pulse[1].Enabled = getBit(value, 1)
+	apu.Triangle.Enabled = getBit(value, 2)
+	apu.Noise.Enabled = getBit(value, 3)
+	for i := range apu.Pulse {
+		if !apu.Pulse[i].Enabled {
+			apu.Pulse[i].Length = 0
+		}
+	}
+	if !apu.Triangle.Enabled {
+		apu.Triangle.Length = 0
+	}
+	if !apu.Noise.Enabled {
+		apu.Noise.Length = 0
+	}
+
+	d := &apu.DMC
+	d.IRQ = false
+	if !getBit(value, 4) {
+		d.Remaining = 0
+	} else if d.Remaining == 0 {
+		d.restart()
+	}
+}
+
+// $4015 reads the length counter and IRQ status, reading acknowledges the frame IRQ
+func (apu *APU) readStatus() uint8 {
+	var status uint8
+	if apu.Pulse[0].Length > 0 {
+		status |= 0x01
+	}
+	if apu.Pulse[1].Length > 0 {
+		status |= 0x02
+	}
+	if apu.Triangle.Length > 0 {
+		status |= 0x04
+	}
+	if apu.Noise.Length > 0 {
+		status |= 0x08
+	}
+	if apu.DMC.Remaining > 0 {
+		status |= 0x10
+	}
+	if apu.Frame.IRQ {
+		status |= 0x40
+	}
+	if apu.DMC.IRQ {
+		status |= 0x80
+	}
+	apu.Frame.IRQ = false
+	return status
+}
+
+// The IRQ line, polled by the runner before every instruction
+func (apu *APU) IRQ() bool {
+	return apu.Frame.IRQ || apu.DMC.IRQ
+}
+
+func (apu *APU) quarterFrame() {
+	apu.Pulse[0].Envelope.clock()
+	apu.Pulse[1].Envelope.clock()
+	apu.Noise.Envelope.clock()
+	apu.Triangle.clockLinear()
+}
+
+func (apu *APU) halfFrame() {
+	for i := range apu.Pulse {
+		apu.Pulse[i].clockLength()
+		apu.Pulse[i].clockSweep()
+	}
+	apu.Triangle.clockLength()
+	apu.Noise.clockLength()
+}
+
+func (apu *APU) clockFrameCounter() {
+	f := &apu.Frame
+	f.Cycle++
+	steps := apu.region.FrameSteps4[:]
+	if f.FiveStep {
+		steps = apu.region.FrameSteps5[:]
+	}
+	// The sequence restarts the cycle after its last step, so a 4-step frame is 29830 cycles
+	if int(f.Step) == len(steps) {
+		f.Cycle = 0
+		f.Step = 0
+		return
+	}
+	if f.Cycle != steps[f.Step] {
+		return
+	}
+
+	last := int(f.Step) == len(steps)-1
+	switch {
+	case f.FiveStep && f.Step == 3:
+		// The fourth step of the 5-step sequence does nothing
+	case f.Step == 1 || last:
+		apu.quarterFrame()
+		apu.halfFrame()
+	default:
+		apu.quarterFrame()
+	}
+	if last && !f.FiveStep && !f.IRQInhibit {
+		f.IRQ = true
+	}
+	f.Step++
+}
+
+// Runs the APU for one CPU cycle
+func (apu *APU) Clock() {
+	apu.clockFrameCounter()
+	if apu.Cycle&1 == 1 {
+		apu.Pulse[0].clockTimer()
+		apu.Pulse[1].clockTimer()
+	}
+	apu.Triangle.clockTimer()
+	apu.Noise.clockTimer()
+	apu.DMC.clockTimer(apu.cpu)
+	apu.Cycle++
+}
+
+// Current level of each channel, pulse 1, pulse 2, triangle, noise and DMC
+func (apu *APU) channelOutputs() [5]uint8 {
+	return [5]uint8{
+		apu.Pulse[0].output(),
+		apu.Pulse[1].output(),
+		apu.Triangle.output(),
+		apu.Noise.output(),
+		apu.DMC.output(),
+	}
+}
+
+// Output of the expansion sound chip, zero without one
+func (apu *APU) expansionOutput() float64 {
+	if apu.Expansion == nil {
+		return 0
+	}
+	return apu.Expansion.output()
+}
+
+// Mixes channel levels into the 0-1 output of the NES
+func mixAPU(levels [5]uint8) float64 {
+	return pulseMixTable[levels[0]+levels[1]] + tndMixTable[3*int(levels[2])+2*int(levels[3])+int(levels[4])]
+}
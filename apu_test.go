@@ -0,0 +1,359 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Difference between the loudest and quietest output over cycles CPU cycles
+func peakToPeak(cycles int, clock func(), output func() float64) float64 {
+	low, high := math.Inf(1), math.Inf(-1)
+	for i := 0; i < cycles; i++ {
+		clock()
+		level := output()
+		low, high = min(low, level), max(high, level)
+	}
+	return high - low
+}
+
+// Plays one channel of a mapper's sound chip at full volume after setup writes
+func expansionLevel(m Mapper, writes ...[2]uint16) float64 {
+	newMapperCPU(m)
+	for _, w := range writes {
+		m.Write(w[0], uint8(w[1]))
+	}
+	audio := m.(audioMapper).Audio()
+	return peakToPeak(50000, m.Clock, audio.output)
+}
+
+/*
+Each expansion channel at full volume against a 2A03 pulse at full volume, the levels
+the chips are documented to mix at
+*/
+func TestExpansionAudioLevels(t *testing.T) {
+	apu := NewAPU(&CPU{}, regionNTSC)
+	for _, w := range [][2]uint16{{0x4015, 0x01}, {0x4000, 0xBF}, {0x4002, 0x40}, {0x4003, 0x00}} {
+		apu.write(w[0], uint8(w[1]))
+	}
+	pulse := peakToPeak(50000, apu.Clock, func() float64 { return mixAPU(apu.channelOutputs()) })
+	if math.Abs(pulse-pulseMixTable[15]) > 1e-9 {
+		t.Fatalf("2A03 pulse peak to peak %v, want %v", pulse, pulseMixTable[15])
+	}
+
+	n163 := NewNamco163(numberedBanks(8, 0x2000))
+	n163.Sound.Channel = 7
+	tests := []struct {
+		name      string
+		level     float64
+		want      float64
+		tolerance float64
+	}{
+		{
+			"mmc5 pulse",
+			expansionLevel(NewMMC5(numberedBanks(8, 0x2000), nil), [2]uint16{0x5015, 0x01}, [2]uint16{0x5000, 0xBF}, [2]uint16{0x5002, 0x40}, [2]uint16{0x5003, 0x00}),
+			1, 1e-9,
+		},
+		{
+			"vrc6 pulse",
+			expansionLevel(NewVRC6(numberedBanks(8, 0x4000), false), [2]uint16{0x9000, 0x7F}, [2]uint16{0x9001, 0x40}, [2]uint16{0x9002, 0x80}),
+			1, 1e-9,
+		},
+		{
+			"sunsoft 5b square",
+			expansionLevel(NewFME7(numberedBanks(8, 0x2000), nil), [2]uint16{0xC000, 7}, [2]uint16{0xE000, 0x3E}, [2]uint16{0xC000, 0}, [2]uint16{0xE000, 0x10}, [2]uint16{0xC000, 8}, [2]uint16{0xE000, 0x0F}),
+			1, 1e-9,
+		},
+		{
+			// A wave of samples 0 and 15, the loudest a channel plays, is about twice a pulse
+			"namco 163 channel",
+			expansionLevel(n163,
+				[2]uint16{0xF800, 0x80}, [2]uint16{0x4800, 0xF0}, [2]uint16{0x4800, 0xF0},
+				[2]uint16{0xF800, 0x80 | 0x7C}, [2]uint16{0x4800, 0xFD}, [2]uint16{0x4800, 0x00}, [2]uint16{0x4800, 0x00}, [2]uint16{0x4800, 0x0F}),
+			2, 0.25,
+		},
+		{
+			// A sine carrier with the modulator turned down as far as it goes
+			"vrc7 channel",
+			expansionLevel(NewVRC7(numberedBanks(8, 0x2000)),
+				[2]uint16{0x9010, 0x02}, [2]uint16{0x9030, 0x3F}, [2]uint16{0x9010, 0x05}, [2]uint16{0x9030, 0xF0},
+				[2]uint16{0x9010, 0x01}, [2]uint16{0x9030, 0x21},
+				[2]uint16{0x9010, 0x10}, [2]uint16{0x9030, 0x00}, [2]uint16{0x9010, 0x20}, [2]uint16{0x9030, 0x19}),
+			1, 0.1,
+		},
+	}
+	for _, test := range tests {
+		if ratio := test.level / pulse; math.Abs(ratio-test.want) > test.tolerance {
+			t.Errorf("%s is %.3f times a 2A03 pulse, want %v", test.name, ratio, test.want)
+		}
+	}
+}
+
+func TestFrameCounterIRQ(t *testing.T) {
+	apu := NewAPU(&CPU{}, regionNTSC)
+	apu.write(0x4017, 0x00)
+	for i := 1; i < 29829; i++ {
+		apu.Clock()
+		if apu.IRQ() {
+			t.Fatalf("frame IRQ after %d cycles", i)
+		}
+	}
+	apu.Clock()
+	if !apu.IRQ() {
+		t.Fatal("no frame IRQ at the end of the 4-step sequence")
+	}
+	if status := apu.readStatus(); status&0x40 == 0 || apu.IRQ() {
+		t.Fatalf("$4015 read $%02X and left the IRQ at %v", status, apu.IRQ())
+	}
+
+	// The next one comes a whole 29830 cycle frame later
+	cycles := 0
+	for !apu.IRQ() {
+		apu.Clock()
+		cycles++
+	}
+	if cycles != 29830 {
+		t.Errorf("frame IRQs %d cycles apart, want 29830", cycles)
+	}
+
+	for _, value := range []uint8{0x80, 0x40} {
+		apu.write(0x4017, value)
+		if apu.IRQ() && value == 0x40 {
+			t.Error("setting the inhibit flag did not clear the IRQ")
+		}
+		apu.Frame.IRQ = false
+		for i := 0; i < 2*37282; i++ {
+			apu.Clock()
+		}
+		if apu.IRQ() {
+			t.Errorf("$4017 = $%02X raised a frame IRQ", value)
+		}
+	}
+}
+
+func TestFrameCounterClocks(t *testing.T) {
+	// A halted length counter only counts half frames, so count its clocks through length
+	tests := []struct {
+		control uint8
+		cycles  int
+		halves  int
+	}{
+		{0x00, 29830, 2},
+		{0x00, 2 * 29830, 4},
+		{0x80, 37282, 2 + 1}, // the write itself clocks a half frame in 5-step mode
+	}
+	for _, test := range tests {
+		apu := NewAPU(&CPU{}, regionNTSC)
+		apu.write(0x4015, 0x01)
+		apu.write(0x4003, 0x00) // length 10
+		apu.write(0x4017, test.control)
+		for i := 0; i < test.cycles; i++ {
+			apu.Clock()
+		}
+		if halves := 10 - int(apu.Pulse[0].Length); halves != test.halves {
+			t.Errorf("$4017 = $%02X: %d half frames in %d cycles, want %d", test.control, halves, test.cycles, test.halves)
+		}
+	}
+}
+
+func TestPulseSequencer(t *testing.T) {
+	for duty := uint8(0); duty < 4; duty++ {
+		p := &Pulse{Enabled: true}
+		p.write(0, duty<<6|0x3F) // constant volume 15, halted length
+		p.write(2, 0x10)
+		p.write(3, 0x00)
+		var got [8]uint8
+		for step := range got {
+			for p.Timer > 0 {
+				p.clockTimer()
+			}
+			p.clockTimer()
+			if p.Timer != 0x10 {
+				t.Fatalf("timer reloaded with %d, want the period 16", p.Timer)
+			}
+			got[step] = p.output() / 15
+		}
+		// Each step moves on before the output is read, so the table starts at step 1
+		var want [8]uint8
+		for step := range want {
+			want[step] = dutyTable[duty][(step+1)&7]
+		}
+		if got != want {
+			t.Errorf("duty %d played %v, want %v", duty, got, want)
+		}
+	}
+}
+
+func TestPulseSweep(t *testing.T) {
+	tests := []struct {
+		name   string
+		ones   bool
+		sweep  uint8
+		period uint16
+		target uint16
+		muted  bool
+	}{
+		{"add", true, 0x81, 0x100, 0x180, false},
+		{"ones' complement negate", true, 0x89, 0x100, 0x7F, false},
+		{"twos' complement negate", false, 0x89, 0x100, 0x80, false},
+		{"target overflow mutes", false, 0x01, 0x600, 0x900, true},
+		{"short period mutes", false, 0x00, 0x007, 0x00E, true},
+	}
+	for _, test := range tests {
+		p := &Pulse{Enabled: true, OnesComplement: test.ones}
+		p.write(0, 0x3F)
+		p.write(1, test.sweep)
+		p.TimerPeriod = test.period
+		if target := p.sweepTarget(); target != test.target {
+			t.Errorf("%s: target $%03X, want $%03X", test.name, target, test.target)
+		}
+		if p.muted() != test.muted {
+			t.Errorf("%s: muted %v, want %v", test.name, p.muted(), test.muted)
+		}
+	}
+
+	// An enabled sweep with period 0 updates the period every half frame
+	p := &Pulse{}
+	p.write(1, 0x81)
+	p.TimerPeriod = 0x100
+	for _, want := range []uint16{0x180, 0x240} {
+		p.clockSweep()
+		if p.TimerPeriod != want {
+			t.Errorf("period $%03X after a sweep, want $%03X", p.TimerPeriod, want)
+		}
+	}
+}
+
+func TestTriangleSequencer(t *testing.T) {
+	tri := &Triangle{Enabled: true}
+	tri.write(0, 0x81)
+	tri.write(2, 0x04)
+	tri.write(3, 0x00)
+	tri.clockLinear()
+	var got [32]uint8
+	for step := range got {
+		for tri.Timer > 0 {
+			tri.clockTimer()
+		}
+		tri.clockTimer()
+		got[step] = tri.output()
+	}
+	want := [32]uint8{}
+	for step := range want {
+		want[step] = triangleTable[(step+1)&31]
+	}
+	if got != want {
+		t.Errorf("triangle played %v, want %v", got, want)
+	}
+
+	// Ultrasonic periods and an expired linear counter hold the step
+	tests := []struct {
+		name   string
+		period uint16
+		linear uint8
+	}{
+		{"period 1", 1, 1},
+		{"linear counter 0", 4, 0},
+	}
+	for _, test := range tests {
+		tri := &Triangle{Length: 10, Linear: test.linear, TimerPeriod: test.period, Step: 5}
+		for i := 0; i < 100; i++ {
+			tri.clockTimer()
+		}
+		if tri.Step != 5 {
+			t.Errorf("%s: step moved to %d", test.name, tri.Step)
+		}
+	}
+}
+
+func TestNoiseSequencer(t *testing.T) {
+	tests := []struct {
+		mode   uint8
+		length int
+	}{
+		{0x00, 32767},
+		{0x80, 93},
+	}
+	for _, test := range tests {
+		apu := NewAPU(&CPU{}, regionNTSC)
+		apu.write(0x400E, test.mode)
+		n := &apu.Noise
+		steps := 0
+		for {
+			shift := n.Shift
+			apu.Clock()
+			if n.Shift != shift {
+				steps++
+				if n.Shift == 1 {
+					break
+				}
+			}
+			if steps > 40000 {
+				t.Fatalf("mode $%02X: the shift register never returned to 1", test.mode)
+			}
+		}
+		if steps != test.length {
+			t.Errorf("mode $%02X: sequence of %d, want %d", test.mode, steps, test.length)
+		}
+	}
+
+	// Period index 3 on NTSC is 32 cycles a step
+	apu := NewAPU(&CPU{}, regionNTSC)
+	apu.write(0x400E, 0x03)
+	steps := 0
+	for i := 0; i < 32*10; i++ {
+		shift := apu.Noise.Shift
+		apu.Clock()
+		if apu.Noise.Shift != shift {
+			steps++
+		}
+	}
+	if steps != 10 {
+		t.Errorf("%d noise steps in 320 cycles at period 32, want 10", steps)
+	}
+}
+
+func TestDMC(t *testing.T) {
+	prg := testPRG()
+	prg[0x4000] = 0xFF // $C000, every bit raises the level
+	r := newTestRunner(&NROM{prg: prg})
+	apu := r.cpu.APU
+	apu.write(0x4010, 0x8F) // IRQ, rate 54
+	// Let the output unit finish the cycle it started at power-on, so it is silent
+	for i := 0; i < 9*54; i++ {
+		apu.Clock()
+	}
+	apu.write(0x4011, 0x40)
+	apu.write(0x4012, 0x00)
+	apu.write(0x4013, 0x00) // 1 byte
+	apu.write(0x4015, 0x10)
+	if status := apu.readStatus(); status&0x10 == 0 {
+		t.Fatalf("$4015 read $%02X, want the DMC active", status)
+	}
+
+	for i := 0; i < 20*54; i++ {
+		apu.Clock()
+	}
+	if apu.DMC.Level != 0x50 {
+		t.Errorf("level $%02X after the sample, want $50", apu.DMC.Level)
+	}
+	if !apu.IRQ() {
+		t.Error("finishing the sample did not raise the DMC IRQ")
+	}
+	if status := apu.readStatus(); status != 0x80 {
+		t.Errorf("$4015 read $%02X, want only the DMC IRQ", status)
+	}
+	apu.write(0x4015, 0x00)
+	if apu.IRQ() {
+		t.Error("writing $4015 did not acknowledge the DMC IRQ")
+	}
+
+	// The level saturates rather than wrapping
+	apu.write(0x4011, 0x7E)
+	apu.write(0x4015, 0x10)
+	for i := 0; i < 20*54; i++ {
+		apu.Clock()
+	}
+	if apu.DMC.Level != 0x7E {
+		t.Errorf("level $%02X, want it held at $7E", apu.DMC.Level)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Width of the band-limited step in output samples and the number of sub-sample phases
+const (
+	blipTaps   = 16
+	blipPhases = 64
+)
+
+// Cutoff of the resampling filter as a fraction of the output sample rate
+const blipCutoff = 0.45
+
+// Names of the stem files, in the order of APU.channelOutputs
+var stemNames = [5]string{"pulse1", "pulse2", "triangle", "noise", "dmc"}
+
+/*
+Impulse response of a Blackman windowed sinc lowpass, sampled at each sub-sample
+phase. Every phase sums to 1 so a step settles at exactly its height.
+*/
+var blipKernel [blipPhases][blipTaps]float64
+
+func init() {
+	center := float64(blipTaps / 2)
+	for phase := range blipKernel {
+		var sum float64
+		for i := range blipKernel[phase] {
+			x := float64(i) - center + 1 - float64(phase)/blipPhases
+			h := 2 * blipCutoff
+			if x != 0 {
+				h = math.Sin(2*math.Pi*blipCutoff*x) / (math.Pi * x)
+			}
+			w := 0.0
+			if math.Abs(x) < center {
+				w = 0.42 + 0.5*math.Cos(math.Pi*x/center) + 0.08*math.Cos(2*math.Pi*x/center)
+			}
+			blipKernel[phase][i] = h * w
+			sum += h * w
+		}
+		for i := range blipKernel[phase] {
+			blipKernel[phase][i] /= sum
+		}
+	}
+}
+
+// First order highpass, the NES output stage has two of these at 90Hz and 440Hz
+type highPass struct {
+	alpha float64
+	x     float64
+	y     float64
+}
+
+func newHighPass(cutoff float64, rate int) highPass {
+	rc := 1 / (2 * math.Pi * cutoff)
+	return highPass{alpha: rc / (rc + 1/float64(rate))}
+}
+
+func (hp *highPass) filter(x float64) float64 {
+	hp.y = hp.alpha * (hp.y + x - hp.x)
+	hp.x = x
+	return hp.y
+}
+
+/*
+resampler turns a signal sampled every CPU cycle into the output rate. The APU output
+only changes in steps, so each change adds a band-limited step to the output instead
+of filtering every input cycle. Output lags the input by half the kernel width.
+*/
+type resampler struct {
+	ratio float64 // output samples per CPU cycle
+	time  float64 // position of the current cycle in output samples, relative to buf[0]
+	level float64
+	buf   []float64 // differences still to be summed into output samples
+	sum   float64
+	hp    [2]highPass
+}
+
+// clock is the CPU clock in Hz
+func newResampler(rate int, clock float64) *resampler {
+	return &resampler{
+		ratio: float64(rate) / clock,
+		hp:    [2]highPass{newHighPass(90, rate), newHighPass(440, rate)},
+	}
+}
+
+// Adds the level for one CPU cycle
+func (rs *resampler) add(level float64) {
+	if level != rs.level {
+		delta := level - rs.level
+		rs.level = level
+		i := int(rs.time)
+		for len(rs.buf) < i+blipTaps {
+			rs.buf = append(rs.buf, 0)
+		}
+		kernel := &blipKernel[int((rs.time-float64(i))*blipPhases)]
+		for j, k := range kernel {
+			rs.buf[i+j] += delta * k
+		}
+	}
+	rs.time += rs.ratio
+}
+
+// Returns the output samples that no later input can change
+func (rs *resampler) read() []int16 {
+	n := int(rs.time)
+	for len(rs.buf) < n {
+		rs.buf = append(rs.buf, 0)
+	}
+	out := make([]int16, n)
+	for i := range out {
+		rs.sum += rs.buf[i]
+		v := rs.hp[1].filter(rs.hp[0].filter(rs.sum))
+		out[i] = int16(math.Max(-1, math.Min(1, v)) * 32767)
+	}
+	rs.buf = rs.buf[:copy(rs.buf, rs.buf[n:])]
+	rs.time -= float64(n)
+	return out
+}
+
+/*
+AudioRecorder captures the mixed APU output to a WAV file, and optionally each channel
+on its own to a stem file named after the main one, e.g. music.triangle.wav.
+*/
+type AudioRecorder struct {
+	Rate int
+	// Scales everything recorded, lowered to fade out
+	Volume float64
+
+	// Index 0 is the mix, followed by the stems when they are recorded
+	resamplers []*resampler
+	writers    []*wavWriter
+	files      []*os.File
+	err        error
+}
+
+func newAudioRecorder(rate int, region *Region, outputs []io.Writer) (*AudioRecorder, error) {
+	ar := &AudioRecorder{Rate: rate, Volume: 1}
+	for _, out := range outputs {
+		ww, err := newWAVWriter(out, rate)
+		if err != nil {
+			return nil, fmt.Errorf("error writing audio: %w", err)
+		}
+		ar.resamplers = append(ar.resamplers, newResampler(rate, region.CPUClock()))
+		ar.writers = append(ar.writers, ww)
+	}
+	return ar, nil
+}
+
+func NewAudioRecorder(filename string, rate int, stems bool, region *Region) (*AudioRecorder, error) {
+	names := []string{filename}
+	if stems {
+		ext := filepath.Ext(filename)
+		for _, stem := range stemNames {
+			names = append(names, strings.TrimSuffix(filename, ext)+"."+stem+ext)
+		}
+	}
+
+	var files []*os.File
+	var outputs []io.Writer
+	for _, name := range names {
+		file, err := os.Create(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("error creating audio file: %w", err)
+		}
+		files = append(files, file)
+		outputs = append(outputs, file)
+	}
+
+	ar, err := newAudioRecorder(rate, region, outputs)
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	ar.files = files
+	return ar, nil
+}
+
+// Called once per CPU cycle after the APU has been clocked
+func (ar *AudioRecorder) sample(apu *APU) {
+	levels := apu.channelOutputs()
+	ar.resamplers[0].add((mixAPU(levels) + apu.expansionOutput()) * ar.Volume)
+	for i := 1; i < len(ar.resamplers); i++ {
+		// A stem is the channel mixed with the others silent
+		var solo [5]uint8
+		solo[i-1] = levels[i-1]
+		ar.resamplers[i].add(mixAPU(solo) * ar.Volume)
+	}
+}
+
+// Writes out the samples that are complete, called at every frame boundary
+func (ar *AudioRecorder) flush() {
+	for i, rs := range ar.resamplers {
+		if err := ar.writers[i].write(rs.read()); err != nil && ar.err == nil {
+			ar.err = fmt.Errorf("error writing audio: %w", err)
+		}
+	}
+}
+
+// Flushes the remaining samples and finishes the files
+func (ar *AudioRecorder) Close() error {
+	ar.flush()
+	for _, ww := range ar.writers {
+		if err := ww.close(); err != nil && ar.err == nil {
+			ar.err = fmt.Errorf("error writing audio: %w", err)
+		}
+	}
+	for _, f := range ar.files {
+		if err := f.Close(); err != nil && ar.err == nil {
+			ar.err = fmt.Errorf("error writing audio: %w", err)
+		}
+	}
+	return ar.err
+}
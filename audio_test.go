@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResamplerRate(t *testing.T) {
+	clock := regionNTSC.CPUClock()
+	rs := newResampler(44100, clock)
+	samples := 0
+	for i := 0; i < int(clock); i++ {
+		rs.add(0)
+		if i%29830 == 0 {
+			samples += len(rs.read())
+		}
+	}
+	samples += len(rs.read())
+	if samples < 44099 || samples > 44100 {
+		t.Errorf("%d samples from a second of cycles, want 44100", samples)
+	}
+}
+
+func TestResamplerSquare(t *testing.T) {
+	// A 1kHz square wave crosses zero twice a cycle once the highpass has removed DC
+	clock := regionNTSC.CPUClock()
+	rs := newResampler(44100, clock)
+	half := clock / 2000
+	for i := 0; i < int(clock); i++ {
+		level := 0.0
+		if int(float64(i)/half)%2 == 1 {
+			level = 0.5
+		}
+		rs.add(level)
+	}
+	out := rs.read()
+
+	crossings := 0
+	var low, high int16
+	for i := len(out) / 2; i < len(out); i++ {
+		if (out[i-1] < 0) != (out[i] < 0) {
+			crossings++
+		}
+		low, high = min(low, out[i]), max(high, out[i])
+	}
+	if crossings < 995 || crossings > 1005 {
+		t.Errorf("%d zero crossings in half a second of 1kHz, want 1000", crossings)
+	}
+	// Each edge jumps by the whole 0.5 step from wherever the highpass let the level sag
+	if amplitude := int(high) - int(low); amplitude < 16384 || amplitude >= 2*16384 {
+		t.Errorf("peak to peak %d, want between one and two steps of 16384", amplitude)
+	}
+}
+
+func TestAudioRecorderStems(t *testing.T) {
+	dir := t.TempDir()
+	ar, err := NewAudioRecorder(filepath.Join(dir, "music.wav"), 44100, true, regionNTSC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apu := NewAPU(&CPU{}, regionNTSC)
+	apu.write(0x4015, 0x04)
+	apu.write(0x4008, 0xFF)
+	apu.write(0x400A, 0x40)
+	apu.write(0x400B, 0x00)
+	for i := 0; i < 4*29830; i++ {
+		apu.Clock()
+		ar.sample(apu)
+		if i%29830 == 0 {
+			ar.flush()
+		}
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var size uint32
+	for _, name := range []string{"music", "music.pulse1", "music.pulse2", "music.triangle", "music.noise", "music.dmc"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".wav"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := readWAVHeader(t, data)
+		if size == 0 {
+			size = header.DataSize
+		}
+		if header.DataSize != size || int(header.DataSize) != len(data)-44 || header.Size != 36+size {
+			t.Errorf("%s: RIFF size %d, data size %d, %d bytes", name, header.Size, header.DataSize, len(data))
+		}
+
+		// Only the mix and the triangle stem have the triangle in them
+		silent := true
+		for i := 44; i < len(data); i += 2 {
+			if binary.LittleEndian.Uint16(data[i:]) != 0 {
+				silent = false
+				break
+			}
+		}
+		if want := name != "music" && name != "music.triangle"; silent != want {
+			t.Errorf("%s: silent %v, want %v", name, silent, want)
+		}
+	}
+	if size == 0 {
+		t.Fatal("no samples were recorded")
+	}
+}
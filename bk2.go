@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NesHawk button names and the controller bit each one drives
+var bk2Buttons = []struct {
+	name     string
+	mnemonic byte
+	bit      uint8
+}{
+	{"Up", 'U', 4}, {"Down", 'D', 5}, {"Left", 'L', 6}, {"Right", 'R', 7},
+	{"Start", 'S', 3}, {"Select", 's', 2}, {"B", 'B', 1}, {"A", 'A', 0},
+}
+
+/*
+Reads a BizHawk movie, a zip archive holding Header.txt and Input Log.txt. The input
+columns are described by the LogKey line so buttons are found by name.
+*/
+func readBK2File(filename string) (*Movie, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening movie: %w", err)
+	}
+	defer archive.Close()
+
+	movie := &Movie{Checkpoints: make(map[int]uint64)}
+	var haveInput bool
+	for _, f := range archive.File {
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading movie: %w", err)
+		}
+		switch f.Name {
+		case "Header.txt":
+			movie.parseBK2Header(data)
+		case "Input Log.txt":
+			if err := movie.parseBK2Input(data); err != nil {
+				return nil, err
+			}
+			haveInput = true
+		case "Core.bin":
+			movie.StartState = data
+		case "RAMHashes.txt":
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				var frame int
+				var hash uint64
+				if n, _ := fmt.Sscanf(scanner.Text(), "%d %x", &frame, &hash); n == 2 {
+					movie.Checkpoints[frame] = hash
+				}
+			}
+		}
+	}
+	if !haveInput {
+		return nil, fmt.Errorf("movie has no Input Log.txt")
+	}
+	return movie, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (m *Movie) parseBK2Header(data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		switch key {
+		case "GameName":
+			m.ROMName = value
+		case "rerecordCount":
+			m.Rerecords, _ = strconv.Atoi(value)
+		case "PAL":
+			m.PAL = strings.EqualFold(value, "true")
+		case "SHA1":
+			sum, err := hex.DecodeString(value)
+			if err == nil && len(sum) == len(m.SHA1) {
+				copy(m.SHA1[:], sum)
+			}
+		}
+	}
+}
+
+type bk2Column struct {
+	port int
+	bit  uint8
+}
+
+func (m *Movie) parseBK2Input(data []byte) error {
+	// Columns of each "|" separated group, nil entries are buttons we do not emulate
+	var groups [][]*bk2Column
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "LogKey:"):
+			groups = nil
+			for _, group := range strings.Split(strings.TrimPrefix(line, "LogKey:"), "#")[1:] {
+				var columns []*bk2Column
+				for _, name := range strings.Split(strings.TrimSuffix(group, "|"), "|") {
+					columns = append(columns, bk2ColumnFor(name))
+				}
+				groups = append(groups, columns)
+			}
+		case strings.HasPrefix(line, "|"):
+			if groups == nil {
+				return fmt.Errorf("BK2 input log has no LogKey")
+			}
+			var input [2]uint8
+			fields := strings.Split(strings.Trim(line, "|"), "|")
+			for g := 0; g < len(fields) && g < len(groups); g++ {
+				for i := 0; i < len(fields[g]) && i < len(groups[g]); i++ {
+					column := groups[g][i]
+					if column != nil && fields[g][i] != '.' && fields[g][i] != ' ' {
+						input[column.port] = setBit(input[column.port], column.bit)
+					}
+				}
+			}
+			m.Input = append(m.Input, input)
+		}
+	}
+	return scanner.Err()
+}
+
+// Maps a LogKey name such as "P1 Up" to a controller bit
+func bk2ColumnFor(name string) *bk2Column {
+	for port, prefix := range []string{"P1 ", "P2 "} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		for _, button := range bk2Buttons {
+			if name[len(prefix):] == button.name {
+				return &bk2Column{port: port, bit: button.bit}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Movie) writeBK2File(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating movie: %w", err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	write := func(name string, data []byte) {
+		if err != nil {
+			return
+		}
+		var w io.Writer
+		if w, err = archive.Create(name); err == nil {
+			_, err = w.Write(data)
+		}
+	}
+
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "MovieVersion BizHawk v2.0.0\n")
+	fmt.Fprintf(&header, "Platform NES\n")
+	fmt.Fprintf(&header, "GameName %s\n", m.ROMName)
+	fmt.Fprintf(&header, "SHA1 %s\n", strings.ToUpper(hex.EncodeToString(m.SHA1[:])))
+	fmt.Fprintf(&header, "Core NesHawk\n")
+	fmt.Fprintf(&header, "rerecordCount %d\n", m.Rerecords)
+	if m.PAL {
+		fmt.Fprintf(&header, "PAL True\n")
+	}
+	if m.StartState != nil {
+		fmt.Fprintf(&header, "StartsFromSavestate True\n")
+	}
+	write("Header.txt", header.Bytes())
+
+	var input bytes.Buffer
+	input.WriteString("[Input]\nLogKey:#Reset|Power|")
+	for port := 1; port <= 2; port++ {
+		input.WriteString("#")
+		for _, button := range bk2Buttons {
+			fmt.Fprintf(&input, "P%d %s|", port, button.name)
+		}
+	}
+	input.WriteString("\n")
+	for _, frame := range m.Input {
+		fmt.Fprintf(&input, "|..|%s|%s|\n", formatBK2Buttons(frame[0]), formatBK2Buttons(frame[1]))
+	}
+	input.WriteString("[/Input]\n")
+	write("Input Log.txt", input.Bytes())
+
+	if m.StartState != nil {
+		write("Core.bin", m.StartState)
+		write("Comments.txt", []byte(movieStartStateNote+"\n"))
+	}
+	var hashes bytes.Buffer
+	for frame := 0; frame < len(m.Input); frame++ {
+		if hash, ok := m.Checkpoints[frame]; ok {
+			fmt.Fprintf(&hashes, "%d %016x\n", frame, hash)
+		}
+	}
+	write("RAMHashes.txt", hashes.Bytes())
+
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing movie: %w", err)
+	}
+	return nil
+}
+
+func formatBK2Buttons(buttons uint8) string {
+	var b bytes.Buffer
+	for _, button := range bk2Buttons {
+		if getBit(buttons, button.bit) {
+			b.WriteByte(button.mnemonic)
+		} else {
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,141 @@
+package main
+
+/*
+Reads a byte as the CPU sees it, memory mapped registers are handled here and
+everything else comes from memory
+*/
+func (cpu *CPU) read(address uint16) uint8 {
+	value := cpu.readBus(address)
+	if cpu.hooks != nil {
+		value = cpu.hooks.read(address, value)
+	}
+	return value
+}
+
+/*
+Reads an opcode or operand byte. Cartridge space is seen through the cheats like on
+the bus, so Game Genie codes patch code as well as data, but hooks, registers and
+mappers are skipped: fetching an operand is not a read of the address it names.
+*/
+func (cpu *CPU) fetch(address uint16) uint8 {
+	value := cpu.memory[address]
+	if cpu.Cheats != nil && address >= 0x4020 {
+		value = cpu.Cheats.read(address, value)
+	}
+	return value
+}
+
+func (cpu *CPU) readBus(address uint16) uint8 {
+	switch address {
+	case 0x4015:
+		return cpu.APU.readStatus()
+	case 0x4016:
+		return cpu.Controllers[0].read()
+	case 0x4017:
+		return cpu.Controllers[1].read()
+	}
+	if address >= 0x2000 && address < 0x4000 {
+		cpu.vram.read(cpu, address)
+	}
+	if address < 0x4020 {
+		return cpu.memory[address]
+	}
+	value := cpu.memory[address]
+	if cpu.Mapper != nil {
+		if v, ok := cpu.Mapper.Read(address); ok {
+			value = v
+		}
+	}
+	if cpu.Cheats != nil {
+		value = cpu.Cheats.read(address, value)
+	}
+	return value
+}
+
+// Writes a byte as the CPU does, the mapper gets first look at cartridge space
+func (cpu *CPU) write(address uint16, value uint8) {
+	if cpu.hooks != nil {
+		cpu.hooks.write(address, value)
+	}
+	cpu.writeBus(address, value)
+}
+
+func (cpu *CPU) writeBus(address uint16, value uint8) {
+	if address >= 0x2000 && address < 0x4000 {
+		cpu.vram.write(address, value)
+	}
+	switch {
+	case address == 0x4016:
+		// The strobe line is shared by both controller ports
+		cpu.Controllers[0].write(value)
+		cpu.Controllers[1].write(value)
+	case address >= 0x4000 && address <= 0x4013, address == 0x4015, address == 0x4017:
+		cpu.APU.write(address, value)
+	case address >= 0x4020 && cpu.Mapper != nil && cpu.Mapper.Write(address, value):
+		return
+	case address >= 0x8000:
+		return
+	default:
+		cpu.memory[address] = value
+	}
+}
+
+/*
+The PPU's VRAM address, set through $2006 and stepped by every $2007 access. There is
+no PPU yet, this is only kept so pattern table reads through $2007 reach the mapper
+and the code/data logger.
+*/
+type vramAddress struct {
+	Address uint16
+	// The next $2006 write is the low byte
+	Low bool
+	// $2000 bit 2, step down a column of the nametable instead of across it
+	Step32 bool
+}
+
+func (v *vramAddress) read(cpu *CPU, address uint16) {
+	switch address & 7 {
+	case 2: // reading the status resets the $2006 write toggle
+		v.Low = false
+	case 7:
+		if pattern := v.Address & 0x3FFF; pattern < 0x2000 {
+			cpu.readCHR(pattern)
+		}
+		v.step()
+	}
+}
+
+func (v *vramAddress) write(address uint16, value uint8) {
+	switch address & 7 {
+	case 0:
+		v.Step32 = getBit(value, 2)
+	case 6:
+		if v.Low {
+			v.Address = v.Address&0xFF00 | uint16(value)
+		} else {
+			v.Address = uint16(value&0x3F)<<8 | v.Address&0x00FF
+		}
+		v.Low = !v.Low
+	case 7:
+		v.step()
+	}
+}
+
+func (v *vramAddress) step() {
+	if v.Step32 {
+		v.Address += 32
+	} else {
+		v.Address++
+	}
+}
+
+// A pattern table byte read back by the CPU, mappers with CHR banks see the fetch
+func (cpu *CPU) readCHR(address uint16) {
+	offset := int(address)
+	if m, ok := cpu.Mapper.(chrMapper); ok {
+		offset = m.fetchCHR(address)
+	}
+	if cpu.CDL != nil {
+		cpu.CDL.LogCHR(offset, false)
+	}
+}
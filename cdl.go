@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// FCEUX CDL flags for PRG ROM bytes
+const (
+	cdlCode         = 0x01
+	cdlData         = 0x02
+	cdlIndirectCode = 0x10
+	cdlIndirectData = 0x20
+	cdlPCM          = 0x40
+)
+
+// FCEUX CDL flags for CHR ROM bytes
+const (
+	cdlRendered = 0x01
+	cdlCHRRead  = 0x02
+)
+
+// Stores write to their effective address, they never mark PRG ROM as data
+var storeOpcodes = map[uint8]bool{
+	0x81: true, 0x84: true, 0x85: true, 0x86: true, 0x8C: true, 0x8D: true, 0x8E: true,
+	0x91: true, 0x94: true, 0x95: true, 0x96: true, 0x99: true, 0x9D: true,
+}
+
+/*
+CodeDataLogger marks every PRG ROM byte the CPU executes or reads and every CHR ROM
+byte read back through $2007, in the layout of an FCEUX .cdl file. Marking CHR as
+rendered waits for a PPU to fetch pattern data.
+*/
+type CodeDataLogger struct {
+	PRG []uint8
+	CHR []uint8
+
+	// Opcode of the instruction being executed
+	opcode uint8
+}
+
+func NewCodeDataLogger(cart *Cartridge) *CodeDataLogger {
+	return &CodeDataLogger{
+		PRG: make([]uint8, len(cart.PRG)),
+		CHR: make([]uint8, len(cart.CHR)),
+	}
+}
+
+/*
+Marks a PRG byte with flags. Bits 2-3 record which 8KB window of $8000-$FFFF the byte
+was mapped to when it was accessed.
+*/
+func (c *CodeDataLogger) markPRG(cpu *CPU, address uint16, flags uint8) {
+	offset, ok := cpu.prgOffset(address)
+	if !ok || offset >= len(c.PRG) {
+		return
+	}
+	c.PRG[offset] |= flags | uint8(address>>13&3)<<2
+}
+
+// Marks the instruction at address as code, called from the fetch path
+func (c *CodeDataLogger) logCode(cpu *CPU, address uint16, opcode uint8) {
+	c.opcode = opcode
+	for i := 0; i < instructionSize(opcode); i++ {
+		c.markPRG(cpu, address+uint16(i), cdlCode)
+	}
+}
+
+// Marks an operand read, indirect is set for reads through a pointer
+func (c *CodeDataLogger) logData(cpu *CPU, address uint16, indirect bool) {
+	if storeOpcodes[c.opcode] {
+		return
+	}
+	if indirect {
+		c.markPRG(cpu, address, cdlData|cdlIndirectData)
+	} else {
+		c.markPRG(cpu, address, cdlData)
+	}
+}
+
+// Marks the target of an indirect jump
+func (c *CodeDataLogger) logIndirectCode(cpu *CPU, address uint16) {
+	c.markPRG(cpu, address, cdlIndirectCode)
+}
+
+// Marks a byte fetched by the DMC as sample data
+func (c *CodeDataLogger) logPCM(cpu *CPU, address uint16) {
+	c.markPRG(cpu, address, cdlData|cdlPCM)
+}
+
+// Marks a CHR ROM byte, rendered when fetched by the PPU and read when read through $2007
+func (c *CodeDataLogger) LogCHR(offset int, rendered bool) {
+	if offset < 0 || offset >= len(c.CHR) {
+		return
+	}
+	if rendered {
+		c.CHR[offset] |= cdlRendered
+	} else {
+		c.CHR[offset] |= cdlCHRRead
+	}
+}
+
+/*
+Merges a previously written CDL file so logging can continue across sessions.
+A missing file is not an error, the log simply starts empty.
+*/
+func (c *CodeDataLogger) LoadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading CDL file: %w", err)
+	}
+	if len(data) != len(c.PRG)+len(c.CHR) {
+		return fmt.Errorf("CDL file %s does not match the ROM size", filename)
+	}
+	for i := range c.PRG {
+		c.PRG[i] |= data[i]
+	}
+	for i := range c.CHR {
+		c.CHR[i] |= data[len(c.PRG)+i]
+	}
+	return nil
+}
+
+// Writes the log as an FCEUX .cdl file, PRG flags followed by CHR flags
+func (c *CodeDataLogger) WriteFile(filename string) error {
+	data := make([]uint8, 0, len(c.PRG)+len(c.CHR))
+	data = append(data, c.PRG...)
+	data = append(data, c.CHR...)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("error writing CDL file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestCodeDataLogger(t *testing.T) {
+	prg := testPRG(
+		0xA0, 0x05, // LDY #$05
+		0xB1, 0x10, // LDA ($10),Y reads $8105
+		0xAD, 0x00, 0x82, // LDA $8200
+		0xA9, 0x01, // LDA #$01
+		0x8D, 0x06, 0x20, // STA $2006
+		0xA9, 0x10, // LDA #$10
+		0x8D, 0x06, 0x20, // STA $2006, VRAM address $0110
+		0xAD, 0x07, 0x20, // LDA $2007
+		0xAD, 0x07, 0x20, // LDA $2007
+	)
+	cart := &Cartridge{PRG: prg, CHR: make([]uint8, 0x2000)}
+	r := newTestRunner(&NROM{prg: prg})
+	r.cpu.CDL = NewCodeDataLogger(cart)
+	r.cpu.memory[0x10] = 0x00
+	r.cpu.memory[0x11] = 0x81
+	runTo(t, r, 0x8017, 20)
+
+	tests := []struct {
+		name   string
+		flags  []uint8
+		offset int
+		want   uint8
+	}{
+		{"opcode", r.cpu.CDL.PRG, 0x0000, cdlCode},
+		{"operand", r.cpu.CDL.PRG, 0x0003, cdlCode},
+		{"indirect data", r.cpu.CDL.PRG, 0x0105, cdlData | cdlIndirectData},
+		{"data", r.cpu.CDL.PRG, 0x0200, cdlData},
+		{"not read", r.cpu.CDL.PRG, 0x0300, 0},
+		{"chr read", r.cpu.CDL.CHR, 0x0110, cdlCHRRead},
+		{"chr read after step", r.cpu.CDL.CHR, 0x0111, cdlCHRRead},
+		{"chr not read", r.cpu.CDL.CHR, 0x0112, 0},
+	}
+	for _, test := range tests {
+		if got := test.flags[test.offset]; got != test.want {
+			t.Errorf("%s: flags at $%04X = $%02X, want $%02X", test.name, test.offset, got, test.want)
+		}
+	}
+}
+
+func TestVRAMAddress(t *testing.T) {
+	var v vramAddress
+	cpu := &CPU{}
+	v.write(0x2006, 0x3F)
+	v.write(0x2006, 0x00)
+	if v.Address != 0x3F00 {
+		t.Fatalf("address = $%04X, want $3F00", v.Address)
+	}
+	// A status read resets the toggle halfway through
+	v.write(0x2006, 0x21)
+	v.read(cpu, 0x2002)
+	v.write(0x2006, 0x01)
+	v.write(0x2006, 0x40)
+	if v.Address != 0x0140 {
+		t.Fatalf("address = $%04X, want $0140", v.Address)
+	}
+	v.write(0x2000, 0x04)
+	v.read(cpu, 0x2007)
+	v.write(0x200F, 0)
+	if v.Address != 0x0180 {
+		t.Errorf("address after two steps of 32 = $%04X, want $0180", v.Address)
+	}
+}
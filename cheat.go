@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Game Genie letters in the order of the nibbles they encode
+const gameGenieLetters = "APZLGITYEOXUKSVN"
+
+/*
+Cheat is either a read override or a RAM freeze. Overrides replace what the CPU reads
+from an address in cartridge space, only while the real byte equals Compare when there
+is one. Freezes are written to their address at the end of every frame.
+*/
+type Cheat struct {
+	Name    string
+	Address uint16
+	Value   uint8
+	// Byte the override has to replace, -1 to always replace it
+	Compare    int
+	Substitute bool
+	Enabled    bool
+}
+
+/*
+Decodes a cheat code: a 6 or 8 letter Game Genie code, or a Pro Action Replay style
+raw "AAAA:VV" or "AAAA?CC:VV" address, optional compare and value in hex. Raw codes
+below $8000 freeze RAM, the rest override reads like Game Genie codes do.
+*/
+func ParseCheat(code string) (*Cheat, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if strings.Contains(code, ":") {
+		return parseRawCheat(code)
+	}
+	if len(code) != 6 && len(code) != 8 {
+		return nil, fmt.Errorf("invalid cheat code %q", code)
+	}
+
+	n := make([]uint16, len(code))
+	for i := range code {
+		index := strings.IndexByte(gameGenieLetters, code[i])
+		if index < 0 {
+			return nil, fmt.Errorf("invalid Game Genie code %q", code)
+		}
+		n[i] = uint16(index)
+	}
+	cheat := &Cheat{Substitute: true, Enabled: true, Compare: -1}
+	cheat.Address = 0x8000 | (n[3]&7)<<12 | (n[5]&7)<<8 | (n[4]&8)<<8 |
+		(n[2]&7)<<4 | (n[1]&8)<<4 | n[4]&7 | n[3]&8
+	value := (n[1]&7)<<4 | (n[0]&8)<<4 | n[0]&7
+	if len(code) == 6 {
+		value |= n[5] & 8
+	} else {
+		value |= n[7] & 8
+		cheat.Compare = int((n[7]&7)<<4 | (n[6]&8)<<4 | n[6]&7 | n[5]&8)
+	}
+	cheat.Value = uint8(value)
+	return cheat, nil
+}
+
+func parseRawCheat(code string) (*Cheat, error) {
+	target, value, _ := strings.Cut(code, ":")
+	target, compare, hasCompare := strings.Cut(target, "?")
+
+	address, err := strconv.ParseUint(target, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cheat address in %q", code)
+	}
+	v, err := strconv.ParseUint(value, 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cheat value in %q", code)
+	}
+	cheat := &Cheat{Address: uint16(address), Value: uint8(v), Compare: -1, Enabled: true}
+	cheat.Substitute = cheat.Address >= 0x8000
+	if hasCompare {
+		c, err := strconv.ParseUint(compare, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cheat compare value in %q", code)
+		}
+		cheat.Compare = int(c)
+	}
+	return cheat, nil
+}
+
+/*
+CheatList holds the cheats of a game. Overrides are indexed by address so a read only
+pays for a map lookup, and Enabled can be flipped directly or through Toggle.
+*/
+type CheatList struct {
+	Cheats []*Cheat
+
+	overrides map[uint16][]*Cheat
+}
+
+func NewCheatList() *CheatList {
+	return &CheatList{overrides: make(map[uint16][]*Cheat)}
+}
+
+// Adds a cheat decoded from code, see ParseCheat
+func (l *CheatList) AddCode(code string, name string) (*Cheat, error) {
+	cheat, err := ParseCheat(code)
+	if err != nil {
+		return nil, err
+	}
+	cheat.Name = name
+	l.Add(cheat)
+	return cheat, nil
+}
+
+func (l *CheatList) Add(cheat *Cheat) {
+	l.Cheats = append(l.Cheats, cheat)
+	if cheat.Substitute {
+		l.overrides[cheat.Address] = append(l.overrides[cheat.Address], cheat)
+	}
+}
+
+func (l *CheatList) Remove(index int) error {
+	if index < 0 || index >= len(l.Cheats) {
+		return fmt.Errorf("no cheat %d", index)
+	}
+	l.Cheats = append(l.Cheats[:index], l.Cheats[index+1:]...)
+	clear(l.overrides)
+	for _, cheat := range l.Cheats {
+		if cheat.Substitute {
+			l.overrides[cheat.Address] = append(l.overrides[cheat.Address], cheat)
+		}
+	}
+	return nil
+}
+
+// Flips a cheat on or off and returns whether it is now enabled
+func (l *CheatList) Toggle(index int) (bool, error) {
+	if index < 0 || index >= len(l.Cheats) {
+		return false, fmt.Errorf("no cheat %d", index)
+	}
+	cheat := l.Cheats[index]
+	cheat.Enabled = !cheat.Enabled
+	return cheat.Enabled, nil
+}
+
+// Returns the byte the CPU sees at address given the byte that is really there
+func (l *CheatList) read(address uint16, value uint8) uint8 {
+	for _, cheat := range l.overrides[address] {
+		if cheat.Enabled && (cheat.Compare < 0 || cheat.Compare == int(value)) {
+			return cheat.Value
+		}
+	}
+	return value
+}
+
+// Writes every enabled freeze, called at the end of each frame
+func (l *CheatList) freeze(cpu *CPU) {
+	for _, cheat := range l.Cheats {
+		if cheat.Enabled && !cheat.Substitute {
+			cpu.write(cheat.Address, cheat.Value)
+		}
+	}
+}
+
+/*
+Loads an FCEUX .cht file, one "[S][C][:]AAAA:VV[:CC]:name" cheat per line. S marks a
+read override, C a compare value and a colon before the address a disabled cheat.
+*/
+func (l *CheatList) LoadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening cheat file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cheat := &Cheat{Compare: -1, Enabled: true}
+		rest := line
+		if strings.HasPrefix(rest, "S") {
+			cheat.Substitute = true
+			rest = rest[1:]
+		}
+		hasCompare := strings.HasPrefix(rest, "C")
+		if hasCompare {
+			rest = rest[1:]
+		}
+		if strings.HasPrefix(rest, ":") {
+			cheat.Enabled = false
+			rest = rest[1:]
+		}
+
+		fields := 3
+		if hasCompare {
+			fields = 4
+		}
+		parts := strings.SplitN(rest, ":", fields)
+		if len(parts) != fields {
+			return fmt.Errorf("invalid cheat line %q", line)
+		}
+		address, err := strconv.ParseUint(parts[0], 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid cheat address in %q", line)
+		}
+		value, err := strconv.ParseUint(parts[1], 16, 8)
+		if err != nil {
+			return fmt.Errorf("invalid cheat value in %q", line)
+		}
+		if hasCompare {
+			compare, err := strconv.ParseUint(parts[2], 16, 8)
+			if err != nil {
+				return fmt.Errorf("invalid cheat compare value in %q", line)
+			}
+			cheat.Compare = int(compare)
+		}
+		cheat.Address, cheat.Value = uint16(address), uint8(value)
+		cheat.Name = parts[fields-1]
+		l.Add(cheat)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading cheat file: %w", err)
+	}
+	return nil
+}
+
+// Writes the cheats as an FCEUX .cht file
+func (l *CheatList) WriteFile(filename string) error {
+	var b strings.Builder
+	for _, cheat := range l.Cheats {
+		if cheat.Substitute {
+			b.WriteString("S")
+		}
+		if cheat.Compare >= 0 {
+			b.WriteString("C")
+		}
+		if !cheat.Enabled {
+			b.WriteString(":")
+		}
+		fmt.Fprintf(&b, "%04X:%02X:", cheat.Address, cheat.Value)
+		if cheat.Compare >= 0 {
+			fmt.Fprintf(&b, "%02X:", cheat.Compare)
+		}
+		b.WriteString(cheat.Name + "\n")
+	}
+	if err := os.WriteFile(filename, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("error writing cheat file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCheat(t *testing.T) {
+	tests := []struct {
+		code string
+		want Cheat
+		err  bool
+	}{
+		{code: "SXIOPO", want: Cheat{Address: 0x91D9, Value: 0xAD, Compare: -1, Substitute: true}},
+		{code: "sxiopo", want: Cheat{Address: 0x91D9, Value: 0xAD, Compare: -1, Substitute: true}},
+		{code: "AAAAAAAA", want: Cheat{Address: 0x8000, Value: 0x00, Compare: 0x00, Substitute: true}},
+		{code: "NNNNNNNN", want: Cheat{Address: 0xFFFF, Value: 0xFF, Compare: 0xFF, Substitute: true}},
+		{code: "AAAAAAPZ", want: Cheat{Address: 0x8000, Value: 0x00, Compare: 0x21, Substitute: true}},
+		// The sixth letter goes to the address and the compare in 8 letter codes
+		{code: "AAAAAVAP", want: Cheat{Address: 0x8600, Value: 0x00, Compare: 0x18, Substitute: true}},
+		{code: "0075:09", want: Cheat{Address: 0x0075, Value: 0x09, Compare: -1}},
+		{code: "C123?10:FF", want: Cheat{Address: 0xC123, Value: 0xFF, Compare: 0x10, Substitute: true}},
+		{code: "SXIOP", err: true},
+		{code: "SXIOPB", err: true},
+		{code: "ZZZZ:01", err: true},
+		{code: "0075:1FF", err: true},
+		{code: "8000?XX:01", err: true},
+	}
+	for _, test := range tests {
+		cheat, err := ParseCheat(test.code)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseCheat(%q) did not fail", test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCheat(%q): %v", test.code, err)
+			continue
+		}
+		test.want.Enabled = true
+		if *cheat != test.want {
+			t.Errorf("ParseCheat(%q) = %+v, want %+v", test.code, *cheat, test.want)
+		}
+	}
+}
+
+func TestCheatFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.cht")
+	content := "# lives\n" +
+		"0075:09:Infinite lives\n" +
+		"SC:91D9:AD:DE:Disabled override\n" +
+		"\n" +
+		"S8001:05:Start with 5\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cheats := NewCheatList()
+	if err := cheats.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	want := []Cheat{
+		{Name: "Infinite lives", Address: 0x0075, Value: 0x09, Compare: -1, Enabled: true},
+		{Name: "Disabled override", Address: 0x91D9, Value: 0xAD, Compare: 0xDE, Substitute: true},
+		{Name: "Start with 5", Address: 0x8001, Value: 0x05, Compare: -1, Substitute: true, Enabled: true},
+	}
+	var got []Cheat
+	for _, cheat := range cheats.Cheats {
+		got = append(got, *cheat)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %+v, want %+v", got, want)
+	}
+
+	// Writing the list back gives a file that loads the same
+	path = filepath.Join(t.TempDir(), "saved.cht")
+	if err := cheats.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	saved := NewCheatList()
+	if err := saved.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, cheat := range saved.Cheats {
+		got = append(got, *cheat)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("saved file loaded %+v, want %+v", got, want)
+	}
+
+	for _, line := range []string{"S8001:05\n", "C8001:05:name\n", "S8001:105:name\n"} {
+		if err := os.WriteFile(path, []byte(line), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewCheatList().LoadFile(path); err == nil {
+			t.Errorf("loading %q did not fail", line)
+		}
+	}
+}
+
+func TestCheatsPatchCode(t *testing.T) {
+	program := []uint8{
+		0xA9, 0x01, // LDA #$01
+		0x8D, 0x10, 0x00, // STA $0010
+		0xD0, 0x03, // BNE $800A
+		0x4C, 0x00, 0x90, // JMP $9000
+		0x4C, 0x00, 0xA0, // JMP $A000
+	}
+	tests := []struct {
+		name  string
+		code  string
+		pc    uint16 // where the CPU is after four instructions
+		store uint16 // where the value ends up
+		value uint8
+	}{
+		{"none", "", 0xA000, 0x10, 0x01},
+		{"immediate operand", "8001:05", 0xA000, 0x10, 0x05},
+		{"compare mismatch", "8001?02:05", 0xA000, 0x10, 0x01},
+		{"opcode", "8000:A2", 0xA000, 0x10, 0x00}, // LDX #$01, A stays 0
+		{"absolute operand", "8003:11", 0xA000, 0x11, 0x01},
+		{"branch offset", "8006:00", 0x9000, 0x10, 0x01},
+		{"jump target", "800C:B0", 0xB000, 0x10, 0x01},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRunner(&NROM{prg: testPRG(program...)})
+			r.cpu.Cheats = NewCheatList()
+			if test.code != "" {
+				if _, err := r.cpu.Cheats.AddCode(test.code, test.name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 4; i++ {
+				r.Step()
+			}
+			if r.cpu.PC != test.pc {
+				t.Errorf("PC $%04X, want $%04X", r.cpu.PC, test.pc)
+			}
+			if r.cpu.memory[test.store] != test.value {
+				t.Errorf("$%04X holds $%02X, want $%02X", test.store, r.cpu.memory[test.store], test.value)
+			}
+			// ROM itself is untouched
+			if r.cpu.memory[0x8001] != 0x01 {
+				t.Error("the cheat was written to ROM")
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
-	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 type CPU struct {
@@ -18,96 +22,134 @@ type CPU struct {
 	memory [65536]uint8
 
 	Cycles uint16
+
+	// Size of the PRG ROM mapped at $8000, zero when no cartridge is loaded
+	prgSize int
+	// PRG ROM offset of each 4KB bank at $8000-$FFFF, kept up to date by the mapper
+	prgBanks [8]int
+	// Joypads read through $4016 and $4017
+	Controllers [2]Controller
+	// Sound registers at $4000-$4017, clocked by the runner
+	APU *APU
+	// Cartridge hardware at $4020-$FFFF, also clocked by the runner
+	Mapper Mapper
+	// VRAM address of $2006/$2007, there is no PPU behind it yet
+	vram vramAddress
+
+	// Optional labels used by the disassembler, traces and the profiler
+	Symbols *SymbolTable
+	// Optional code/data logger fed by instruction fetches and the addressing modes
+	CDL *CodeDataLogger
+	// Optional cheats, overriding cartridge reads and freezing RAM every frame
+	Cheats *CheatList
+	// Read, write and execute hooks, nil when there are none
+	hooks      *cpuHooks
+	lastHookID HookID
 }
 
 // Addressing Modes
 /*
-Returns value, address of a Zero Page of memory, the first 256 bits base of 3 cycles
+Returns the address of a Zero Page of memory, the first 256 bits base of 3 cycles.
+The addressing modes only work out addresses, instructions read and write through
+the bus so hooks and mappers see every access.
 */
-func (cpu *CPU) ZeroPage() (uint8, uint16) {
-	address := cpu.memory[cpu.PC+1]
-
-	value := cpu.memory[address]
+func (cpu *CPU) ZeroPage() uint16 {
+	address := cpu.fetch(cpu.PC + 1)
 
 	cpu.PC += 2
 	cpu.Cycles += 3
-	return value, uint16(address)
+	return uint16(address)
 }
 
 /*
-Returns (value, address)+x of a Zero Page of memory, the first 256 bits base of 3 cycles
+Returns address+x of a Zero Page of memory, the first 256 bits base of 3 cycles
 */
-func (cpu *CPU) ZeroPageX() (uint8, uint16) {
-	zeroAddress := cpu.memory[cpu.PC+1]
+func (cpu *CPU) ZeroPageX() uint16 {
+	zeroAddress := cpu.fetch(cpu.PC + 1)
 	effectiveAddress := uint8(zeroAddress + cpu.X)
-	value := cpu.memory[effectiveAddress]
 	cpu.PC += 2
 	cpu.Cycles += 4
-	return value, uint16(effectiveAddress)
+	return uint16(effectiveAddress)
 }
 
-func (cpu *CPU) IndexedIndirect() (uint8, uint16) {
-	zeroAddress := cpu.memory[cpu.PC+1]
-	effectiveAddress := zeroAddress + cpu.X&0xFF
-	value := cpu.memory[effectiveAddress]
-	return value, uint16(effectiveAddress)
+// Returns the address stored at zero page address+x, the pointer wraps within the zero page
+func (cpu *CPU) IndexedIndirect() uint16 {
+	pointer := cpu.fetch(cpu.PC+1) + cpu.X
+	effectiveAddress := cpu.zeroPagePointer(pointer)
+	if cpu.CDL != nil {
+		cpu.CDL.logData(cpu, effectiveAddress, true)
+	}
+	cpu.Cycles += 6
+	cpu.PC += 2
+	return effectiveAddress
 }
 
-func (cpu *CPU) IndirectIndex() (uint8, uint16) {
-	zeroAddress := cpu.memory[cpu.PC+1]
-	effectiveAddress := zeroAddress + cpu.Y&0xFF
-	value := cpu.memory[effectiveAddress]
+// Returns the address stored at a zero page address, plus y
+func (cpu *CPU) IndirectIndex() uint16 {
+	pointer := cpu.fetch(cpu.PC + 1)
+	effectiveAddress := cpu.zeroPagePointer(pointer) + uint16(cpu.Y)
+	if cpu.CDL != nil {
+		cpu.CDL.logData(cpu, effectiveAddress, true)
+	}
 	cpu.Cycles += 5
 	cpu.PC += 2
-	return value, uint16(effectiveAddress)
+	return effectiveAddress
+}
+
+// Reads a 16 bit pointer from the zero page, the high byte of $FF comes from $00
+func (cpu *CPU) zeroPagePointer(pointer uint8) uint16 {
+	return uint16(cpu.read(uint16(pointer+1)))<<8 | uint16(cpu.read(uint16(pointer)))
 }
 
 func (cpu *CPU) Indirect() uint16 {
-	lowByte := uint16(cpu.memory[cpu.PC+1])
-	highByte := uint16(cpu.memory[cpu.PC+2])
+	lowByte := uint16(cpu.fetch(cpu.PC + 1))
+	highByte := uint16(cpu.fetch(cpu.PC + 2))
 
 	effectiveAddress := (highByte << 8) | lowByte
 	cpu.PC += 3
+	if cpu.CDL != nil {
+		cpu.CDL.logData(cpu, effectiveAddress, false)
+		cpu.CDL.logData(cpu, effectiveAddress+1, false)
+	}
 	// NES/6502 bug: If the indirect vector falls on a page boundary (i.e., $xxFF where xx is any value from $00 to $FF),
 	// the second byte is fetched from the beginning of that page rather than the beginning of the next page.
 	if lowByte == 0xFF {
-		lowAddress := uint16(cpu.memory[effectiveAddress])
-		highAddress := uint16(cpu.memory[effectiveAddress&0xFF00])
+		lowAddress := uint16(cpu.read(effectiveAddress))
+		highAddress := uint16(cpu.read(effectiveAddress & 0xFF00))
 		return (highAddress << 8) | lowAddress
 	} else {
-		lowAddress := uint16(cpu.memory[effectiveAddress])
-		highAddress := uint16(cpu.memory[effectiveAddress+1])
+		lowAddress := uint16(cpu.read(effectiveAddress))
+		highAddress := uint16(cpu.read(effectiveAddress + 1))
 		return (highAddress << 8) | lowAddress
 	}
 }
 
 func (cpu *CPU) Relative() uint16 {
-	offset := int8(cpu.memory[cpu.PC+1])
+	offset := int8(cpu.fetch(cpu.PC + 1))
 	// targetAddress := cpu.PC + 2 + uint16(offset)
 	// return targetAddress
 	return uint16(offset)
 }
 
 func (cpu *CPU) Relativetest() int8 {
-	offset := int8(cpu.memory[cpu.PC+1])
+	offset := int8(cpu.fetch(cpu.PC + 1))
 	// targetAddress := cpu.PC + 2 + uint16(offset)
 	// return targetAddress
 	return (offset)
 }
 
-// Returns the first 8 bits in memory
-func (cpu *CPU) ZeroPageY() (uint8, uint16) {
-	zeroAddress := cpu.memory[cpu.PC+1]
+// Returns address+y in the first 256 bytes of memory
+func (cpu *CPU) ZeroPageY() uint16 {
+	zeroAddress := cpu.fetch(cpu.PC + 1)
 	effectiveAddress := uint8(zeroAddress + cpu.Y)
-	value := cpu.memory[effectiveAddress]
 	cpu.PC += 2
 	cpu.Cycles += 4
-	return value, uint16(effectiveAddress)
+	return uint16(effectiveAddress)
 }
 
 // Returns a value immediately supplied in the command, takes base of 2 Cycles
 func (cpu *CPU) Immediate() uint8 {
-	value := cpu.memory[cpu.PC+1]
+	value := cpu.fetch(cpu.PC + 1)
 	cpu.PC += 2
 	cpu.Cycles += 2
 	return value
@@ -115,34 +157,43 @@ func (cpu *CPU) Immediate() uint8 {
 
 // Returns a 16 bit memory address, takes base of 4 Cycles
 func (cpu *CPU) Absolute() uint16 {
-	lowByte := uint16(cpu.memory[cpu.PC+1])
-	highByte := uint16(cpu.memory[cpu.PC+2])
+	lowByte := uint16(cpu.fetch(cpu.PC + 1))
+	highByte := uint16(cpu.fetch(cpu.PC + 2))
 
 	absoluteAddress := (highByte << 8) | lowByte
 	cpu.PC += 3
 	cpu.Cycles += 4
+	if cpu.CDL != nil {
+		cpu.CDL.logData(cpu, absoluteAddress, false)
+	}
 	return uint16(absoluteAddress)
 }
 
 // Returns a 16 bit memory address + value in x register, takes base of 4 Cycles
 func (cpu *CPU) AbsoluteX() uint16 {
-	lowByte := uint16(cpu.memory[cpu.PC+1])
-	highByte := uint16(cpu.memory[cpu.PC+2])
+	lowByte := uint16(cpu.fetch(cpu.PC + 1))
+	highByte := uint16(cpu.fetch(cpu.PC + 2))
 	absoluteAddress := (highByte << 8) | lowByte
 	absoluteAddress += uint16(cpu.X)
 	cpu.Cycles += 4
 	cpu.PC += 3
+	if cpu.CDL != nil {
+		cpu.CDL.logData(cpu, absoluteAddress, false)
+	}
 	return uint16(absoluteAddress)
 }
 
 // Returns a 16 bit memory address + value in Y register, takes base of 4 Cycles
 func (cpu *CPU) AbsoluteY() uint16 {
-	lowByte := uint16(cpu.memory[cpu.PC+1])
-	highByte := uint16(cpu.memory[cpu.PC+2])
+	lowByte := uint16(cpu.fetch(cpu.PC + 1))
+	highByte := uint16(cpu.fetch(cpu.PC + 2))
 	absoluteAddress := (highByte << 8) | lowByte
 	absoluteAddress += uint16(cpu.Y)
 	cpu.Cycles += 4
 	cpu.PC += 3
+	if cpu.CDL != nil {
+		cpu.CDL.logData(cpu, absoluteAddress, false)
+	}
 	return uint16(absoluteAddress)
 }
 
@@ -216,7 +267,8 @@ func (cpu *CPU) LDAImmediate() {
 }
 
 func (cpu *CPU) LDAZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -224,7 +276,8 @@ func (cpu *CPU) LDAZeroPage() {
 }
 
 func (cpu *CPU) LDAZeroPageX() {
-	value, _ := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -232,7 +285,8 @@ func (cpu *CPU) LDAZeroPageX() {
 }
 
 func (cpu *CPU) LDAIndexIndirect() {
-	value, _ := cpu.IndexedIndirect()
+	address := cpu.IndexedIndirect()
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -240,7 +294,8 @@ func (cpu *CPU) LDAIndexIndirect() {
 }
 
 func (cpu *CPU) LDAIndirectIndex() {
-	value, _ := cpu.IndirectIndex()
+	address := cpu.IndirectIndex()
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -249,7 +304,7 @@ func (cpu *CPU) LDAIndirectIndex() {
 
 func (cpu *CPU) LDAAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -258,7 +313,7 @@ func (cpu *CPU) LDAAbsolute() {
 
 func (cpu *CPU) LDAAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -267,7 +322,7 @@ func (cpu *CPU) LDAAbsoluteX() {
 
 func (cpu *CPU) LDAAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value
 	cpu.setNegativeFlag(cpu.A)
 	cpu.setZeroFlag(cpu.A)
@@ -284,7 +339,7 @@ func (cpu *CPU) LDXImmediate() {
 
 func (cpu *CPU) LDXAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.X = value
 	cpu.setNegativeFlag(cpu.X)
 	cpu.setZeroFlag(cpu.X)
@@ -292,8 +347,8 @@ func (cpu *CPU) LDXAbsolute() {
 }
 
 func (cpu *CPU) LDXZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	value := cpu.memory[address]
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	cpu.X = value
 	cpu.setNegativeFlag(cpu.X)
 	cpu.setZeroFlag(cpu.X)
@@ -302,7 +357,7 @@ func (cpu *CPU) LDXZeroPageX() {
 
 func (cpu *CPU) LDXAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.X = value
 	cpu.setNegativeFlag(cpu.X)
 	cpu.setZeroFlag(cpu.X)
@@ -310,7 +365,8 @@ func (cpu *CPU) LDXAbsoluteY() {
 }
 
 func (cpu *CPU) LDXZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	cpu.X = value
 	cpu.setNegativeFlag(cpu.X)
 	cpu.setZeroFlag(cpu.X)
@@ -318,7 +374,8 @@ func (cpu *CPU) LDXZeroPage() {
 }
 
 func (cpu *CPU) LDXZeroPageY() {
-	value, _ := cpu.ZeroPageY()
+	address := cpu.ZeroPageY()
+	value := cpu.read(address)
 	cpu.X = value
 	cpu.setNegativeFlag(cpu.X)
 	cpu.setZeroFlag(cpu.X)
@@ -336,7 +393,7 @@ func (cpu *CPU) LDYImmediate() {
 
 func (cpu *CPU) LDYAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.Y = value
 	cpu.setNegativeFlag(cpu.Y)
 
@@ -346,7 +403,7 @@ func (cpu *CPU) LDYAbsolute() {
 
 func (cpu *CPU) LDYAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.Y = value
 	cpu.setNegativeFlag(cpu.Y)
 
@@ -355,7 +412,8 @@ func (cpu *CPU) LDYAbsoluteX() {
 }
 
 func (cpu *CPU) LDYZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	cpu.Y = value
 	cpu.setNegativeFlag(cpu.Y)
 
@@ -364,7 +422,8 @@ func (cpu *CPU) LDYZeroPage() {
 }
 
 func (cpu *CPU) LDYZeroPageX() {
-	value, _ := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	cpu.Y = value
 	cpu.setNegativeFlag(cpu.Y)
 
@@ -374,72 +433,72 @@ func (cpu *CPU) LDYZeroPageX() {
 
 func (cpu *CPU) STAAbsolute() {
 	address := cpu.Absolute()
-	cpu.memory[address] = cpu.A
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STAAbsoluteX() {
 	address := cpu.AbsoluteX()
-	cpu.memory[address] = cpu.A
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STAAbsoluteY() {
 	address := cpu.AbsoluteY()
-	cpu.memory[address] = cpu.A
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STAZeroPage() {
-	_, address := cpu.ZeroPage()
-	cpu.memory[address] = cpu.A
+	address := cpu.ZeroPage()
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STAZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	cpu.memory[address] = cpu.A
+	address := cpu.ZeroPageX()
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STAIndexIndirect() {
-	_, address := cpu.IndexedIndirect()
-	cpu.memory[address] = cpu.A
+	address := cpu.IndexedIndirect()
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STAIndirectIndex() {
-	_, address := cpu.IndirectIndex()
-	cpu.memory[address] = cpu.A
+	address := cpu.IndirectIndex()
+	cpu.write(address, cpu.A)
 }
 
 func (cpu *CPU) STXAbsolute() {
 	address := cpu.Absolute()
-	cpu.memory[address] = cpu.X
+	cpu.write(address, cpu.X)
 }
 
 func (cpu *CPU) STXXZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	cpu.memory[address] = cpu.X
+	address := cpu.ZeroPageX()
+	cpu.write(address, cpu.X)
 }
 
 func (cpu *CPU) STXZeroPage() {
-	_, address := cpu.ZeroPage()
-	cpu.memory[address] = cpu.X
+	address := cpu.ZeroPage()
+	cpu.write(address, cpu.X)
 }
 
 func (cpu *CPU) STXZeroPageY() {
-	_, address := cpu.ZeroPageY()
-	cpu.memory[address] = cpu.X
+	address := cpu.ZeroPageY()
+	cpu.write(address, cpu.X)
 }
 
 func (cpu *CPU) STYAbsolute() {
 	address := cpu.Absolute()
-	cpu.memory[address] = cpu.Y
+	cpu.write(address, cpu.Y)
 }
 
 func (cpu *CPU) STYZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	cpu.memory[address] = cpu.Y
+	address := cpu.ZeroPageX()
+	cpu.write(address, cpu.Y)
 }
 
 func (cpu *CPU) STYZeroPage() {
-	_, address := cpu.ZeroPage()
-	cpu.memory[address] = cpu.Y
+	address := cpu.ZeroPage()
+	cpu.write(address, cpu.Y)
 }
 
 func (cpu *CPU) TAX() {
@@ -489,14 +548,14 @@ func (cpu *CPU) TYA() {
 }
 
 func (cpu *CPU) Push(value uint8) {
-	cpu.memory[0x0100+uint16(cpu.SP)] = value
+	cpu.write(0x0100+uint16(cpu.SP), value)
 	cpu.SP--
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) Pull() uint8 {
 	cpu.SP++
-	return cpu.memory[0x0100+uint16(cpu.SP)]
+	return cpu.read(0x0100 + uint16(cpu.SP))
 }
 
 func (cpu *CPU) PHA() {
@@ -531,7 +590,7 @@ func (cpu *CPU) ANDImmediate() {
 func (cpu *CPU) ANDAbsolute() {
 	address := cpu.Absolute()
 
-	val := cpu.memory[address]
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -540,7 +599,7 @@ func (cpu *CPU) ANDAbsolute() {
 func (cpu *CPU) ANDAbsoluteX() {
 	address := cpu.AbsoluteX()
 
-	val := cpu.memory[address]
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -549,42 +608,42 @@ func (cpu *CPU) ANDAbsoluteX() {
 func (cpu *CPU) ANDAbsoluteY() {
 	address := cpu.AbsoluteY()
 
-	val := cpu.memory[address]
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) ANDZeroPage() {
-	_, address := cpu.ZeroPage()
+	address := cpu.ZeroPage()
 
-	val := cpu.memory[address]
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) ANDZeroPageX() {
-	_, address := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
 
-	val := cpu.memory[address]
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) ANDIndexIndirect() {
-	_, address := cpu.IndexedIndirect()
+	address := cpu.IndexedIndirect()
 
-	val := cpu.memory[address]
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) ANDIndirectIndex() {
-	_, address := cpu.IndirectIndex()
-	val := cpu.memory[address]
+	address := cpu.IndirectIndex()
+	val := cpu.read(address)
 	cpu.A = val & cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -598,16 +657,16 @@ func (cpu *CPU) EORImmediate() {
 }
 
 func (cpu *CPU) EORZeroPage() {
-	_, address := cpu.ZeroPage()
-	value := cpu.memory[address]
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) EORZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	value := cpu.memory[address]
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -615,7 +674,7 @@ func (cpu *CPU) EORZeroPageX() {
 
 func (cpu *CPU) EORAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -623,7 +682,7 @@ func (cpu *CPU) EORAbsolute() {
 
 func (cpu *CPU) EORAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -631,23 +690,23 @@ func (cpu *CPU) EORAbsoluteX() {
 
 func (cpu *CPU) EORAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) EORIndirectIndex() {
-	_, address := cpu.IndirectIndex()
-	value := cpu.memory[address]
+	address := cpu.IndirectIndex()
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
 }
 
 func (cpu *CPU) EORIndexIndirect() {
-	_, address := cpu.IndexedIndirect()
-	value := cpu.memory[address]
+	address := cpu.IndexedIndirect()
+	value := cpu.read(address)
 	cpu.A = value ^ cpu.A
 	cpu.setZeroFlag(cpu.A)
 	cpu.setNegativeFlag(cpu.A)
@@ -662,8 +721,8 @@ func (cpu *CPU) ORAImmediate() {
 }
 
 func (cpu *CPU) ORAZeroPage() {
-	_, address := cpu.ZeroPage()
-	value := cpu.memory[address]
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -671,8 +730,8 @@ func (cpu *CPU) ORAZeroPage() {
 }
 
 func (cpu *CPU) ORAZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	value := cpu.memory[address]
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -681,7 +740,7 @@ func (cpu *CPU) ORAZeroPageX() {
 
 func (cpu *CPU) ORAAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -690,7 +749,7 @@ func (cpu *CPU) ORAAbsolute() {
 
 func (cpu *CPU) ORAAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -699,7 +758,7 @@ func (cpu *CPU) ORAAbsoluteX() {
 
 func (cpu *CPU) ORAAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -707,8 +766,8 @@ func (cpu *CPU) ORAAbsoluteY() {
 }
 
 func (cpu *CPU) ORAIndirectIndex() {
-	_, address := cpu.IndirectIndex()
-	value := cpu.memory[address]
+	address := cpu.IndirectIndex()
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -716,8 +775,8 @@ func (cpu *CPU) ORAIndirectIndex() {
 }
 
 func (cpu *CPU) ORAIndexIndirect() {
-	_, address := cpu.IndexedIndirect()
-	value := cpu.memory[address]
+	address := cpu.IndexedIndirect()
+	value := cpu.read(address)
 	cpu.A = value | cpu.A
 
 	cpu.setZeroFlag(cpu.A)
@@ -725,7 +784,8 @@ func (cpu *CPU) ORAIndexIndirect() {
 }
 
 func (cpu *CPU) BITZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 
 	if cpu.A&value == 0 {
 		cpu.P = setBit(cpu.P, 1)
@@ -748,7 +808,7 @@ func (cpu *CPU) BITZeroPage() {
 
 func (cpu *CPU) BITAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 
 	if cpu.A&value == 0 {
 		cpu.P = setBit(cpu.P, 1)
@@ -771,7 +831,7 @@ func (cpu *CPU) BITAbsolute() {
 
 func (cpu *CPU) ADCAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -790,7 +850,7 @@ func (cpu *CPU) ADCImmediate() {
 
 func (cpu *CPU) ADCAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -800,7 +860,7 @@ func (cpu *CPU) ADCAbsoluteX() {
 
 func (cpu *CPU) ADCAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -809,8 +869,8 @@ func (cpu *CPU) ADCAbsoluteY() {
 }
 
 func (cpu *CPU) ADCZeroPage() {
-	_, address := cpu.ZeroPage()
-	value := cpu.memory[address]
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -819,8 +879,8 @@ func (cpu *CPU) ADCZeroPage() {
 }
 
 func (cpu *CPU) ADCZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	value := cpu.memory[address]
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -829,8 +889,8 @@ func (cpu *CPU) ADCZeroPageX() {
 }
 
 func (cpu *CPU) ADCIndirectIndex() {
-	_, address := cpu.IndirectIndex()
-	value := cpu.memory[address]
+	address := cpu.IndirectIndex()
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -839,8 +899,8 @@ func (cpu *CPU) ADCIndirectIndex() {
 }
 
 func (cpu *CPU) ADCIndexIndirect() {
-	_, address := cpu.IndexedIndirect()
-	value := cpu.memory[address]
+	address := cpu.IndexedIndirect()
+	value := cpu.read(address)
 	cpu.setCarryFlag(cpu.A, value)
 	cpu.setADDOverflowFlag(uint(cpu.A), uint(value))
 	cpu.A += value
@@ -863,7 +923,8 @@ func (cpu *CPU) SBCImmediate() {
 }
 
 func (cpu *CPU) SBCZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
 		oldCarry = 1
@@ -877,7 +938,8 @@ func (cpu *CPU) SBCZeroPage() {
 }
 
 func (cpu *CPU) SBCZeroPageX() {
-	value, _ := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
 		oldCarry = 1
@@ -892,7 +954,7 @@ func (cpu *CPU) SBCZeroPageX() {
 
 func (cpu *CPU) SBCAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
@@ -908,7 +970,7 @@ func (cpu *CPU) SBCAbsolute() {
 
 func (cpu *CPU) SBCAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
 		oldCarry = 1
@@ -923,7 +985,7 @@ func (cpu *CPU) SBCAbsoluteX() {
 
 func (cpu *CPU) SBCAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
 		oldCarry = 1
@@ -937,7 +999,8 @@ func (cpu *CPU) SBCAbsoluteY() {
 }
 
 func (cpu *CPU) SBCIndirectIndex() {
-	value, _ := cpu.IndirectIndex()
+	address := cpu.IndirectIndex()
+	value := cpu.read(address)
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
 		oldCarry = 1
@@ -951,7 +1014,8 @@ func (cpu *CPU) SBCIndirectIndex() {
 }
 
 func (cpu *CPU) SBCIndexIndirect() {
-	value, _ := cpu.IndexedIndirect()
+	address := cpu.IndexedIndirect()
+	value := cpu.read(address)
 	oldCarry := uint8(0)
 	if getBit(cpu.P, 0) {
 		oldCarry = 1
@@ -974,7 +1038,8 @@ func (cpu *CPU) CMPImmediate() {
 }
 
 func (cpu *CPU) CMPZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -984,7 +1049,8 @@ func (cpu *CPU) CMPZeroPage() {
 }
 
 func (cpu *CPU) CMPZeroPageX() {
-	value, _ := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -995,7 +1061,7 @@ func (cpu *CPU) CMPZeroPageX() {
 
 func (cpu *CPU) CMPAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1006,7 +1072,7 @@ func (cpu *CPU) CMPAbsolute() {
 
 func (cpu *CPU) CMPAbsoluteY() {
 	address := cpu.AbsoluteY()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1017,7 +1083,7 @@ func (cpu *CPU) CMPAbsoluteY() {
 
 func (cpu *CPU) CMPAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1027,7 +1093,8 @@ func (cpu *CPU) CMPAbsoluteX() {
 }
 
 func (cpu *CPU) CMPIndirectIndirect() {
-	value, _ := cpu.IndirectIndex()
+	address := cpu.IndirectIndex()
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1037,7 +1104,8 @@ func (cpu *CPU) CMPIndirectIndirect() {
 }
 
 func (cpu *CPU) CMPIndexedIndirect() {
-	value, _ := cpu.IndexedIndirect()
+	address := cpu.IndexedIndirect()
+	value := cpu.read(address)
 	if cpu.A > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1056,7 +1124,8 @@ func (cpu *CPU) CPXImmediate() {
 }
 
 func (cpu *CPU) CPXZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	if cpu.X > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1067,7 +1136,7 @@ func (cpu *CPU) CPXZeroPage() {
 
 func (cpu *CPU) CPXAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	if cpu.X > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1086,7 +1155,8 @@ func (cpu *CPU) CPYImmediate() {
 }
 
 func (cpu *CPU) CPYZeroPage() {
-	value, _ := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	if cpu.Y > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1097,7 +1167,7 @@ func (cpu *CPU) CPYZeroPage() {
 
 func (cpu *CPU) CPYAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	if cpu.Y > value {
 		cpu.P = setBit(cpu.P, 0)
 	}
@@ -1107,34 +1177,34 @@ func (cpu *CPU) CPYAbsolute() {
 }
 
 func (cpu *CPU) INCZeroPage() {
-	_, address := cpu.ZeroPage()
-	cpu.memory[address]++
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	address := cpu.ZeroPage()
+	cpu.write(address, cpu.read(address)+1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 2
 }
 
 func (cpu *CPU) INCZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	cpu.memory[address]++
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	address := cpu.ZeroPageX()
+	cpu.write(address, cpu.read(address)+1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) INCAbsolute() {
 	address := cpu.Absolute()
-	cpu.memory[address]++
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)+1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 2
 }
 
 func (cpu *CPU) INCAbsoluteX() {
 	address := cpu.AbsoluteX()
-	cpu.memory[address]++
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)+1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 3
 }
 
@@ -1157,37 +1227,37 @@ func (cpu *CPU) INY() {
 }
 
 func (cpu *CPU) DECZeroPage() {
-	_, address := cpu.ZeroPage()
-	cpu.memory[address]--
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	address := cpu.ZeroPage()
+	cpu.write(address, cpu.read(address)-1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 3
 	cpu.PC++
 }
 
 func (cpu *CPU) DECZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	cpu.memory[address]--
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	address := cpu.ZeroPageX()
+	cpu.write(address, cpu.read(address)-1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 3
 	cpu.PC++
 }
 
 func (cpu *CPU) DECAbsolute() {
 	address := cpu.Absolute()
-	cpu.memory[address]--
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)-1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 2
 	cpu.PC++
 }
 
 func (cpu *CPU) DECAbsoluteX() {
 	address := cpu.AbsoluteX()
-	cpu.memory[address]--
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)-1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 	cpu.Cycles += 3
 }
 
@@ -1236,56 +1306,56 @@ func (cpu *CPU) ASLAccumulator() {
 }
 
 func (cpu *CPU) ASLZeroPage() {
-	_, address := cpu.ZeroPage()
+	address := cpu.ZeroPage()
 
-	leftbit := getBit(cpu.memory[address], 7)
+	leftbit := getBit(cpu.read(address), 7)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] << 1
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)<<1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 }
 
 func (cpu *CPU) ASLZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	leftbit := getBit(cpu.memory[address], 7)
+	address := cpu.ZeroPageX()
+	leftbit := getBit(cpu.read(address), 7)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] << 1
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)<<1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 }
 
 func (cpu *CPU) ASLAbsolute() {
 	address := cpu.Absolute()
-	leftbit := getBit(cpu.memory[address], 7)
+	leftbit := getBit(cpu.read(address), 7)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] << 1
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)<<1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 }
 
 func (cpu *CPU) ASLAbsoluteX() {
 	address := cpu.AbsoluteX()
-	leftbit := getBit(cpu.memory[address], 7)
+	leftbit := getBit(cpu.read(address), 7)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] << 1
-	cpu.setZeroFlag(cpu.memory[address])
-	cpu.setNegativeFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)<<1)
+	cpu.setZeroFlag(cpu.read(address))
+	cpu.setNegativeFlag(cpu.read(address))
 }
 
 func (cpu *CPU) LSRAccumulator() {
@@ -1303,55 +1373,55 @@ func (cpu *CPU) LSRAccumulator() {
 }
 
 func (cpu *CPU) LSRZeroPage() {
-	_, address := cpu.ZeroPage()
-	leftbit := getBit(cpu.memory[address], 0)
+	address := cpu.ZeroPage()
+	leftbit := getBit(cpu.read(address), 0)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] >> 1
-	cpu.setNegativeFlag(cpu.memory[address])
-	cpu.setZeroFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)>>1)
+	cpu.setNegativeFlag(cpu.read(address))
+	cpu.setZeroFlag(cpu.read(address))
 }
 
 func (cpu *CPU) LSRZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	leftbit := getBit(cpu.memory[address], 0)
+	address := cpu.ZeroPageX()
+	leftbit := getBit(cpu.read(address), 0)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] >> 1
-	cpu.setNegativeFlag(cpu.memory[address])
-	cpu.setZeroFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)>>1)
+	cpu.setNegativeFlag(cpu.read(address))
+	cpu.setZeroFlag(cpu.read(address))
 }
 
 func (cpu *CPU) LSRAbsolute() {
 	address := cpu.Absolute()
-	leftbit := getBit(cpu.memory[address], 0)
+	leftbit := getBit(cpu.read(address), 0)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] >> 1
-	cpu.setNegativeFlag(cpu.memory[address])
-	cpu.setZeroFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)>>1)
+	cpu.setNegativeFlag(cpu.read(address))
+	cpu.setZeroFlag(cpu.read(address))
 }
 
 func (cpu *CPU) LSRAbsoluteX() {
 	address := cpu.Absolute()
-	leftbit := getBit(cpu.memory[address], 0)
+	leftbit := getBit(cpu.read(address), 0)
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
 	} else {
 		cpu.P = clearBit(cpu.P, 0)
 	}
-	cpu.memory[address] = cpu.memory[address] >> 1
-	cpu.setNegativeFlag(cpu.memory[address])
-	cpu.setZeroFlag(cpu.memory[address])
+	cpu.write(address, cpu.read(address)>>1)
+	cpu.setNegativeFlag(cpu.read(address))
+	cpu.setZeroFlag(cpu.read(address))
 }
 
 func (cpu *CPU) ROLAccumulator() {
@@ -1374,13 +1444,14 @@ func (cpu *CPU) ROLAccumulator() {
 }
 
 func (cpu *CPU) ROLZeroPage() {
-	value, address := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	leftbit := getBit(value, 7)
-	cpu.memory[address] = cpu.memory[address] << 1
+	cpu.write(address, cpu.read(address)<<1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 0)
+		cpu.write(address, setBit(cpu.read(address), 0))
 	} else {
-		cpu.A = clearBit(cpu.memory[address], 0)
+		cpu.A = clearBit(cpu.read(address), 0)
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1393,13 +1464,14 @@ func (cpu *CPU) ROLZeroPage() {
 }
 
 func (cpu *CPU) ROLZeroPageX() {
-	value, address := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	leftbit := getBit(value, 7)
-	cpu.memory[address] = cpu.memory[address] << 1
+	cpu.write(address, cpu.read(address)<<1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 0)
+		cpu.write(address, setBit(cpu.read(address), 0))
 	} else {
-		cpu.A = clearBit(cpu.memory[address], 0)
+		cpu.A = clearBit(cpu.read(address), 0)
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1413,13 +1485,13 @@ func (cpu *CPU) ROLZeroPageX() {
 
 func (cpu *CPU) ROLAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	leftbit := getBit(value, 7)
-	cpu.memory[address] = cpu.memory[address] << 1
+	cpu.write(address, cpu.read(address)<<1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 0)
+		cpu.write(address, setBit(cpu.read(address), 0))
 	} else {
-		cpu.A = clearBit(cpu.memory[address], 0)
+		cpu.A = clearBit(cpu.read(address), 0)
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1433,13 +1505,13 @@ func (cpu *CPU) ROLAbsolute() {
 
 func (cpu *CPU) ROLAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	leftbit := getBit(value, 7)
-	cpu.memory[address] = cpu.memory[address] << 1
+	cpu.write(address, cpu.read(address)<<1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 0)
+		cpu.write(address, setBit(cpu.read(address), 0))
 	} else {
-		cpu.A = clearBit(cpu.memory[address], 0)
+		cpu.A = clearBit(cpu.read(address), 0)
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1471,13 +1543,14 @@ func (cpu *CPU) RORAccumulator() {
 }
 
 func (cpu *CPU) RORZeroPage() {
-	value, address := cpu.ZeroPage()
+	address := cpu.ZeroPage()
+	value := cpu.read(address)
 	leftbit := getBit(value, 0)
-	cpu.memory[address] = cpu.memory[address] >> 1
+	cpu.write(address, cpu.read(address)>>1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 7)
+		cpu.write(address, setBit(cpu.read(address), 7))
 	} else {
-		cpu.memory[address] = clearBit(cpu.memory[address], 7)
+		cpu.write(address, clearBit(cpu.read(address), 7))
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1490,13 +1563,14 @@ func (cpu *CPU) RORZeroPage() {
 }
 
 func (cpu *CPU) RORZeroPageX() {
-	value, address := cpu.ZeroPageX()
+	address := cpu.ZeroPageX()
+	value := cpu.read(address)
 	leftbit := getBit(value, 0)
-	cpu.memory[address] = cpu.memory[address] >> 1
+	cpu.write(address, cpu.read(address)>>1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 7)
+		cpu.write(address, setBit(cpu.read(address), 7))
 	} else {
-		cpu.memory[address] = clearBit(cpu.memory[address], 7)
+		cpu.write(address, clearBit(cpu.read(address), 7))
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1510,13 +1584,13 @@ func (cpu *CPU) RORZeroPageX() {
 
 func (cpu *CPU) RORAbsolute() {
 	address := cpu.Absolute()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	leftbit := getBit(value, 0)
-	cpu.memory[address] = cpu.memory[address] >> 1
+	cpu.write(address, cpu.read(address)>>1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 7)
+		cpu.write(address, setBit(cpu.read(address), 7))
 	} else {
-		cpu.memory[address] = clearBit(cpu.memory[address], 7)
+		cpu.write(address, clearBit(cpu.read(address), 7))
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1530,13 +1604,13 @@ func (cpu *CPU) RORAbsolute() {
 
 func (cpu *CPU) RORAbsoluteX() {
 	address := cpu.AbsoluteX()
-	value := cpu.memory[address]
+	value := cpu.read(address)
 	leftbit := getBit(value, 0)
-	cpu.memory[address] = cpu.memory[address] >> 1
+	cpu.write(address, cpu.read(address)>>1)
 	if getBit(cpu.P, 0) {
-		cpu.memory[address] = setBit(cpu.memory[address], 7)
+		cpu.write(address, setBit(cpu.read(address), 7))
 	} else {
-		cpu.memory[address] = clearBit(cpu.memory[address], 7)
+		cpu.write(address, clearBit(cpu.read(address), 7))
 	}
 	if leftbit {
 		cpu.P = setBit(cpu.P, 0)
@@ -1549,8 +1623,8 @@ func (cpu *CPU) RORAbsoluteX() {
 }
 
 func (cpu *CPU) JMPAbsolute() {
-	lowByte := uint16(cpu.memory[cpu.PC+1])
-	highByte := uint16(cpu.memory[cpu.PC+2])
+	lowByte := uint16(cpu.fetch(cpu.PC + 1))
+	highByte := uint16(cpu.fetch(cpu.PC + 2))
 	address := (highByte << 8) | lowByte
 	cpu.PC = address
 	cpu.Cycles += 3
@@ -1559,16 +1633,19 @@ func (cpu *CPU) JMPAbsolute() {
 func (cpu *CPU) JMPIndirect() {
 	address := cpu.Indirect()
 	cpu.PC = address
+	if cpu.CDL != nil {
+		cpu.CDL.logIndirectCode(cpu, address)
+	}
 }
 
 func (cpu *CPU) JSRAbsolute() {
-	lowByte := uint16(cpu.memory[cpu.PC+1])
-	highByte := uint16(cpu.memory[cpu.PC+2])
+	lowByte := uint16(cpu.fetch(cpu.PC + 1))
+	highByte := uint16(cpu.fetch(cpu.PC + 2))
 	targetAddress := (highByte << 8) | lowByte
 	returnAddress := cpu.PC + 1
-	cpu.memory[0x100|uint16(cpu.SP)] = byte((returnAddress >> 8) & 0xFF)
+	cpu.write(0x100|uint16(cpu.SP), byte((returnAddress>>8)&0xFF))
 	cpu.SP--
-	cpu.memory[0x100|uint16(cpu.SP)] = byte(returnAddress & 0xFF)
+	cpu.write(0x100|uint16(cpu.SP), byte(returnAddress&0xFF))
 	cpu.SP--
 	cpu.PC = targetAddress
 	cpu.Cycles += 6
@@ -1576,9 +1653,9 @@ func (cpu *CPU) JSRAbsolute() {
 
 func (cpu *CPU) RTS() {
 	cpu.SP++
-	lowByte := uint16(cpu.memory[0x100|uint16(cpu.SP)])
+	lowByte := uint16(cpu.read(0x100 | uint16(cpu.SP)))
 	cpu.SP++
-	highByte := uint16(cpu.memory[0x100|uint16(cpu.SP)])
+	highByte := uint16(cpu.read(0x100 | uint16(cpu.SP)))
 	// Combine the low and high bytes to get the full return address
 	returnAddress := (highByte << 8) | lowByte
 	// Set the program counter to the return address + 1 (minus one is accounted for here)
@@ -1712,50 +1789,50 @@ func (cpu *CPU) SEC() {
 
 func (cpu *CPU) ISCAbsolute() {
 	address := cpu.Absolute()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) ISCAbsoluteX() {
 	address := cpu.AbsoluteX()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) ISCAbsoluteY() {
 	address := cpu.AbsoluteY()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) ISCZeroPage() {
-	_, address := cpu.ZeroPage()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	address := cpu.ZeroPage()
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 2
 }
 
 func (cpu *CPU) ISCZeroPageX() {
-	_, address := cpu.ZeroPageX()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	address := cpu.ZeroPageX()
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) ISCIndirectIndex() {
-	_, address := cpu.IndirectIndex()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	address := cpu.IndirectIndex()
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 3
 }
 
 func (cpu *CPU) ISCIndexIndirect() {
-	_, address := cpu.IndexedIndirect()
-	cpu.memory[address] = cpu.memory[address] + 1
-	cpu.sbc(cpu.memory[address])
+	address := cpu.IndexedIndirect()
+	cpu.write(address, cpu.read(address)+1)
+	cpu.sbc(cpu.read(address))
 	cpu.Cycles += 3
 }
 
@@ -1789,13 +1866,13 @@ func (cpu *CPU) BRK() {
 	// Increment PC to point to the next instruction
 	cpu.PC++
 	// Push high byte of the PC onto the stack
-	cpu.memory[0x100|uint16(cpu.SP)] = byte((cpu.PC >> 8) & 0xFF)
+	cpu.write(0x100|uint16(cpu.SP), byte((cpu.PC>>8)&0xFF))
 	cpu.SP--
 	// Push low byte of the PC onto the stack
-	cpu.memory[0x100|uint16(cpu.SP)] = byte(cpu.PC & 0xFF)
+	cpu.write(0x100|uint16(cpu.SP), byte(cpu.PC&0xFF))
 	cpu.SP--
 	// Push the status register onto the stack with the break flag set
-	cpu.memory[0x100|uint16(cpu.SP)] = cpu.P | (1 << 4)
+	cpu.write(0x100|uint16(cpu.SP), cpu.P|(1<<4))
 	cpu.SP--
 	// Set the break flag in the status register
 	cpu.P |= (1 << 4)
@@ -1807,6 +1884,36 @@ func (cpu *CPU) BRK() {
 	cpu.Cycles += 7
 }
 
+func (cpu *CPU) RTI() {
+	// The break flag only exists on the stack, bit 5 always reads as set
+	cpu.P = clearBit(cpu.Pull(), 4) | 0x20
+	lowByte := uint16(cpu.Pull())
+	highByte := uint16(cpu.Pull())
+	cpu.PC = (highByte << 8) | lowByte
+	cpu.Cycles += 6
+}
+
+/*
+Takes an interrupt request unless the I flag masks it: pushes PC and the status with
+the break flag clear, sets I and jumps through the vector at $FFFE. Returns false
+when the request was masked.
+*/
+func (cpu *CPU) IRQ() bool {
+	if getBit(cpu.P, 2) {
+		return false
+	}
+	cpu.write(0x100|uint16(cpu.SP), byte(cpu.PC>>8))
+	cpu.SP--
+	cpu.write(0x100|uint16(cpu.SP), byte(cpu.PC))
+	cpu.SP--
+	cpu.write(0x100|uint16(cpu.SP), clearBit(cpu.P, 4)|0x20)
+	cpu.SP--
+	cpu.P = setBit(cpu.P, 2)
+	cpu.PC = uint16(cpu.read(0xFFFF))<<8 | uint16(cpu.read(0xFFFE))
+	cpu.Cycles += 7
+	return true
+}
+
 func (cpu *CPU) NOP() {
 	cpu.PC++
 }
@@ -1964,6 +2071,7 @@ func (cpu *CPU) ExecuteInstruction(opcode uint8) {
 		0x78: (*CPU).SEI,
 		0x20: (*CPU).JSRAbsolute,
 		0x60: (*CPU).RTS,
+		0x40: (*CPU).RTI,
 		0x00: (*CPU).BRK,
 		0x4C: (*CPU).JMPAbsolute,
 		0x6c: (*CPU).JMPIndirect,
@@ -1973,10 +2081,13 @@ func (cpu *CPU) ExecuteInstruction(opcode uint8) {
 		0xFB: (*CPU).ISCAbsoluteX,
 		0xE3: (*CPU).ISCIndirectIndex,
 		0xF3: (*CPU).ISCIndexIndirect,
-		// 0x40: (*CPU).RT,
 		// 0xEA: (*CPU).NOP,
 	}
 
+	if cpu.CDL != nil {
+		cpu.CDL.logCode(cpu, cpu.PC, opcode)
+	}
+
 	// Look up the instruction function for the given opcode
 	if instrFunc, exists := opcodeTable[opcode]; exists {
 		instrFunc(cpu) // Execute the instruction
@@ -1994,71 +2105,532 @@ func (cpu *CPU) LoadProgram(program []uint8, startAddress uint16) {
 	cpu.PC = startAddress // Set the program counter to the start of our program
 }
 
-func readNESFile(filename string) ([]uint8, error) {
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("error opening file: %w", err)
-	}
-	defer file.Close()
+// Nametable mirroring of a cartridge
+const (
+	mirrorHorizontal = 0
+	mirrorVertical   = 1
+	mirrorFourScreen = 2
+	mirrorSingleA    = 3
+	mirrorSingleB    = 4
+)
+
+var mirroringNames = map[uint8]string{
+	mirrorHorizontal: "horizontal",
+	mirrorVertical:   "vertical",
+	mirrorFourScreen: "four-screen",
+	mirrorSingleA:    "single-screen A",
+	mirrorSingleB:    "single-screen B",
+}
+
+// Cartridge holds the ROM images and header fields of a loaded game
+type Cartridge struct {
+	PRG []uint8
+	CHR []uint8
 
-	// Read the entire file
-	data, err := io.ReadAll(file)
+	Mapper    uint8
+	Mirroring uint8
+	Battery   bool
+	Region    *Region
+
+	// Known only when the ROM database or a UNIF file names the game
+	Title string
+	// UNIF board name, empty for iNES images
+	Board string
+	// Sides of a Famicom Disk System image, which has no PRG or CHR ROM
+	Disks [][]uint8
+	// Set for NSF music files, whose data is laid out in PRG
+	NSF *NSF
+}
+
+/*
+Loads an iNES, UNIF, FDS or NSF image, either as a plain file or inside a .zip or .gz archive.
+When patchPath is set the patch is applied to the image before it is parsed.
+*/
+func readNESFile(filename string, patchPath string) (*Cartridge, error) {
+	data, err := readROMFile(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
+		return nil, err
 	}
+	if patchPath != "" {
+		if data, err = applyPatchFile(data, patchPath); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte(unifMagic)):
+		return parseUNIF(data)
+	case isFDSImage(data):
+		return parseFDS(data)
+	case isNSFImage(data):
+		return parseNSF(data)
+	}
+	return parseINES(data)
+}
 
+func parseINES(data []uint8) (*Cartridge, error) {
 	// Check if it's a valid NES file (should start with "NES\x1A")
 	if len(data) < 16 || string(data[:4]) != "NES\x1A" {
 		return nil, fmt.Errorf("not a valid NES file")
 	}
 
-	// Get the size of PRG-ROM in 16KB units
+	// Get the size of PRG-ROM in 16KB units and CHR-ROM in 8KB units
 	prgRomSize := int(data[4]) * 16384
+	chrRomSize := int(data[5]) * 8192
+
+	// A 512 byte trainer sits between the header and PRG-ROM when flag 6 bit 2 is set
+	prgStart := headerSize
+	if getBit(data[6], 2) {
+		prgStart += 512
+	}
 
-	// Check if the file is long enough to contain the PRG-ROM
-	if len(data) < 16+prgRomSize {
-		return nil, fmt.Errorf("file is too short to contain the expected PRG-ROM data")
+	// Check if the file is long enough to contain the PRG-ROM and CHR-ROM
+	if len(data) < prgStart+prgRomSize+chrRomSize {
+		return nil, fmt.Errorf("file is too short to contain the expected PRG-ROM and CHR-ROM data")
 	}
 
-	// Extract the PRG-ROM data
-	prgRom := data[16 : 16+prgRomSize]
+	cart := &Cartridge{
+		// Extract the PRG-ROM and CHR-ROM data
+		PRG: data[prgStart : prgStart+prgRomSize],
+		CHR: data[prgStart+prgRomSize : prgStart+prgRomSize+chrRomSize],
+
+		Mapper:    data[6]>>4 | data[7]&0xF0,
+		Mirroring: data[6] & 1,
+		Battery:   getBit(data[6], 1),
+		Region:    regionNTSC,
+	}
 
-	return prgRom, nil
+	// NES 2.0 stores the timing in byte 12, iNES only has a rarely set PAL bit in byte 9
+	if data[7]&0x0C == 0x08 {
+		switch data[12] & 3 {
+		case 1:
+			cart.Region = regionPAL
+		case 3:
+			cart.Region = regionDendy
+		}
+	} else if getBit(data[9], 0) {
+		cart.Region = regionPAL
+	}
+	if getBit(data[6], 3) {
+		cart.Mirroring = mirrorFourScreen
+	}
+	return cart, nil
 }
 
 func (cpu *CPU) LoadNESROM(prgROM []uint8) {
+	cpu.prgSize = len(prgROM)
 	for i, data := range prgROM {
 		cpu.memory[0x8000+i] = data
 		if len(prgROM) == 16384 {
 			cpu.memory[0xC000+i] = data
 		}
 	}
+	for i := range cpu.prgBanks {
+		cpu.prgBanks[i] = i * 0x1000 % max(cpu.prgSize, 1)
+	}
+}
+
+// Returns the PRG ROM offset mapped at address, false outside cartridge ROM
+func (cpu *CPU) prgOffset(address uint16) (int, bool) {
+	if address < 0x8000 || cpu.prgSize == 0 {
+		return 0, false
+	}
+	return cpu.prgBanks[(address-0x8000)>>12] + int(address&0x0FFF), true
+}
+
+// Formats an address as $XXXX followed by its label when one is known
+func (cpu *CPU) addressName(address uint16) string {
+	if name, ok := cpu.Symbols.Lookup(cpu, address); ok {
+		return fmt.Sprintf("$%04X %s", address, name)
+	}
+	return fmt.Sprintf("$%04X", address)
 }
 
 func main() {
-	cpu := &CPU{}
+	romPath := flag.String("rom", "nestest.nes", "path of the iNES, UNIF or FDS image or the NSF file to run")
+	frames := flag.Int("frames", 0, "stop after this many frames, 0 runs until BRK")
+	trace := flag.Bool("trace", true, "print every executed instruction")
+	profilePath := flag.String("profile", "", "write folded call stacks for flame graphs to this file")
+	reportPath := flag.String("profile-report", "", "write the hot routine and address report to this file")
+	profileStart := flag.Int("profile-start", 0, "first frame to profile")
+	profileEnd := flag.Int("profile-end", -1, "last frame to profile, -1 profiles to the end")
+	symbolPaths := flag.String("symbols", "", "comma separated ca65 .dbg, FCEUX .nl or Mesen .mlb label files")
+	breakList := flag.String("break", "", "comma separated labels or $addresses to stop at")
+	loadState := flag.String("load-state", "", "restore this save state before running")
+	saveState := flag.String("save-state", "", "write a save state here when the run ends")
+	moviePath := flag.String("movie", "", "play back an FCEUX .fm2 or BizHawk .bk2 movie")
+	recordPath := flag.String("record", "", "record input to an .fm2 or .bk2 movie, from the loaded state if any, which only this emulator can play back")
+	screenshotPath := flag.String("screenshot", "", "save the frame as .png or .ppm, a %d in the name is replaced by the frame number")
+	screenshotAt := flag.String("screenshot-at", "", "comma separated frames to capture, default is the last frame")
+	scale := flag.Int("scale", 1, "screenshot scale factor")
+	palettePath := flag.String("palette", "", "64 or 512 colour .pal file used for screenshots, or \"ntsc\" to generate one")
+	hue := flag.Float64("hue", 0, "hue shift in degrees of the generated NTSC palette and the NTSC filter")
+	saturation := flag.Float64("saturation", 1, "saturation of the generated NTSC palette and the NTSC filter")
+	contrast := flag.Float64("contrast", 1, "contrast of the generated NTSC palette and the NTSC filter")
+	brightness := flag.Float64("brightness", 0, "brightness offset of the generated NTSC palette and the NTSC filter")
+	gamma := flag.Float64("gamma", 2.2, "gamma of the TV imitated by the generated NTSC palette and the NTSC filter")
+	ntsc := flag.Bool("ntsc", false, "render screenshots and video through the NTSC composite filter")
+	ntscSharpness := flag.Float64("ntsc-sharpness", 0.2, "luma sharpness of the NTSC filter, 0 to 1")
+	ntscArtifacts := flag.Float64("ntsc-artifacts", 1, "amount of composite colour artifacts of the NTSC filter, 0 to 1")
+	cheatPath := flag.String("cheats", "", "load FCEUX .cht cheats from this file")
+	cheatCodes := flag.String("cheat", "", "comma separated Game Genie or raw AAAA:VV cheat codes")
+	scriptPath := flag.String("script", "", "run this Lua script alongside the game")
+	dapAddress := flag.String("dap", "", "run as a Debug Adapter Protocol server on \"stdio\" or a TCP address, the ROM comes from the launch request")
+	gdbAddress := flag.String("gdb", "", "wait for a GDB remote debugger on this address, such as localhost:2345, before running")
+	watchPath := flag.String("watch", "", "JSON watch list whose values are printed and saved back when the run ends")
+	cdlPath := flag.String("cdl", "", "log code and data accesses to this FCEUX .cdl file, merging any existing log")
+	wavPath := flag.String("wav", "", "record the APU output to this WAV file")
+	wavRate := flag.Int("wav-rate", 44100, "sample rate of the WAV recording")
+	wavStems := flag.Bool("wav-stems", false, "also record each APU channel to its own WAV file next to -wav")
+	y4mPath := flag.String("y4m", "", "record every frame to this YUV4MPEG2 file, use with -wav for audio")
+	videoPipe := flag.String("video-pipe", "", "pipe every frame as raw RGBA to the standard input of this shell command")
+	regionName := flag.String("region", "auto", "console region: ntsc, pal, dendy, or auto to use the ROM header")
+	biosPath := flag.String("fds-bios", "", "Famicom Disk System BIOS for .fds images, by default disksys.rom next to the image")
+	patchPath := flag.String("patch", "", "IPS, UPS or BPS patch applied to the ROM, by default one named after the ROM, or \"off\"")
+	romDBPath := flag.String("romdb", "", "NES 2.0 XML database used to correct ROM headers, the built in one when empty, or \"off\"")
+	track := flag.Int("track", 0, "NSF track to play, counting from 1, by default the file's starting track")
+	listTracks := flag.Bool("tracks", false, "print the metadata and track list of an NSF and exit")
+	allTracks := flag.Bool("all-tracks", false, "render every NSF track to its own WAV file named after -wav")
+	trackLength := flag.Float64("track-length", 150, "seconds to render of NSF tracks the file gives no length for")
+	goldenPath := flag.String("golden", "", "check the frames listed in this golden manifest and exit")
+	goldenUpdate := flag.Bool("golden-update", false, "rewrite the golden hashes and reference frames instead of checking them")
+	goldenDiff := flag.String("golden-diff", "golden-diff", "directory for the images of mismatching frames")
+	flag.Parse()
+
+	if *goldenPath != "" {
+		if err := CheckGolden(*goldenPath, *goldenDiff, *goldenUpdate); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	region, err := regionByName(*regionName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var db *ROMDatabase
+	if *romDBPath != "off" {
+		if db, err = LoadROMDatabase(*romDBPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *dapAddress != "" {
+		if *dapAddress == "stdio" {
+			err = ServeDAPStdio(region, db)
+		} else {
+			err = ServeDAPTCP(*dapAddress, region, db)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	runner, cart, err := loadROM(*romPath, *patchPath, *biosPath, region, db)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if cart.Title != "" {
+		fmt.Printf("%s (%s)\n", cart.Title, runner.Region.Name)
+	}
+	cpu := runner.cpu
+
+	if player := runner.NSF(); player != nil {
+		if *listTracks {
+			player.NSF.describe(os.Stdout)
+			return
+		}
+		if *track != 0 {
+			if err := player.Start(*track - 1); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		// With a WAV to write the tracks are rendered without running the rest
+		if *wavPath != "" {
+			tracks := []int{player.Track()}
+			if *allTracks {
+				tracks = player.NSF.Playlist
+				if tracks == nil {
+					for i := range player.NSF.Tracks {
+						tracks = append(tracks, i)
+					}
+				}
+			}
+			renders, err := runner.RenderNSF(tracks, *wavPath, *wavRate, *wavStems, *trackLength)
+			for _, render := range renders {
+				if render.Stopped {
+					fmt.Printf("track %d stopped at BRK\n", render.Track+1)
+				}
+				fmt.Printf("wrote track %d to %s\n", render.Track+1, render.Filename)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	if *symbolPaths != "" {
+		cpu.Symbols = NewSymbolTable()
+		for _, path := range strings.Split(*symbolPaths, ",") {
+			if err := cpu.Symbols.LoadFile(path); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *cdlPath != "" {
+		cpu.CDL = NewCodeDataLogger(cart)
+		if err := cpu.CDL.LoadFile(*cdlPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *cheatPath != "" || *cheatCodes != "" {
+		cpu.Cheats = NewCheatList()
+		if *cheatPath != "" {
+			if err := cpu.Cheats.LoadFile(*cheatPath); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if *cheatCodes != "" {
+			for _, code := range strings.Split(*cheatCodes, ",") {
+				if _, err := cpu.Cheats.AddCode(code, code); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+		}
+	}
+
+	breakpoints := make(map[uint16]bool)
+	if *breakList != "" {
+		for _, name := range strings.Split(*breakList, ",") {
+			addresses, err := cpu.Symbols.Resolve(cpu, name)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, address := range addresses {
+				breakpoints[address] = true
+			}
+		}
+	}
+
+	if *loadState != "" {
+		if err := runner.LoadStateFile(*loadState); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *moviePath != "" {
+		movie, err := LoadMovieFile(*moviePath)
+		if err == nil {
+			err = movie.CheckROM(cart)
+		}
+		if err == nil {
+			err = runner.StartPlayback(movie)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if *recordPath != "" {
+		movie := NewMovie(cart, filepath.Base(*romPath))
+		if err := runner.StartRecording(movie, *loadState != ""); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if movie.StartState != nil {
+			fmt.Println("warning: the movie starts from a save state, so FCEUX and BizHawk cannot play it back")
+		}
+	}
+
+	ntscParams := NTSCParams{*hue, *saturation, *contrast, *brightness, *gamma}
+	if *ntsc {
+		runner.Filter = NewNTSCFilter(ntscParams, *ntscSharpness, *ntscArtifacts)
+	}
+	palette := defaultPalette
+	if *palettePath == "ntsc" {
+		palette = GenerateNTSCPalette(ntscParams)
+	} else if *palettePath != "" {
+		if palette, err = LoadPaletteFile(*palettePath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	screenshotFrames := make(map[int]bool)
+	if *screenshotAt != "" {
+		for _, text := range strings.Split(*screenshotAt, ",") {
+			frame, err := strconv.Atoi(text)
+			if err != nil {
+				fmt.Printf("invalid screenshot frame %q\n", text)
+				os.Exit(1)
+			}
+			screenshotFrames[frame] = true
+		}
+	}
+	if (*screenshotPath != "" || *y4mPath != "" || *videoPipe != "") && *scriptPath == "" {
+		fmt.Fprintln(os.Stderr, "warning: there is no PPU yet, so frames are blank unless a script draws them")
+	}
+	screenshot := func() {
+		if err := runner.Screenshot(frameFileName(*screenshotPath, runner.Frame), palette, *scale); err != nil {
+			fmt.Println(err)
+		}
+	}
 
-	program, _ := readNESFile("nestest.nes")
+	if *profilePath != "" || *reportPath != "" {
+		runner.Profiler = NewProfiler(*profileStart, *profileEnd)
+	}
+
+	if *wavPath != "" {
+		if runner.Audio, err = NewAudioRecorder(*wavPath, *wavRate, *wavStems, runner.Region); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	switch {
+	case *y4mPath != "":
+		runner.Video, err = NewY4MRecorder(*y4mPath, palette, *scale, runner.Region)
+	case *videoPipe != "":
+		runner.Video, err = NewPipeRecorder(*videoPipe, palette, *scale)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *scriptPath != "" {
+		if _, err := runner.LoadScript(*scriptPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *gdbAddress != "" {
+		server, err := ListenGDB(runner, *gdbAddress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Waiting for GDB on %s\n", server.Addr())
+		killed, err := server.Serve()
+		server.Close()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if killed {
+			os.Exit(0)
+		}
+	}
 
-	cpu.LoadNESROM(program)
-	cpu.PC = 0x8000
-	cpu.P = 0x24
 	i := 0
-	for {
-		opcode := cpu.memory[cpu.PC]
-		fmt.Printf("Opcode: 0x%02X at PC: 0x%04X\n", opcode, cpu.PC)
-		cpu.ExecuteInstruction(opcode)
-		// if i == 500 {
-		// 	break
-		// }
-		fmt.Printf("Step %d: PC: 0x%04X, A: %d, X: 0x%02X, Y: 0x%02X, P: 0x%02X \n",
-			i+1, cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.P)
+	for *frames == 0 || runner.Frame < *frames {
+		pc := cpu.PC
+		if breakpoints[pc] {
+			fmt.Printf("BREAKPOINT at %s\n", cpu.addressName(pc))
+			break
+		}
+		if *trace {
+			text, _ := cpu.Disassemble(pc)
+			fmt.Printf("Opcode: 0x%02X at PC: %s  %s\n", cpu.fetch(pc), cpu.addressName(pc), text)
+		}
+		frame := runner.Frame
+		opcode := runner.Step()
+		if runner.Frame != frame && screenshotFrames[runner.Frame] && *screenshotPath != "" {
+			screenshot()
+		}
+		if *trace {
+			fmt.Printf("Step %d: PC: 0x%04X, A: %d, X: 0x%02X, Y: 0x%02X, P: 0x%02X \n",
+				i+1, cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.P)
+		}
 		i++
 		if opcode == 0x00 {
 			fmt.Println("BREAK")
 			break
 		}
-		fmt.Println("---")
+		if runner.Script != nil && runner.Script.Err != nil {
+			fmt.Println(runner.Script.Err)
+			os.Exit(1)
+		}
+		if *trace {
+			fmt.Println("---")
+		}
+	}
+
+	if *screenshotPath != "" && len(screenshotFrames) == 0 {
+		screenshot()
+	}
+	if *moviePath != "" && runner.Desync >= 0 {
+		fmt.Printf("movie desynced at frame %d\n", runner.Desync)
+	}
+
+	if runner.Audio != nil {
+		if err := runner.Audio.Close(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if runner.Video != nil {
+		if err := runner.Video.Close(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *recordPath != "" && runner.Movie != nil {
+		if err := runner.StopMovie().WriteFile(*recordPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *saveState != "" {
+		if err := runner.SaveStateFile(*saveState); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *watchPath != "" {
+		watches, err := LoadWatchList(*watchPath)
+		if err == nil {
+			err = watches.WriteFile(*watchPath, cpu)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, w := range watches.Watches {
+			fmt.Printf("%s $%04X = %d\n", w.Name, w.Address, w.Value)
+		}
+	}
+
+	if cpu.CDL != nil {
+		if err := cpu.CDL.WriteFile(*cdlPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if runner.Profiler != nil {
+		if err := writeProfile(runner.Profiler, cpu, *profilePath, *reportPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+// 32KB of PRG ROM with program at $8000
+func testPRG(program ...uint8) []uint8 {
+	prg := make([]uint8, 0x8000)
+	copy(prg, program)
+	return prg
+}
+
+// A runner on NTSC with the cartridge hardware of mapper, starting at $8000
+func newTestRunner(mapper Mapper) *Runner {
+	cpu := &CPU{}
+	cpu.APU = NewAPU(cpu, regionNTSC)
+	cpu.Mapper = mapper
+	cpu.P = 0x24
+	cpu.SP = 0xFD
+	mapper.Reset(cpu)
+	cpu.PC = 0x8000
+	return NewRunner(cpu, regionNTSC)
+}
+
+// Steps until the CPU reaches address, failing after limit instructions
+func runTo(t testing.TB, r *Runner, address uint16, limit int) {
+	t.Helper()
+	for i := 0; r.cpu.PC != address; i++ {
+		if i == limit {
+			t.Fatalf("PC $%04X did not reach $%04X in %d instructions", r.cpu.PC, address, limit)
+		}
+		r.Step()
+	}
+}
+
+func TestIndirectAddressing(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []uint8
+		want    uint8
+	}{
+		// LDY #$05, LDA ($10),Y
+		{"indirect indexed", []uint8{0xA0, 0x05, 0xB1, 0x10}, 0x33},
+		// LDX #$02, LDA ($0E,X)
+		{"indexed indirect", []uint8{0xA2, 0x02, 0xA1, 0x0E}, 0x22},
+		// LDX #$01, LDA ($FE,X) takes its high byte from $00
+		{"zero page wrap", []uint8{0xA2, 0x01, 0xA1, 0xFE}, 0x11},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prg := testPRG(test.program...)
+			prg[0x0100] = 0x22
+			prg[0x0105] = 0x33
+			r := newTestRunner(&NROM{prg: prg})
+			r.cpu.memory[0x00] = 0x02
+			r.cpu.memory[0x10] = 0x00
+			r.cpu.memory[0x11] = 0x81
+			r.cpu.memory[0xFF] = 0x00
+			r.cpu.memory[0x0200] = 0x11
+			r.Step()
+			r.Step()
+			if r.cpu.A != test.want {
+				t.Errorf("A = $%02X, want $%02X", r.cpu.A, test.want)
+			}
+			if r.cpu.PC != 0x8004 {
+				t.Errorf("PC = $%04X, want $8004", r.cpu.PC)
+			}
+		})
+	}
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Instructions run between checks for requests such as pause while the program runs
+const dapPollInterval = 1000
+
+// Variable references of the scopes, the only containers in the variables view
+const (
+	dapRegisters = iota + 1
+	dapFlags
+	dapZeroPage
+	dapStack
+)
+
+// Flags of P from bit 7 down, "-" is the unused bit
+const dapFlagNames = "NV-BDIZC"
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type dapResponse struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	Verified bool       `json:"verified"`
+	Line     int        `json:"line,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	// Address of the code the breakpoint stops at
+	InstructionReference string `json:"instructionReference,omitempty"`
+}
+
+type dapStackFrame struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Source *dapSource `json:"source,omitempty"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+	// Address of the frame's current instruction
+	InstructionPointerReference string `json:"instructionPointerReference"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// Arguments of launch, the ROM settings default to the command line's
+type dapLaunchArguments struct {
+	Program     string   `json:"program"`
+	Symbols     []string `json:"symbols"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+	Patch       string   `json:"patch"`
+	FDSBIOS     string   `json:"fdsBios"`
+}
+
+// How a step ends, checked after every instruction with the opcode it ran
+type dapStepper func(opcode uint8) bool
+
+/*
+DAPServer is a Debug Adapter Protocol server for editors, speaking JSON messages with
+Content-Length headers over a stream. The client launches a ROM, sets breakpoints by
+source line through ld65 debug info or by label, steps by line or instruction and
+inspects the registers, flags, zero page, stack and memory. The program only runs
+inside Serve, which also takes requests while it runs so it can be paused.
+*/
+type DAPServer struct {
+	// Used to load ROMs, set from the command line
+	Region      *Region
+	ROMDatabase *ROMDatabase
+
+	reader *bufio.Reader
+	writer io.Writer
+	seq    int
+	// Lines as the client counts them start at 1 unless it says otherwise
+	lineBase int
+
+	runner *Runner
+	// Requested breakpoints by source path, and the code locations they resolved to
+	sourceBreakpoints   map[string][]int
+	functionBreakpoints []string
+	breakpoints         map[codeLocation]bool
+
+	requests chan dapMessage
+	// Closed when Serve returns, so the reader stops handing it requests
+	done    chan struct{}
+	running bool
+	// Ends the current step, nil when continuing
+	stepper      dapStepper
+	stopOnEntry  bool
+	disconnected bool
+}
+
+func NewDAPServer(r io.Reader, w io.Writer) *DAPServer {
+	return &DAPServer{
+		reader:            bufio.NewReader(r),
+		writer:            w,
+		lineBase:          1,
+		sourceBreakpoints: make(map[string][]int),
+		breakpoints:       make(map[codeLocation]bool),
+	}
+}
+
+/*
+Serves DAP on the standard input and output. Output of the emulator is sent to the
+standard error instead so it does not get mixed into the messages.
+*/
+func ServeDAPStdio(region *Region, db *ROMDatabase) error {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+	server := NewDAPServer(os.Stdin, stdout)
+	server.Region, server.ROMDatabase = region, db
+	return server.Serve()
+}
+
+// Waits for one client on address and serves it
+func ServeDAPTCP(address string, region *Region, db *ROMDatabase) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening for DAP: %w", err)
+	}
+	defer listener.Close()
+	fmt.Printf("Waiting for a DAP client on %s\n", listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		return fmt.Errorf("error accepting DAP connection: %w", err)
+	}
+	defer conn.Close()
+	server := NewDAPServer(conn, conn)
+	server.Region, server.ROMDatabase = region, db
+	return server.Serve()
+}
+
+// Handles requests until the client disconnects
+func (d *DAPServer) Serve() error {
+	d.requests = make(chan dapMessage)
+	d.done = make(chan struct{})
+	defer close(d.done)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(d.requests)
+		for {
+			message, err := d.readMessage()
+			if err != nil {
+				if err != io.EOF {
+					errs <- err
+				}
+				return
+			}
+			select {
+			case d.requests <- message:
+			case <-d.done:
+				return
+			}
+		}
+	}()
+
+	for !d.disconnected {
+		if d.running {
+			if err := d.run(); err != nil {
+				return err
+			}
+			continue
+		}
+		request, ok := <-d.requests
+		if !ok {
+			break
+		}
+		if err := d.handle(request); err != nil {
+			return err
+		}
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (d *DAPServer) readMessage() (dapMessage, error) {
+	var message dapMessage
+	length := -1
+	for {
+		line, err := d.reader.ReadString('\n')
+		if err != nil {
+			return message, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return message, fmt.Errorf("invalid DAP content length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return message, fmt.Errorf("DAP message without a content length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(d.reader, body); err != nil {
+		return message, fmt.Errorf("error reading DAP message: %w", err)
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return message, fmt.Errorf("error decoding DAP message: %w", err)
+	}
+	return message, nil
+}
+
+func (d *DAPServer) send(message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("error encoding DAP message: %w", err)
+	}
+	if _, err := fmt.Fprintf(d.writer, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		return fmt.Errorf("error writing DAP message: %w", err)
+	}
+	return nil
+}
+
+func (d *DAPServer) respond(request dapMessage, body any) error {
+	d.seq++
+	return d.send(dapResponse{Seq: d.seq, Type: "response", RequestSeq: request.Seq, Success: true, Command: request.Command, Body: body})
+}
+
+func (d *DAPServer) fail(request dapMessage, message string) error {
+	d.seq++
+	return d.send(dapResponse{Seq: d.seq, Type: "response", RequestSeq: request.Seq, Command: request.Command, Message: message})
+}
+
+func (d *DAPServer) event(name string, body any) error {
+	d.seq++
+	return d.send(dapEvent{Seq: d.seq, Type: "event", Event: name, Body: body})
+}
+
+func (d *DAPServer) stopped(reason string) error {
+	d.running, d.stepper = false, nil
+	return d.event("stopped", map[string]any{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+}
+
+// Stops on a panic of the emulator, the client shows message as the exception
+func (d *DAPServer) exception(message string) error {
+	d.running, d.stepper = false, nil
+	return d.event("stopped", map[string]any{
+		"reason": "exception", "description": "Paused on exception", "text": message,
+		"threadId": 1, "allThreadsStopped": true,
+	})
+}
+
+// Returns an error only when the client can no longer be written to
+func (d *DAPServer) handle(request dapMessage) error {
+	if request.Type != "request" {
+		return nil
+	}
+	switch request.Command {
+	case "initialize", "launch", "disconnect", "terminate":
+	default:
+		if d.runner == nil {
+			return d.fail(request, "no program has been launched")
+		}
+	}
+
+	switch request.Command {
+	case "initialize":
+		var args struct {
+			LinesStartAt1 *bool `json:"linesStartAt1"`
+		}
+		json.Unmarshal(request.Arguments, &args)
+		if args.LinesStartAt1 != nil && !*args.LinesStartAt1 {
+			d.lineBase = 0
+		}
+		return d.respond(request, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsReadMemoryRequest":        true,
+			"supportsSteppingGranularity":      true,
+			"supportsTerminateRequest":         true,
+		})
+
+	case "launch":
+		if err := d.launch(request.Arguments); err != nil {
+			return d.fail(request, err.Error())
+		}
+		if err := d.respond(request, nil); err != nil {
+			return err
+		}
+		// Breakpoints can only be placed once the ROM and its debug info are loaded
+		return d.event("initialized", nil)
+
+	case "configurationDone":
+		if err := d.respond(request, nil); err != nil {
+			return err
+		}
+		if d.stopOnEntry {
+			return d.stopped("entry")
+		}
+		d.running = true
+		return nil
+
+	case "setBreakpoints":
+		var args struct {
+			Source      dapSource `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return d.fail(request, err.Error())
+		}
+		var lines []int
+		for _, breakpoint := range args.Breakpoints {
+			lines = append(lines, breakpoint.Line-d.lineBase+1)
+		}
+		d.sourceBreakpoints[args.Source.Path] = lines
+		breakpoints := make([]dapBreakpoint, len(lines))
+		for i, line := range lines {
+			breakpoints[i] = d.sourceBreakpoint(args.Source.Path, line)
+		}
+		d.resolveBreakpoints()
+		return d.respond(request, map[string]any{"breakpoints": breakpoints})
+
+	case "setFunctionBreakpoints":
+		var args struct {
+			Breakpoints []struct {
+				Name string `json:"name"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return d.fail(request, err.Error())
+		}
+		d.functionBreakpoints = nil
+		breakpoints := make([]dapBreakpoint, len(args.Breakpoints))
+		for i, breakpoint := range args.Breakpoints {
+			addresses, err := d.runner.cpu.Symbols.Resolve(d.runner.cpu, breakpoint.Name)
+			if err != nil {
+				breakpoints[i] = dapBreakpoint{Message: err.Error()}
+				continue
+			}
+			d.functionBreakpoints = append(d.functionBreakpoints, breakpoint.Name)
+			breakpoints[i] = dapBreakpoint{Verified: true, InstructionReference: dapAddress(addresses[0])}
+		}
+		d.resolveBreakpoints()
+		return d.respond(request, map[string]any{"breakpoints": breakpoints})
+
+	case "threads":
+		return d.respond(request, map[string]any{"threads": []map[string]any{{"id": 1, "name": "6502"}}})
+
+	case "stackTrace":
+		frames := d.stackFrames()
+		return d.respond(request, map[string]any{"stackFrames": frames, "totalFrames": len(frames)})
+
+	case "scopes":
+		return d.respond(request, map[string]any{"scopes": []map[string]any{
+			{"name": "Registers", "presentationHint": "registers", "variablesReference": dapRegisters, "expensive": false},
+			{"name": "Flags", "variablesReference": dapFlags, "expensive": false},
+			{"name": "Zero Page", "variablesReference": dapZeroPage, "expensive": false},
+			{"name": "Stack", "variablesReference": dapStack, "expensive": false},
+		}})
+
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return d.fail(request, err.Error())
+		}
+		return d.respond(request, map[string]any{"variables": d.variables(args.VariablesReference)})
+
+	case "readMemory":
+		var args struct {
+			MemoryReference string `json:"memoryReference"`
+			Offset          int    `json:"offset"`
+			Count           int    `json:"count"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return d.fail(request, err.Error())
+		}
+		addresses, err := d.runner.cpu.Symbols.Resolve(d.runner.cpu, args.MemoryReference)
+		if err != nil {
+			return d.fail(request, err.Error())
+		}
+		// Memory ends at $FFFF, anything asked for past it is unreadable
+		start := int(addresses[0]) + args.Offset
+		if start < 0 || start > 0xFFFF || args.Count < 0 {
+			return d.respond(request, map[string]any{"address": fmt.Sprintf("0x%X", max(start, 0)), "unreadableBytes": args.Count})
+		}
+		count := min(args.Count, 0x10000-start)
+		data := d.runner.cpu.memory[start : start+count]
+		return d.respond(request, map[string]any{
+			"address":         dapAddress(uint16(start)),
+			"data":            base64.StdEncoding.EncodeToString(data),
+			"unreadableBytes": args.Count - count,
+		})
+
+	case "continue":
+		d.running, d.stepper = true, nil
+		return d.respond(request, map[string]any{"allThreadsContinued": true})
+
+	case "next", "stepIn", "stepOut":
+		var args struct {
+			Granularity string `json:"granularity"`
+		}
+		json.Unmarshal(request.Arguments, &args)
+		d.stepper = d.newStepper(request.Command, args.Granularity == "instruction")
+		d.running = true
+		return d.respond(request, nil)
+
+	case "pause":
+		if err := d.respond(request, nil); err != nil {
+			return err
+		}
+		if d.running {
+			return d.stopped("pause")
+		}
+		return nil
+
+	case "terminate":
+		if err := d.respond(request, nil); err != nil {
+			return err
+		}
+		d.running = false
+		return d.event("terminated", nil)
+
+	case "disconnect":
+		d.running, d.disconnected = false, true
+		return d.respond(request, nil)
+	}
+	return d.fail(request, fmt.Sprintf("unsupported request %q", request.Command))
+}
+
+// Loads the ROM and its debug info, which defaults to the .dbg file next to the ROM
+func (d *DAPServer) launch(arguments json.RawMessage) error {
+	var args dapLaunchArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return fmt.Errorf("invalid launch arguments: %w", err)
+	}
+	if args.Program == "" {
+		return fmt.Errorf("launch needs the ROM in program")
+	}
+	runner, _, err := loadROM(args.Program, args.Patch, args.FDSBIOS, d.Region, d.ROMDatabase)
+	if err != nil {
+		return err
+	}
+	symbols := args.Symbols
+	if symbols == nil {
+		debugInfo := strings.TrimSuffix(args.Program, filepath.Ext(args.Program)) + ".dbg"
+		if _, err := os.Stat(debugInfo); err == nil {
+			symbols = []string{debugInfo}
+		}
+	}
+	if len(symbols) > 0 {
+		runner.cpu.Symbols = NewSymbolTable()
+		for _, path := range symbols {
+			if err := runner.cpu.Symbols.LoadFile(path); err != nil {
+				return err
+			}
+		}
+	}
+	d.runner, d.stopOnEntry = runner, args.StopOnEntry
+	return nil
+}
+
+// Lines searched after a breakpoint's line for one with code
+const dapBreakpointSearch = 20
+
+/*
+Returns the code of a source line. A line without code, a comment or a label, moves
+the breakpoint to the next line that has some, as editors expect, so the line found
+is returned too.
+*/
+func (d *DAPServer) lineLocations(path string, line int) (int, []codeLocation) {
+	for next := line; next < line+dapBreakpointSearch; next++ {
+		if locations := d.runner.cpu.Symbols.LineLocations(path, next); locations != nil {
+			return next, locations
+		}
+	}
+	return line, nil
+}
+
+func (d *DAPServer) sourceBreakpoint(path string, line int) dapBreakpoint {
+	line, locations := d.lineLocations(path, line)
+	if locations == nil {
+		return dapBreakpoint{Line: line - 1 + d.lineBase, Message: "no code at this line"}
+	}
+	breakpoint := dapBreakpoint{Verified: true, Line: line - 1 + d.lineBase, Source: &dapSource{Name: filepath.Base(path), Path: path}}
+	if address, ok := d.locationAddress(locations[0]); ok {
+		breakpoint.InstructionReference = dapAddress(address)
+	}
+	return breakpoint
+}
+
+// Rebuilds the code locations to stop at from the requested breakpoints
+func (d *DAPServer) resolveBreakpoints() {
+	cpu := d.runner.cpu
+	clear(d.breakpoints)
+	for path, lines := range d.sourceBreakpoints {
+		for _, line := range lines {
+			_, locations := d.lineLocations(path, line)
+			for _, location := range locations {
+				d.breakpoints[location] = true
+			}
+		}
+	}
+	for _, name := range d.functionBreakpoints {
+		addresses, _ := cpu.Symbols.Resolve(cpu, name)
+		for _, address := range addresses {
+			d.breakpoints[cpu.codeLocation(address)] = true
+		}
+	}
+}
+
+// Returns the CPU address a location is at in the current mapping
+func (d *DAPServer) locationAddress(location codeLocation) (uint16, bool) {
+	cpu := d.runner.cpu
+	if !location.prg {
+		return uint16(location.address), true
+	}
+	for address := 0x8000; address <= 0xFFFF; address += 0x1000 {
+		if offset, ok := cpu.prgOffset(uint16(address)); ok && location.address >= offset && location.address < offset+0x1000 {
+			return uint16(address + location.address - offset), true
+		}
+	}
+	return 0, false
+}
+
+/*
+Runs until the step ends, a breakpoint is hit, the program reaches BRK or a request
+stops it. The instruction at the PC is always run, so continuing from a breakpoint
+does not stop on it again. A panic, such as an opcode the CPU does not know, stops
+the program as an exception and the client can still inspect it.
+*/
+func (d *DAPServer) run() (err error) {
+	cpu := d.runner.cpu
+	defer func() {
+		if r := recover(); r != nil {
+			err = d.exception(strings.TrimSpace(fmt.Sprint(r)))
+		}
+	}()
+	for n := 1; n <= dapPollInterval; n++ {
+		opcode := d.runner.Step()
+		if opcode == 0x00 {
+			d.running = false
+			if err := d.event("exited", map[string]any{"exitCode": 0}); err != nil {
+				return err
+			}
+			return d.event("terminated", nil)
+		}
+		if d.stepper != nil && d.stepper(opcode) {
+			return d.stopped("step")
+		}
+		if len(d.breakpoints) > 0 && d.breakpoints[cpu.codeLocation(cpu.PC)] {
+			return d.stopped("breakpoint")
+		}
+	}
+	select {
+	case request, ok := <-d.requests:
+		if !ok {
+			d.disconnected = true
+			return nil
+		}
+		return d.handle(request)
+	default:
+		return nil
+	}
+}
+
+/*
+Returns how a step ends. Steps by line run until the start of another source line,
+or back to the start of the same one, and treat code without lines as part of the
+line that called it. Step over does not stop inside subroutines called by JSR, step
+out runs until the subroutine returns.
+*/
+func (d *DAPServer) newStepper(command string, instruction bool) dapStepper {
+	cpu := d.runner.cpu
+	startPC := cpu.PC
+	startLine, hasLine := cpu.Symbols.LineAt(cpu, startPC)
+	// Subroutines entered since the step started, counted by JSR and RTS
+	depth := 0
+	newLine := func() bool {
+		if instruction || !hasLine {
+			return true
+		}
+		line, ok := cpu.Symbols.LineAt(cpu, cpu.PC)
+		return ok && (line != startLine || cpu.PC == startPC)
+	}
+	return func(opcode uint8) bool {
+		switch opcode {
+		case 0x20:
+			depth++
+		case 0x60:
+			depth--
+		}
+		switch command {
+		case "stepIn":
+			return newLine()
+		case "next":
+			return depth <= 0 && newLine()
+		}
+		return depth < 0
+	}
+}
+
+/*
+Returns the current frame and the callers found on the stack. The stack holds no
+frame pointers, so any pair of bytes pointing into a JSR is taken to be a
+return address.
+*/
+func (d *DAPServer) stackFrames() []dapStackFrame {
+	cpu := d.runner.cpu
+	frames := []dapStackFrame{d.frame(0, cpu.PC, cpu.addressName(cpu.PC))}
+	for sp := int(cpu.SP) + 1; sp <= 0xFF; sp++ {
+		returnAddress := uint16(cpu.memory[0x100+sp]) | uint16(cpu.memory[0x100+(sp+1)&0xFF])<<8
+		// JSR here pushes the address of its second byte, which RTS steps past
+		jsr := returnAddress - 1
+		if cpu.memory[jsr] != 0x20 {
+			continue
+		}
+		target := uint16(cpu.memory[jsr+1]) | uint16(cpu.memory[jsr+2])<<8
+		frames[len(frames)-1].Name = cpu.addressName(target)
+		frames = append(frames, d.frame(len(frames), jsr, cpu.addressName(jsr)))
+		sp++
+	}
+	return frames
+}
+
+func (d *DAPServer) frame(id int, address uint16, name string) dapStackFrame {
+	frame := dapStackFrame{ID: id, Name: name, InstructionPointerReference: dapAddress(address)}
+	if line, ok := d.runner.cpu.Symbols.LineAt(d.runner.cpu, address); ok {
+		frame.Source = &dapSource{Name: filepath.Base(line.File), Path: line.File}
+		frame.Line, frame.Column = line.Line-1+d.lineBase, d.lineBase
+	}
+	return frame
+}
+
+// Memory is shown as it is, without the side effects of reading through the bus
+func (d *DAPServer) variables(reference int) []dapVariable {
+	cpu := d.runner.cpu
+	variables := []dapVariable{}
+	switch reference {
+	case dapRegisters:
+		variables = append(variables,
+			dapVariable{Name: "A", Value: dapByte(cpu.A)},
+			dapVariable{Name: "X", Value: dapByte(cpu.X)},
+			dapVariable{Name: "Y", Value: dapByte(cpu.Y)},
+			dapVariable{Name: "SP", Value: dapByte(cpu.SP), MemoryReference: dapAddress(0x100 + uint16(cpu.SP))},
+			dapVariable{Name: "PC", Value: cpu.addressName(cpu.PC), MemoryReference: dapAddress(cpu.PC)},
+			dapVariable{Name: "P", Value: fmt.Sprintf("$%02X %s", cpu.P, dapFlagString(cpu.P))},
+		)
+	case dapFlags:
+		for i := 0; i < 8; i++ {
+			if dapFlagNames[i] == '-' {
+				continue
+			}
+			variables = append(variables, dapVariable{Name: dapFlagNames[i : i+1], Value: strconv.Itoa(int(cpu.P >> (7 - i) & 1))})
+		}
+	case dapZeroPage:
+		for address := uint16(0); address < 0x100; address++ {
+			variables = append(variables, d.memoryVariable(address))
+		}
+	case dapStack:
+		for address := 0x101 + uint16(cpu.SP); address <= 0x1FF && address > 0x100; address++ {
+			variables = append(variables, d.memoryVariable(address))
+		}
+	}
+	return variables
+}
+
+func (d *DAPServer) memoryVariable(address uint16) dapVariable {
+	cpu := d.runner.cpu
+	name := fmt.Sprintf("$%04X", address)
+	if address < 0x100 {
+		name = fmt.Sprintf("$%02X", address)
+	}
+	if label, ok := cpu.Symbols.Lookup(cpu, address); ok {
+		name += " " + label
+	}
+	return dapVariable{Name: name, Value: dapByte(cpu.memory[address]), MemoryReference: dapAddress(address)}
+}
+
+// Formats P with set flags in capitals, like NV-bdIzc
+func dapFlagString(p uint8) string {
+	flags := []byte(dapFlagNames)
+	for i := range flags {
+		if p>>(7-i)&1 == 0 && flags[i] != '-' {
+			flags[i] += 'a' - 'A'
+		}
+	}
+	return string(flags)
+}
+
+func dapByte(value uint8) string {
+	return fmt.Sprintf("$%02X (%d)", value, value)
+}
+
+func dapAddress(address uint16) string {
+	return fmt.Sprintf("0x%04X", address)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The editor end of a DAP session, messages arrive on messages as they are read
+type dapClient struct {
+	t        *testing.T
+	conn     net.Conn
+	seq      int
+	messages chan map[string]any
+	served   chan error
+}
+
+/*
+Writes program to an NROM image at $8000 with the ca65 debug info dbg next to it, and
+serves a client over a pipe
+*/
+func newDAPClient(t *testing.T, program []uint8, dbg string) (*dapClient, string) {
+	t.Helper()
+	dir := t.TempDir()
+	rom := filepath.Join(dir, "game.nes")
+	header := []uint8{'N', 'E', 'S', 0x1A, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := os.WriteFile(rom, join(header, testPRG(program...), make([]uint8, 0x2000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "game.dbg"), []byte(dbg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, conn := net.Pipe()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &dapClient{t: t, conn: conn, messages: make(chan map[string]any, 16), served: make(chan error, 1)}
+	go func() {
+		c.served <- NewDAPServer(serverConn, serverConn).Serve()
+		serverConn.Close()
+	}()
+	go func() {
+		defer close(c.messages)
+		reader := bufio.NewReader(conn)
+		for {
+			var length int
+			if _, err := fmt.Fscanf(reader, "Content-Length: %d\r\n\r\n", &length); err != nil {
+				return
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				return
+			}
+			var message map[string]any
+			if err := json.Unmarshal(body, &message); err != nil {
+				t.Error(err)
+				return
+			}
+			c.messages <- message
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c, filepath.Join(dir, "game.s")
+}
+
+func (c *dapClient) request(command string, arguments any) {
+	c.t.Helper()
+	c.seq++
+	body, _ := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	if _, err := fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Returns the next message, which must be the response to command or the event
+func (c *dapClient) next(kind, name string) map[string]any {
+	c.t.Helper()
+	message, ok := <-c.messages
+	if !ok {
+		c.t.Fatalf("connection closed waiting for %s %s", kind, name)
+	}
+	key := map[string]string{"response": "command", "event": "event"}[kind]
+	if message["type"] != kind || message[key] != name {
+		c.t.Fatalf("got %v, want %s %s", message, kind, name)
+	}
+	if kind == "response" && message["success"] != true {
+		c.t.Fatalf("%s failed: %v", name, message["message"])
+	}
+	body, _ := message["body"].(map[string]any)
+	return body
+}
+
+// Sends a request and returns the body of its response
+func (c *dapClient) call(command string, arguments any) map[string]any {
+	c.t.Helper()
+	c.request(command, arguments)
+	return c.next("response", command)
+}
+
+func (c *dapClient) stopped(reason string) map[string]any {
+	c.t.Helper()
+	body := c.next("event", "stopped")
+	if body["reason"] != reason {
+		c.t.Fatalf("stopped for %v, want %s", body["reason"], reason)
+	}
+	return body
+}
+
+// Returns the instruction pointer, name and line of each frame
+func (c *dapClient) stackTrace() []string {
+	c.t.Helper()
+	var frames []string
+	for _, frame := range c.call("stackTrace", map[string]any{"threadId": 1})["stackFrames"].([]any) {
+		frame := frame.(map[string]any)
+		frames = append(frames, fmt.Sprintf("%v %v:%v", frame["instructionPointerReference"], frame["name"], frame["line"]))
+	}
+	return frames
+}
+
+// One span and line record per source line, starting at the span's offset from $8000
+func dapDebugInfo(lines map[int][2]int) string {
+	var b strings.Builder
+	b.WriteString("file\tid=0,name=\"game.s\"\n")
+	b.WriteString("seg\tid=0,name=\"CODE\",start=0x008000,size=0x8000,type=ro,oname=\"game.nes\",ooffs=16\n")
+	b.WriteString("sym\tid=0,name=\"sub\",addrsize=absolute,scope=0,def=0,val=0x8009,seg=0,type=lab\n")
+	for line, span := range lines {
+		fmt.Fprintf(&b, "span\tid=%d,seg=0,start=%d,size=%d\n", line, span[0], span[1])
+		fmt.Fprintf(&b, "line\tid=%d,file=0,line=%d,span=%d\n", line, line, line)
+	}
+	return b.String()
+}
+
+func TestDAPServer(t *testing.T) {
+	// LDA #5, JSR sub, STA $10, BRK, then sub: INX, RTS
+	program := []uint8{0xA9, 0x05, 0x20, 0x09, 0x80, 0x85, 0x10, 0x00, 0x00, 0xE8, 0x60}
+	lines := map[int][2]int{1: {0, 2}, 2: {2, 3}, 3: {5, 2}, 4: {7, 1}, 6: {9, 1}, 7: {10, 1}}
+	c, source := newDAPClient(t, program, dapDebugInfo(lines))
+
+	c.call("initialize", map[string]any{"linesStartAt1": true})
+	c.call("launch", map[string]any{"program": filepath.Join(filepath.Dir(source), "game.nes"), "stopOnEntry": true})
+	c.next("event", "initialized")
+
+	// Line 5 is blank, so the breakpoint moves to the subroutine
+	breakpoints := c.call("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": source},
+		"breakpoints": []map[string]any{{"line": 5}},
+	})["breakpoints"].([]any)
+	if breakpoint := breakpoints[0].(map[string]any); breakpoint["verified"] != true || breakpoint["line"] != 6.0 {
+		t.Errorf("breakpoint %v, want verified on line 6", breakpoint)
+	}
+
+	c.call("configurationDone", nil)
+	c.stopped("entry")
+	if frames := c.stackTrace(); strings.Join(frames, ", ") != "0x8000 $8000:1" {
+		t.Errorf("entry frames %v", frames)
+	}
+
+	c.call("continue", map[string]any{"threadId": 1})
+	c.stopped("breakpoint")
+	want := "0x8009 $8009 sub:6, 0x8002 $8002:2"
+	if frames := c.stackTrace(); strings.Join(frames, ", ") != want {
+		t.Errorf("breakpoint frames %v, want %s", frames, want)
+	}
+
+	c.call("next", map[string]any{"threadId": 1})
+	c.stopped("step")
+	if frames := c.stackTrace(); frames[0] != "0x800A $8009 sub:7" {
+		t.Errorf("stepped to %v", frames)
+	}
+
+	c.call("continue", map[string]any{"threadId": 1})
+	c.next("event", "exited")
+	c.next("event", "terminated")
+
+	c.call("disconnect", nil)
+	if err := <-c.served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDAPServerException(t *testing.T) {
+	c, source := newDAPClient(t, []uint8{0xEA, 0x02}, dapDebugInfo(map[int][2]int{1: {0, 1}, 2: {1, 1}}))
+	c.call("initialize", nil)
+	c.call("launch", map[string]any{"program": filepath.Join(filepath.Dir(source), "game.nes")})
+	c.next("event", "initialized")
+	c.call("configurationDone", nil)
+
+	body := c.stopped("exception")
+	if text, _ := body["text"].(string); !strings.Contains(text, "Unhandled opcode: 02") {
+		t.Errorf("exception text %q", text)
+	}
+	// The session goes on after the exception
+	if frames := c.stackTrace(); len(frames) == 0 {
+		t.Error("no frames after the exception")
+	}
+	c.call("disconnect", nil)
+	if err := <-c.served; err != nil {
+		t.Error(err)
+	}
+}
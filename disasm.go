@@ -0,0 +1,164 @@
+package main
+
+import "fmt"
+
+// Addressing modes as seen by the disassembler
+const (
+	modeImplied = iota
+	modeAccumulator
+	modeImmediate
+	modeZeroPage
+	modeZeroPageX
+	modeZeroPageY
+	modeAbsolute
+	modeAbsoluteX
+	modeAbsoluteY
+	modeIndirect
+	modeIndexedIndirect
+	modeIndirectIndex
+	modeRelative
+)
+
+// Instruction length in bytes for each addressing mode
+var modeSizes = [...]int{
+	modeImplied:         1,
+	modeAccumulator:     1,
+	modeImmediate:       2,
+	modeZeroPage:        2,
+	modeZeroPageX:       2,
+	modeZeroPageY:       2,
+	modeAbsolute:        3,
+	modeAbsoluteX:       3,
+	modeAbsoluteY:       3,
+	modeIndirect:        3,
+	modeIndexedIndirect: 2,
+	modeIndirectIndex:   2,
+	modeRelative:        2,
+}
+
+type opcodeInfo struct {
+	name string
+	mode int
+}
+
+var opcodeInfos = map[uint8]opcodeInfo{
+	0x00: {"BRK", modeImplied}, 0x01: {"ORA", modeIndexedIndirect}, 0x05: {"ORA", modeZeroPage},
+	0x06: {"ASL", modeZeroPage}, 0x08: {"PHP", modeImplied}, 0x09: {"ORA", modeImmediate},
+	0x0A: {"ASL", modeAccumulator}, 0x0D: {"ORA", modeAbsolute}, 0x0E: {"ASL", modeAbsolute},
+	0x10: {"BPL", modeRelative}, 0x11: {"ORA", modeIndirectIndex}, 0x15: {"ORA", modeZeroPageX},
+	0x16: {"ASL", modeZeroPageX}, 0x18: {"CLC", modeImplied}, 0x19: {"ORA", modeAbsoluteY},
+	0x1A: {"NOP", modeImplied}, 0x1D: {"ORA", modeAbsoluteX}, 0x1E: {"ASL", modeAbsoluteX},
+	0x20: {"JSR", modeAbsolute}, 0x21: {"AND", modeIndexedIndirect}, 0x24: {"BIT", modeZeroPage},
+	0x25: {"AND", modeZeroPage}, 0x26: {"ROL", modeZeroPage}, 0x28: {"PLP", modeImplied},
+	0x29: {"AND", modeImmediate}, 0x2A: {"ROL", modeAccumulator}, 0x2C: {"BIT", modeAbsolute},
+	0x2D: {"AND", modeAbsolute}, 0x2E: {"ROL", modeAbsolute}, 0x30: {"BMI", modeRelative},
+	0x31: {"AND", modeIndirectIndex}, 0x35: {"AND", modeZeroPageX}, 0x36: {"ROL", modeZeroPageX},
+	0x38: {"SEC", modeImplied}, 0x39: {"AND", modeAbsoluteY}, 0x3D: {"AND", modeAbsoluteX},
+	0x3E: {"ROL", modeAbsoluteX}, 0x40: {"RTI", modeImplied}, 0x41: {"EOR", modeIndexedIndirect},
+	0x45: {"EOR", modeZeroPage}, 0x46: {"LSR", modeZeroPage}, 0x48: {"PHA", modeImplied},
+	0x49: {"EOR", modeImmediate}, 0x4A: {"LSR", modeAccumulator}, 0x4C: {"JMP", modeAbsolute},
+	0x4D: {"EOR", modeAbsolute}, 0x4E: {"LSR", modeAbsolute}, 0x50: {"BVC", modeRelative},
+	0x51: {"EOR", modeIndirectIndex}, 0x55: {"EOR", modeZeroPageX}, 0x56: {"LSR", modeZeroPageX},
+	0x58: {"CLI", modeImplied}, 0x59: {"EOR", modeAbsoluteY}, 0x5D: {"EOR", modeAbsoluteX},
+	0x5E: {"LSR", modeAbsoluteX}, 0x60: {"RTS", modeImplied}, 0x61: {"ADC", modeIndexedIndirect},
+	0x65: {"ADC", modeZeroPage}, 0x66: {"ROR", modeZeroPage}, 0x68: {"PLA", modeImplied},
+	0x69: {"ADC", modeImmediate}, 0x6A: {"ROR", modeAccumulator}, 0x6C: {"JMP", modeIndirect},
+	0x6D: {"ADC", modeAbsolute}, 0x6E: {"ROR", modeAbsolute}, 0x70: {"BVS", modeRelative},
+	0x71: {"ADC", modeIndirectIndex}, 0x75: {"ADC", modeZeroPageX}, 0x76: {"ROR", modeZeroPageX},
+	0x78: {"SEI", modeImplied}, 0x79: {"ADC", modeAbsoluteY}, 0x7D: {"ADC", modeAbsoluteX},
+	0x7E: {"ROR", modeAbsoluteX}, 0x81: {"STA", modeIndexedIndirect}, 0x84: {"STY", modeZeroPage},
+	0x85: {"STA", modeZeroPage}, 0x86: {"STX", modeZeroPage}, 0x88: {"DEY", modeImplied},
+	0x8A: {"TXA", modeImplied}, 0x8C: {"STY", modeAbsolute}, 0x8D: {"STA", modeAbsolute},
+	0x8E: {"STX", modeAbsolute}, 0x90: {"BCC", modeRelative}, 0x91: {"STA", modeIndirectIndex},
+	0x94: {"STY", modeZeroPageX}, 0x95: {"STA", modeZeroPageX}, 0x96: {"STX", modeZeroPageY},
+	0x98: {"TYA", modeImplied}, 0x99: {"STA", modeAbsoluteY}, 0x9A: {"TXS", modeImplied},
+	0x9D: {"STA", modeAbsoluteX}, 0xA0: {"LDY", modeImmediate}, 0xA1: {"LDA", modeIndexedIndirect},
+	0xA2: {"LDX", modeImmediate}, 0xA4: {"LDY", modeZeroPage}, 0xA5: {"LDA", modeZeroPage},
+	0xA6: {"LDX", modeZeroPage}, 0xA8: {"TAY", modeImplied}, 0xA9: {"LDA", modeImmediate},
+	0xAA: {"TAX", modeImplied}, 0xAC: {"LDY", modeAbsolute}, 0xAD: {"LDA", modeAbsolute},
+	0xAE: {"LDX", modeAbsolute}, 0xB0: {"BCS", modeRelative}, 0xB1: {"LDA", modeIndirectIndex},
+	0xB4: {"LDY", modeZeroPageX}, 0xB5: {"LDA", modeZeroPageX}, 0xB6: {"LDX", modeZeroPageY},
+	0xB8: {"CLV", modeImplied}, 0xB9: {"LDA", modeAbsoluteY}, 0xBA: {"TSX", modeImplied},
+	0xBC: {"LDY", modeAbsoluteX}, 0xBD: {"LDA", modeAbsoluteX}, 0xBE: {"LDX", modeAbsoluteY},
+	0xC0: {"CPY", modeImmediate}, 0xC1: {"CMP", modeIndexedIndirect}, 0xC4: {"CPY", modeZeroPage},
+	0xC5: {"CMP", modeZeroPage}, 0xC6: {"DEC", modeZeroPage}, 0xC8: {"INY", modeImplied},
+	0xC9: {"CMP", modeImmediate}, 0xCA: {"DEX", modeImplied}, 0xCC: {"CPY", modeAbsolute},
+	0xCD: {"CMP", modeAbsolute}, 0xCE: {"DEC", modeAbsolute}, 0xD0: {"BNE", modeRelative},
+	0xD1: {"CMP", modeIndirectIndex}, 0xD5: {"CMP", modeZeroPageX}, 0xD6: {"DEC", modeZeroPageX},
+	0xD8: {"CLD", modeImplied}, 0xD9: {"CMP", modeAbsoluteY}, 0xDD: {"CMP", modeAbsoluteX},
+	0xDE: {"DEC", modeAbsoluteX}, 0xE0: {"CPX", modeImmediate}, 0xE1: {"SBC", modeIndexedIndirect},
+	0xE3: {"ISC", modeIndexedIndirect}, 0xE4: {"CPX", modeZeroPage}, 0xE5: {"SBC", modeZeroPage},
+	0xE6: {"INC", modeZeroPage}, 0xE7: {"ISC", modeZeroPage}, 0xE8: {"INX", modeImplied},
+	0xE9: {"SBC", modeImmediate}, 0xEA: {"NOP", modeImplied}, 0xEC: {"CPX", modeAbsolute},
+	0xED: {"SBC", modeAbsolute}, 0xEE: {"INC", modeAbsolute}, 0xEF: {"ISC", modeAbsolute},
+	0xF0: {"BEQ", modeRelative}, 0xF1: {"SBC", modeIndirectIndex}, 0xF3: {"ISC", modeIndirectIndex},
+	0xF5: {"SBC", modeZeroPageX}, 0xF6: {"INC", modeZeroPageX}, 0xF7: {"ISC", modeZeroPageX},
+	0xF8: {"SED", modeImplied}, 0xF9: {"SBC", modeAbsoluteY}, 0xFB: {"ISC", modeAbsoluteY},
+	0xFD: {"SBC", modeAbsoluteX}, 0xFE: {"INC", modeAbsoluteX},
+}
+
+// Returns the length in bytes of the instruction starting with opcode, 1 for unknown opcodes
+func instructionSize(opcode uint8) int {
+	if info, ok := opcodeInfos[opcode]; ok {
+		return modeSizes[info.mode]
+	}
+	return 1
+}
+
+/*
+Disassembles the instruction at address, returns the text and its length in bytes.
+Bytes are fetched like the CPU fetches them, cheats included, so disassembling has no
+side effects on the running program.
+*/
+func (cpu *CPU) Disassemble(address uint16) (string, int) {
+	opcode := cpu.fetch(address)
+	info, ok := opcodeInfos[opcode]
+	if !ok {
+		return fmt.Sprintf(".db $%02X", opcode), 1
+	}
+
+	low := cpu.fetch(address + 1)
+	word := uint16(cpu.fetch(address+2))<<8 | uint16(low)
+
+	var operand string
+	switch info.mode {
+	case modeAccumulator:
+		operand = "A"
+	case modeImmediate:
+		operand = fmt.Sprintf("#$%02X", low)
+	case modeZeroPage:
+		operand = cpu.operandName(uint16(low), "$%02X")
+	case modeZeroPageX:
+		operand = cpu.operandName(uint16(low), "$%02X") + ",X"
+	case modeZeroPageY:
+		operand = cpu.operandName(uint16(low), "$%02X") + ",Y"
+	case modeAbsolute:
+		operand = cpu.operandName(word, "$%04X")
+	case modeAbsoluteX:
+		operand = cpu.operandName(word, "$%04X") + ",X"
+	case modeAbsoluteY:
+		operand = cpu.operandName(word, "$%04X") + ",Y"
+	case modeIndirect:
+		operand = "(" + cpu.operandName(word, "$%04X") + ")"
+	case modeIndexedIndirect:
+		operand = "(" + cpu.operandName(uint16(low), "$%02X") + ",X)"
+	case modeIndirectIndex:
+		operand = "(" + cpu.operandName(uint16(low), "$%02X") + "),Y"
+	case modeRelative:
+		target := uint16(int32(address) + 2 + int32(int8(low)))
+		operand = cpu.operandName(target, "$%04X")
+	}
+
+	if operand == "" {
+		return info.name, modeSizes[info.mode]
+	}
+	return info.name + " " + operand, modeSizes[info.mode]
+}
+
+// Returns the label for an operand address, or the address in the given hex format
+func (cpu *CPU) operandName(address uint16, format string) string {
+	if name, ok := cpu.Symbols.Lookup(cpu, address); ok {
+		return name
+	}
+	return fmt.Sprintf(format, address)
+}
@@ -0,0 +1,95 @@
+package main
+
+import "io"
+
+type discreteRegisters struct {
+	PRG       uint8
+	CHR       uint8
+	Mirroring uint8
+}
+
+/*
+Discrete is one of the boards built from plain logic chips instead of a mapper: a
+single latch written anywhere in $8000-$FFFF that selects a 32KB PRG bank and, on
+some boards, an 8KB CHR bank. AxROM (7) selects one screen mirroring instead of CHR,
+Color Dreams (11) and GxROM (66) have bus conflicts, so the value written is ANDed
+with the ROM byte at the address.
+*/
+type Discrete struct {
+	Registers discreteRegisters
+
+	mapper uint8
+	prg    []uint8
+	chr    []uint8
+	cpu    *CPU
+}
+
+func NewDiscrete(mapper uint8, prg []uint8, chr []uint8) *Discrete {
+	m := &Discrete{mapper: mapper, prg: prg, chr: chr}
+	if mapper == 7 {
+		m.Registers.Mirroring = mirrorSingleA
+	}
+	return m
+}
+
+func (m *Discrete) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+func (m *Discrete) mapBanks() {
+	m.cpu.mapPRG(m.prg, 0x8000, 0x8000, int(m.Registers.PRG))
+}
+
+func (m *Discrete) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+func (m *Discrete) Write(address uint16, value uint8) bool {
+	if address < 0x8000 {
+		return false
+	}
+	r := &m.Registers
+	switch m.mapper {
+	case 7:
+		r.PRG = value & 7
+		r.Mirroring = mirrorSingleA
+		if getBit(value, 4) {
+			r.Mirroring = mirrorSingleB
+		}
+	case 11:
+		value &= m.cpu.memory[address]
+		r.PRG = value & 3
+		r.CHR = value >> 4
+	case 66:
+		value &= m.cpu.memory[address]
+		r.PRG = value >> 4 & 3
+		r.CHR = value & 3
+	}
+	m.mapBanks()
+	return true
+}
+
+func (m *Discrete) Clock() {}
+
+func (m *Discrete) IRQ() bool {
+	return false
+}
+
+func (m *Discrete) fetchCHR(address uint16) int {
+	return chrBank(m.chr, int(m.Registers.CHR), 0x2000) + int(address&0x1FFF)
+}
+
+func (m *Discrete) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers)
+}
+
+func (m *Discrete) loadState(r io.Reader) error {
+	registers := m.Registers
+	if err := readMapperState(r, &registers); err != nil {
+		return err
+	}
+	m.Registers = registers
+	m.mapBanks()
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestDiscreteBanks(t *testing.T) {
+	tests := []struct {
+		name      string
+		mapper    uint8
+		address   uint16
+		value     uint8
+		prg       uint8
+		chr       uint8
+		mirroring uint8
+	}{
+		{"AxROM", 7, 0x8000, 0x03, 3, 0, mirrorSingleA},
+		{"AxROM single screen B", 7, 0xC000, 0x15, 5, 0, mirrorSingleB},
+		{"Color Dreams", 11, 0xFFFF, 0x21, 1, 2, 0},
+		{"Color Dreams bus conflict", 11, 0x8100, 0x32, 2, 0, 0},
+		{"GxROM", 66, 0xFFFF, 0x21, 2, 1, 0},
+		{"GxROM bus conflict", 66, 0x8100, 0x31, 0, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prg := numberedBanks(8, 0x8000)
+			for bank := 0; bank < 8; bank++ {
+				// Every bank has $FF at $FFFF to write through and $0F at $8100 to conflict with
+				prg[bank*0x8000+0x7FFF] = 0xFF
+				prg[bank*0x8000+0x0100] = 0x0F
+			}
+			chr := numberedBanks(4, 0x2000)
+			m := NewDiscrete(test.mapper, prg, chr)
+			cpu := newMapperCPU(m)
+			checkBanks(t, cpu, map[uint16]uint8{0x8000: 0})
+
+			m.Write(test.address, test.value)
+			checkBanks(t, cpu, map[uint16]uint8{0x8000: test.prg, 0xC000: test.prg})
+			if test.mapper != 7 {
+				checkCHR(t, m, chr, 0x2000, 0x1234, test.chr)
+			}
+			if m.Registers.Mirroring != test.mirroring {
+				t.Errorf("mirroring %d, want %d", m.Registers.Mirroring, test.mirroring)
+			}
+		})
+	}
+}
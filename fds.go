@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	fdsMagic      = "FDS\x1A"
+	fdsHeaderSize = 16
+	// Every disk side starts with this disk info block
+	fdsDiskMagic = "\x01*NINTENDO-HVC*"
+	fdsSideSize  = 65500
+	fdsBIOSSize  = 8192
+
+	// Gaps of the disk as the drive sees it, in bytes
+	fdsLeadIn   = 28300 / 8
+	fdsBlockGap = 976 / 8
+	// Room on a side for the gaps and files written by games
+	fdsSideCapacity = 68000
+
+	// Drive timing in CPU cycles, the disk passes the head at about 96.4 kbit/s
+	fdsByteCycles   = 150
+	fdsSpinUpCycles = 50000
+)
+
+// CRCs are not checked, blocks end with these two bytes in place of one
+var fdsCRC = [2]uint8{0x4D, 0x62}
+
+// Returns true when data starts like an .fds image, with or without its header
+func isFDSImage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(fdsMagic)) || bytes.HasPrefix(data, []byte(fdsDiskMagic))
+}
+
+/*
+Parses an .fds image: an optional 16 byte header followed by 65500 bytes for each disk
+side, holding the blocks without their gaps and CRCs
+*/
+func parseFDS(data []uint8) (*Cartridge, error) {
+	if bytes.HasPrefix(data, []byte(fdsMagic)) {
+		if len(data) < fdsHeaderSize {
+			return nil, fmt.Errorf("not a valid FDS file")
+		}
+		data = data[fdsHeaderSize:]
+	}
+	if len(data) == 0 || len(data)%fdsSideSize != 0 {
+		return nil, fmt.Errorf("FDS image is not a whole number of %d byte disk sides", fdsSideSize)
+	}
+
+	cart := &Cartridge{Region: regionNTSC}
+	for offset := 0; offset < len(data); offset += fdsSideSize {
+		side := data[offset : offset+fdsSideSize]
+		if !bytes.HasPrefix(side, []byte(fdsDiskMagic)) {
+			return nil, fmt.Errorf("FDS disk side %d has no disk info block", len(cart.Disks))
+		}
+		cart.Disks = append(cart.Disks, side)
+	}
+	return cart, nil
+}
+
+func loadFDSBIOS(filename string) ([]uint8, error) {
+	bios, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading FDS BIOS: %w", err)
+	}
+	if len(bios) != fdsBIOSSize {
+		return nil, fmt.Errorf("FDS BIOS must be %d bytes, %s is %d", fdsBIOSSize, filename, len(bios))
+	}
+	return bios, nil
+}
+
+/*
+Lays a side out the way it passes under the head: a lead-in gap, then every block
+behind a $80 start mark and followed by its CRC and a gap
+*/
+func fdsDiskImage(side []uint8) []uint8 {
+	out := make([]uint8, fdsLeadIn, fdsSideCapacity)
+	fileSize := 0
+	for pos := 0; pos < len(side); {
+		var size int
+		switch side[pos] {
+		case 1:
+			size = 56
+		case 2:
+			size = 2
+		case 3:
+			size = 16
+			if pos+16 <= len(side) {
+				fileSize = int(binary.LittleEndian.Uint16(side[pos+13:]))
+			}
+		case 4:
+			size = 1 + fileSize
+		}
+		if size == 0 || pos+size > len(side) {
+			break
+		}
+		out = append(out, 0x80)
+		out = append(out, side[pos:pos+size]...)
+		out = append(out, fdsCRC[:]...)
+		out = append(out, make([]uint8, fdsBlockGap)...)
+		pos += size
+	}
+	if len(out) < fdsSideCapacity {
+		out = append(out, make([]uint8, fdsSideCapacity-len(out))...)
+	}
+	return out
+}
+
+// RAM adapter timer IRQ at $4020-$4022
+type FDSTimer struct {
+	Reload  uint16
+	Counter uint16
+	Enabled bool
+	Repeat  bool
+	IRQ     bool
+}
+
+// Disk drive registers and the position of the head
+type FDSDrive struct {
+	DiskIO  bool // $4023 enables the disk and sound registers
+	SoundIO bool
+
+	// $4025
+	MotorOn       bool
+	ResetTransfer bool
+	ReadMode      bool
+	CRCControl    bool
+	Ready         bool
+	IRQEnabled    bool
+	Mirroring     uint8
+	// $4026
+	External uint8
+
+	ReadData    uint8
+	WriteData   uint8
+	Transferred bool // a byte went past the head
+	IRQ         bool
+	EndOfHead   bool
+	Scanning    bool
+	GapEnded    bool
+	PreviousCRC bool
+	Position    uint32
+	Delay       uint32
+}
+
+/*
+FDS is the Famicom Disk System: the RAM adapter with 32KB of RAM at $6000-$DFFF, the
+BIOS at $E000, the disk drive and the wavetable sound unit. Disks are kept as the drive
+reads them, so the BIOS finds the gaps and block marks where it expects them. The timer
+and drive IRQs reach the CPU, but the BIOS also waits on vblank NMIs and uses opcodes
+the CPU does not have yet, so until there is a PPU no disk boots and the drive is
+only usable by code driving its registers directly.
+*/
+type FDS struct {
+	Disks [][]uint8
+	// Side in the drive, -1 when there is none
+	Side int32
+
+	Timer FDSTimer
+	Drive FDSDrive
+	Sound FDSAudio
+
+	bios []uint8
+	cpu  *CPU
+}
+
+// Creates the disk system with the first side of sides inserted
+func NewFDS(sides [][]uint8, bios []uint8) *FDS {
+	f := &FDS{bios: bios}
+	for _, side := range sides {
+		f.Disks = append(f.Disks, fdsDiskImage(side))
+	}
+	f.Sound.EnvelopeSpeed = 0xE8
+	f.Drive.EndOfHead = true
+	return f
+}
+
+func (f *FDS) Reset(cpu *CPU) {
+	f.cpu = cpu
+	copy(cpu.memory[0xE000:], f.bios)
+}
+
+func (f *FDS) Audio() ExpansionAudio {
+	return &f.Sound
+}
+
+// Number of disk sides, side 0 is disk 1 side A, side 1 is disk 1 side B and so on
+func (f *FDS) Sides() int {
+	return len(f.Disks)
+}
+
+// Puts a side in the drive, the BIOS sees a disk change on its next check
+func (f *FDS) InsertDisk(side int) error {
+	if side < 0 || side >= len(f.Disks) {
+		return fmt.Errorf("disk side %d does not exist, the image has %d", side, len(f.Disks))
+	}
+	f.Side = int32(side)
+	f.Drive.EndOfHead = true
+	f.Drive.Scanning = false
+	return nil
+}
+
+func (f *FDS) EjectDisk() {
+	f.Side = -1
+	f.Drive.Scanning = false
+}
+
+func (f *FDS) Read(address uint16) (uint8, bool) {
+	switch {
+	case address == 0x4030:
+		var value uint8
+		if f.Timer.IRQ {
+			value |= 0x01
+		}
+		if f.Drive.Transferred {
+			value |= 0x02
+		}
+		if f.Drive.EndOfHead {
+			value |= 0x40
+		}
+		if f.Drive.DiskIO {
+			value |= 0x80
+		}
+		// Reading acknowledges both IRQs
+		f.Timer.IRQ = false
+		f.Drive.Transferred = false
+		f.Drive.IRQ = false
+		return value, true
+	case address == 0x4031:
+		f.Drive.Transferred = false
+		f.Drive.IRQ = false
+		return f.Drive.ReadData, true
+	case address == 0x4032:
+		value := uint8(0x40)
+		if f.Side < 0 {
+			// No disk, which also reads as write protected
+			value |= 0x05
+		}
+		if f.Side < 0 || !f.Drive.Scanning {
+			value |= 0x02
+		}
+		return value, true
+	case address == 0x4033:
+		// Bit 7 set means the battery is good
+		return 0x80 | f.Drive.External&0x7F, true
+	case address >= 0x4040 && address <= 0x4092 && f.Drive.SoundIO:
+		return f.Sound.read(address)
+	}
+	return 0, false
+}
+
+func (f *FDS) Write(address uint16, value uint8) bool {
+	switch {
+	case address == 0x4020:
+		f.Timer.Reload = f.Timer.Reload&0xFF00 | uint16(value)
+	case address == 0x4021:
+		f.Timer.Reload = f.Timer.Reload&0x00FF | uint16(value)<<8
+	case address == 0x4022:
+		f.Timer.Repeat = getBit(value, 0)
+		f.Timer.Enabled = getBit(value, 1) && f.Drive.DiskIO
+		if f.Timer.Enabled {
+			f.Timer.Counter = f.Timer.Reload
+		} else {
+			f.Timer.IRQ = false
+		}
+	case address == 0x4023:
+		f.Drive.DiskIO = getBit(value, 0)
+		f.Drive.SoundIO = getBit(value, 1)
+		if !f.Drive.DiskIO {
+			f.Timer.Enabled = false
+			f.Timer.IRQ = false
+			f.Drive.IRQ = false
+		}
+	case address >= 0x4024 && address <= 0x4026 && !f.Drive.DiskIO:
+		// The disk registers are off
+	case address == 0x4024:
+		f.Drive.WriteData = value
+		f.Drive.Transferred = false
+		f.Drive.IRQ = false
+	case address == 0x4025:
+		d := &f.Drive
+		d.MotorOn = getBit(value, 0)
+		d.ResetTransfer = getBit(value, 1)
+		d.ReadMode = getBit(value, 2)
+		d.Mirroring = mirrorVertical
+		if getBit(value, 3) {
+			d.Mirroring = mirrorHorizontal
+		}
+		d.CRCControl = getBit(value, 4)
+		d.Ready = getBit(value, 6)
+		d.IRQEnabled = getBit(value, 7)
+		d.IRQ = false
+	case address == 0x4026:
+		f.Drive.External = value
+	case address >= 0x4040 && address <= 0x408A:
+		if f.Drive.SoundIO {
+			f.Sound.write(address, value)
+		}
+	case address >= 0x6000 && address < 0xE000:
+		f.cpu.memory[address] = value
+	case address >= 0xE000:
+		// BIOS ROM
+	default:
+		return false
+	}
+	return true
+}
+
+func (f *FDS) Clock() {
+	t := &f.Timer
+	if t.Enabled {
+		if t.Counter == 0 {
+			t.IRQ = true
+			t.Counter = t.Reload
+			if !t.Repeat {
+				t.Enabled = false
+			}
+		} else {
+			t.Counter--
+		}
+	}
+	f.clockDrive()
+	f.Sound.clock()
+}
+
+/*
+Moves the disk under the head. After the motor starts the drive waits for the disk to
+spin up, then a byte passes every fdsByteCycles cycles until the end of the side.
+*/
+func (f *FDS) clockDrive() {
+	d := &f.Drive
+	if f.Side < 0 || !d.MotorOn {
+		d.EndOfHead = true
+		d.Scanning = false
+		return
+	}
+	if d.ResetTransfer && !d.Scanning {
+		return
+	}
+	if d.EndOfHead {
+		d.Delay = fdsSpinUpCycles
+		d.EndOfHead = false
+		d.Position = 0
+		d.GapEnded = false
+		return
+	}
+	if d.Delay > 0 {
+		d.Delay--
+		return
+	}
+
+	d.Scanning = true
+	disk := f.Disks[f.Side]
+	needIRQ := d.IRQEnabled
+	if d.ReadMode {
+		data := disk[d.Position]
+		if !d.Ready {
+			d.GapEnded = false
+		} else if data != 0 && !d.GapEnded {
+			// The $80 mark at the end of a gap raises no IRQ
+			d.GapEnded = true
+			needIRQ = false
+		}
+		if d.GapEnded {
+			d.Transferred = true
+			d.ReadData = data
+			if needIRQ {
+				d.IRQ = true
+			}
+		}
+	} else {
+		data := d.WriteData
+		if d.CRCControl {
+			data = fdsCRC[0]
+			if d.PreviousCRC {
+				data = fdsCRC[1]
+			}
+		} else {
+			d.Transferred = true
+			if needIRQ {
+				d.IRQ = true
+			}
+		}
+		if !d.Ready {
+			data = 0
+		}
+		disk[d.Position] = data
+		d.GapEnded = false
+	}
+	d.PreviousCRC = d.CRCControl
+
+	d.Position++
+	if int(d.Position) >= len(disk) {
+		d.MotorOn = false
+		if needIRQ {
+			d.IRQ = true
+		}
+	} else {
+		d.Delay = fdsByteCycles
+	}
+}
+
+func (f *FDS) IRQ() bool {
+	return f.Timer.IRQ || f.Drive.IRQ
+}
+
+// Disks are saved whole as games write to them
+func (f *FDS) saveState(w io.Writer) {
+	binary.Write(w, binary.LittleEndian, &f.Timer)
+	binary.Write(w, binary.LittleEndian, &f.Drive)
+	binary.Write(w, binary.LittleEndian, &f.Sound)
+	binary.Write(w, binary.LittleEndian, f.Side)
+	for _, disk := range f.Disks {
+		w.Write(disk)
+	}
+}
+
+func (f *FDS) loadState(r io.Reader) error {
+	var timer FDSTimer
+	var drive FDSDrive
+	var audio FDSAudio
+	var side int32
+	for _, v := range []any{&timer, &drive, &audio, &side} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("error reading save state: %w", err)
+		}
+	}
+	disks := make([][]uint8, len(f.Disks))
+	for i := range disks {
+		disks[i] = make([]uint8, len(f.Disks[i]))
+		if _, err := io.ReadFull(r, disks[i]); err != nil {
+			return fmt.Errorf("error reading save state: %w", err)
+		}
+	}
+	f.Timer, f.Drive, f.Sound, f.Side, f.Disks = timer, drive, audio, side, disks
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A disk side with its info block and a file count block, the rest is empty
+func testDiskSide(name string) []uint8 {
+	side := make([]uint8, fdsSideSize)
+	copy(side, fdsDiskMagic)
+	copy(side[16:], name)
+	side[56] = 2
+	side[57] = 0
+	return side
+}
+
+// A BIOS whose IRQ vector points at $6100 in the RAM adapter's RAM
+func testFDSBIOS() []uint8 {
+	bios := make([]uint8, fdsBIOSSize)
+	bios[0x1FFE] = 0x00
+	bios[0x1FFF] = 0x61
+	return bios
+}
+
+func TestParseFDS(t *testing.T) {
+	side := testDiskSide("GAME")
+	header := append([]uint8(fdsMagic), 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	tests := []struct {
+		name  string
+		data  []uint8
+		sides int
+	}{
+		{"headerless", side, 1},
+		{"with header", append(append(append([]uint8{}, header...), side...), side...), 2},
+		{"partial side", side[:1000], 0},
+		{"side without info block", make([]uint8, fdsSideSize), 0},
+	}
+	for _, test := range tests {
+		cart, err := parseFDS(test.data)
+		if test.sides == 0 {
+			if err == nil {
+				t.Errorf("%s: parseFDS did not fail", test.name)
+			}
+			continue
+		}
+		if err != nil || len(cart.Disks) != test.sides {
+			t.Errorf("%s: got %v, want %d sides", test.name, err, test.sides)
+		}
+	}
+}
+
+func TestFDSDiskImage(t *testing.T) {
+	disk := fdsDiskImage(testDiskSide("GAME"))
+	if len(disk) != fdsSideCapacity {
+		t.Fatalf("disk is %d bytes, want %d", len(disk), fdsSideCapacity)
+	}
+	// Lead-in, then the info block behind its mark with a CRC and a gap after it
+	info := fdsLeadIn
+	files := info + 1 + 56 + 2 + fdsBlockGap
+	if !bytes.Equal(disk[:info], make([]uint8, fdsLeadIn)) || disk[info] != 0x80 || disk[info+1] != 1 {
+		t.Errorf("info block does not follow the lead-in")
+	}
+	if !bytes.Equal(disk[info+57:info+59], fdsCRC[:]) {
+		t.Errorf("info block is not followed by its CRC")
+	}
+	if disk[files] != 0x80 || disk[files+1] != 2 {
+		t.Errorf("file count block is not after the gap: % X", disk[files:files+2])
+	}
+}
+
+func TestFDSTimerIRQ(t *testing.T) {
+	tests := []struct {
+		name    string
+		control uint8
+		cli     bool
+		want    uint8
+	}{
+		{"once", 0x02, true, 1},
+		{"repeat", 0x03, true, 3},
+		{"masked", 0x02, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fds := NewFDS([][]uint8{testDiskSide("GAME")}, testFDSBIOS())
+			r := newTestRunner(fds)
+			cli := uint8(0x58)
+			if !test.cli {
+				cli = 0xEA
+			}
+			r.cpu.LoadProgram([]uint8{
+				0xA9, 0x01, 0x8D, 0x23, 0x40, // LDA #$01, STA $4023 enables the disk registers
+				0xA9, 0xD0, 0x8D, 0x20, 0x40, // LDA #$D0, STA $4020
+				0xA9, 0x07, 0x8D, 0x21, 0x40, // LDA #$07, STA $4021, reload $07D0
+				0xA9, test.control, 0x8D, 0x22, 0x40, // STA $4022
+				cli,              // CLI
+				0x4C, 0x15, 0x60, // JMP $6015
+			}, 0x6000)
+			// The handler acknowledges the IRQ and counts it
+			copy(r.cpu.memory[0x6100:], []uint8{0xAD, 0x30, 0x40, 0xE6, 0x10, 0x40})
+
+			// Enough for three IRQs of a $07D0 cycle timer, not for four
+			for r.cpu.Cycles < 4*2000 && r.Frame == 0 {
+				r.Step()
+			}
+			if got := r.cpu.memory[0x10]; got != test.want {
+				t.Errorf("handler ran %d times, want %d", got, test.want)
+			}
+			if test.cli && fds.Timer.IRQ {
+				t.Error("timer IRQ still pending after the handler read $4030")
+			}
+		})
+	}
+}
+
+func TestFDSDriveTiming(t *testing.T) {
+	fds := NewFDS([][]uint8{testDiskSide("GAME"), testDiskSide("GAME")}, testFDSBIOS())
+	fds.Reset(&CPU{})
+	fds.Write(0x4023, 0x01)
+	// Motor on, read mode, ready, transfer IRQs enabled
+	fds.Write(0x4025, 0xC5)
+
+	cycles := 0
+	for !fds.Drive.Transferred {
+		fds.Clock()
+		cycles++
+	}
+	// One cycle to start the motor, the spin up, then each gap byte takes a cycle plus its delay
+	if want := 1 + fdsSpinUpCycles + 1 + fdsLeadIn*(fdsByteCycles+1); cycles != want {
+		t.Errorf("first byte after %d cycles, want %d", cycles, want)
+	}
+	if fds.Drive.ReadData != 0x80 || fds.IRQ() {
+		t.Errorf("block mark read as $%02X with IRQ %v, want $80 without an IRQ", fds.Drive.ReadData, fds.IRQ())
+	}
+
+	if value, _ := fds.Read(0x4031); value != 0x80 {
+		t.Errorf("$4031 = $%02X, want $80", value)
+	}
+	for i := 0; i <= fdsByteCycles; i++ {
+		fds.Clock()
+	}
+	if !fds.IRQ() || fds.Drive.ReadData != 0x01 {
+		t.Errorf("block type $%02X with IRQ %v, want $01 with an IRQ", fds.Drive.ReadData, fds.IRQ())
+	}
+	if status, _ := fds.Read(0x4030); status&0x02 == 0 || fds.IRQ() {
+		t.Errorf("$4030 = $%02X did not report and acknowledge the transfer", status)
+	}
+
+	tests := []struct {
+		name   string
+		change func() error
+		status uint8
+	}{
+		{"scanning", func() error { return nil }, 0x40},
+		{"ejected", func() error { fds.EjectDisk(); return nil }, 0x47},
+		{"other side", func() error { return fds.InsertDisk(1) }, 0x42},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if status, _ := fds.Read(0x4032); status != test.status {
+			t.Errorf("%s: $4032 = $%02X, want $%02X", test.name, status, test.status)
+		}
+	}
+	if fds.Side != 1 {
+		t.Errorf("side %d in the drive, want 1", fds.Side)
+	}
+	if err := fds.InsertDisk(2); err == nil {
+		t.Error("inserting a side the image does not have did not fail")
+	}
+}
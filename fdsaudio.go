@@ -0,0 +1,239 @@
+package main
+
+// Master volume of the FDS sound unit, in 1/36ths of full volume
+var fdsMasterVolumes = [4]uint32{36, 24, 17, 14}
+
+// Modulation table steps, 4 resets the counter
+var fdsModSteps = [8]int8{0, 1, 2, 4, 0, -4, -2, -1}
+
+// Volume and modulation envelopes of the FDS sound unit
+type FDSEnvelope struct {
+	Off      bool
+	Increase bool
+	Speed    uint8
+	Gain     uint8
+	Timer    uint32
+}
+
+func (e *FDSEnvelope) write(value uint8, master uint8) {
+	e.Off = getBit(value, 7)
+	e.Increase = getBit(value, 6)
+	e.Speed = value & 0x3F
+	if e.Off {
+		e.Gain = e.Speed
+	}
+	e.resetTimer(master)
+}
+
+func (e *FDSEnvelope) resetTimer(master uint8) {
+	e.Timer = 8 * (uint32(e.Speed) + 1) * uint32(master)
+}
+
+// Returns true when the gain was stepped
+func (e *FDSEnvelope) clock(master uint8) bool {
+	if e.Off || master == 0 {
+		return false
+	}
+	if e.Timer > 0 {
+		e.Timer--
+	}
+	if e.Timer > 0 {
+		return false
+	}
+	e.resetTimer(master)
+	if e.Increase && e.Gain < 32 {
+		e.Gain++
+	} else if !e.Increase && e.Gain > 0 {
+		e.Gain--
+	}
+	return true
+}
+
+/*
+FDSAudio is the wavetable channel of the disk system: a 64 step wave of 6 bit samples
+whose pitch is bent by a second table stepping a modulation counter.
+*/
+type FDSAudio struct {
+	Wave         [64]uint8
+	WavePosition uint8
+	WaveCounter  uint16
+	WaveWrite    bool // $4089 bit 7, the wave can be written and its output holds
+	WaveHalt     bool
+	Frequency    uint16
+
+	EnvelopesHalt bool
+	EnvelopeSpeed uint8
+	MasterVolume  uint8
+	Volume        FDSEnvelope
+
+	Mod          FDSEnvelope
+	ModTable     [64]uint8
+	ModPosition  uint8
+	ModCounter   int8 // 7 bit signed
+	ModFrequency uint16
+	ModAccum     uint16
+	ModHalt      bool
+	Pitch        int32 // frequency change from the modulator
+
+	Output uint8
+}
+
+func (a *FDSAudio) read(address uint16) (uint8, bool) {
+	switch {
+	case address >= 0x4040 && address < 0x4080:
+		return a.Wave[address&0x3F] | 0x40, true
+	case address == 0x4090:
+		return a.Volume.Gain | 0x40, true
+	case address == 0x4092:
+		return a.Mod.Gain | 0x40, true
+	}
+	return 0, false
+}
+
+// Handles writes to $4040-$408A
+func (a *FDSAudio) write(address uint16, value uint8) {
+	switch {
+	case address < 0x4080:
+		if a.WaveWrite {
+			a.Wave[address&0x3F] = value & 0x3F
+		}
+	case address == 0x4080:
+		a.Volume.write(value, a.EnvelopeSpeed)
+	case address == 0x4082:
+		a.Frequency = a.Frequency&0x0F00 | uint16(value)
+		a.updatePitch()
+	case address == 0x4083:
+		a.Frequency = a.Frequency&0x00FF | uint16(value&0x0F)<<8
+		a.EnvelopesHalt = getBit(value, 6)
+		a.WaveHalt = getBit(value, 7)
+		if a.EnvelopesHalt {
+			a.Volume.resetTimer(a.EnvelopeSpeed)
+			a.Mod.resetTimer(a.EnvelopeSpeed)
+		}
+		if a.WaveHalt {
+			a.WavePosition = 0
+			a.WaveCounter = 0
+		}
+		a.updatePitch()
+	case address == 0x4084:
+		a.Mod.write(value, a.EnvelopeSpeed)
+		a.updatePitch()
+	case address == 0x4085:
+		a.setModCounter(int(value))
+		a.updatePitch()
+	case address == 0x4086:
+		a.ModFrequency = a.ModFrequency&0x0F00 | uint16(value)
+	case address == 0x4087:
+		a.ModFrequency = a.ModFrequency&0x00FF | uint16(value&0x0F)<<8
+		a.ModHalt = getBit(value, 7)
+		if a.ModHalt {
+			a.ModAccum = 0
+		}
+	case address == 0x4088:
+		// Each write fills two entries of the table, only while the modulator is halted
+		if a.ModHalt {
+			a.ModTable[a.ModPosition] = value & 7
+			a.ModTable[a.ModPosition+1] = value & 7
+			a.ModPosition = (a.ModPosition + 2) & 0x3F
+		}
+	case address == 0x4089:
+		a.WaveWrite = getBit(value, 7)
+		a.MasterVolume = value & 3
+	case address == 0x408A:
+		a.EnvelopeSpeed = value
+	}
+}
+
+// The counter wraps around as a 7 bit signed value
+func (a *FDSAudio) setModCounter(value int) {
+	value &= 0x7F
+	if value >= 64 {
+		value -= 128
+	}
+	a.ModCounter = int8(value)
+}
+
+/*
+Pitch change for the current counter and gain, worked out with the same rounding as
+the hardware, see the NESdev wiki FDS audio page
+*/
+func (a *FDSAudio) updatePitch() {
+	temp := int32(a.ModCounter) * int32(a.Mod.Gain)
+	remainder := temp & 0x0F
+	temp >>= 4
+	if remainder > 0 && temp&0x80 == 0 {
+		if a.ModCounter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+	temp *= int32(a.Frequency)
+	remainder = temp & 0x3F
+	temp >>= 6
+	if remainder >= 32 {
+		temp++
+	}
+	a.Pitch = temp
+}
+
+// Runs the sound unit for one CPU cycle
+func (a *FDSAudio) clock() {
+	if !a.WaveHalt && !a.EnvelopesHalt {
+		a.Volume.clock(a.EnvelopeSpeed)
+		if a.Mod.clock(a.EnvelopeSpeed) {
+			a.updatePitch()
+		}
+	}
+
+	if !a.ModHalt && a.ModFrequency > 0 {
+		a.ModAccum += a.ModFrequency
+		if a.ModAccum < a.ModFrequency {
+			// The accumulator overflowed, step through the table
+			step := a.ModTable[a.ModPosition]
+			if step == 4 {
+				a.setModCounter(0)
+			} else {
+				a.setModCounter(int(a.ModCounter) + int(fdsModSteps[step]))
+			}
+			a.ModPosition = (a.ModPosition + 1) & 0x3F
+			a.updatePitch()
+		}
+	}
+
+	if a.WaveHalt {
+		a.WavePosition = 0
+		a.updateOutput()
+		return
+	}
+	a.updateOutput()
+	if frequency := int32(a.Frequency) + a.Pitch; frequency > 0 && !a.WaveWrite {
+		step := uint16(frequency)
+		a.WaveCounter += step
+		if a.WaveCounter < step {
+			a.WavePosition = (a.WavePosition + 1) & 0x3F
+		}
+	}
+}
+
+func (a *FDSAudio) updateOutput() {
+	// The output holds its last level while the wave is being written
+	if a.WaveWrite {
+		return
+	}
+	level := uint32(min(a.Volume.Gain, 32)) * fdsMasterVolumes[a.MasterVolume]
+	a.Output = uint8(uint32(a.Wave[a.WavePosition]) * level / 1152)
+}
+
+/*
+At full volume the FDS is about 2.4 times as loud as one pulse channel of the APU,
+Output is at most 63
+*/
+func (a *FDSAudio) output() float64 {
+	return float64(a.Output) / 63 * 2.4 * pulseMixTable[15]
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Gamepad buttons in FM2 column order, most significant button bit first
+const fm2Buttons = "RLDUTSBA"
+
+/*
+Reads an FCEUX movie. The header is "key value" lines followed by one input line per
+frame, "|commands|port0|port1|port2|". RAM hashes are kept in comment lines.
+*/
+func readFM2File(filename string) (*Movie, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening movie: %w", err)
+	}
+	defer file.Close()
+
+	movie := &Movie{Checkpoints: make(map[int]uint64)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "|") {
+			fields := strings.Split(line, "|")
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("invalid FM2 input line %q", line)
+			}
+			movie.Input = append(movie.Input, [2]uint8{parseButtons(fields[2], 7), parseButtons(fields[3], 7)})
+			continue
+		}
+
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch key {
+		case "romFilename":
+			movie.ROMName = value
+		case "rerecordCount":
+			movie.Rerecords, _ = strconv.Atoi(value)
+		case "palFlag":
+			movie.PAL = value == "1"
+		case "romChecksum":
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+			if err == nil && len(sum) == len(movie.MD5) {
+				copy(movie.MD5[:], sum)
+			}
+		case "savestate":
+			if movie.StartState, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:")); err != nil {
+				return nil, fmt.Errorf("invalid FM2 savestate: %w", err)
+			}
+		case "comment":
+			var frame int
+			var hash uint64
+			if n, _ := fmt.Sscanf(value, "ramhash %d %x", &frame, &hash); n == 2 {
+				movie.Checkpoints[frame] = hash
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading movie: %w", err)
+	}
+	return movie, nil
+}
+
+/*
+Parses a gamepad field, any character other than '.' or ' ' is a pressed button.
+firstBit is the button bit of the first column, columns count down from it.
+*/
+func parseButtons(field string, firstBit int) uint8 {
+	var buttons uint8
+	for i := 0; i < len(field) && i <= firstBit; i++ {
+		if field[i] != '.' && field[i] != ' ' {
+			buttons = setBit(buttons, uint8(firstBit-i))
+		}
+	}
+	return buttons
+}
+
+// Formats the buttons with one letter per column, '.' for released
+func formatButtons(buttons uint8, letters string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(letters); i++ {
+		if getBit(buttons, uint8(len(letters)-1-i)) {
+			b.WriteByte(letters[i])
+		} else {
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
+
+func (m *Movie) writeFM2File(filename string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "version 3\n")
+	fmt.Fprintf(&b, "emuVersion 22020\n")
+	fmt.Fprintf(&b, "rerecordCount %d\n", m.Rerecords)
+	if m.PAL {
+		fmt.Fprintf(&b, "palFlag 1\n")
+	} else {
+		fmt.Fprintf(&b, "palFlag 0\n")
+	}
+	fmt.Fprintf(&b, "romFilename %s\n", m.ROMName)
+	fmt.Fprintf(&b, "romChecksum base64:%s\n", base64.StdEncoding.EncodeToString(m.MD5[:]))
+	guid := strings.ToUpper(hex.EncodeToString(m.MD5[:]))
+	fmt.Fprintf(&b, "guid %s-%s-%s-%s-%s\n", guid[:8], guid[8:12], guid[12:16], guid[16:20], guid[20:])
+	fmt.Fprintf(&b, "fourscore 0\nmicrophone 0\nport0 1\nport1 1\nport2 0\nFDS 0\nNewPPU 0\n")
+	if m.StartState != nil {
+		fmt.Fprintf(&b, "comment %s\n", movieStartStateNote)
+		fmt.Fprintf(&b, "savestate base64:%s\n", base64.StdEncoding.EncodeToString(m.StartState))
+	}
+	for frame := 0; frame < len(m.Input); frame++ {
+		if hash, ok := m.Checkpoints[frame]; ok {
+			fmt.Fprintf(&b, "comment ramhash %d %016x\n", frame, hash)
+		}
+	}
+	for _, input := range m.Input {
+		fmt.Fprintf(&b, "|0|%s|%s||\n", formatButtons(input[0], fm2Buttons), formatButtons(input[1], fm2Buttons))
+	}
+
+	if err := os.WriteFile(filename, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing movie: %w", err)
+	}
+	return nil
+}
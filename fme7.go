@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io"
+	"math"
+)
+
+// Output of each of the 32 envelope levels, 1.5 dB apart with level 0 silent
+var sunsoft5BLevels [32]float64
+
+func init() {
+	for i := 1; i < len(sunsoft5BLevels); i++ {
+		sunsoft5BLevels[i] = math.Pow(10, float64(i-31)*1.5/20)
+	}
+}
+
+/*
+Sunsoft5BAudio is the sound of the Sunsoft 5B, a YM2149F (AY-3-8910) inside the FME-7:
+three square channels, a shared noise generator and a shared envelope, with
+logarithmic volume. Its counters tick every 16 CPU cycles and the tones toggle once per
+period, so a tone plays at CPU clock / (32 * period).
+*/
+type Sunsoft5BAudio struct {
+	Address   uint8
+	Registers [16]uint8
+
+	Divider    uint8
+	ToneTimers [3]uint16
+	ToneHigh   [3]bool
+	NoiseTimer uint8
+	NoiseFlip  bool // the noise runs at half the tone rate
+	Noise      uint32
+
+	EnvelopeTimer uint16
+	EnvelopeStep  uint8 // 0-31
+	EnvelopeHold  bool
+	EnvelopeUp    bool
+}
+
+func newSunsoft5BAudio() Sunsoft5BAudio {
+	return Sunsoft5BAudio{Noise: 1}
+}
+
+// $C000 selects a register and $E000 writes it
+func (a *Sunsoft5BAudio) write(address uint16, value uint8) {
+	if address < 0xE000 {
+		a.Address = value & 0x0F
+		return
+	}
+	a.Registers[a.Address] = value
+	if a.Address == 13 {
+		// Writing the shape restarts the envelope
+		a.EnvelopeTimer = 0
+		a.EnvelopeHold = false
+		a.EnvelopeUp = getBit(value, 2)
+		a.EnvelopeStep = 0
+	}
+}
+
+func (a *Sunsoft5BAudio) tonePeriod(ch int) uint16 {
+	return max(uint16(a.Registers[ch*2])|uint16(a.Registers[ch*2+1]&0x0F)<<8, 1)
+}
+
+func (a *Sunsoft5BAudio) clock() {
+	a.Divider++
+	if a.Divider < 16 {
+		return
+	}
+	a.Divider = 0
+
+	for ch := range a.ToneTimers {
+		a.ToneTimers[ch]++
+		if a.ToneTimers[ch] >= a.tonePeriod(ch) {
+			a.ToneTimers[ch] = 0
+			a.ToneHigh[ch] = !a.ToneHigh[ch]
+		}
+	}
+
+	a.NoiseFlip = !a.NoiseFlip
+	if a.NoiseFlip {
+		a.NoiseTimer++
+		if a.NoiseTimer >= max(a.Registers[6]&0x1F, 1) {
+			a.NoiseTimer = 0
+			// 17 bit LFSR with taps at bits 0 and 3
+			a.Noise = a.Noise>>1 | (a.Noise^a.Noise>>3)&1<<16
+		}
+	}
+
+	a.EnvelopeTimer++
+	if period := max(uint16(a.Registers[11])|uint16(a.Registers[12])<<8, 1); a.EnvelopeTimer >= period {
+		a.EnvelopeTimer = 0
+		a.clockEnvelope()
+	}
+}
+
+// Shape bits are continue, attack, alternate and hold
+func (a *Sunsoft5BAudio) clockEnvelope() {
+	if a.EnvelopeHold {
+		return
+	}
+	a.EnvelopeStep++
+	if a.EnvelopeStep < 32 {
+		return
+	}
+	shape := a.Registers[13]
+	if !getBit(shape, 3) {
+		// Without continue the envelope drops to zero and stays there
+		a.EnvelopeHold = true
+		a.EnvelopeUp = false
+		a.EnvelopeStep = 31
+		return
+	}
+	if getBit(shape, 1) {
+		a.EnvelopeUp = !a.EnvelopeUp
+	}
+	if getBit(shape, 0) {
+		a.EnvelopeHold = true
+		a.EnvelopeStep = 31
+		return
+	}
+	a.EnvelopeStep = 0
+}
+
+func (a *Sunsoft5BAudio) envelopeLevel() uint8 {
+	if a.EnvelopeUp {
+		return a.EnvelopeStep
+	}
+	return 31 - a.EnvelopeStep
+}
+
+/*
+Sum of the three channels. A full volume channel is about as loud as an APU pulse, the
+5B's logarithmic steps are finer than the APU's so quiet notes are quieter.
+*/
+func (a *Sunsoft5BAudio) output() float64 {
+	mixer := a.Registers[7]
+	var sum float64
+	for ch := 0; ch < 3; ch++ {
+		tone := a.ToneHigh[ch] || getBit(mixer, uint8(ch))
+		noise := a.Noise&1 != 0 || getBit(mixer, uint8(ch+3))
+		if !tone || !noise {
+			continue
+		}
+		volume := a.Registers[8+ch]
+		level := volume&0x0F*2 + 1
+		if volume&0x0F == 0 {
+			level = 0
+		}
+		if getBit(volume, 4) {
+			level = a.envelopeLevel()
+		}
+		sum += sunsoft5BLevels[level]
+	}
+	return sum * pulseMixTable[15]
+}
+
+type fme7Registers struct {
+	Command   uint8
+	PRG       [4]uint8 // $6000, $8000, $A000 and $C000
+	CHR       [8]uint8
+	Mirroring uint8
+
+	// Command 13, bit 0 enables the IRQ and bit 7 the counter
+	IRQControl uint8
+	IRQCounter uint16
+	IRQ        bool
+}
+
+/*
+FME7 is Sunsoft's mapper 69. Registers are written by selecting a command at $8000
+and writing its parameter at $A000. Four 8KB banks are switchable, the one at $6000
+can also be RAM, and the last 8KB is fixed at $E000. A 16 bit counter counts down
+every CPU cycle and raises the IRQ when it wraps from 0 to $FFFF.
+*/
+type FME7 struct {
+	Registers fme7Registers
+	Sound     Sunsoft5BAudio
+
+	prg []uint8
+	chr []uint8
+	cpu *CPU
+	// PRG RAM at $6000, kept aside while ROM is mapped there
+	ram [0x2000]uint8
+}
+
+func NewFME7(prg []uint8, chr []uint8) *FME7 {
+	return &FME7{prg: prg, chr: chr, Sound: newSunsoft5BAudio()}
+}
+
+func (m *FME7) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+// Bit 6 of the $6000 bank selects RAM
+func (m *FME7) ramMapped() bool {
+	return getBit(m.Registers.PRG[0], 6)
+}
+
+func (m *FME7) mapBanks() {
+	r := &m.Registers
+	if !m.ramMapped() {
+		m.cpu.mapPRG(m.prg, 0x6000, 0x2000, int(r.PRG[0]&0x3F))
+	}
+	for i := 1; i < 4; i++ {
+		m.cpu.mapPRG(m.prg, 0x6000+uint16(i)*0x2000, 0x2000, int(r.PRG[i]&0x3F))
+	}
+	m.cpu.mapPRG(m.prg, 0xE000, 0x2000, -1)
+}
+
+func (m *FME7) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+func (m *FME7) Write(address uint16, value uint8) bool {
+	r := &m.Registers
+	switch {
+	case address >= 0x6000 && address < 0x8000:
+		// ROM, or RAM that is write protected unless bit 7 is set
+		return !m.ramMapped() || !getBit(r.PRG[0], 7)
+	case address < 0x8000:
+		return false
+	case address < 0xA000:
+		r.Command = value & 0x0F
+	case address < 0xC000:
+		m.writeCommand(value)
+	default:
+		m.Sound.write(address, value)
+	}
+	return true
+}
+
+func (m *FME7) writeCommand(value uint8) {
+	r := &m.Registers
+	switch command := r.Command; {
+	case command < 8:
+		r.CHR[command] = value
+	case command == 8:
+		wasRAM := m.ramMapped()
+		if wasRAM {
+			copy(m.ram[:], m.cpu.memory[0x6000:0x8000])
+		}
+		r.PRG[0] = value
+		if m.ramMapped() {
+			if !wasRAM {
+				copy(m.cpu.memory[0x6000:0x8000], m.ram[:])
+			}
+			return
+		}
+		m.mapBanks()
+	case command < 12:
+		r.PRG[command-8] = value
+		m.mapBanks()
+	case command == 12:
+		r.Mirroring = value & 3
+	case command == 13:
+		// Any write acknowledges the IRQ
+		r.IRQControl = value
+		r.IRQ = false
+	case command == 14:
+		r.IRQCounter = r.IRQCounter&0xFF00 | uint16(value)
+	case command == 15:
+		r.IRQCounter = r.IRQCounter&0x00FF | uint16(value)<<8
+	}
+}
+
+func (m *FME7) Clock() {
+	r := &m.Registers
+	if getBit(r.IRQControl, 7) {
+		r.IRQCounter--
+		if r.IRQCounter == 0xFFFF && getBit(r.IRQControl, 0) {
+			r.IRQ = true
+		}
+	}
+	m.Sound.clock()
+}
+
+func (m *FME7) IRQ() bool {
+	return m.Registers.IRQ
+}
+
+func (m *FME7) fetchCHR(address uint16) int {
+	return chrBank(m.chr, int(m.Registers.CHR[address>>10&7]), 0x400) + int(address&0x3FF)
+}
+
+func (m *FME7) Audio() ExpansionAudio {
+	return &m.Sound
+}
+
+func (m *FME7) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.Sound, &m.ram)
+}
+
+func (m *FME7) loadState(r io.Reader) error {
+	registers, sound, ram := m.Registers, m.Sound, m.ram
+	if err := readMapperState(r, &registers, &sound, &ram); err != nil {
+		return err
+	}
+	m.Registers, m.Sound, m.ram = registers, sound, ram
+	m.mapBanks()
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Selects command and writes its parameter
+func writeFME7(m *FME7, command uint8, value uint8) {
+	m.Write(0x8000, command)
+	m.Write(0xA000, value)
+}
+
+func TestFME7Banks(t *testing.T) {
+	chr := numberedBanks(64, 0x400)
+	m := NewFME7(numberedBanks(64, 0x2000), chr)
+	cpu := newMapperCPU(m)
+	writeFME7(m, 8, 5)
+	writeFME7(m, 9, 1)
+	writeFME7(m, 10, 2)
+	writeFME7(m, 11, 3)
+	checkBanks(t, cpu, map[uint16]uint8{0x6000: 5, 0x8000: 1, 0xA000: 2, 0xC000: 3, 0xE000: 63})
+
+	for i := uint8(0); i < 8; i++ {
+		writeFME7(m, i, 40+i)
+	}
+	for i := uint16(0); i < 8; i++ {
+		checkCHR(t, m, chr, 0x400, i*0x400+0x3FF, 40+uint8(i))
+	}
+}
+
+func TestFME7RAM(t *testing.T) {
+	m := NewFME7(numberedBanks(64, 0x2000), nil)
+	cpu := newMapperCPU(m)
+
+	// RAM, write enabled
+	writeFME7(m, 8, 0xC0)
+	cpu.write(0x6000, 0x42)
+	if cpu.memory[0x6000] != 0x42 {
+		t.Fatal("write to enabled RAM was lost")
+	}
+
+	// Back to ROM and to RAM again, which kept its contents
+	writeFME7(m, 8, 0x05)
+	checkBanks(t, cpu, map[uint16]uint8{0x6000: 5})
+	writeFME7(m, 8, 0xC0)
+	if cpu.memory[0x6000] != 0x42 {
+		t.Fatalf("RAM holds $%02X after mapping ROM over it", cpu.memory[0x6000])
+	}
+
+	// RAM, write protected
+	writeFME7(m, 8, 0x40)
+	cpu.write(0x6000, 0x99)
+	if cpu.memory[0x6000] != 0x42 {
+		t.Error("write protected RAM was written")
+	}
+}
+
+func TestFME7IRQ(t *testing.T) {
+	tests := []struct {
+		name    string
+		control uint8
+		counter uint16
+		cycles  int // clocks until the IRQ, 0 for none
+	}{
+		{"counts down through zero", 0x81, 3, 4},
+		{"fires on wrapping from zero", 0x81, 0, 1},
+		{"counts without the IRQ enabled", 0x80, 3, 0},
+		{"IRQ enabled without counting", 0x01, 3, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewFME7(numberedBanks(8, 0x2000), nil)
+			newMapperCPU(m)
+			writeFME7(m, 14, uint8(test.counter))
+			writeFME7(m, 15, uint8(test.counter>>8))
+			writeFME7(m, 13, test.control)
+
+			for i := 1; i <= 8; i++ {
+				m.Clock()
+				if want := test.cycles != 0 && i >= test.cycles; m.IRQ() != want {
+					t.Fatalf("IRQ is %v after %d cycles", m.IRQ(), i)
+				}
+			}
+			if counting := getBit(test.control, 7); counting != (m.Registers.IRQCounter != test.counter) {
+				t.Errorf("counter at $%04X after 8 cycles", m.Registers.IRQCounter)
+			}
+
+			// Any write to the control acknowledges
+			writeFME7(m, 13, test.control)
+			if m.IRQ() {
+				t.Error("writing the control did not acknowledge the IRQ")
+			}
+		})
+	}
+}
+
+// Selects a 5B register and writes it
+func write5B(m *FME7, register uint8, value uint8) {
+	m.Write(0xC000, register)
+	m.Write(0xE000, value)
+}
+
+func TestSunsoft5BEnvelopeShapes(t *testing.T) {
+	// Levels after 0, 31, 32, 63 and 64 envelope steps
+	tests := []struct {
+		shape  uint8
+		levels [5]uint8
+	}{
+		{0x00, [5]uint8{31, 0, 0, 0, 0}},    // \___
+		{0x04, [5]uint8{0, 31, 0, 0, 0}},    // /___
+		{0x08, [5]uint8{31, 0, 31, 0, 31}},  // \\\\
+		{0x0A, [5]uint8{31, 0, 0, 31, 31}},  // \/\/
+		{0x0B, [5]uint8{31, 0, 31, 31, 31}}, // \‾‾‾
+		{0x0C, [5]uint8{0, 31, 0, 31, 0}},   // ////
+		{0x0D, [5]uint8{0, 31, 31, 31, 31}}, // /‾‾‾
+		{0x0E, [5]uint8{0, 31, 31, 0, 0}},   // /\/\
+		{0x0F, [5]uint8{0, 31, 0, 0, 0}},    // /___
+	}
+	for _, test := range tests {
+		m := NewFME7(numberedBanks(8, 0x2000), nil)
+		newMapperCPU(m)
+		// Period 1, one step every 16 CPU cycles
+		write5B(m, 11, 1)
+		write5B(m, 12, 0)
+		write5B(m, 13, test.shape)
+
+		var levels [5]uint8
+		step := 0
+		for i, at := range []int{0, 31, 32, 63, 64} {
+			for ; step < at; step++ {
+				for cycle := 0; cycle < 16; cycle++ {
+					m.Clock()
+				}
+			}
+			levels[i] = m.Sound.envelopeLevel()
+		}
+		if levels != test.levels {
+			t.Errorf("shape $%X: levels %v, want %v", test.shape, levels, test.levels)
+		}
+	}
+}
+
+func TestSunsoft5BVolume(t *testing.T) {
+	m := NewFME7(numberedBanks(8, 0x2000), nil)
+	newMapperCPU(m)
+	// Channel A always high with noise off, B and C silent
+	write5B(m, 7, 0x3F)
+	for _, test := range []struct {
+		volume uint8
+		level  float64
+	}{
+		{0x0F, 1},
+		{0x0E, sunsoft5BLevels[29]},
+		{0x00, 0},
+		{0x10, sunsoft5BLevels[31]}, // the envelope, which starts at the top
+	} {
+		write5B(m, 13, 0)
+		write5B(m, 8, test.volume)
+		if got := m.Sound.output() / pulseMixTable[15]; math.Abs(got-test.level) > 1e-9 {
+			t.Errorf("volume $%02X: level %v, want %v", test.volume, got, test.level)
+		}
+	}
+	// Each volume step is 3 dB
+	if ratio := sunsoft5BLevels[31] / sunsoft5BLevels[29]; math.Abs(20*math.Log10(ratio)-3) > 1e-9 {
+		t.Errorf("volume steps are %v dB apart", 20*math.Log10(ratio))
+	}
+}
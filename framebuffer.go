@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	screenWidth  = 256
+	screenHeight = 240
+)
+
+/*
+Framebuffer holds one frame of PPU output. Each pixel is a 6 bit palette index with
+the three colour emphasis bits of $2001 in bits 6-8, so colour is only applied when
+the frame is converted to an image.
+*/
+type Framebuffer struct {
+	Pixels [screenWidth * screenHeight]uint16
+}
+
+/*
+Builds a pixel the way the PPU outputs it given the colour read from palette RAM and
+the $2001 mask. Greyscale forces the colour into the grey column, and the emphasis
+bits 5-7 move to pixel bits 6-8.
+*/
+func ppuPixel(colour uint8, mask uint8) uint16 {
+	if getBit(mask, 0) {
+		colour &= 0x30
+	}
+	return uint16(colour&0x3F) | uint16(mask>>5)<<6
+}
+
+func (fb *Framebuffer) At(x int, y int) uint16 {
+	return fb.Pixels[y*screenWidth+x]
+}
+
+func (fb *Framebuffer) Set(x int, y int, pixel uint16) {
+	fb.Pixels[y*screenWidth+x] = pixel
+}
+
+// Converts the frame to RGBA, each pixel scaled up to a scale x scale block
+func (fb *Framebuffer) Image(palette *Palette, scale int) *image.RGBA {
+	if scale < 1 {
+		scale = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, screenWidth*scale, screenHeight*scale))
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			c := palette[fb.At(x, y)&0x1FF]
+			for sy := 0; sy < scale; sy++ {
+				for sx := 0; sx < scale; sx++ {
+					img.SetRGBA(x*scale+sx, y*scale+sy, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// Writes a binary PPM (P6) image
+func writePPM(w io.Writer, img *image.RGBA) error {
+	bounds := img.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			bw.Write([]byte{c.R, c.G, c.B})
+		}
+	}
+	return bw.Flush()
+}
+
+// Writes img as a PNG, or as a PPM when the file name ends in .ppm
+func writeImageFile(filename string, img *image.RGBA) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating screenshot: %w", err)
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(filename)) == ".ppm" {
+		err = writePPM(file, img)
+	} else {
+		err = png.Encode(file, img)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing screenshot: %w", err)
+	}
+	return nil
+}
+
+// Replaces each %d in a screenshot file name with the frame number, any other % is kept
+func frameFileName(pattern string, frame int) string {
+	return strings.Replace(pattern, "%d", strconv.Itoa(frame), -1)
+}
+
+// Converts the current frame through the NTSC filter when one is set, otherwise the palette
+func (r *Runner) frameImage(palette *Palette, scale int) *image.RGBA {
+	if r.Filter != nil {
+		return r.Filter.Image(r.Framebuffer, r.Frame, scale)
+	}
+	if palette == nil {
+		palette = defaultPalette
+	}
+	return r.Framebuffer.Image(palette, scale)
+}
+
+// Saves the current frame, a nil palette uses the default one
+func (r *Runner) Screenshot(filename string, palette *Palette, scale int) error {
+	return writeImageFile(filename, r.frameImage(palette, scale))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A frame with a few distinct colours to tell the pixels apart
+func testFramebuffer() *Framebuffer {
+	fb := &Framebuffer{}
+	fb.Set(0, 0, 0x16)
+	fb.Set(1, 0, 0x2A)
+	fb.Set(255, 239, 0x12)
+	fb.Set(5, 7, ppuPixel(0x21, 0x20))
+	return fb
+}
+
+func TestFramebufferImageScale(t *testing.T) {
+	fb := testFramebuffer()
+	for _, scale := range []int{0, 1, 3} {
+		img := fb.Image(defaultPalette, scale)
+		size := max(scale, 1)
+		if img.Bounds().Dx() != screenWidth*size || img.Bounds().Dy() != screenHeight*size {
+			t.Errorf("scale %d: image is %v", scale, img.Bounds())
+			continue
+		}
+		for _, p := range [][2]int{{0, 0}, {1, 0}, {255, 239}, {5, 7}, {100, 100}} {
+			want := defaultPalette[fb.At(p[0], p[1])]
+			for sy := 0; sy < size; sy++ {
+				for sx := 0; sx < size; sx++ {
+					if c := img.RGBAAt(p[0]*size+sx, p[1]*size+sy); c != want {
+						t.Errorf("scale %d: pixel %v block %d,%d is %v, want %v", scale, p, sx, sy, c, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWritePPM(t *testing.T) {
+	img := testFramebuffer().Image(defaultPalette, 2)
+	var out bytes.Buffer
+	if err := writePPM(&out, img); err != nil {
+		t.Fatal(err)
+	}
+	header := "P6\n512 480\n255\n"
+	if !bytes.HasPrefix(out.Bytes(), []byte(header)) {
+		t.Fatalf("header %q, want %q", out.Bytes()[:len(header)], header)
+	}
+	data := out.Bytes()[len(header):]
+	if len(data) != 512*480*3 {
+		t.Fatalf("%d bytes of pixels, want %d", len(data), 512*480*3)
+	}
+	// The last pixel is the bottom right of the scaled $12
+	c := defaultPalette[0x12]
+	if last := data[len(data)-3:]; !bytes.Equal(last, []byte{c.R, c.G, c.B}) {
+		t.Errorf("last pixel %v, want %v", last, c)
+	}
+	c = defaultPalette[0x2A]
+	if second := data[2*3 : 3*3]; !bytes.Equal(second, []byte{c.R, c.G, c.B}) {
+		t.Errorf("pixel 2 of the first row %v, want %v", second, c)
+	}
+}
+
+func TestScreenshotFormats(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRunner(&NROM{prg: testPRG()})
+	r.Framebuffer = testFramebuffer()
+
+	pngPath := filepath.Join(dir, "frame.png")
+	if err := r.Screenshot(pngPath, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(pngPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("screenshot is not a PNG: %v", err)
+	}
+	for _, p := range [][2]int{{0, 0}, {1, 0}, {255, 239}, {5, 7}} {
+		want := defaultPalette[r.Framebuffer.At(p[0], p[1])]
+		if c := color.RGBAModel.Convert(img.At(p[0], p[1])); c != want {
+			t.Errorf("PNG pixel %v is %v, want %v", p, c, want)
+		}
+	}
+
+	ppmPath := filepath.Join(dir, "frame.PPM")
+	if err := r.Screenshot(ppmPath, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(ppmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("P6\n256 240\n255\n")) {
+		t.Errorf(".PPM screenshot starts %q, want a P6 header", data[:min(len(data), 16)])
+	}
+
+	if err := r.Screenshot(filepath.Join(dir, "missing", "frame.png"), nil, 1); err == nil {
+		t.Error("screenshot into a missing directory succeeded")
+	}
+}
+
+func TestFrameFileName(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"shot.png", "shot.png"},
+		{"shot%d.png", "shot42.png"},
+		{"%d/shot-%d.ppm", "42/shot-42.ppm"},
+		{"100%/shot%d.png", "100%/shot42.png"},
+		{"shot%s%x.png", "shot%s%x.png"},
+	}
+	for _, test := range tests {
+		if got := frameFileName(test.pattern, 42); got != test.want {
+			t.Errorf("frameFileName(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+Register layout given to GDB, the same order the g packet uses. GDB has no 6502
+target, so front ends learn the registers from this description.
+*/
+const gdbTargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.6502.core">
+    <reg name="a" bitsize="8" type="uint8" regnum="0"/>
+    <reg name="x" bitsize="8" type="uint8"/>
+    <reg name="y" bitsize="8" type="uint8"/>
+    <reg name="p" bitsize="8" type="uint8"/>
+    <reg name="sp" bitsize="8" type="uint8"/>
+    <reg name="pc" bitsize="16" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+// Steps run between checks for an interrupt from the debugger while continuing
+const gdbInterruptInterval = 1000
+
+// Why the target stopped, sent to GDB as a T packet
+type gdbStop struct {
+	// Stop reason as GDB names it, "swbreak", "hwbreak", "watch", "rwatch" or "awatch"
+	reason  string
+	address uint16
+}
+
+// A software (kind 0) or hardware (kind 1) breakpoint, the two are set and cleared separately
+type gdbBreakpoint struct {
+	kind    int
+	address uint16
+}
+
+// A watchpoint as GDB sets and clears it, watchpoints only differing in type or length are separate
+type gdbWatchpoint struct {
+	kind    int
+	address uint16
+	length  int
+}
+
+/*
+GDBServer is a GDB remote serial protocol stub for the CPU. A debugger connects over
+TCP and can read and write the registers and memory, set breakpoints and read, write
+and access watchpoints, and single step or continue until one is hit or it interrupts.
+Memory accesses from the debugger go straight to memory without bus side effects.
+*/
+type GDBServer struct {
+	runner   *Runner
+	listener net.Listener
+
+	// Software and hardware breakpoints, both checked before each instruction
+	breakpoints map[gdbBreakpoint]bool
+	// Runner hooks of each watchpoint
+	watchpoints map[gdbWatchpoint][]HookID
+	// Set by a watchpoint hook during a step
+	stop *gdbStop
+
+	conn      net.Conn
+	writer    *bufio.Writer
+	packets   chan string
+	interrupt chan struct{}
+	done      chan struct{}
+}
+
+// Listens for a debugger on address, for example "localhost:2345"
+func ListenGDB(r *Runner, address string) (*GDBServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for GDB: %w", err)
+	}
+	return NewGDBServer(r, listener), nil
+}
+
+func NewGDBServer(r *Runner, listener net.Listener) *GDBServer {
+	return &GDBServer{
+		runner:      r,
+		listener:    listener,
+		breakpoints: make(map[gdbBreakpoint]bool),
+		watchpoints: make(map[gdbWatchpoint][]HookID),
+	}
+}
+
+func (g *GDBServer) Addr() net.Addr {
+	return g.listener.Addr()
+}
+
+func (g *GDBServer) Close() error {
+	return g.listener.Close()
+}
+
+/*
+Accepts one debugger and serves it until it detaches or disconnects, returning true
+if it asked for the emulator to be killed. The emulator is only run from here, so
+the caller must not step the runner meanwhile.
+*/
+func (g *GDBServer) Serve() (bool, error) {
+	conn, err := g.listener.Accept()
+	if err != nil {
+		return false, fmt.Errorf("error accepting GDB connection: %w", err)
+	}
+	defer conn.Close()
+	g.conn, g.writer = conn, bufio.NewWriter(conn)
+	g.packets = make(chan string)
+	g.interrupt = make(chan struct{}, 1)
+	g.done = make(chan struct{})
+	defer close(g.done)
+	go g.readPackets(bufio.NewReader(conn))
+
+	for packet := range g.packets {
+		reply, done, killed := g.handle(packet)
+		if reply != nil {
+			if err := g.send(*reply); err != nil {
+				return false, err
+			}
+		}
+		if done {
+			g.clearWatchpoints()
+			return killed, nil
+		}
+	}
+	g.clearWatchpoints()
+	return false, nil
+}
+
+// Splits the byte stream into packets, acknowledging them until no-ack mode starts
+func (g *GDBServer) readPackets(r *bufio.Reader) {
+	defer close(g.packets)
+	noAck := false
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case 0x03:
+			select {
+			case g.interrupt <- struct{}{}:
+			default:
+			}
+			continue
+		case '$':
+		default:
+			// Acks, naks and noise between packets
+			continue
+		}
+
+		data, err := r.ReadString('#')
+		if err != nil {
+			return
+		}
+		data = data[:len(data)-1]
+		checksum := make([]byte, 2)
+		if _, err := io.ReadFull(r, checksum); err != nil {
+			return
+		}
+		sum, err := strconv.ParseUint(string(checksum), 16, 8)
+		if !noAck {
+			if err != nil || uint8(sum) != gdbChecksum(data) {
+				g.conn.Write([]byte("-"))
+				continue
+			}
+			g.conn.Write([]byte("+"))
+			// The acknowledgement of this packet is the last one
+			noAck = data == "QStartNoAckMode"
+		}
+		select {
+		case g.packets <- gdbUnescape(data):
+		case <-g.done:
+			return
+		}
+	}
+}
+
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// Undoes the } escapes of binary data, the byte after } is XORed with $20
+func gdbUnescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+		} else {
+			b.WriteByte(data[i])
+		}
+	}
+	return b.String()
+}
+
+func (g *GDBServer) send(data string) error {
+	var b strings.Builder
+	b.WriteByte('$')
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '$', '#', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(c ^ 0x20)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	fmt.Fprintf(&b, "#%02x", gdbChecksum(b.String()[1:]))
+	if _, err := g.writer.WriteString(b.String()); err != nil {
+		return fmt.Errorf("error writing to GDB: %w", err)
+	}
+	if err := g.writer.Flush(); err != nil {
+		return fmt.Errorf("error writing to GDB: %w", err)
+	}
+	return nil
+}
+
+func gdbReply(s string) *string {
+	return &s
+}
+
+func gdbError(code int) *string {
+	return gdbReply(fmt.Sprintf("E%02x", code))
+}
+
+/*
+Handles one packet, returning the reply, nil for none, and whether the session is
+over and the emulator should be killed. Unsupported packets get the empty reply.
+*/
+func (g *GDBServer) handle(packet string) (reply *string, done bool, killed bool) {
+	cpu := g.runner.cpu
+	if packet == "" {
+		return gdbReply(""), false, false
+	}
+	command, args := packet[0], packet[1:]
+	switch command {
+	case '?':
+		return gdbReply("S05"), false, false
+
+	case 'g':
+		return gdbReply(g.registers()), false, false
+
+	case 'G':
+		data, err := hex.DecodeString(args)
+		if err != nil || len(data) < 7 {
+			return gdbError(1), false, false
+		}
+		cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP = data[0], data[1], data[2], data[3], data[4]
+		cpu.PC = uint16(data[5]) | uint16(data[6])<<8
+		return gdbReply("OK"), false, false
+
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n > 5 {
+			return gdbError(1), false, false
+		}
+		registers := g.registers()
+		if n == 5 {
+			return gdbReply(registers[10:14]), false, false
+		}
+		return gdbReply(registers[n*2 : n*2+2]), false, false
+
+	case 'P':
+		register, value, _ := strings.Cut(args, "=")
+		n, err1 := strconv.ParseUint(register, 16, 8)
+		data, err2 := hex.DecodeString(value)
+		if err1 != nil || err2 != nil || len(data) == 0 || n > 5 {
+			return gdbError(1), false, false
+		}
+		switch n {
+		case 0:
+			cpu.A = data[0]
+		case 1:
+			cpu.X = data[0]
+		case 2:
+			cpu.Y = data[0]
+		case 3:
+			cpu.P = data[0]
+		case 4:
+			cpu.SP = data[0]
+		case 5:
+			cpu.PC = uint16(data[0])
+			if len(data) > 1 {
+				cpu.PC |= uint16(data[1]) << 8
+			}
+		}
+		return gdbReply("OK"), false, false
+
+	case 'm':
+		address, length, ok := gdbAddressLength(args)
+		if !ok {
+			return gdbError(1), false, false
+		}
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = cpu.memory[uint16(address+i)]
+		}
+		return gdbReply(hex.EncodeToString(data)), false, false
+
+	case 'M':
+		target, value, _ := strings.Cut(args, ":")
+		address, length, ok := gdbAddressLength(target)
+		data, err := hex.DecodeString(value)
+		if !ok || err != nil || len(data) != length {
+			return gdbError(1), false, false
+		}
+		for i, b := range data {
+			cpu.memory[uint16(address+i)] = b
+		}
+		return gdbReply("OK"), false, false
+
+	case 'c', 's':
+		if args != "" {
+			address, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return gdbError(1), false, false
+			}
+			cpu.PC = uint16(address)
+		}
+		return gdbReply(g.resume(command == 's')), false, false
+
+	case 'v':
+		switch {
+		case args == "Cont?":
+			return gdbReply("vCont;c;C;s;S"), false, false
+		case strings.HasPrefix(args, "Cont;"):
+			// There is one thread, so the first action applies to it
+			action := strings.TrimPrefix(args, "Cont;")
+			if action == "" {
+				return gdbError(1), false, false
+			}
+			return gdbReply(g.resume(action[0] == 's' || action[0] == 'S')), false, false
+		case strings.HasPrefix(args, "Kill"):
+			return gdbReply("OK"), true, true
+		}
+		return gdbReply(""), false, false
+
+	case 'Z', 'z':
+		return g.setPoint(command == 'Z', args), false, false
+
+	case 'q':
+		return g.query(args), false, false
+
+	case 'Q':
+		if args == "StartNoAckMode" {
+			return gdbReply("OK"), false, false
+		}
+		return gdbReply(""), false, false
+
+	case 'H', 'T':
+		return gdbReply("OK"), false, false
+
+	case 'D':
+		return gdbReply("OK"), true, false
+
+	case 'k':
+		return nil, true, true
+	}
+	return gdbReply(""), false, false
+}
+
+func (g *GDBServer) registers() string {
+	cpu := g.runner.cpu
+	return hex.EncodeToString([]byte{cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, uint8(cpu.PC), uint8(cpu.PC >> 8)})
+}
+
+// Parses "addr,length" in hex
+func gdbAddressLength(s string) (int, int, bool) {
+	a, l, found := strings.Cut(s, ",")
+	address, err1 := strconv.ParseUint(a, 16, 16)
+	length, err2 := strconv.ParseUint(l, 16, 16)
+	if !found || err1 != nil || err2 != nil || length > 0x10000 {
+		return 0, 0, false
+	}
+	return int(address), int(length), true
+}
+
+func (g *GDBServer) query(args string) *string {
+	name, _, _ := strings.Cut(args, ":")
+	switch name {
+	case "Supported":
+		return gdbReply("PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+;vContSupported+")
+	case "Attached":
+		return gdbReply("1")
+	case "C":
+		return gdbReply("QC1")
+	case "fThreadInfo":
+		return gdbReply("m1")
+	case "sThreadInfo":
+		return gdbReply("l")
+	case "Symbol":
+		return gdbReply("OK")
+	case "Xfer":
+		// qXfer:features:read:target.xml:offset,length
+		parts := strings.Split(args, ":")
+		if len(parts) != 5 || parts[1] != "features" || parts[2] != "read" || parts[3] != "target.xml" {
+			return gdbReply("")
+		}
+		offset, length, ok := gdbAddressLength(parts[4])
+		if !ok {
+			return gdbError(1)
+		}
+		if offset >= len(gdbTargetXML) {
+			return gdbReply("l")
+		}
+		end := min(offset+length, len(gdbTargetXML))
+		if end == len(gdbTargetXML) {
+			return gdbReply("l" + gdbTargetXML[offset:end])
+		}
+		return gdbReply("m" + gdbTargetXML[offset:end])
+	}
+	return gdbReply("")
+}
+
+/*
+Sets or clears a breakpoint (types 0 and 1) or a write, read or access watchpoint
+(types 2, 3 and 4), "type,address,kind" where kind is the watched length
+*/
+func (g *GDBServer) setPoint(set bool, args string) *string {
+	kind, rest, _ := strings.Cut(args, ",")
+	rest, _, _ = strings.Cut(rest, ";")
+	address, length, ok := gdbAddressLength(rest)
+	if !ok {
+		return gdbError(1)
+	}
+	pointType, err := strconv.Atoi(kind)
+	if err != nil || pointType < 0 || pointType > 4 {
+		return gdbReply("")
+	}
+	at := uint16(address)
+
+	if pointType <= 1 {
+		if set {
+			g.breakpoints[gdbBreakpoint{pointType, at}] = true
+		} else {
+			delete(g.breakpoints, gdbBreakpoint{pointType, at})
+		}
+		return gdbReply("OK")
+	}
+
+	w := gdbWatchpoint{kind: pointType, address: at, length: max(length, 1)}
+	if hooks, ok := g.watchpoints[w]; ok {
+		for _, id := range hooks {
+			g.runner.RemoveHook(id)
+		}
+		delete(g.watchpoints, w)
+	}
+	if !set {
+		return gdbReply("OK")
+	}
+	var hooks []HookID
+	addresses := AddressRange{at, uint16(min(address+w.length-1, 0xFFFF))}
+	if pointType == 2 || pointType == 4 {
+		reason := map[int]string{2: "watch", 4: "awatch"}[pointType]
+		hooks = append(hooks, g.runner.OnWrite(addresses, func(address uint16, value uint8) {
+			g.hit(reason, address)
+		}))
+	}
+	if pointType == 3 || pointType == 4 {
+		reason := map[int]string{3: "rwatch", 4: "awatch"}[pointType]
+		hooks = append(hooks, g.runner.OnRead(addresses, func(address uint16, value uint8) uint8 {
+			g.hit(reason, address)
+			return value
+		}))
+	}
+	g.watchpoints[w] = hooks
+	return gdbReply("OK")
+}
+
+// Records the first watchpoint an instruction triggers
+func (g *GDBServer) hit(reason string, address uint16) {
+	if g.stop == nil {
+		g.stop = &gdbStop{reason: reason, address: address}
+	}
+}
+
+func (g *GDBServer) clearWatchpoints() {
+	for w, hooks := range g.watchpoints {
+		for _, id := range hooks {
+			g.runner.RemoveHook(id)
+		}
+		delete(g.watchpoints, w)
+	}
+}
+
+/*
+Runs one instruction, or until a breakpoint, watchpoint or interrupt when continuing,
+and returns the stop reply. The instruction at the current PC is always run, so a
+continue from a breakpoint does not stop on it again. A BRK ends the program like it
+does for the runner, and is reported as an exit. A panic, such as an opcode the CPU
+does not know, is sent to GDB's console and reported as an illegal instruction.
+*/
+func (g *GDBServer) resume(step bool) (reply string) {
+	cpu := g.runner.cpu
+	g.stop = nil
+	// Drop an interrupt sent while the target was already stopped
+	select {
+	case <-g.interrupt:
+	default:
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			message := strings.TrimSpace(fmt.Sprint(r))
+			g.send("O" + hex.EncodeToString([]byte(message+"\n")))
+			reply = "T04thread:1;"
+		}
+	}()
+
+	for n := 1; ; n++ {
+		if g.runner.Step() == 0x00 {
+			return "W00"
+		}
+		switch {
+		case g.stop != nil:
+		case step:
+			g.stop = &gdbStop{}
+		case g.breakpoints[gdbBreakpoint{0, cpu.PC}]:
+			g.stop = &gdbStop{reason: "swbreak"}
+		case g.breakpoints[gdbBreakpoint{1, cpu.PC}]:
+			g.stop = &gdbStop{reason: "hwbreak"}
+		case n%gdbInterruptInterval == 0:
+			select {
+			case <-g.interrupt:
+				return "T02thread:1;"
+			default:
+			}
+		}
+		if g.stop != nil {
+			break
+		}
+	}
+
+	switch g.stop.reason {
+	case "":
+		return "T05thread:1;"
+	case "swbreak", "hwbreak":
+		return fmt.Sprintf("T05thread:1;%s:;", g.stop.reason)
+	}
+	return fmt.Sprintf("T05thread:1;%s:%04x;", g.stop.reason, g.stop.address)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The debugger end of a GDB session with a server running program
+type gdbClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	served chan bool
+}
+
+func newGDBClient(t *testing.T, program ...uint8) *gdbClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGDBServer(newTestRunner(&NROM{prg: testPRG(program...)}), listener)
+	t.Cleanup(func() { server.Close() })
+
+	served := make(chan bool, 1)
+	go func() {
+		killed, err := server.Serve()
+		if err != nil {
+			t.Error(err)
+		}
+		served <- killed
+	}()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &gdbClient{t: t, conn: conn, reader: bufio.NewReader(conn), served: served}
+}
+
+func (c *gdbClient) send(packet string) {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, gdbChecksum(packet))
+	if ack, err := c.reader.ReadByte(); err != nil || ack != '+' {
+		c.t.Fatalf("packet %q was acknowledged with %q, %v", packet, ack, err)
+	}
+}
+
+// Reads the next packet from the server and acknowledges it
+func (c *gdbClient) receive() string {
+	c.t.Helper()
+	if _, err := c.reader.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.reader.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	checksum := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, checksum); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.Write([]byte("+"))
+	return gdbUnescape(data[:len(data)-1])
+}
+
+// Sends packet and checks the reply
+func (c *gdbClient) expect(packet, want string) {
+	c.t.Helper()
+	c.send(packet)
+	if reply := c.receive(); reply != want {
+		c.t.Errorf("%s replied %q, want %q", packet, reply, want)
+	}
+}
+
+func TestGDBServer(t *testing.T) {
+	// LDA #5, STA $10, then INC $10 in a loop
+	c := newGDBClient(t, 0xA9, 0x05, 0x85, 0x10, 0xE6, 0x10, 0x4C, 0x04, 0x80)
+
+	c.expect("?", "S05")
+	c.expect("g", "00000024fd0080")
+	c.expect("M300,2:abcd", "OK")
+	c.expect("m300,2", "abcd")
+
+	c.expect("Z0,8004,1", "OK")
+	c.expect("c", "T05thread:1;swbreak:;")
+	c.expect("m10,1", "05")
+	// Clearing a hardware breakpoint leaves the software one set
+	c.expect("z1,8004,1", "OK")
+	c.expect("c", "T05thread:1;swbreak:;")
+	c.expect("m10,1", "06")
+	c.expect("z0,8004,1", "OK")
+	c.expect("Z-1,8004,1", "")
+	c.expect("vCont;", "E01")
+
+	c.expect("Z2,10,1", "OK")
+	c.expect("c", "T05thread:1;watch:0010;")
+	c.expect("m10,1", "07")
+
+	// Clearing a watchpoint of another length leaves this one set
+	c.expect("Z2,10,2", "OK")
+	c.expect("z2,10,1", "OK")
+	c.expect("c", "T05thread:1;watch:0010;")
+	c.expect("m10,1", "08")
+	c.expect("z2,10,2", "OK")
+
+	// Nothing stops the loop now but an interrupt
+	c.send("c")
+	interrupted := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-interrupted:
+				return
+			case <-time.After(10 * time.Millisecond):
+				c.conn.Write([]byte{0x03})
+			}
+		}
+	}()
+	reply := c.receive()
+	close(interrupted)
+	if reply != "T02thread:1;" {
+		t.Errorf("interrupt replied %q, want T02thread:1;", reply)
+	}
+
+	c.expect("P5=0480", "OK")
+	c.expect("s", "T05thread:1;")
+	c.expect("p5", "0680")
+
+	c.send("k")
+	if killed := <-c.served; !killed {
+		t.Error("k did not kill the emulator")
+	}
+}
+
+func TestGDBServerStops(t *testing.T) {
+	t.Run("brk", func(t *testing.T) {
+		c := newGDBClient(t, 0xEA, 0x00)
+		c.expect("c", "W00")
+	})
+
+	t.Run("unhandled opcode", func(t *testing.T) {
+		c := newGDBClient(t, 0xEA, 0x02)
+		c.send("c")
+		output, err := hex.DecodeString(strings.TrimPrefix(c.receive(), "O"))
+		if err != nil || !strings.Contains(string(output), "Unhandled opcode: 02") {
+			t.Errorf("console output %q, %v", output, err)
+		}
+		if reply := c.receive(); reply != "T04thread:1;" {
+			t.Errorf("c replied %q, want T04thread:1;", reply)
+		}
+		c.expect("p5", "0180")
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+GoldenCase runs a ROM, optionally with an input movie, up to the start of Frame and
+compares hashes of the RAM and CPU registers and of the framebuffer there, and of the
+audio up to it, with the stored ones. A hash missing from the case is not compared.
+Until there is a PPU every frame is blank, so updating a manifest leaves the video
+hash out rather than recording one that checks nothing. Paths are relative to the
+manifest.
+*/
+type GoldenCase struct {
+	Name  string `json:"name"`
+	ROM   string `json:"rom"`
+	Movie string `json:"movie,omitempty"`
+	Patch string `json:"patch,omitempty"`
+	BIOS  string `json:"bios,omitempty"`
+	Frame int    `json:"frame"`
+	// ntsc, pal or dendy, the ROM header decides when empty
+	Region string `json:"region,omitempty"`
+	State  string `json:"state,omitempty"`
+	Video  string `json:"video,omitempty"`
+	Audio  string `json:"audio,omitempty"`
+}
+
+// Sample rate of the audio that is hashed
+const goldenAudioRate = 44100
+
+type goldenManifest struct {
+	Cases []GoldenCase `json:"cases"`
+}
+
+func readGoldenManifest(filename string) (*goldenManifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading golden manifest: %w", err)
+	}
+	var manifest goldenManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing golden manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func (m *goldenManifest) writeFile(filename string) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing golden manifest: %w", err)
+	}
+	return nil
+}
+
+// SHA-1 of the raw pixel values, so emphasis bits are covered as well as colour
+func (fb *Framebuffer) Hash() string {
+	buf := make([]byte, len(fb.Pixels)*2)
+	for i, pixel := range fb.Pixels {
+		binary.LittleEndian.PutUint16(buf[i*2:], pixel)
+	}
+	sum := sha1.Sum(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+SHA-1 of the CPU registers, the internal RAM and the work RAM at $6000-$7FFF, which
+is what a test ROM leaves its results in
+*/
+func (r *Runner) stateHash() string {
+	cpu := r.cpu
+	h := sha1.New()
+	h.Write([]byte{cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP, uint8(cpu.PC >> 8), uint8(cpu.PC)})
+	h.Write(cpu.memory[:0x0800])
+	h.Write(cpu.memory[0x6000:0x8000])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+Runs the case from power-on and returns the runner stopped at the start of its frame,
+along with the hash of the WAV recorded on the way
+*/
+func (c *GoldenCase) run(dir string, db *ROMDatabase) (*Runner, string, error) {
+	region, err := regionByName(c.Region)
+	if err != nil {
+		return nil, "", err
+	}
+	patch := c.Patch
+	if patch != "" && patch != "off" {
+		patch = filepath.Join(dir, patch)
+	}
+	bios := c.BIOS
+	if bios != "" {
+		bios = filepath.Join(dir, bios)
+	}
+	runner, cart, err := loadROM(filepath.Join(dir, c.ROM), patch, bios, region, db)
+	if err != nil {
+		return nil, "", err
+	}
+	audio := sha1.New()
+	if runner.Audio, err = newAudioRecorder(goldenAudioRate, runner.Region, []io.Writer{audio}); err != nil {
+		return nil, "", err
+	}
+	if c.Movie != "" {
+		movie, err := LoadMovieFile(filepath.Join(dir, c.Movie))
+		if err == nil {
+			err = movie.CheckROM(cart)
+		}
+		if err == nil {
+			err = runner.StartPlayback(movie)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// A ROM that stops on BRK keeps its last frame, which is what gets compared
+	for runner.Frame < c.Frame && runner.RunFrame() {
+	}
+	if runner.Movie != nil && runner.Desync >= 0 {
+		return nil, "", fmt.Errorf("movie desynced at frame %d", runner.Desync)
+	}
+	if err := runner.Audio.Close(); err != nil {
+		return nil, "", err
+	}
+	return runner, hex.EncodeToString(audio.Sum(nil)), nil
+}
+
+/*
+Writes the frame that was produced and an image where every pixel that differs from
+the reference frame is red, over a dimmed copy of the frame. Without a reference
+only the produced frame is written.
+*/
+func writeGoldenDiff(actual *image.RGBA, referencePath string, diffDir string, name string) error {
+	if err := os.MkdirAll(diffDir, 0755); err != nil {
+		return fmt.Errorf("error creating diff directory: %w", err)
+	}
+	if err := writeImageFile(filepath.Join(diffDir, name+".actual.png"), actual); err != nil {
+		return err
+	}
+
+	file, err := os.Open(referencePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	reference, err := png.Decode(file)
+	if err != nil {
+		return fmt.Errorf("error reading reference frame: %w", err)
+	}
+
+	bounds := actual.Bounds()
+	diff := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			a := actual.RGBAAt(x, y)
+			if color.RGBAModel.Convert(reference.At(x, y)) != a {
+				diff.SetRGBA(x, y, color.RGBA{0xFF, 0x00, 0x00, 0xFF})
+			} else {
+				diff.SetRGBA(x, y, color.RGBA{a.R / 4, a.G / 4, a.B / 4, 0xFF})
+			}
+		}
+	}
+	return writeImageFile(filepath.Join(diffDir, name+".diff.png"), diff)
+}
+
+// Hashes and the last frame of a case that ran
+type goldenResult struct {
+	state string
+	video string
+	audio string
+	image *image.RGBA
+}
+
+// Runs the case, a panic such as an unhandled opcode is returned as an error
+func (c *GoldenCase) result(dir string, db *ROMDatabase) (result goldenResult, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic before frame %d: %v", c.Frame, p)
+		}
+	}()
+	runner, audio, err := c.run(dir, db)
+	if err != nil {
+		return result, err
+	}
+	return goldenResult{
+		state: runner.stateHash(),
+		video: runner.Framebuffer.Hash(),
+		audio: audio,
+		image: runner.Framebuffer.Image(defaultPalette, 1),
+	}, nil
+}
+
+/*
+Compares the result with the stored hashes and returns what differs. A mismatching
+frame is written to diffDir along with its difference to the reference frame.
+*/
+func (c *GoldenCase) compare(result goldenResult, dir string, diffDir string) ([]string, error) {
+	var failures []string
+	if c.State != "" && result.state != c.State {
+		failures = append(failures, fmt.Sprintf("state hash %s, expected %s", result.state, c.State))
+	}
+	if c.Video != "" && result.video != c.Video {
+		failures = append(failures, fmt.Sprintf("frame %d hash %s, expected %s", c.Frame, result.video, c.Video))
+		if err := writeGoldenDiff(result.image, filepath.Join(dir, c.Name+".png"), diffDir, c.Name); err != nil {
+			return failures, err
+		}
+	}
+	if c.Audio != "" && result.audio != c.Audio {
+		failures = append(failures, fmt.Sprintf("audio hash %s, expected %s", result.audio, c.Audio))
+	}
+	return failures, nil
+}
+
+/*
+Runs every case in the manifest and compares the hashes, for -golden. Mismatching
+frames are written to diffDir. With update set the state and audio hashes are
+replaced instead.
+*/
+func CheckGolden(manifestPath string, diffDir string, update bool) error {
+	manifest, err := readGoldenManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(manifestPath)
+	db, err := LoadROMDatabase("")
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i := range manifest.Cases {
+		c := &manifest.Cases[i]
+		result, err := c.result(dir, db)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.Name, err)
+			failed++
+			continue
+		}
+
+		if update {
+			c.State, c.Audio = result.state, result.audio
+			fmt.Printf("updated %s\n", c.Name)
+			continue
+		}
+		failures, err := c.compare(result, dir, diffDir)
+		if err != nil {
+			return err
+		}
+		if len(failures) > 0 {
+			fmt.Printf("FAIL %s: %s\n", c.Name, strings.Join(failures, ", "))
+			failed++
+		} else {
+			fmt.Printf("ok   %s\n", c.Name)
+		}
+	}
+
+	if update {
+		return manifest.writeFile(manifestPath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d golden cases failed", failed, len(manifest.Cases))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+/*
+Runs a golden case as part of a test, dir is the directory of its manifest. Failures
+are reported on t and mismatching frames are written to diffDir.
+*/
+func runGoldenCase(t testing.TB, dir string, c GoldenCase, diffDir string) {
+	t.Helper()
+	db, err := LoadROMDatabase("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.result(dir, db)
+	if err != nil {
+		t.Fatalf("%s: %v", c.Name, err)
+	}
+	failures, err := c.compare(result, dir, diffDir)
+	for _, failure := range failures {
+		t.Errorf("%s: %s", c.Name, failure)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Runs every case of a manifest as a subtest of t
+func runGoldenManifest(t *testing.T, manifestPath string, diffDir string) {
+	t.Helper()
+	manifest, err := readGoldenManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range manifest.Cases {
+		t.Run(c.Name, func(t *testing.T) {
+			runGoldenCase(t, filepath.Dir(manifestPath), c, diffDir)
+		})
+	}
+}
+
+func TestGolden(t *testing.T) {
+	runGoldenManifest(t, filepath.Join("testdata", "golden", "manifest.json"), filepath.Join(os.TempDir(), "nes-golden-diff"))
+}
+
+// Collects the failures of a golden case instead of failing the test running it
+type goldenRecorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *goldenRecorder) Helper() {}
+
+func (r *goldenRecorder) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *goldenRecorder) Fatalf(format string, args ...any) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func (r *goldenRecorder) Fatal(args ...any) {
+	r.failures = append(r.failures, fmt.Sprint(args...))
+	runtime.Goexit()
+}
+
+func recordGoldenCase(dir string, c GoldenCase, diffDir string) []string {
+	recorder := &goldenRecorder{}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		runGoldenCase(recorder, dir, c, diffDir)
+	}()
+	<-done
+	return recorder.failures
+}
+
+func TestGoldenFailures(t *testing.T) {
+	manifest, err := readGoldenManifest(filepath.Join("testdata", "golden", "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := manifest.Cases[0]
+	otherInput := counter
+	otherInput.Movie = ""
+
+	tests := []struct {
+		name string
+		dir  string
+		c    GoldenCase
+		want string
+	}{
+		// nestest reaches an opcode the CPU does not have within its first frame
+		{"panic", ".", GoldenCase{Name: "nestest", ROM: "nestest.nes", Frame: 1}, "Unhandled opcode"},
+		{"state", filepath.Join("testdata", "golden"), otherInput, "state hash"},
+		{"missing rom", ".", GoldenCase{Name: "missing", ROM: "missing.nes", Frame: 1}, "missing.nes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failures := recordGoldenCase(test.dir, test.c, t.TempDir())
+			if len(failures) == 0 || !strings.Contains(strings.Join(failures, "\n"), test.want) {
+				t.Errorf("failures %q do not mention %q", failures, test.want)
+			}
+		})
+	}
+}
+
+func TestGoldenVideoDiff(t *testing.T) {
+	// The counter case in a directory of its own, with a reference frame that has one
+	// pixel changed and a video hash that cannot match
+	dir := t.TempDir()
+	manifest, err := readGoldenManifest(filepath.Join("testdata", "golden", "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := manifest.Cases[0]
+	for _, name := range []string{c.ROM, c.Movie} {
+		data, err := os.ReadFile(filepath.Join("testdata", "golden", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reference := (&Framebuffer{}).Image(defaultPalette, 1)
+	reference.SetRGBA(3, 4, color.RGBA{0x12, 0x34, 0x56, 0xFF})
+	if err := writeImageFile(filepath.Join(dir, c.Name+".png"), reference); err != nil {
+		t.Fatal(err)
+	}
+	c.Video = strings.Repeat("0", 40)
+
+	diffDir := filepath.Join(t.TempDir(), "diff")
+	failures := recordGoldenCase(dir, c, diffDir)
+	if len(failures) != 1 || !strings.Contains(failures[0], "frame 30 hash") {
+		t.Fatalf("failures %q, want only the frame hash", failures)
+	}
+
+	readPNG := func(name string) image.Image {
+		t.Helper()
+		file, err := os.Open(filepath.Join(diffDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		img, err := png.Decode(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	if bounds := readPNG(c.Name + ".actual.png").Bounds(); bounds.Dx() != screenWidth || bounds.Dy() != screenHeight {
+		t.Errorf("actual frame is %v", bounds)
+	}
+	diff := readPNG(c.Name + ".diff.png")
+	red := color.RGBA{0xFF, 0x00, 0x00, 0xFF}
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			if got := color.RGBAModel.Convert(diff.At(x, y)); (got == red) != (x == 3 && y == 4) {
+				t.Fatalf("diff pixel (%d, %d) is %v", x, y, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// AddressRange is an inclusive range of CPU addresses
+type AddressRange struct {
+	Start uint16
+	End   uint16
+}
+
+func (a AddressRange) Contains(address uint16) bool {
+	return address >= a.Start && address <= a.End
+}
+
+// Read hooks return the value the CPU sees, normally the value they were given
+type ReadHook func(address uint16, value uint8) uint8
+
+// Write hooks run before the write reaches memory or a register
+type WriteHook func(address uint16, value uint8)
+
+// Execute hooks run before the instruction at address is fetched
+type ExecuteHook func(address uint16)
+
+// Identifies a hook for RemoveHook
+type HookID int
+
+type hook struct {
+	id        HookID
+	addresses AddressRange
+	read      ReadHook
+	write     WriteHook
+	execute   ExecuteHook
+}
+
+/*
+cpuHooks holds the hooks of each kind with a count of those touching every 256 byte
+page, so an access to a page without hooks costs one array lookup. The CPU only has
+one while hooks are installed, without any the bus checks a nil pointer.
+*/
+type cpuHooks struct {
+	reads    []*hook
+	writes   []*hook
+	executes []*hook
+
+	readPages    [256]uint16
+	writePages   [256]uint16
+	executePages [256]uint16
+}
+
+func (h *cpuHooks) read(address uint16, value uint8) uint8 {
+	if h.readPages[address>>8] == 0 {
+		return value
+	}
+	for _, hook := range h.reads {
+		if hook.addresses.Contains(address) {
+			value = hook.read(address, value)
+		}
+	}
+	return value
+}
+
+func (h *cpuHooks) write(address uint16, value uint8) {
+	if h.writePages[address>>8] == 0 {
+		return
+	}
+	for _, hook := range h.writes {
+		if hook.addresses.Contains(address) {
+			hook.write(address, value)
+		}
+	}
+}
+
+func (h *cpuHooks) execute(address uint16) {
+	if h.executePages[address>>8] == 0 {
+		return
+	}
+	for _, hook := range h.executes {
+		if hook.addresses.Contains(address) {
+			hook.execute(address)
+		}
+	}
+}
+
+// Adds or removes a hook's pages from the counts
+func countPages(pages *[256]uint16, addresses AddressRange, delta int) {
+	for page := int(addresses.Start >> 8); page <= int(addresses.End>>8); page++ {
+		pages[page] = uint16(int(pages[page]) + delta)
+	}
+}
+
+func (cpu *CPU) addHook(h *hook) HookID {
+	if cpu.hooks == nil {
+		cpu.hooks = &cpuHooks{}
+	}
+	hooks := cpu.hooks
+	// IDs keep counting across hooks being removed, so a stale one never matches
+	cpu.lastHookID++
+	h.id = cpu.lastHookID
+	// The lists are copied rather than appended to in place, so a hook added by a
+	// running hook does not disturb the loop calling it
+	switch {
+	case h.read != nil:
+		hooks.reads = append(hooks.reads[:len(hooks.reads):len(hooks.reads)], h)
+		countPages(&hooks.readPages, h.addresses, 1)
+	case h.write != nil:
+		hooks.writes = append(hooks.writes[:len(hooks.writes):len(hooks.writes)], h)
+		countPages(&hooks.writePages, h.addresses, 1)
+	case h.execute != nil:
+		hooks.executes = append(hooks.executes[:len(hooks.executes):len(hooks.executes)], h)
+		countPages(&hooks.executePages, h.addresses, 1)
+	}
+	return h.id
+}
+
+// Returns the list without the hook, as a new slice, and the hook if it was there
+func withoutHook(list []*hook, id HookID) ([]*hook, *hook) {
+	for i, h := range list {
+		if h.id == id {
+			rest := make([]*hook, 0, len(list)-1)
+			rest = append(rest, list[:i]...)
+			return append(rest, list[i+1:]...), h
+		}
+	}
+	return list, nil
+}
+
+func (cpu *CPU) removeHook(id HookID) bool {
+	hooks := cpu.hooks
+	if hooks == nil {
+		return false
+	}
+	var removed *hook
+	if hooks.reads, removed = withoutHook(hooks.reads, id); removed != nil {
+		countPages(&hooks.readPages, removed.addresses, -1)
+	} else if hooks.writes, removed = withoutHook(hooks.writes, id); removed != nil {
+		countPages(&hooks.writePages, removed.addresses, -1)
+	} else if hooks.executes, removed = withoutHook(hooks.executes, id); removed != nil {
+		countPages(&hooks.executePages, removed.addresses, -1)
+	} else {
+		return false
+	}
+	if len(hooks.reads)+len(hooks.writes)+len(hooks.executes) == 0 {
+		cpu.hooks = nil
+	}
+	return true
+}
+
+/*
+Calls fn for every CPU read in addresses, including those of the stack and of pointers.
+Opcode and operand fetches are not reads, use OnExecute for those. The value fn returns
+is what the CPU gets, so a hook can override memory; hooks added later see the values
+of earlier ones.
+*/
+func (r *Runner) OnRead(addresses AddressRange, fn ReadHook) HookID {
+	return r.cpu.addHook(&hook{addresses: addresses, read: fn})
+}
+
+// Calls fn for every CPU write in addresses, before the write takes effect
+func (r *Runner) OnWrite(addresses AddressRange, fn WriteHook) HookID {
+	return r.cpu.addHook(&hook{addresses: addresses, write: fn})
+}
+
+// Calls fn before each instruction whose first byte is in addresses
+func (r *Runner) OnExecute(addresses AddressRange, fn ExecuteHook) HookID {
+	return r.cpu.addHook(&hook{addresses: addresses, execute: fn})
+}
+
+// Removes a hook added by OnRead, OnWrite or OnExecute, false if there is none with the ID
+func (r *Runner) RemoveHook(id HookID) bool {
+	return r.cpu.removeHook(id)
+}
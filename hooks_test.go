@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadHookOverridesValue(t *testing.T) {
+	// LDA $0300, STA $10, LDY #1, LDA ($20),Y with ($20) pointing at $02FF, STA $11
+	r := newTestRunner(&NROM{prg: testPRG(0xAD, 0x00, 0x03, 0x85, 0x10, 0xA0, 0x01, 0xB1, 0x20, 0x85, 0x11)})
+	r.cpu.memory[0x0300] = 0x11
+	r.cpu.memory[0x20], r.cpu.memory[0x21] = 0xFF, 0x02
+
+	var reads []uint16
+	r.OnRead(AddressRange{0x0300, 0x0300}, func(address uint16, value uint8) uint8 {
+		reads = append(reads, address)
+		return value + 0x31
+	})
+	runTo(t, r, 0x800B, 5)
+
+	if r.cpu.memory[0x10] != 0x42 || r.cpu.memory[0x11] != 0x42 {
+		t.Errorf("LDA abs loaded $%02X and LDA (zp),Y $%02X, want $42", r.cpu.memory[0x10], r.cpu.memory[0x11])
+	}
+	if !reflect.DeepEqual(reads, []uint16{0x0300, 0x0300}) {
+		t.Errorf("hook saw reads of %04X", reads)
+	}
+	if r.cpu.memory[0x0300] != 0x11 {
+		t.Error("the hook changed memory")
+	}
+}
+
+func TestHookRanges(t *testing.T) {
+	// STA $0F, STA $10, STA $11
+	r := newTestRunner(&NROM{prg: testPRG(0x85, 0x0F, 0x85, 0x10, 0x85, 0x11)})
+	var writes, executes []uint16
+	r.OnWrite(AddressRange{0x10, 0x10}, func(address uint16, value uint8) {
+		writes = append(writes, address)
+	})
+	r.OnExecute(AddressRange{0x8002, 0x8003}, func(address uint16) {
+		executes = append(executes, address)
+	})
+	runTo(t, r, 0x8006, 3)
+
+	if !reflect.DeepEqual(writes, []uint16{0x10}) {
+		t.Errorf("write hook saw %04X, want 0010", writes)
+	}
+	if !reflect.DeepEqual(executes, []uint16{0x8002}) {
+		t.Errorf("execute hook saw %04X, want 8002", executes)
+	}
+}
+
+func TestRemoveHook(t *testing.T) {
+	r := newTestRunner(&NROM{prg: testPRG()})
+	read := r.OnRead(AddressRange{0x0000, 0x01FF}, func(address uint16, value uint8) uint8 { return value })
+	write := r.OnWrite(AddressRange{0x0100, 0x0100}, func(address uint16, value uint8) {})
+	hooks := r.cpu.hooks
+	if hooks.readPages[0] != 1 || hooks.readPages[1] != 1 || hooks.writePages[1] != 1 {
+		t.Fatalf("page counts %d %d %d, want 1", hooks.readPages[0], hooks.readPages[1], hooks.writePages[1])
+	}
+
+	if !r.RemoveHook(read) {
+		t.Fatal("removing the read hook failed")
+	}
+	if hooks.readPages[0] != 0 || hooks.readPages[1] != 0 || r.cpu.hooks == nil {
+		t.Errorf("after removing the read hook: read pages %d %d, hooks %v", hooks.readPages[0], hooks.readPages[1], r.cpu.hooks)
+	}
+	if !r.RemoveHook(write) {
+		t.Fatal("removing the write hook failed")
+	}
+	// Without hooks the bus is back to checking a nil pointer
+	if r.cpu.hooks != nil {
+		t.Error("hooks remain after removing the last one")
+	}
+
+	if r.RemoveHook(write) {
+		t.Error("removing a hook twice succeeded")
+	}
+	r.OnExecute(AddressRange{0x8000, 0x8000}, func(uint16) {})
+	if r.RemoveHook(HookID(1000)) || r.RemoveHook(read) {
+		t.Error("removing an unknown hook succeeded")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+// Standard controller buttons, in the order they are shifted out of $4016/$4017
+const (
+	ButtonA = 1 << iota
+	ButtonB
+	ButtonSelect
+	ButtonStart
+	ButtonUp
+	ButtonDown
+	ButtonLeft
+	ButtonRight
+)
+
+// Controller is a standard joypad, Buttons is latched into the shift register by the strobe
+type Controller struct {
+	Buttons uint8
+
+	strobe bool
+	shift  uint8
+}
+
+func (c *Controller) write(value uint8) {
+	c.strobe = getBit(value, 0)
+	if c.strobe {
+		c.shift = c.Buttons
+	}
+}
+
+// After all eight buttons are read the register returns 1s, bit 6 is open bus
+func (c *Controller) read() uint8 {
+	if c.strobe {
+		return 0x40 | c.Buttons&1
+	}
+	bit := c.shift & 1
+	c.shift = c.shift>>1 | 0x80
+	return 0x40 | bit
+}
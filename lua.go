@@ -0,0 +1,500 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+A small interpreter for the subset of Lua that emulator scripts use, so scripting
+needs no cgo or outside packages. It has the Lua 5.1 statements, closures, varargs,
+multiple returns, tables and the 5.3 bitwise operators, but no metatables, goto,
+coroutines or integer subtype: every number is a float64.
+
+Values are nil, bool, float64, string, *luaTable, *luaClosure and *luaGoFunction.
+*/
+type luaValue = any
+
+// A Go function callable from Lua, errors are raised with luaState.errorf
+type luaGoFunction struct {
+	name string
+	fn   func(l *luaState, args []luaValue) []luaValue
+}
+
+// A runtime error, with the script position it happened at
+type luaError struct {
+	message string
+	// Value passed to error() when it was not a string
+	value luaValue
+}
+
+func (e *luaError) Error() string {
+	return e.message
+}
+
+/*
+luaTable keeps the keys 1..n in a slice and the rest in a map. Map keys are also kept
+in insertion order so pairs always visits them the same way.
+*/
+type luaTable struct {
+	array []luaValue
+	hash  map[luaValue]luaValue
+	order []luaValue
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{}
+}
+
+// Converts float keys with an integer value so 1 and 1.0 are the same key
+func luaArrayIndex(key luaValue) (int, bool) {
+	f, ok := key.(float64)
+	if !ok || f != math.Trunc(f) || f < 1 || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func (t *luaTable) get(key luaValue) luaValue {
+	if i, ok := luaArrayIndex(key); ok && i <= len(t.array) {
+		return t.array[i-1]
+	}
+	if t.hash == nil {
+		return nil
+	}
+	return t.hash[key]
+}
+
+func (t *luaTable) getString(key string) luaValue {
+	if t.hash == nil {
+		return nil
+	}
+	return t.hash[key]
+}
+
+func (t *luaTable) set(key luaValue, value luaValue) {
+	if i, ok := luaArrayIndex(key); ok {
+		switch {
+		case i <= len(t.array):
+			t.array[i-1] = value
+			if i == len(t.array) && value == nil {
+				t.trimArray()
+			}
+			return
+		case i == len(t.array)+1 && value != nil:
+			t.array = append(t.array, value)
+			t.migrate()
+			return
+		}
+	}
+	if t.hash == nil {
+		if value == nil {
+			return
+		}
+		t.hash = make(map[luaValue]luaValue)
+	}
+	if value == nil {
+		delete(t.hash, key)
+		return
+	}
+	if _, ok := t.hash[key]; !ok {
+		t.order = append(t.order, key)
+		if len(t.order) > 2*len(t.hash)+8 {
+			t.compact()
+		}
+	}
+	t.hash[key] = value
+}
+
+// Moves keys following the array part out of the map once the array reaches them
+func (t *luaTable) migrate() {
+	for t.hash != nil {
+		next := float64(len(t.array) + 1)
+		value, ok := t.hash[next]
+		if !ok {
+			return
+		}
+		delete(t.hash, next)
+		t.array = append(t.array, value)
+	}
+}
+
+func (t *luaTable) trimArray() {
+	for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+		t.array = t.array[:len(t.array)-1]
+	}
+}
+
+// Drops deleted keys from the insertion order
+func (t *luaTable) compact() {
+	order := t.order[:0]
+	for _, key := range t.order {
+		if _, ok := t.hash[key]; ok {
+			order = append(order, key)
+		}
+	}
+	t.order = order
+}
+
+func (t *luaTable) length() int {
+	return len(t.array)
+}
+
+// The keys of the table in iteration order, array part first
+func (t *luaTable) keys() []luaValue {
+	keys := make([]luaValue, 0, len(t.array)+len(t.hash))
+	for i, value := range t.array {
+		if value != nil {
+			keys = append(keys, float64(i+1))
+		}
+	}
+	for _, key := range t.order {
+		if _, ok := t.hash[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func luaTruthy(v luaValue) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+func luaFormatNumber(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	case f == math.Trunc(f) && math.Abs(f) < 1e15:
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 14, 64)
+}
+
+func luaToString(v luaValue) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return luaFormatNumber(v)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%s: %p", luaTypeName(v), v)
+}
+
+// Numbers as Lua converts them, strings holding a number are accepted
+func luaToNumber(v luaValue) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return luaParseNumber(strings.TrimSpace(v))
+	}
+	return 0, false
+}
+
+func luaParseNumber(s string) (float64, bool) {
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative, s = true, s[1:]
+	}
+	var f float64
+	if len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		f = float64(n)
+	} else {
+		var err error
+		if f, err = strconv.ParseFloat(s, 64); err != nil || s == "" || strings.ContainsAny(s, "xXnN_") {
+			return 0, false
+		}
+	}
+	if negative {
+		f = -f
+	}
+	return f, true
+}
+
+// Lexer
+
+type luaTokenKind int
+
+const (
+	luaEOF luaTokenKind = iota
+	luaName
+	luaNumber
+	luaString
+	// Keywords and symbols, the text says which
+	luaSymbol
+)
+
+type luaToken struct {
+	kind luaTokenKind
+	text string
+	num  float64
+	line int
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// Symbols longest first so the lexer takes the longest match
+var luaSymbols = func() []string {
+	symbols := []string{
+		"...", "..", "==", "~=", "<=", ">=", "<<", ">>", "//", "::",
+		"+", "-", "*", "/", "%", "^", "#", "&", "~", "|", "<", ">", "=",
+		"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return len(symbols[i]) > len(symbols[j]) })
+	return symbols
+}()
+
+type luaLexer struct {
+	chunk  string
+	source string
+	pos    int
+	line   int
+}
+
+func (lx *luaLexer) errorf(format string, args ...any) {
+	panic(&luaError{message: fmt.Sprintf("%s:%d: %s", lx.chunk, lx.line, fmt.Sprintf(format, args...))})
+}
+
+// Skips whitespace and comments
+func (lx *luaLexer) skip() {
+	for lx.pos < len(lx.source) {
+		c := lx.source[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			lx.pos++
+		case strings.HasPrefix(lx.source[lx.pos:], "--"):
+			lx.pos += 2
+			if level := lx.longBracket(); level >= 0 {
+				lx.readLong(level)
+				continue
+			}
+			for lx.pos < len(lx.source) && lx.source[lx.pos] != '\n' {
+				lx.pos++
+			}
+		case lx.pos == 0 && strings.HasPrefix(lx.source, "#"):
+			// A #! line at the start of the file
+			for lx.pos < len(lx.source) && lx.source[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Returns the level of a [[ or [==[ opening at the position, or -1
+func (lx *luaLexer) longBracket() int {
+	rest := lx.source[lx.pos:]
+	if !strings.HasPrefix(rest, "[") {
+		return -1
+	}
+	level := 1
+	for level < len(rest) && rest[level] == '=' {
+		level++
+	}
+	if level < len(rest) && rest[level] == '[' {
+		return level - 1
+	}
+	return -1
+}
+
+func (lx *luaLexer) readLong(level int) string {
+	lx.pos += level + 2
+	if strings.HasPrefix(lx.source[lx.pos:], "\r\n") {
+		lx.pos += 2
+		lx.line++
+	} else if strings.HasPrefix(lx.source[lx.pos:], "\n") {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.source[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf("unfinished long string or comment")
+	}
+	text := lx.source[lx.pos : lx.pos+end]
+	lx.line += strings.Count(text, "\n")
+	lx.pos += end + len(closing)
+	return text
+}
+
+func (lx *luaLexer) next() luaToken {
+	lx.skip()
+	if lx.pos >= len(lx.source) {
+		return luaToken{kind: luaEOF, text: "<eof>", line: lx.line}
+	}
+	start := lx.pos
+	c := lx.source[lx.pos]
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for lx.pos < len(lx.source) && isLuaNameChar(lx.source[lx.pos]) {
+			lx.pos++
+		}
+		text := lx.source[start:lx.pos]
+		if luaKeywords[text] {
+			return luaToken{kind: luaSymbol, text: text, line: lx.line}
+		}
+		return luaToken{kind: luaName, text: text, line: lx.line}
+
+	case c >= '0' && c <= '9' || c == '.' && lx.pos+1 < len(lx.source) && lx.source[lx.pos+1] >= '0' && lx.source[lx.pos+1] <= '9':
+		hex := strings.HasPrefix(lx.source[lx.pos:], "0x") || strings.HasPrefix(lx.source[lx.pos:], "0X")
+		if hex {
+			lx.pos += 2
+		}
+		for lx.pos < len(lx.source) {
+			c := lx.source[lx.pos]
+			exponent := c == 'e' || c == 'E'
+			if !hex && exponent && lx.pos+1 < len(lx.source) && strings.IndexByte("+-", lx.source[lx.pos+1]) >= 0 {
+				lx.pos += 2
+				continue
+			}
+			if !isLuaNameChar(c) && c != '.' {
+				break
+			}
+			lx.pos++
+		}
+		text := lx.source[start:lx.pos]
+		num, ok := luaParseNumber(text)
+		if !ok {
+			lx.errorf("malformed number near '%s'", text)
+		}
+		return luaToken{kind: luaNumber, text: text, num: num, line: lx.line}
+
+	case c == '"' || c == '\'':
+		return luaToken{kind: luaString, text: lx.readString(c), line: lx.line}
+
+	case c == '[':
+		if level := lx.longBracket(); level >= 0 {
+			line := lx.line
+			return luaToken{kind: luaString, text: lx.readLong(level), line: line}
+		}
+	}
+
+	for _, symbol := range luaSymbols {
+		if strings.HasPrefix(lx.source[lx.pos:], symbol) {
+			lx.pos += len(symbol)
+			return luaToken{kind: luaSymbol, text: symbol, line: lx.line}
+		}
+	}
+	lx.errorf("unexpected symbol near '%c'", c)
+	return luaToken{}
+}
+
+func isLuaNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (lx *luaLexer) readString(quote byte) string {
+	lx.pos++
+	var b strings.Builder
+	for {
+		if lx.pos >= len(lx.source) || lx.source[lx.pos] == '\n' {
+			lx.errorf("unfinished string")
+		}
+		c := lx.source[lx.pos]
+		lx.pos++
+		if c == quote {
+			return b.String()
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if lx.pos >= len(lx.source) {
+			lx.errorf("unfinished string")
+		}
+		c = lx.source[lx.pos]
+		lx.pos++
+		switch c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\n':
+			b.WriteByte('\n')
+			lx.line++
+		case 'x':
+			if lx.pos+2 > len(lx.source) {
+				lx.errorf("hexadecimal digit expected")
+			}
+			n, err := strconv.ParseUint(lx.source[lx.pos:lx.pos+2], 16, 8)
+			if err != nil {
+				lx.errorf("hexadecimal digit expected")
+			}
+			b.WriteByte(byte(n))
+			lx.pos += 2
+		default:
+			if c >= '0' && c <= '9' {
+				n := int(c - '0')
+				for i := 0; i < 2 && lx.pos < len(lx.source) && lx.source[lx.pos] >= '0' && lx.source[lx.pos] <= '9'; i++ {
+					n = n*10 + int(lx.source[lx.pos]-'0')
+					lx.pos++
+				}
+				if n > 255 {
+					lx.errorf("decimal escape too large")
+				}
+				b.WriteByte(byte(n))
+			} else {
+				// \\, \", \' and anything else stand for themselves
+				b.WriteByte(c)
+			}
+		}
+	}
+}
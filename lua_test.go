@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Runs a chunk named "test" and returns what it printed
+func runLua(t *testing.T, source string) (string, error) {
+	t.Helper()
+	var output bytes.Buffer
+	l := newLuaState()
+	l.output = &output
+	err := l.DoString("test", source)
+	return output.String(), err
+}
+
+func TestLuaPrograms(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"arithmetic", `print(1 + 2 * 3, (1 + 2) * 3, 2 ^ 3 ^ 2, -2 ^ 2, 7 / 2, 6 / 2)`, "7\t9\t512\t-4\t3.5\t3\n"},
+		{"floor division and modulo", `print(7 // 2, -7 // 2, 7 % 3, -7 % 3, 7 % -3, 5.5 % 2)`, "3\t-4\t1\t2\t-2\t1.5\n"},
+		{"numbers", `print(0x10, 1e2, .5, 3.0, 1/0, -1/0, 2^53, 0.1)`, "16\t100\t0.5\t3\tinf\t-inf\t9.007199254741e+15\t0.1\n"},
+		{"string coercion", `print("10" + 5, 10 .. 20, "3" * "4", #"hello")`, "15\t1020\t12\t5\n"},
+		{"comparison", `print(1 < 2, "a" < "b", "abc" < "abd", 1 == 1.0, "1" == 1, nil == false)`, "true\ttrue\ttrue\ttrue\tfalse\tfalse\n"},
+		{"logic", `print(nil or "default", false and error("skipped"), 1 and 2, not nil, not 0)`, "default\tfalse\t2\ttrue\tfalse\n"},
+		{"bitwise", `print(0xF0 & 0x3C, 0xF0 | 0x0F, 0xFF ~ 0x0F, ~0, 1 << 4, 256 >> 4, 1 << 64)`, "48\t255\t240\t-1\t16\t16\t0\n"},
+		{"bit library", `print(bit.band(0xFF, 0x0F, 0x3), bit.bor(1, 2, 4), bit.lshift(1, 8), AND(6, 3), OR(4, 1), XOR(5, 1), BIT(7))`, "3\t7\t256\t2\t5\t4\t128\n"},
+		{
+			"loops",
+			`local s = 0
+			for i = 1, 10 do s = s + i end
+			for i = 10, 1, -3 do s = s + i end
+			local n = 0
+			while n < 5 do n = n + 1 if n == 4 then break end end
+			local r = 0
+			repeat local done = r >= 3; r = r + 1 until done
+			print(s, n, r)`,
+			"77\t4\t4\n",
+		},
+		{
+			"closures",
+			`local function counter()
+				local n = 0
+				return function() n = n + 1 return n end
+			end
+			local a, b = counter(), counter()
+			a() a()
+			local fns = {}
+			for i = 1, 3 do fns[i] = function() return i end end
+			print(a(), b(), fns[1](), fns[3]())`,
+			"3\t1\t1\t3\n",
+		},
+		{
+			"varargs and multiple results",
+			`local function f(...) return select("#", ...), ... end
+			local function two() return 1, 2 end
+			local t = {two(), two()}
+			print(f(nil, nil))
+			print(#t, (two()), select(2, "a", "b", "c"))
+			print(select(-1, "a", "b"))
+			local x, y, z = two()
+			print(x, y, z)`,
+			"2\tnil\tnil\n3\t1\tb\tc\nb\n1\t2\tnil\n",
+		},
+		{
+			"recursion",
+			`local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+			print(fib(20))`,
+			"6765\n",
+		},
+		{
+			"tables",
+			`local t = {10, 20, 30, x = 1, ["y z"] = 2, [5] = 50}
+			t[4] = 40
+			local point = {x = 1}
+			function point:move(dx) self.x = self.x + dx return self end
+			print(#t, t.x, t["y z"], t[5], point:move(2):move(3).x)
+			t[5] = nil
+			print(#t, t[1.0])`,
+			"5\t1\t2\t50\t6\n4\t10\n",
+		},
+		{
+			"iteration order",
+			`local t = {"a", "b", c = 1, d = 2}
+			t.e = 3
+			t.c = nil
+			local keys = {}
+			for k, v in pairs(t) do keys[#keys + 1] = tostring(k) end
+			for i, v in ipairs({"x", "y", nil, "z"}) do keys[#keys + 1] = v end
+			print(table.concat(keys, ","))`,
+			"1,2,d,e,x,y\n",
+		},
+		{
+			"string library",
+			`local s = "Hello, World"
+			print(s:sub(1, 5), s:sub(-5), s:sub(8, 100), s:upper(), s:lower(), s:len())
+			print(s:find("o", 6), s:find("xyz"), ("ab"):rep(3), s:reverse(), s:find("World"))
+			print(string.char(72, 105), string.byte("ABC", 1, 3))`,
+			"Hello\tWorld\tWorld\tHELLO, WORLD\thello, world\t12\n9\tnil\tababab\tdlroW ,olleH\t8\t12\nHi\t65\t66\t67\n",
+		},
+		{
+			"format",
+			`print(string.format("%d %5.2f %s %x %X %02X %-4s| %%", 42, 3.14159, "str", 255, 255, 10, "ab"))`,
+			"42  3.14 str ff FF 0A ab  | %\n",
+		},
+		{
+			"table library",
+			`local t = {3, 1, 2}
+			table.insert(t, 4)
+			table.insert(t, 1, 0)
+			print(table.concat(t, " "), table.remove(t), table.remove(t, 1), #t)
+			table.sort(t)
+			print(table.concat(t, " "))
+			table.sort(t, function(a, b) return a > b end)
+			print(table.concat(t, " "), unpack({1, 2, 3}))`,
+			"0 3 1 2 4\t4\t0\t3\n1 2 3\n3 2 1\t1\t2\t3\n",
+		},
+		{
+			"math library",
+			`print(math.floor(-1.5), math.ceil(1.2), math.abs(-3), math.max(1, 5, 3), math.min(4, 2), math.fmod(7, 3), math.sqrt(16), math.huge)`,
+			"-2\t2\t3\t5\t2\t1\t4\tinf\n",
+		},
+		{
+			"conversions",
+			`print(tonumber("0x1F"), tonumber("  12  "), tonumber("z", 36), tonumber("ff", 16), tonumber("12a"), tostring(nil), type(print), type({}))`,
+			"31\t12\t35\t255\tnil\tnil\tfunction\ttable\n",
+		},
+		{
+			"errors caught",
+			`print(pcall(error, "plain", 0))
+			print(pcall(error, {code = 1}))
+			print(pcall(function() local t = {}; return t.a.b end))
+			print(select("#", pcall(function() return 1, 2 end)))`,
+			"false\tplain\nfalse\ttable: \n" +
+				"false\ttest:3: attempt to index a nil value (field 'a')\n3\n",
+		},
+		{
+			"strings and comments",
+			"-- line comment\n--[[ long\ncomment ]] print(\"tab\\there\", 'q\\'s', \"\\65\\x42\", [[long\nstring]], [==[a]]b]==])",
+			"tab\there\tq's\tAB\tlong\nstring\ta]]b\n",
+		},
+		{
+			"scopes",
+			`local x = 1
+			do local x = 2 end
+			if x == 1 then y = "global" elseif x == 2 then y = "no" else y = "no" end
+			print(x, y, _G.y)`,
+			"1\tglobal\tglobal\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := runLua(t, test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Tables print with their address, which changes between runs
+			if i := strings.Index(output, "table: 0x"); i >= 0 {
+				end := i + strings.IndexAny(output[i:], "\t\n")
+				output = output[:i] + "table: " + output[end:]
+			}
+			if output != test.want {
+				t.Errorf("printed\n%q\nwant\n%q", output, test.want)
+			}
+		})
+	}
+}
+
+func TestLuaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"unfinished block", "if true then\nprint(1)\n", "test:3:"},
+		{"unexpected symbol", "x = = 1", "test:1:"},
+		{"unfinished string", "print(\"abc\nprint(1)", "test:1: unfinished string"},
+		{"malformed number", "x = 0x1G", "test:1: malformed number"},
+		{"call nil", "\nundefined()", "test:2: attempt to call a nil value"},
+		{"arithmetic on nil", "local t = {}\nreturn t.x + 1", "test:2: attempt to perform arithmetic on a nil value"},
+		{"compare", "return 1 < \"2\"", "test:1: attempt to compare"},
+		{"concatenate table", "return \"a\" .. {}", "test:1: attempt to concatenate"},
+		{"error with position", "\n\nerror(\"boom\")", "test:3: boom"},
+		{"assert", "assert(false, \"checked\")", "checked"},
+		{"stack overflow", "local function f() return 1 + f() end\nf()", "stack overflow"},
+		{"bad argument", "string.rep()", "bad argument #1 to 'rep'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := runLua(t, test.source)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLuaCallFromGo(t *testing.T) {
+	l := newLuaState()
+	if err := l.DoString("test", "function add(a, b) return a + b, a * b end"); err != nil {
+		t.Fatal(err)
+	}
+	results, err := l.Call(l.globals.getString("add"), []luaValue{3.0, 4.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0] != 7.0 || results[1] != 12.0 {
+		t.Errorf("add(3, 4) = %v", results)
+	}
+
+	// An error leaves the state usable
+	if _, err := l.Call(l.globals.getString("add"), []luaValue{nil, 1.0}); err == nil {
+		t.Fatal("adding nil did not fail")
+	}
+	if _, err := l.Call(l.globals.getString("add"), []luaValue{1.0, 1.0}); err != nil {
+		t.Errorf("call after an error: %v", err)
+	}
+}
+
+func TestLuaTable(t *testing.T) {
+	table := newLuaTable()
+	for i := 1; i <= 3; i++ {
+		table.set(float64(i), float64(i*10))
+	}
+	// Keys beyond the array move into it once the gap is filled
+	table.set(5.0, 50.0)
+	table.set(4.0, 40.0)
+	if table.length() != 5 || len(table.hash) != 0 {
+		t.Errorf("length %d with %d hashed keys, want 5 and none", table.length(), len(table.hash))
+	}
+	table.set(5.0, nil)
+	table.set("name", "x")
+	table.set(2.5, "half")
+	if table.length() != 4 || table.get(2.5) != "half" || table.get(4.0) != 40.0 {
+		t.Errorf("length %d, [2.5] = %v, [4] = %v", table.length(), table.get(2.5), table.get(4.0))
+	}
+
+	// Deleting and adding many keys keeps the order compact
+	for i := 0; i < 100; i++ {
+		table.set(float64(1000+i), true)
+		table.set(float64(1000+i), nil)
+	}
+	if len(table.order) > 2*len(table.hash)+8 {
+		t.Errorf("%d keys in the order for %d hashed keys", len(table.order), len(table.hash))
+	}
+	keys := table.keys()
+	if len(keys) != 6 || keys[4] != "name" || keys[5] != 2.5 {
+		t.Errorf("keys %v", keys)
+	}
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Deepest nesting of Lua calls before a stack overflow error
+const luaMaxDepth = 200
+
+type luaCell struct {
+	v luaValue
+}
+
+type luaClosure struct {
+	proto  *luaProto
+	upvals []*luaCell
+}
+
+// Activation of a Lua function: a cell per local slot, so closures can share them
+type luaFrame struct {
+	cells   []*luaCell
+	upvals  []*luaCell
+	varargs []luaValue
+	ret     []luaValue
+}
+
+type luaFlow int
+
+const (
+	luaNormal luaFlow = iota
+	luaBreak
+	luaReturn
+)
+
+/*
+luaState runs parsed chunks against one set of globals. Runtime errors are raised
+as *luaError panics and turned back into errors by Call and DoString.
+*/
+type luaState struct {
+	globals *luaTable
+	// Methods of string values, the string library
+	stringMethods *luaTable
+	// Where print writes
+	output io.Writer
+
+	chunk string
+	line  int
+	depth int
+}
+
+func newLuaState() *luaState {
+	l := &luaState{globals: newLuaTable(), output: os.Stdout}
+	l.openLibraries()
+	return l
+}
+
+func (l *luaState) errorf(format string, args ...any) {
+	panic(&luaError{message: fmt.Sprintf("%s:%d: %s", l.chunk, l.line, fmt.Sprintf(format, args...))})
+}
+
+func (l *luaState) setGlobal(name string, value luaValue) {
+	l.globals.set(name, value)
+}
+
+// Registers Go functions as the fields of a global table
+func (l *luaState) register(table string, functions map[string]func(*luaState, []luaValue) []luaValue) *luaTable {
+	t, ok := l.globals.getString(table).(*luaTable)
+	if !ok {
+		t = newLuaTable()
+		l.setGlobal(table, t)
+	}
+	for name, fn := range functions {
+		t.set(name, &luaGoFunction{name: table + "." + name, fn: fn})
+	}
+	return t
+}
+
+// Compiles and runs a chunk
+func (l *luaState) DoString(chunk string, source string) error {
+	proto, err := parseLua(chunk, source)
+	if err != nil {
+		return err
+	}
+	_, err = l.Call(&luaClosure{proto: proto}, nil)
+	return err
+}
+
+// Calls fn from Go, returning any Lua error instead of raising it
+func (l *luaState) Call(fn luaValue, args []luaValue) (results []luaValue, err error) {
+	depth, chunk, line := l.depth, l.chunk, l.line
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			l.depth, l.chunk, l.line = depth, chunk, line
+			err = e
+		}
+	}()
+	return l.call(fn, args), nil
+}
+
+func (l *luaState) call(fn luaValue, args []luaValue) []luaValue {
+	switch f := fn.(type) {
+	case *luaGoFunction:
+		return f.fn(l, args)
+	case *luaClosure:
+		proto := f.proto
+		if l.depth >= luaMaxDepth {
+			l.errorf("stack overflow")
+		}
+		l.depth++
+		chunk, line := l.chunk, l.line
+		l.chunk = proto.chunk
+
+		frame := &luaFrame{cells: make([]*luaCell, proto.slots), upvals: f.upvals}
+		for i, slot := range proto.params {
+			var v luaValue
+			if i < len(args) {
+				v = args[i]
+			}
+			frame.cells[slot] = &luaCell{v}
+		}
+		if proto.vararg && len(args) > len(proto.params) {
+			frame.varargs = args[len(proto.params):]
+		}
+		var results []luaValue
+		if l.execBlock(frame, proto.body) == luaReturn {
+			results = frame.ret
+		}
+
+		l.chunk, l.line = chunk, line
+		l.depth--
+		return results
+	}
+	l.errorf("attempt to call a %s value", luaTypeName(fn))
+	return nil
+}
+
+func (l *luaState) closure(f *luaFrame, proto *luaProto) *luaClosure {
+	c := &luaClosure{proto: proto, upvals: make([]*luaCell, len(proto.upvals))}
+	for i, desc := range proto.upvals {
+		if desc.local {
+			if f.cells[desc.index] == nil {
+				f.cells[desc.index] = &luaCell{}
+			}
+			c.upvals[i] = f.cells[desc.index]
+		} else {
+			c.upvals[i] = f.upvals[desc.index]
+		}
+	}
+	return c
+}
+
+func (l *luaState) execBlock(f *luaFrame, body []luaStmt) luaFlow {
+	for _, s := range body {
+		if flow := l.exec(f, s); flow != luaNormal {
+			return flow
+		}
+	}
+	return luaNormal
+}
+
+func (l *luaState) exec(f *luaFrame, stmt luaStmt) luaFlow {
+	switch s := stmt.(type) {
+	case *luaLine:
+		l.line = s.line
+		return l.exec(f, s.stmt)
+
+	case *luaLocalStmt:
+		values := l.evalList(f, s.exprs, len(s.slots))
+		for i, slot := range s.slots {
+			f.cells[slot] = &luaCell{values[i]}
+		}
+
+	case *luaAssignStmt:
+		if len(s.targets) == 1 && len(s.exprs) == 1 {
+			l.assign(f, s.targets[0], l.eval(f, s.exprs[0]))
+			break
+		}
+		values := l.evalList(f, s.exprs, len(s.targets))
+		for i, target := range s.targets {
+			l.assign(f, target, values[i])
+		}
+
+	case *luaCallStmt:
+		l.evalCall(f, s.call)
+
+	case *luaDoStmt:
+		return l.execBlock(f, s.body)
+
+	case *luaWhileStmt:
+		for luaTruthy(l.eval(f, s.cond)) {
+			if flow := l.execBlock(f, s.body); flow == luaBreak {
+				break
+			} else if flow == luaReturn {
+				return flow
+			}
+		}
+
+	case *luaRepeatStmt:
+		for {
+			if flow := l.execBlock(f, s.body); flow == luaBreak {
+				break
+			} else if flow == luaReturn {
+				return flow
+			}
+			if luaTruthy(l.eval(f, s.cond)) {
+				break
+			}
+		}
+
+	case *luaIfStmt:
+		for i, cond := range s.conds {
+			if luaTruthy(l.eval(f, cond)) {
+				return l.execBlock(f, s.blocks[i])
+			}
+		}
+		return l.execBlock(f, s.orElse)
+
+	case *luaNumericForStmt:
+		start := l.forNumber(l.eval(f, s.start), "initial")
+		limit := l.forNumber(l.eval(f, s.limit), "limit")
+		step := l.forNumber(l.eval(f, s.step), "step")
+		if step == 0 {
+			l.errorf("'for' step is zero")
+		}
+		for v := start; step > 0 && v <= limit || step < 0 && v >= limit; v += step {
+			f.cells[s.slot] = &luaCell{v}
+			if flow := l.execBlock(f, s.body); flow == luaBreak {
+				break
+			} else if flow == luaReturn {
+				return flow
+			}
+		}
+
+	case *luaGenericForStmt:
+		values := l.evalList(f, s.exprs, 3)
+		fn, state, control := values[0], values[1], values[2]
+		for {
+			results := l.call(fn, []luaValue{state, control})
+			if len(results) == 0 || results[0] == nil {
+				break
+			}
+			control = results[0]
+			for i, slot := range s.slots {
+				var v luaValue
+				if i < len(results) {
+					v = results[i]
+				}
+				f.cells[slot] = &luaCell{v}
+			}
+			if flow := l.execBlock(f, s.body); flow == luaBreak {
+				break
+			} else if flow == luaReturn {
+				return flow
+			}
+		}
+
+	case *luaLocalFunctionStmt:
+		// The cell exists before the closure so the function can call itself
+		cell := &luaCell{}
+		f.cells[s.slot] = cell
+		cell.v = l.closure(f, s.fn.proto)
+
+	case *luaReturnStmt:
+		if len(s.exprs) == 1 {
+			if call, ok := s.exprs[0].(*luaCallExpr); ok {
+				f.ret = l.evalCall(f, call)
+				return luaReturn
+			}
+		}
+		f.ret = l.evalMulti(f, s.exprs)
+		return luaReturn
+
+	case *luaBreakStmt:
+		return luaBreak
+	}
+	return luaNormal
+}
+
+func (l *luaState) forNumber(v luaValue, what string) float64 {
+	f, ok := v.(float64)
+	if !ok {
+		l.errorf("'for' %s value must be a number", what)
+	}
+	return f
+}
+
+func (l *luaState) assign(f *luaFrame, target luaExpr, value luaValue) {
+	switch t := target.(type) {
+	case *luaLocalExpr:
+		if f.cells[t.slot] == nil {
+			f.cells[t.slot] = &luaCell{}
+		}
+		f.cells[t.slot].v = value
+	case *luaUpvalExpr:
+		f.upvals[t.index].v = value
+	case *luaGlobalExpr:
+		l.globals.set(t.name, value)
+	case *luaIndexExpr:
+		object := l.eval(f, t.object)
+		table, ok := object.(*luaTable)
+		if !ok {
+			l.errorf("attempt to index a %s value%s", luaTypeName(object), luaDescribe(t.object))
+		}
+		key := l.eval(f, t.key)
+		switch k := key.(type) {
+		case nil:
+			l.errorf("table index is nil")
+		case float64:
+			if math.IsNaN(k) {
+				l.errorf("table index is NaN")
+			}
+		}
+		table.set(key, value)
+	}
+}
+
+// Names the variable an expression reads, for error messages
+func luaDescribe(e luaExpr) string {
+	switch e := e.(type) {
+	case *luaGlobalExpr:
+		return fmt.Sprintf(" (global '%s')", e.name)
+	case *luaIndexExpr:
+		if key, ok := e.key.(*luaConstExpr); ok {
+			if name, ok := key.value.(string); ok {
+				return fmt.Sprintf(" (field '%s')", name)
+			}
+		}
+	}
+	return ""
+}
+
+func (l *luaState) index(object luaValue, key luaValue, expr luaExpr) luaValue {
+	switch o := object.(type) {
+	case *luaTable:
+		return o.get(key)
+	case string:
+		return l.stringMethods.get(key)
+	}
+	l.errorf("attempt to index a %s value%s", luaTypeName(object), luaDescribe(expr))
+	return nil
+}
+
+func (l *luaState) evalCall(f *luaFrame, c *luaCallExpr) []luaValue {
+	fn := l.eval(f, c.fn)
+	var args []luaValue
+	if c.method != "" {
+		object := fn
+		fn = l.index(object, c.method, c.fn)
+		args = append([]luaValue{object}, l.evalMulti(f, c.args)...)
+	} else {
+		args = l.evalMulti(f, c.args)
+	}
+	l.line = c.line
+	switch fn.(type) {
+	case *luaClosure, *luaGoFunction:
+	default:
+		description := luaDescribe(c.fn)
+		if c.method != "" {
+			description = fmt.Sprintf(" (method '%s')", c.method)
+		}
+		l.errorf("attempt to call a %s value%s", luaTypeName(fn), description)
+	}
+	return l.call(fn, args)
+}
+
+// Evaluates expressions, the last one giving all its values if it is a call or ...
+func (l *luaState) evalMulti(f *luaFrame, exprs []luaExpr) []luaValue {
+	if len(exprs) == 0 {
+		return nil
+	}
+	values := make([]luaValue, 0, len(exprs))
+	for _, e := range exprs[:len(exprs)-1] {
+		values = append(values, l.eval(f, e))
+	}
+	switch last := exprs[len(exprs)-1].(type) {
+	case *luaCallExpr:
+		return append(values, l.evalCall(f, last)...)
+	case *luaVarargExpr:
+		return append(values, f.varargs...)
+	default:
+		return append(values, l.eval(f, last))
+	}
+}
+
+// Evaluates expressions into exactly n values, padding with nil
+func (l *luaState) evalList(f *luaFrame, exprs []luaExpr, n int) []luaValue {
+	values := l.evalMulti(f, exprs)
+	for len(values) < n {
+		values = append(values, nil)
+	}
+	return values[:n]
+}
+
+func (l *luaState) eval(f *luaFrame, expr luaExpr) luaValue {
+	switch e := expr.(type) {
+	case *luaConstExpr:
+		return e.value
+	case *luaLocalExpr:
+		if cell := f.cells[e.slot]; cell != nil {
+			return cell.v
+		}
+		return nil
+	case *luaUpvalExpr:
+		return f.upvals[e.index].v
+	case *luaGlobalExpr:
+		return l.globals.getString(e.name)
+	case *luaIndexExpr:
+		return l.index(l.eval(f, e.object), l.eval(f, e.key), e.object)
+	case *luaCallExpr:
+		if results := l.evalCall(f, e); len(results) > 0 {
+			return results[0]
+		}
+		return nil
+	case *luaVarargExpr:
+		if len(f.varargs) > 0 {
+			return f.varargs[0]
+		}
+		return nil
+	case *luaParenExpr:
+		return l.eval(f, e.a)
+	case *luaFunctionExpr:
+		return l.closure(f, e.proto)
+	case *luaBinaryExpr:
+		switch e.op {
+		case "and":
+			if a := l.eval(f, e.a); !luaTruthy(a) {
+				return a
+			}
+			return l.eval(f, e.b)
+		case "or":
+			if a := l.eval(f, e.a); luaTruthy(a) {
+				return a
+			}
+			return l.eval(f, e.b)
+		}
+		return l.binary(e.op, l.eval(f, e.a), l.eval(f, e.b))
+	case *luaUnaryExpr:
+		return l.unary(e.op, l.eval(f, e.a))
+	case *luaTableExpr:
+		t := newLuaTable()
+		for i, item := range e.items {
+			if i == len(e.items)-1 {
+				for j, v := range l.evalMulti(f, []luaExpr{item}) {
+					t.set(float64(i+j+1), v)
+				}
+				break
+			}
+			t.set(float64(i+1), l.eval(f, item))
+		}
+		for i, key := range e.keys {
+			k := l.eval(f, key)
+			if k == nil {
+				l.errorf("table index is nil")
+			}
+			t.set(k, l.eval(f, e.values[i]))
+		}
+		return t
+	}
+	panic(fmt.Sprintf("unknown Lua expression %T", expr))
+}
+
+func (l *luaState) arithmeticOperand(v luaValue) float64 {
+	f, ok := luaToNumber(v)
+	if !ok {
+		l.errorf("attempt to perform arithmetic on a %s value", luaTypeName(v))
+	}
+	return f
+}
+
+func (l *luaState) toInteger(v luaValue) int64 {
+	f, ok := luaToNumber(v)
+	if !ok {
+		l.errorf("attempt to perform bitwise operation on a %s value", luaTypeName(v))
+	}
+	if f != math.Trunc(f) || math.Abs(f) > 1<<63 {
+		l.errorf("number has no integer representation")
+	}
+	return int64(f)
+}
+
+func luaShiftLeft(x int64, n int64) int64 {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n < 0:
+		return int64(uint64(x) >> uint(-n))
+	}
+	return int64(uint64(x) << uint(n))
+}
+
+func (l *luaState) binary(op string, a luaValue, b luaValue) luaValue {
+	switch op {
+	case "==":
+		return a == b
+	case "~=":
+		return a != b
+	case "<", "<=", ">", ">=":
+		if op == ">" || op == ">=" {
+			a, b = b, a
+			op = map[string]string{">": "<", ">=": "<="}[op]
+		}
+		x, xNumber := a.(float64)
+		y, yNumber := b.(float64)
+		if xNumber && yNumber {
+			return x < y || op == "<=" && x == y
+		}
+		s, xString := a.(string)
+		t, yString := b.(string)
+		if xString && yString {
+			return s < t || op == "<=" && s == t
+		}
+		if luaTypeName(a) == luaTypeName(b) {
+			l.errorf("attempt to compare two %s values", luaTypeName(a))
+		}
+		l.errorf("attempt to compare %s with %s", luaTypeName(a), luaTypeName(b))
+	case "..":
+		for _, v := range []luaValue{a, b} {
+			switch v.(type) {
+			case string, float64:
+			default:
+				l.errorf("attempt to concatenate a %s value", luaTypeName(v))
+			}
+		}
+		return luaToString(a) + luaToString(b)
+	case "&", "|", "~", "<<", ">>":
+		x, y := l.toInteger(a), l.toInteger(b)
+		switch op {
+		case "&":
+			return float64(x & y)
+		case "|":
+			return float64(x | y)
+		case "~":
+			return float64(x ^ y)
+		case "<<":
+			return float64(luaShiftLeft(x, y))
+		case ">>":
+			return float64(luaShiftLeft(x, -y))
+		}
+	}
+
+	x, y := l.arithmeticOperand(a), l.arithmeticOperand(b)
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		return x / y
+	case "%":
+		if math.IsInf(y, 0) && !math.IsInf(x, 0) {
+			if x == 0 || (x > 0) == (y > 0) {
+				return x
+			}
+			return y
+		}
+		return x - math.Floor(x/y)*y
+	case "//":
+		return math.Floor(x / y)
+	case "^":
+		return math.Pow(x, y)
+	}
+	panic("unknown Lua operator " + op)
+}
+
+func (l *luaState) unary(op string, a luaValue) luaValue {
+	switch op {
+	case "not":
+		return !luaTruthy(a)
+	case "-":
+		return -l.arithmeticOperand(a)
+	case "~":
+		return float64(^l.toInteger(a))
+	case "#":
+		switch v := a.(type) {
+		case string:
+			return float64(len(v))
+		case *luaTable:
+			return float64(v.length())
+		}
+		l.errorf("attempt to get length of a %s value", luaTypeName(a))
+	}
+	panic("unknown Lua operator " + op)
+}
+
+// Argument helpers for library functions
+
+func (l *luaState) arg(args []luaValue, i int) luaValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func (l *luaState) argError(i int, name string, message string) {
+	l.errorf("bad argument #%d to '%s' (%s)", i+1, name, message)
+}
+
+func (l *luaState) checkNumber(args []luaValue, i int, name string) float64 {
+	f, ok := luaToNumber(l.arg(args, i))
+	if !ok {
+		l.argError(i, name, "number expected, got "+luaTypeName(l.arg(args, i)))
+	}
+	return f
+}
+
+func (l *luaState) checkInt(args []luaValue, i int, name string) int {
+	return int(math.Floor(l.checkNumber(args, i, name)))
+}
+
+func (l *luaState) optInt(args []luaValue, i int, name string, def int) int {
+	if l.arg(args, i) == nil {
+		return def
+	}
+	return l.checkInt(args, i, name)
+}
+
+func (l *luaState) checkString(args []luaValue, i int, name string) string {
+	switch v := l.arg(args, i).(type) {
+	case string:
+		return v
+	case float64:
+		return luaFormatNumber(v)
+	}
+	l.argError(i, name, "string expected, got "+luaTypeName(l.arg(args, i)))
+	return ""
+}
+
+func (l *luaState) checkTable(args []luaValue, i int, name string) *luaTable {
+	t, ok := l.arg(args, i).(*luaTable)
+	if !ok {
+		l.argError(i, name, "table expected, got "+luaTypeName(l.arg(args, i)))
+	}
+	return t
+}
+
+func (l *luaState) checkFunction(args []luaValue, i int, name string) luaValue {
+	switch v := l.arg(args, i).(type) {
+	case *luaClosure, *luaGoFunction:
+		return v
+	}
+	l.argError(i, name, "function expected, got "+luaTypeName(l.arg(args, i)))
+	return nil
+}
+
+// Joins values the way print does
+func luaJoin(args []luaValue, separator string) string {
+	parts := make([]string, len(args))
+	for i, v := range args {
+		parts[i] = luaToString(v)
+	}
+	return strings.Join(parts, separator)
+}
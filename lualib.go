@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type luaLibrary = map[string]func(*luaState, []luaValue) []luaValue
+
+// Installs the base functions and the math, string, table and bit libraries
+func (l *luaState) openLibraries() {
+	base := luaLibrary{
+		"print": func(l *luaState, args []luaValue) []luaValue {
+			fmt.Fprintln(l.output, luaJoin(args, "\t"))
+			return nil
+		},
+		"type": func(l *luaState, args []luaValue) []luaValue {
+			if len(args) == 0 {
+				l.argError(0, "type", "value expected")
+			}
+			return []luaValue{luaTypeName(args[0])}
+		},
+		"tostring": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{luaToString(l.arg(args, 0))}
+		},
+		"tonumber": func(l *luaState, args []luaValue) []luaValue {
+			if base := l.optInt(args, 1, "tonumber", 10); base != 10 {
+				s := strings.ToLower(strings.TrimSpace(l.checkString(args, 0, "tonumber")))
+				n, err := strconv.ParseInt(s, base, 64)
+				if err != nil {
+					return []luaValue{nil}
+				}
+				return []luaValue{float64(n)}
+			}
+			if f, ok := luaToNumber(l.arg(args, 0)); ok {
+				return []luaValue{f}
+			}
+			return []luaValue{nil}
+		},
+		"ipairs": func(l *luaState, args []luaValue) []luaValue {
+			t := l.checkTable(args, 0, "ipairs")
+			iterator := &luaGoFunction{name: "ipairs iterator", fn: func(l *luaState, args []luaValue) []luaValue {
+				i := l.checkNumber(args, 1, "ipairs") + 1
+				if v := t.get(i); v != nil {
+					return []luaValue{i, v}
+				}
+				return []luaValue{nil}
+			}}
+			return []luaValue{iterator, t, 0.0}
+		},
+		"pairs": func(l *luaState, args []luaValue) []luaValue {
+			// The keys are taken up front, so fields can be cleared while iterating
+			t := l.checkTable(args, 0, "pairs")
+			keys, next := t.keys(), 0
+			iterator := &luaGoFunction{name: "pairs iterator", fn: func(l *luaState, args []luaValue) []luaValue {
+				for next < len(keys) {
+					key := keys[next]
+					next++
+					if v := t.get(key); v != nil {
+						return []luaValue{key, v}
+					}
+				}
+				return []luaValue{nil}
+			}}
+			return []luaValue{iterator, t, nil}
+		},
+		"select": func(l *luaState, args []luaValue) []luaValue {
+			if s, ok := l.arg(args, 0).(string); ok && s == "#" {
+				return []luaValue{float64(len(args) - 1)}
+			}
+			n := l.checkInt(args, 0, "select")
+			switch {
+			case n < 0 && -n < len(args):
+				return args[len(args)+n:]
+			case n < 1:
+				l.argError(0, "select", "index out of range")
+			case n >= len(args):
+				return nil
+			}
+			return args[n:]
+		},
+		"error": func(l *luaState, args []luaValue) []luaValue {
+			value := l.arg(args, 0)
+			message, ok := value.(string)
+			if !ok {
+				panic(&luaError{message: luaToString(value), value: value})
+			}
+			if l.optInt(args, 1, "error", 1) > 0 {
+				message = fmt.Sprintf("%s:%d: %s", l.chunk, l.line, message)
+			}
+			panic(&luaError{message: message, value: message})
+		},
+		"assert": func(l *luaState, args []luaValue) []luaValue {
+			if !luaTruthy(l.arg(args, 0)) {
+				message := "assertion failed!"
+				if len(args) > 1 {
+					message = luaToString(args[1])
+				}
+				l.errorf("%s", message)
+			}
+			return args
+		},
+		"pcall": func(l *luaState, args []luaValue) []luaValue {
+			results, err := l.Call(l.arg(args, 0), args[min(1, len(args)):])
+			if err != nil {
+				e := err.(*luaError)
+				if e.value != nil {
+					return []luaValue{false, e.value}
+				}
+				return []luaValue{false, e.message}
+			}
+			return append([]luaValue{true}, results...)
+		},
+		"unpack": luaUnpack,
+		"rawequal": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{l.arg(args, 0) == l.arg(args, 1)}
+		},
+	}
+	for name, fn := range base {
+		l.setGlobal(name, &luaGoFunction{name: name, fn: fn})
+	}
+	l.setGlobal("_G", l.globals)
+
+	l.register("math", luaLibrary{
+		"floor": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Floor(l.checkNumber(args, 0, "floor"))}
+		},
+		"ceil": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Ceil(l.checkNumber(args, 0, "ceil"))}
+		},
+		"abs": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Abs(l.checkNumber(args, 0, "abs"))}
+		},
+		"sqrt": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Sqrt(l.checkNumber(args, 0, "sqrt"))}
+		},
+		"sin": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Sin(l.checkNumber(args, 0, "sin"))}
+		},
+		"cos": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Cos(l.checkNumber(args, 0, "cos"))}
+		},
+		"fmod": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{math.Mod(l.checkNumber(args, 0, "fmod"), l.checkNumber(args, 1, "fmod"))}
+		},
+		"max": func(l *luaState, args []luaValue) []luaValue {
+			result := l.checkNumber(args, 0, "max")
+			for i := 1; i < len(args); i++ {
+				result = math.Max(result, l.checkNumber(args, i, "max"))
+			}
+			return []luaValue{result}
+		},
+		"min": func(l *luaState, args []luaValue) []luaValue {
+			result := l.checkNumber(args, 0, "min")
+			for i := 1; i < len(args); i++ {
+				result = math.Min(result, l.checkNumber(args, i, "min"))
+			}
+			return []luaValue{result}
+		},
+		"random": func(l *luaState, args []luaValue) []luaValue {
+			switch len(args) {
+			case 0:
+				return []luaValue{rand.Float64()}
+			case 1:
+				return []luaValue{float64(1 + rand.Intn(max(l.checkInt(args, 0, "random"), 1)))}
+			}
+			low, high := l.checkInt(args, 0, "random"), l.checkInt(args, 1, "random")
+			if high < low {
+				l.argError(1, "random", "interval is empty")
+			}
+			return []luaValue{float64(low + rand.Intn(high-low+1))}
+		},
+	})
+	mathLib := l.globals.getString("math").(*luaTable)
+	mathLib.set("pi", math.Pi)
+	mathLib.set("huge", math.Inf(1))
+
+	l.stringMethods = l.register("string", luaLibrary{
+		"len": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{float64(len(l.checkString(args, 0, "len")))}
+		},
+		"sub": func(l *luaState, args []luaValue) []luaValue {
+			s := l.checkString(args, 0, "sub")
+			start, end := luaStringRange(len(s), l.checkInt(args, 1, "sub"), l.optInt(args, 2, "sub", -1))
+			if start > end {
+				return []luaValue{""}
+			}
+			return []luaValue{s[start-1 : end]}
+		},
+		"upper": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{strings.ToUpper(l.checkString(args, 0, "upper"))}
+		},
+		"lower": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{strings.ToLower(l.checkString(args, 0, "lower"))}
+		},
+		"rep": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{strings.Repeat(l.checkString(args, 0, "rep"), max(l.checkInt(args, 1, "rep"), 0))}
+		},
+		"reverse": func(l *luaState, args []luaValue) []luaValue {
+			b := []byte(l.checkString(args, 0, "reverse"))
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			return []luaValue{string(b)}
+		},
+		"byte": func(l *luaState, args []luaValue) []luaValue {
+			s := l.checkString(args, 0, "byte")
+			i := l.optInt(args, 1, "byte", 1)
+			start, end := luaStringRange(len(s), i, l.optInt(args, 2, "byte", i))
+			var results []luaValue
+			for ; start <= end; start++ {
+				results = append(results, float64(s[start-1]))
+			}
+			return results
+		},
+		"char": func(l *luaState, args []luaValue) []luaValue {
+			b := make([]byte, len(args))
+			for i := range args {
+				b[i] = byte(l.checkInt(args, i, "char"))
+			}
+			return []luaValue{string(b)}
+		},
+		// Plain text search only, there are no patterns
+		"find": func(l *luaState, args []luaValue) []luaValue {
+			s, pattern := l.checkString(args, 0, "find"), l.checkString(args, 1, "find")
+			start, _ := luaStringRange(len(s), l.optInt(args, 2, "find", 1), -1)
+			if start > len(s)+1 {
+				return []luaValue{nil}
+			}
+			i := strings.Index(s[start-1:], pattern)
+			if i < 0 {
+				return []luaValue{nil}
+			}
+			return []luaValue{float64(start + i), float64(start + i + len(pattern) - 1)}
+		},
+		"format": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{l.format(l.checkString(args, 0, "format"), args[1:])}
+		},
+	})
+
+	l.register("table", luaLibrary{
+		"insert": func(l *luaState, args []luaValue) []luaValue {
+			t := l.checkTable(args, 0, "insert")
+			if len(args) == 2 {
+				t.set(float64(t.length()+1), args[1])
+				return nil
+			}
+			n := t.length()
+			position := l.checkInt(args, 1, "insert")
+			if position < 1 || position > n+1 {
+				l.argError(1, "insert", "position out of bounds")
+			}
+			for i := n; i >= position; i-- {
+				t.set(float64(i+1), t.get(float64(i)))
+			}
+			t.set(float64(position), l.arg(args, 2))
+			return nil
+		},
+		"remove": func(l *luaState, args []luaValue) []luaValue {
+			t := l.checkTable(args, 0, "remove")
+			n := t.length()
+			position := l.optInt(args, 1, "remove", n)
+			if n == 0 && len(args) < 2 {
+				return []luaValue{nil}
+			}
+			if position < 1 || position > n+1 {
+				l.argError(1, "remove", "position out of bounds")
+			}
+			value := t.get(float64(position))
+			for i := position; i < n; i++ {
+				t.set(float64(i), t.get(float64(i+1)))
+			}
+			if position <= n {
+				t.set(float64(n), nil)
+			}
+			return []luaValue{value}
+		},
+		"concat": func(l *luaState, args []luaValue) []luaValue {
+			t := l.checkTable(args, 0, "concat")
+			separator := ""
+			if len(args) > 1 {
+				separator = l.checkString(args, 1, "concat")
+			}
+			first, last := l.optInt(args, 2, "concat", 1), l.optInt(args, 3, "concat", t.length())
+			var parts []string
+			for i := first; i <= last; i++ {
+				v := t.get(float64(i))
+				switch v.(type) {
+				case string, float64:
+					parts = append(parts, luaToString(v))
+				default:
+					l.errorf("invalid value (at index %d) in table for 'concat'", i)
+				}
+			}
+			return []luaValue{strings.Join(parts, separator)}
+		},
+		"sort": func(l *luaState, args []luaValue) []luaValue {
+			t := l.checkTable(args, 0, "sort")
+			less := l.arg(args, 1)
+			sort.SliceStable(t.array, func(i, j int) bool {
+				if less != nil {
+					results := l.call(less, []luaValue{t.array[i], t.array[j]})
+					return len(results) > 0 && luaTruthy(results[0])
+				}
+				return l.binary("<", t.array[i], t.array[j]).(bool)
+			})
+			return nil
+		},
+		"unpack": luaUnpack,
+	})
+
+	// Lua 5.2's bit32 as FCEUX scripts know it, plus the AND/OR/XOR/BIT globals of FCEUX
+	bitwise := func(name string, op string) func(*luaState, []luaValue) []luaValue {
+		return func(l *luaState, args []luaValue) []luaValue {
+			result := l.checkNumber(args, 0, name)
+			for i := 1; i < len(args); i++ {
+				result = l.binary(op, result, l.checkNumber(args, i, name)).(float64)
+			}
+			return []luaValue{result}
+		}
+	}
+	l.register("bit", luaLibrary{
+		"band":   bitwise("band", "&"),
+		"bor":    bitwise("bor", "|"),
+		"bxor":   bitwise("bxor", "~"),
+		"lshift": bitwise("lshift", "<<"),
+		"rshift": bitwise("rshift", ">>"),
+		"bnot": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{l.unary("~", l.checkNumber(args, 0, "bnot"))}
+		},
+	})
+	l.setGlobal("AND", &luaGoFunction{name: "AND", fn: bitwise("AND", "&")})
+	l.setGlobal("OR", &luaGoFunction{name: "OR", fn: bitwise("OR", "|")})
+	l.setGlobal("XOR", &luaGoFunction{name: "XOR", fn: bitwise("XOR", "~")})
+	l.setGlobal("BIT", &luaGoFunction{name: "BIT", fn: func(l *luaState, args []luaValue) []luaValue {
+		return []luaValue{float64(luaShiftLeft(1, int64(l.checkInt(args, 0, "BIT"))))}
+	}})
+}
+
+func luaUnpack(l *luaState, args []luaValue) []luaValue {
+	t := l.checkTable(args, 0, "unpack")
+	first, last := l.optInt(args, 1, "unpack", 1), l.optInt(args, 2, "unpack", t.length())
+	var results []luaValue
+	for i := first; i <= last; i++ {
+		results = append(results, t.get(float64(i)))
+	}
+	return results
+}
+
+// Clamps a Lua string range, negative positions count from the end
+func luaStringRange(length int, start int, end int) (int, int) {
+	if start < 0 {
+		start = max(length+start+1, 1)
+	} else if start == 0 {
+		start = 1
+	}
+	if end < 0 {
+		end = length + end + 1
+	} else if end > length {
+		end = length
+	}
+	return start, end
+}
+
+// string.format, handing each directive to fmt with the argument converted for it
+func (l *luaState) format(format string, args []luaValue) string {
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+ #0123456789.", format[j]) >= 0 {
+			j++
+		}
+		if j >= len(format) {
+			l.errorf("invalid conversion '%s' to 'format'", format[i:])
+		}
+		spec, verb := format[i:j], format[j]
+		i = j
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if next >= len(args) {
+			l.argError(next+1, "format", "no value")
+		}
+		arg := args[next]
+		next++
+		switch verb {
+		case 'd', 'i':
+			fmt.Fprintf(&b, spec+"d", int64(l.formatNumber(arg, next)))
+		case 'x', 'X', 'o':
+			fmt.Fprintf(&b, spec+string(verb), int64(l.formatNumber(arg, next)))
+		case 'c':
+			b.WriteByte(byte(l.formatNumber(arg, next)))
+		case 'e', 'E', 'f', 'g', 'G':
+			fmt.Fprintf(&b, spec+string(verb), l.formatNumber(arg, next))
+		case 's':
+			fmt.Fprintf(&b, spec+"s", luaToString(arg))
+		case 'q':
+			fmt.Fprintf(&b, "%q", luaToString(arg))
+		default:
+			l.errorf("invalid conversion '%s%c' to 'format'", spec, verb)
+		}
+	}
+	return b.String()
+}
+
+func (l *luaState) formatNumber(v luaValue, position int) float64 {
+	f, ok := luaToNumber(v)
+	if !ok {
+		l.argError(position, "format", "number expected, got "+luaTypeName(v))
+	}
+	return f
+}
@@ -0,0 +1,636 @@
+package main
+
+import "fmt"
+
+// Syntax tree. Locals are resolved to slots of their function while parsing.
+
+type luaExpr interface{}
+
+type (
+	luaConstExpr  struct{ value luaValue }
+	luaVarargExpr struct{}
+	luaLocalExpr  struct{ slot int }
+	luaUpvalExpr  struct{ index int }
+	luaGlobalExpr struct{ name string }
+	luaIndexExpr  struct{ object, key luaExpr }
+	luaCallExpr   struct {
+		fn   luaExpr
+		args []luaExpr
+		// Name of the method for a:name() calls, which pass the object as self
+		method string
+		line   int
+	}
+	luaFunctionExpr struct{ proto *luaProto }
+	luaBinaryExpr   struct {
+		op   string
+		a, b luaExpr
+	}
+	luaUnaryExpr struct {
+		op string
+		a  luaExpr
+	}
+	// Brackets cut a call or ... down to one value
+	luaParenExpr struct{ a luaExpr }
+	luaTableExpr struct {
+		items []luaExpr
+		keys  []luaExpr
+		// Values of keys, items has the positional ones
+		values []luaExpr
+	}
+)
+
+type luaStmt interface{}
+
+type (
+	luaLocalStmt struct {
+		slots []int
+		exprs []luaExpr
+	}
+	luaAssignStmt struct {
+		targets []luaExpr
+		exprs   []luaExpr
+	}
+	luaCallStmt  struct{ call *luaCallExpr }
+	luaDoStmt    struct{ body []luaStmt }
+	luaWhileStmt struct {
+		cond luaExpr
+		body []luaStmt
+	}
+	luaRepeatStmt struct {
+		body []luaStmt
+		cond luaExpr
+	}
+	luaIfStmt struct {
+		conds  []luaExpr
+		blocks [][]luaStmt
+		orElse []luaStmt
+	}
+	luaNumericForStmt struct {
+		slot               int
+		start, limit, step luaExpr
+		body               []luaStmt
+	}
+	luaGenericForStmt struct {
+		slots []int
+		exprs []luaExpr
+		body  []luaStmt
+	}
+	luaLocalFunctionStmt struct {
+		slot int
+		fn   *luaFunctionExpr
+	}
+	luaReturnStmt struct{ exprs []luaExpr }
+	luaBreakStmt  struct{}
+)
+
+// A statement and the line it starts on, for error messages
+type luaLine struct {
+	line int
+	stmt luaStmt
+}
+
+// Where a closure finds an upvalue when it is created
+type luaUpvalDesc struct {
+	// A local slot of the enclosing function, otherwise one of its upvalues
+	local bool
+	index int
+}
+
+type luaProto struct {
+	name   string
+	chunk  string
+	params []int
+	vararg bool
+	slots  int
+	upvals []luaUpvalDesc
+	body   []luaStmt
+}
+
+type luaFuncState struct {
+	proto  *luaProto
+	parent *luaFuncState
+	// Names in scope, innermost block last
+	blocks     []map[string]int
+	upvalNames map[string]int
+}
+
+type luaParser struct {
+	lx    *luaLexer
+	tok   luaToken
+	ahead *luaToken
+	fs    *luaFuncState
+}
+
+/*
+Parses a chunk into the prototype of its main function. Syntax errors are returned
+as a *luaError with the chunk name and line.
+*/
+func parseLua(chunk string, source string) (proto *luaProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	p := &luaParser{lx: &luaLexer{chunk: chunk, source: source, line: 1}}
+	p.advance()
+	p.openFunction("main chunk")
+	p.fs.proto.vararg = true
+	body := p.block()
+	if p.tok.kind != luaEOF {
+		p.errorf("'<eof>' expected near '%s'", p.tok.text)
+	}
+	return p.closeFunction(body), nil
+}
+
+func (p *luaParser) errorf(format string, args ...any) {
+	panic(&luaError{message: fmt.Sprintf("%s:%d: %s", p.lx.chunk, p.tok.line, fmt.Sprintf(format, args...))})
+}
+
+func (p *luaParser) advance() {
+	if p.ahead != nil {
+		p.tok, p.ahead = *p.ahead, nil
+		return
+	}
+	p.tok = p.lx.next()
+}
+
+func (p *luaParser) peek() luaToken {
+	if p.ahead == nil {
+		tok := p.lx.next()
+		p.ahead = &tok
+	}
+	return *p.ahead
+}
+
+func (p *luaParser) is(symbol string) bool {
+	return p.tok.kind == luaSymbol && p.tok.text == symbol
+}
+
+func (p *luaParser) accept(symbol string) bool {
+	if p.is(symbol) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(symbol string) {
+	if !p.accept(symbol) {
+		p.errorf("'%s' expected near '%s'", symbol, p.tok.text)
+	}
+}
+
+func (p *luaParser) name() string {
+	if p.tok.kind != luaName {
+		p.errorf("<name> expected near '%s'", p.tok.text)
+	}
+	name := p.tok.text
+	p.advance()
+	return name
+}
+
+func (p *luaParser) openFunction(name string) {
+	p.fs = &luaFuncState{
+		proto:      &luaProto{name: name, chunk: p.lx.chunk},
+		parent:     p.fs,
+		blocks:     []map[string]int{{}},
+		upvalNames: make(map[string]int),
+	}
+}
+
+func (p *luaParser) closeFunction(body []luaStmt) *luaProto {
+	proto := p.fs.proto
+	proto.body = body
+	p.fs = p.fs.parent
+	return proto
+}
+
+// Gives the name a new slot in the current block, shadowing any earlier one
+func (p *luaParser) declare(name string) int {
+	proto := p.fs.proto
+	slot := proto.slots
+	proto.slots++
+	p.fs.blocks[len(p.fs.blocks)-1][name] = slot
+	return slot
+}
+
+func (fs *luaFuncState) findLocal(name string) (int, bool) {
+	for i := len(fs.blocks) - 1; i >= 0; i-- {
+		if slot, ok := fs.blocks[i][name]; ok {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// Finds the upvalue for name in fs, adding it and those of the enclosing functions as needed
+func (fs *luaFuncState) findUpval(name string) (int, bool) {
+	if index, ok := fs.upvalNames[name]; ok {
+		return index, true
+	}
+	if fs.parent == nil {
+		return 0, false
+	}
+	desc := luaUpvalDesc{}
+	if slot, ok := fs.parent.findLocal(name); ok {
+		desc = luaUpvalDesc{local: true, index: slot}
+	} else if index, ok := fs.parent.findUpval(name); ok {
+		desc = luaUpvalDesc{index: index}
+	} else {
+		return 0, false
+	}
+	index := len(fs.proto.upvals)
+	fs.proto.upvals = append(fs.proto.upvals, desc)
+	fs.upvalNames[name] = index
+	return index, true
+}
+
+func (p *luaParser) variable(name string) luaExpr {
+	if slot, ok := p.fs.findLocal(name); ok {
+		return &luaLocalExpr{slot}
+	}
+	if index, ok := p.fs.findUpval(name); ok {
+		return &luaUpvalExpr{index}
+	}
+	return &luaGlobalExpr{name}
+}
+
+func (p *luaParser) blockEnds() bool {
+	if p.tok.kind == luaEOF {
+		return true
+	}
+	if p.tok.kind != luaSymbol {
+		return false
+	}
+	switch p.tok.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+// Parses statements in a new scope
+func (p *luaParser) block() []luaStmt {
+	p.fs.blocks = append(p.fs.blocks, map[string]int{})
+	body := p.statements()
+	p.fs.blocks = p.fs.blocks[:len(p.fs.blocks)-1]
+	return body
+}
+
+func (p *luaParser) statements() []luaStmt {
+	var body []luaStmt
+	for !p.blockEnds() {
+		if p.accept(";") {
+			continue
+		}
+		line := p.tok.line
+		if p.is("return") {
+			p.advance()
+			var exprs []luaExpr
+			if !p.blockEnds() && !p.is(";") {
+				exprs = p.exprList()
+			}
+			p.accept(";")
+			body = append(body, &luaLine{line, &luaReturnStmt{exprs}})
+			if !p.blockEnds() {
+				p.errorf("'end' expected near '%s'", p.tok.text)
+			}
+			break
+		}
+		body = append(body, &luaLine{line, p.statement()})
+	}
+	return body
+}
+
+func (p *luaParser) statement() luaStmt {
+	switch {
+	case p.accept("do"):
+		body := p.block()
+		p.expect("end")
+		return &luaDoStmt{body}
+
+	case p.accept("while"):
+		cond := p.expr()
+		p.expect("do")
+		body := p.block()
+		p.expect("end")
+		return &luaWhileStmt{cond, body}
+
+	case p.accept("repeat"):
+		// The condition can see the locals of the body
+		p.fs.blocks = append(p.fs.blocks, map[string]int{})
+		body := p.statements()
+		p.expect("until")
+		cond := p.expr()
+		p.fs.blocks = p.fs.blocks[:len(p.fs.blocks)-1]
+		return &luaRepeatStmt{body, cond}
+
+	case p.accept("if"):
+		s := &luaIfStmt{}
+		for {
+			s.conds = append(s.conds, p.expr())
+			p.expect("then")
+			s.blocks = append(s.blocks, p.block())
+			if !p.accept("elseif") {
+				break
+			}
+		}
+		if p.accept("else") {
+			s.orElse = p.block()
+		}
+		p.expect("end")
+		return s
+
+	case p.accept("for"):
+		return p.forStatement()
+
+	case p.accept("function"):
+		name := p.name()
+		target := p.variable(name)
+		method := false
+		for p.is(".") || p.is(":") {
+			method = p.is(":")
+			p.advance()
+			key := p.name()
+			name += "." + key
+			target = &luaIndexExpr{target, &luaConstExpr{key}}
+			if method {
+				break
+			}
+		}
+		return &luaAssignStmt{[]luaExpr{target}, []luaExpr{p.function(name, method)}}
+
+	case p.accept("local"):
+		if p.accept("function") {
+			name := p.name()
+			slot := p.declare(name)
+			return &luaLocalFunctionStmt{slot, p.function(name, false)}
+		}
+		names := []string{p.name()}
+		for p.accept(",") {
+			names = append(names, p.name())
+		}
+		var exprs []luaExpr
+		if p.accept("=") {
+			exprs = p.exprList()
+		}
+		s := &luaLocalStmt{exprs: exprs}
+		for _, name := range names {
+			s.slots = append(s.slots, p.declare(name))
+		}
+		return s
+
+	case p.accept("break"):
+		return &luaBreakStmt{}
+
+	case p.is("::"):
+		p.errorf("goto is not supported")
+	}
+
+	expr := p.suffixedExpr()
+	if call, ok := expr.(*luaCallExpr); ok && !p.is("=") && !p.is(",") {
+		return &luaCallStmt{call}
+	}
+	targets := []luaExpr{expr}
+	for p.accept(",") {
+		targets = append(targets, p.suffixedExpr())
+	}
+	for _, target := range targets {
+		switch target.(type) {
+		case *luaLocalExpr, *luaUpvalExpr, *luaGlobalExpr, *luaIndexExpr:
+		default:
+			p.errorf("syntax error near '%s'", p.tok.text)
+		}
+	}
+	p.expect("=")
+	return &luaAssignStmt{targets, p.exprList()}
+}
+
+func (p *luaParser) forStatement() luaStmt {
+	first := p.name()
+	if p.accept("=") {
+		start := p.expr()
+		p.expect(",")
+		limit := p.expr()
+		var step luaExpr = &luaConstExpr{1.0}
+		if p.accept(",") {
+			step = p.expr()
+		}
+		p.expect("do")
+		p.fs.blocks = append(p.fs.blocks, map[string]int{})
+		s := &luaNumericForStmt{slot: p.declare(first), start: start, limit: limit, step: step}
+		s.body = p.block()
+		p.fs.blocks = p.fs.blocks[:len(p.fs.blocks)-1]
+		p.expect("end")
+		return s
+	}
+
+	names := []string{first}
+	for p.accept(",") {
+		names = append(names, p.name())
+	}
+	p.expect("in")
+	s := &luaGenericForStmt{exprs: p.exprList()}
+	p.expect("do")
+	p.fs.blocks = append(p.fs.blocks, map[string]int{})
+	for _, name := range names {
+		s.slots = append(s.slots, p.declare(name))
+	}
+	s.body = p.block()
+	p.fs.blocks = p.fs.blocks[:len(p.fs.blocks)-1]
+	p.expect("end")
+	return s
+}
+
+// Parses a function's parameters and body, the name is only for error messages
+func (p *luaParser) function(name string, method bool) *luaFunctionExpr {
+	p.openFunction(name)
+	proto := p.fs.proto
+	if method {
+		proto.params = append(proto.params, p.declare("self"))
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				proto.vararg = true
+				break
+			}
+			proto.params = append(proto.params, p.declare(p.name()))
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	body := p.block()
+	p.expect("end")
+	return &luaFunctionExpr{p.closeFunction(body)}
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	exprs := []luaExpr{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *luaParser) primaryExpr() luaExpr {
+	switch {
+	case p.tok.kind == luaName:
+		return p.variable(p.name())
+	case p.accept("("):
+		expr := p.expr()
+		p.expect(")")
+		return &luaParenExpr{expr}
+	}
+	p.errorf("unexpected symbol near '%s'", p.tok.text)
+	return nil
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	expr := p.primaryExpr()
+	for {
+		line := p.tok.line
+		switch {
+		case p.accept("."):
+			expr = &luaIndexExpr{expr, &luaConstExpr{p.name()}}
+		case p.accept("["):
+			key := p.expr()
+			p.expect("]")
+			expr = &luaIndexExpr{expr, key}
+		case p.accept(":"):
+			method := p.name()
+			expr = &luaCallExpr{fn: expr, method: method, args: p.callArgs(), line: line}
+		case p.is("(") || p.is("{") || p.tok.kind == luaString:
+			expr = &luaCallExpr{fn: expr, args: p.callArgs(), line: line}
+		default:
+			return expr
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []luaExpr {
+	switch {
+	case p.tok.kind == luaString:
+		s := p.tok.text
+		p.advance()
+		return []luaExpr{&luaConstExpr{s}}
+	case p.is("{"):
+		return []luaExpr{p.tableConstructor()}
+	}
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	args := p.exprList()
+	p.expect(")")
+	return args
+}
+
+func (p *luaParser) tableConstructor() luaExpr {
+	p.expect("{")
+	t := &luaTableExpr{}
+	for !p.is("}") {
+		switch {
+		case p.accept("["):
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.keys = append(t.keys, key)
+			t.values = append(t.values, p.expr())
+		case p.tok.kind == luaName && p.peek().kind == luaSymbol && p.peek().text == "=":
+			key := p.name()
+			p.advance()
+			t.keys = append(t.keys, &luaConstExpr{key})
+			t.values = append(t.values, p.expr())
+		default:
+			t.items = append(t.items, p.expr())
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	return t
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	tok := p.tok
+	switch {
+	case tok.kind == luaNumber:
+		p.advance()
+		return &luaConstExpr{tok.num}
+	case tok.kind == luaString:
+		p.advance()
+		return &luaConstExpr{tok.text}
+	case p.accept("nil"):
+		return &luaConstExpr{nil}
+	case p.accept("true"):
+		return &luaConstExpr{true}
+	case p.accept("false"):
+		return &luaConstExpr{false}
+	case p.accept("..."):
+		if !p.fs.proto.vararg {
+			p.errorf("cannot use '...' outside a vararg function")
+		}
+		return &luaVarargExpr{}
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.accept("function"):
+		return p.function("anonymous", false)
+	}
+	return p.suffixedExpr()
+}
+
+// Left and right binding power of the binary operators
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"|": {4, 4}, "~": {5, 5}, "&": {6, 6}, "<<": {7, 7}, ">>": {7, 7},
+	"..": {9, 8}, "+": {10, 10}, "-": {10, 10},
+	"*": {11, 11}, "/": {11, 11}, "//": {11, 11}, "%": {11, 11},
+	"^": {14, 13},
+}
+
+const luaUnaryPriority = 12
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+func (p *luaParser) subExpr(limit int) luaExpr {
+	var expr luaExpr
+	if p.tok.kind == luaSymbol && (p.is("not") || p.is("-") || p.is("#") || p.is("~")) {
+		op := p.tok.text
+		p.advance()
+		operand := p.subExpr(luaUnaryPriority)
+		// Fold negative constants so -1 is not an operation every time
+		if c, ok := operand.(*luaConstExpr); ok && op == "-" {
+			if f, ok := c.value.(float64); ok {
+				operand, op = &luaConstExpr{-f}, ""
+			}
+		}
+		expr = operand
+		if op != "" {
+			expr = &luaUnaryExpr{op, operand}
+		}
+	} else {
+		expr = p.simpleExpr()
+	}
+	for p.tok.kind == luaSymbol {
+		priority, ok := luaBinaryPriority[p.tok.text]
+		if !ok || priority[0] <= limit {
+			break
+		}
+		op := p.tok.text
+		p.advance()
+		expr = &luaBinaryExpr{op, expr, p.subExpr(priority[1])}
+	}
+	return expr
+}
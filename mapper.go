@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+Mapper is the cartridge hardware behind $4020-$FFFF. ROM banks are copied into CPU
+memory, so the CPU fetches from them like any other memory and a mapper only sees
+the accesses that reach its registers.
+*/
+type Mapper interface {
+	// Maps the power on banks into memory
+	Reset(cpu *CPU)
+	// Register reads and writes, ok false lets the access fall through to memory
+	Read(address uint16) (value uint8, ok bool)
+	Write(address uint16, value uint8) (ok bool)
+	// Runs once per CPU cycle
+	Clock()
+	// The cartridge IRQ line
+	IRQ() bool
+}
+
+// Mappers with state beyond CPU memory that goes into save states
+type mapperState interface {
+	saveState(w io.Writer)
+	loadState(r io.Reader) error
+}
+
+// Mappers with a sound chip, which the APU mixes into its output
+type audioMapper interface {
+	Audio() ExpansionAudio
+}
+
+// Writes fixed size values in order, as a mapper's part of a save state
+func writeMapperState(w io.Writer, values ...any) {
+	for _, v := range values {
+		binary.Write(w, binary.LittleEndian, v)
+	}
+}
+
+func readMapperState(r io.Reader, values ...any) error {
+	for _, v := range values {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("error reading save state: %w", err)
+		}
+	}
+	return nil
+}
+
+/*
+Copies bank number bank of size bytes from prg into memory at address. Bank numbers
+wrap around the ROM and negative ones count back from the last bank.
+*/
+func (cpu *CPU) mapPRG(prg []uint8, address uint16, size int, bank int) {
+	count := max(len(prg)/size, 1)
+	bank %= count
+	if bank < 0 {
+		bank += count
+	}
+	offset := bank * size % len(prg)
+	copy(cpu.memory[address:int(address)+size], prg[offset:])
+	cpu.prgSize = len(prg)
+	for i := 0; i < size; i += 0x1000 {
+		if slot := int(address) + i; slot >= 0x8000 {
+			cpu.prgBanks[(slot-0x8000)>>12] = offset + i
+		}
+	}
+}
+
+/*
+Mappers that switch CHR banks. Pattern data read through $2007 is fetched through
+this, which also lets the MMC2 and MMC4 see the tiles read. There is no PPU, so no
+rendering fetches reach it.
+*/
+type chrMapper interface {
+	// CHR ROM offset of a pattern table address $0000-$1FFF
+	fetchCHR(address uint16) int
+}
+
+// CHR ROM offset of bank number bank of size bytes, wrapping around the ROM like mapPRG
+func chrBank(chr []uint8, bank int, size int) int {
+	return bank % max(len(chr)/size, 1) * size
+}
+
+// NROM has no registers, the one or two 16KB PRG banks are fixed
+type NROM struct {
+	prg []uint8
+}
+
+func (m *NROM) Reset(cpu *CPU) {
+	cpu.LoadNESROM(m.prg)
+}
+
+func (m *NROM) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+// Writes to ROM are dropped here, the ones below $8000 reach memory
+func (m *NROM) Write(address uint16, value uint8) bool {
+	return address >= 0x8000
+}
+
+func (m *NROM) Clock() {}
+
+func (m *NROM) IRQ() bool {
+	return false
+}
+
+/*
+Returns the mapper for a cartridge, biosPath is only used for disk images. Mapper
+numbers without an implementation are an error, running them as NROM would only
+execute whatever the fixed banks happen to hold.
+*/
+func newMapper(cart *Cartridge, biosPath string) (Mapper, error) {
+	if cart.NSF != nil {
+		return NewNSFPlayer(cart.NSF, cart.PRG), nil
+	}
+	if cart.Disks != nil {
+		bios, err := loadFDSBIOS(biosPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewFDS(cart.Disks, bios), nil
+	}
+	switch cart.Mapper {
+	case 0:
+	case 5:
+		return NewMMC5(cart.PRG, cart.CHR), nil
+	case 7, 11, 66:
+		return NewDiscrete(cart.Mapper, cart.PRG, cart.CHR), nil
+	case 9:
+		return NewMMC2(cart.PRG, cart.CHR, false), nil
+	case 10:
+		return NewMMC2(cart.PRG, cart.CHR, true), nil
+	case 19:
+		return NewNamco163(cart.PRG), nil
+	case 21, 22, 23, 25:
+		return NewVRC4(cart.Mapper, cart.PRG, cart.CHR), nil
+	case 24:
+		return NewVRC6(cart.PRG, false), nil
+	case 26:
+		return NewVRC6(cart.PRG, true), nil
+	case 69:
+		return NewFME7(cart.PRG, cart.CHR), nil
+	case 85:
+		return NewVRC7(cart.PRG), nil
+	default:
+		return nil, fmt.Errorf("mapper %d is not supported", cart.Mapper)
+	}
+	return &NROM{prg: cart.PRG}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+// count banks of size bytes, each filled with its own number
+func numberedBanks(count int, size int) []uint8 {
+	rom := make([]uint8, count*size)
+	for i := range rom {
+		rom[i] = uint8(i / size)
+	}
+	return rom
+}
+
+// A CPU with mapper plugged in and reset
+func newMapperCPU(mapper Mapper) *CPU {
+	cpu := &CPU{}
+	cpu.APU = NewAPU(cpu, regionNTSC)
+	cpu.Mapper = mapper
+	mapper.Reset(cpu)
+	return cpu
+}
+
+// Fails unless each address holds the number of the bank mapped there
+func checkBanks(t *testing.T, cpu *CPU, banks map[uint16]uint8) {
+	t.Helper()
+	for address, want := range banks {
+		if got := cpu.memory[address]; got != want {
+			t.Errorf("bank at $%04X = %d, want %d", address, got, want)
+		}
+	}
+}
+
+// Fails unless address is fetched from the CHR bank want of size bytes
+func checkCHR(t *testing.T, m chrMapper, chr []uint8, size int, address uint16, want uint8) {
+	t.Helper()
+	offset := m.fetchCHR(address)
+	if chr[offset] != want || offset%size != int(address)%size {
+		t.Errorf("$%04X fetched from offset $%05X in bank %d, want bank %d", address, offset, chr[offset], want)
+	}
+}
+
+func TestCHRBank(t *testing.T) {
+	chr := make([]uint8, 0x8000)
+	tests := []struct {
+		chr  []uint8
+		bank int
+		size int
+		want int
+	}{
+		{chr, 5, 0x1000, 0x5000},
+		{chr, 9, 0x1000, 0x1000},
+		{chr, 3, 0x2000, 0x6000},
+		{chr, 5, 0x2000, 0x2000},
+		{nil, 3, 0x2000, 0}, // CHR RAM boards have no banks
+	}
+	for _, test := range tests {
+		if got := chrBank(test.chr, test.bank, test.size); got != test.want {
+			t.Errorf("chrBank(%d KB, %d, $%X) = $%X, want $%X", len(test.chr)/1024, test.bank, test.size, got, test.want)
+		}
+	}
+}
+
+func TestNewMapper(t *testing.T) {
+	for _, number := range []uint8{0, 5, 7, 9, 10, 11, 19, 21, 22, 23, 24, 25, 26, 66, 69, 85} {
+		if _, err := newMapper(&Cartridge{Mapper: number, PRG: make([]uint8, 0x8000)}, ""); err != nil {
+			t.Errorf("mapper %d: %v", number, err)
+		}
+	}
+	if _, err := newMapper(&Cartridge{Mapper: 4, PRG: make([]uint8, 0x8000)}, ""); err == nil {
+		t.Error("an unsupported mapper loaded without an error")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import "io"
+
+type mmc2Registers struct {
+	PRG uint8
+	// 4KB CHR banks: the $FD and $FE banks of $0000, then those of $1000
+	CHR [4]uint8
+	// Which bank each pattern table uses, 0 for $FD and 1 for $FE
+	Latch     [2]uint8
+	Mirroring uint8
+}
+
+/*
+MMC2 is Nintendo's mapper 9 and, with mmc4 set, the MMC4 of mapper 10. Each pattern
+table has two CHR banks and a latch choosing between them, which flips when tile $FD
+or $FE is fetched from that table, so a game can switch banks partway down the
+screen. The MMC2 has an 8KB switchable bank at $8000 with the rest fixed, the MMC4 a
+16KB one with PRG RAM at $6000.
+
+There is no PPU, so the only fetches the latches see are pattern table reads the CPU
+makes through $2007. Games flip them with the PPU's tile fetches while rendering,
+which do not happen here.
+*/
+type MMC2 struct {
+	Registers mmc2Registers
+
+	mmc4 bool
+	prg  []uint8
+	chr  []uint8
+	cpu  *CPU
+}
+
+func NewMMC2(prg []uint8, chr []uint8, mmc4 bool) *MMC2 {
+	m := &MMC2{prg: prg, chr: chr, mmc4: mmc4}
+	m.Registers.Latch = [2]uint8{1, 1}
+	return m
+}
+
+func (m *MMC2) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+func (m *MMC2) mapBanks() {
+	bank := int(m.Registers.PRG)
+	if m.mmc4 {
+		m.cpu.mapPRG(m.prg, 0x8000, 0x4000, bank)
+		m.cpu.mapPRG(m.prg, 0xC000, 0x4000, -1)
+		return
+	}
+	m.cpu.mapPRG(m.prg, 0x8000, 0x2000, bank)
+	m.cpu.mapPRG(m.prg, 0xA000, 0x2000, -3)
+	m.cpu.mapPRG(m.prg, 0xC000, 0x2000, -2)
+	m.cpu.mapPRG(m.prg, 0xE000, 0x2000, -1)
+}
+
+func (m *MMC2) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+func (m *MMC2) Write(address uint16, value uint8) bool {
+	if address < 0x8000 {
+		return false
+	}
+	r := &m.Registers
+	switch address & 0xF000 {
+	case 0xA000:
+		r.PRG = value & 0x0F
+		m.mapBanks()
+	case 0xB000, 0xC000, 0xD000, 0xE000:
+		r.CHR[address>>12-0xB] = value & 0x1F
+	case 0xF000:
+		r.Mirroring = mirrorVertical - value&1
+	}
+	return true
+}
+
+func (m *MMC2) Clock() {}
+
+func (m *MMC2) IRQ() bool {
+	return false
+}
+
+/*
+The latch flips after the fetch, so the $FD or $FE tile itself still comes from the
+old bank. The MMC2's first pattern table only reacts to the first byte of the tiles,
+the MMC4 and the second table to any of their bytes.
+*/
+func (m *MMC2) fetchCHR(address uint16) int {
+	r := &m.Registers
+	table := address >> 12 & 1
+	offset := chrBank(m.chr, int(r.CHR[table*2+uint16(r.Latch[table])]), 0x1000) + int(address&0x0FFF)
+
+	tile := address & 0x0FFF
+	if table == 1 || m.mmc4 {
+		tile &^= 7
+	}
+	switch tile {
+	case 0x0FD8:
+		r.Latch[table] = 0
+	case 0x0FE8:
+		r.Latch[table] = 1
+	}
+	return offset
+}
+
+func (m *MMC2) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers)
+}
+
+func (m *MMC2) loadState(r io.Reader) error {
+	registers := m.Registers
+	if err := readMapperState(r, &registers); err != nil {
+		return err
+	}
+	m.Registers = registers
+	m.mapBanks()
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestMMC2PRGBanks(t *testing.T) {
+	t.Run("mmc2", func(t *testing.T) {
+		m := NewMMC2(numberedBanks(16, 0x2000), nil, false)
+		cpu := newMapperCPU(m)
+		checkBanks(t, cpu, map[uint16]uint8{0x8000: 0, 0xA000: 13, 0xC000: 14, 0xE000: 15})
+		m.Write(0xA000, 0x25)
+		checkBanks(t, cpu, map[uint16]uint8{0x8000: 5, 0xA000: 13})
+	})
+	t.Run("mmc4", func(t *testing.T) {
+		m := NewMMC2(numberedBanks(8, 0x4000), nil, true)
+		cpu := newMapperCPU(m)
+		checkBanks(t, cpu, map[uint16]uint8{0x8000: 0, 0xC000: 7})
+		m.Write(0xA000, 3)
+		checkBanks(t, cpu, map[uint16]uint8{0x8000: 3, 0xBFFF: 3, 0xC000: 7})
+	})
+}
+
+// Drives fetchCHR directly, the latch logic a PPU's tile fetches would go through
+func TestMMC2Latches(t *testing.T) {
+	// Each step fetches address and expects it from bank, the latch flips afterwards
+	type fetch struct {
+		address uint16
+		bank    uint8
+	}
+	tests := []struct {
+		name    string
+		mmc4    bool
+		fetches []fetch
+	}{
+		{
+			name: "mmc2",
+			fetches: []fetch{
+				{0x0100, 2}, // both latches power on at $FE
+				{0x0FD8, 2},
+				{0x0100, 1},
+				{0x0FDA, 1}, // the first table only reacts to the first byte of the tile
+				{0x0FE8, 1},
+				{0x0100, 2},
+				{0x1000, 4},
+				{0x1FDB, 4}, // the second table reacts to any byte
+				{0x1000, 3},
+				{0x0100, 2},
+				{0x1FEF, 3},
+				{0x1000, 4},
+			},
+		},
+		{
+			name: "mmc4",
+			mmc4: true,
+			fetches: []fetch{
+				{0x0FDA, 2},
+				{0x0100, 1},
+				{0x0FEF, 1},
+				{0x0100, 2},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chr := numberedBanks(32, 0x1000)
+			m := NewMMC2(numberedBanks(8, 0x4000), chr, test.mmc4)
+			newMapperCPU(m)
+			for i, value := range []uint8{1, 2, 3, 4} {
+				m.Write(0xB000+uint16(i)*0x1000, value)
+			}
+			for _, fetch := range test.fetches {
+				checkCHR(t, m, chr, 0x1000, fetch.address, fetch.bank)
+			}
+		})
+	}
+}
+
+// The CPU reading pattern data through $2007, the only fetch that reaches the mapper
+func TestMMC2LatchThroughPPUData(t *testing.T) {
+	m := NewMMC2(numberedBanks(8, 0x4000), numberedBanks(32, 0x1000), false)
+	cpu := newMapperCPU(m)
+	cpu.write(0x2006, 0x0F)
+	cpu.write(0x2006, 0xD8)
+	cpu.read(0x2007)
+	if m.Registers.Latch[0] != 0 {
+		t.Error("reading tile $FD through $2007 did not flip the latch")
+	}
+}
+
+func TestMMC2Mirroring(t *testing.T) {
+	m := NewMMC2(numberedBanks(8, 0x4000), nil, false)
+	newMapperCPU(m)
+	m.Write(0xF000, 1)
+	if m.Registers.Mirroring != mirrorHorizontal {
+		t.Errorf("mirroring %d after writing 1, want horizontal", m.Registers.Mirroring)
+	}
+	m.Write(0xF000, 0)
+	if m.Registers.Mirroring != mirrorVertical {
+		t.Errorf("mirroring %d after writing 0, want vertical", m.Registers.Mirroring)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import "io"
+
+// The MMC5 clocks its envelopes and length counters at a fixed 240 Hz
+const mmc5FrameCycles = 7457
+
+/*
+MMC5Audio is the sound of the Nintendo MMC5: two pulse channels like the APU's but
+without sweep, and an 8 bit PCM channel written directly or read from $8000-$BFFF.
+*/
+type MMC5Audio struct {
+	Pulse [2]Pulse
+
+	PCM           uint8
+	PCMReadMode   bool
+	PCMIRQEnabled bool
+	PCMIRQ        bool
+
+	FrameTimer uint16
+	Odd        bool // the pulse timers run on every other cycle
+}
+
+func newMMC5Audio() MMC5Audio {
+	a := MMC5Audio{}
+	a.Pulse[0].NoSweep = true
+	a.Pulse[1].NoSweep = true
+	return a
+}
+
+func (a *MMC5Audio) read(address uint16) (uint8, bool) {
+	switch address {
+	case 0x5010:
+		value := uint8(0)
+		if a.PCMIRQ && a.PCMIRQEnabled {
+			value |= 0x80
+		}
+		if a.PCMReadMode {
+			value |= 0x01
+		}
+		a.PCMIRQ = false
+		return value, true
+	case 0x5015:
+		var value uint8
+		for i := range a.Pulse {
+			if a.Pulse[i].Length > 0 {
+				value |= 1 << i
+			}
+		}
+		return value, true
+	}
+	return 0, false
+}
+
+// Handles writes to $5000-$5015
+func (a *MMC5Audio) write(address uint16, value uint8) {
+	switch {
+	case address < 0x5004:
+		a.Pulse[0].write(address&3, value)
+	case address < 0x5008:
+		a.Pulse[1].write(address&3, value)
+	case address == 0x5010:
+		a.PCMReadMode = getBit(value, 0)
+		a.PCMIRQEnabled = getBit(value, 7)
+	case address == 0x5011:
+		// Zero is not written, in read mode it raises the IRQ instead
+		if !a.PCMReadMode && value != 0 {
+			a.PCM = value
+		}
+	case address == 0x5015:
+		for i := range a.Pulse {
+			a.Pulse[i].Enabled = getBit(value, uint8(i))
+			if !a.Pulse[i].Enabled {
+				a.Pulse[i].Length = 0
+			}
+		}
+	}
+}
+
+// Reads from $8000-$BFFF in read mode feed the PCM channel
+func (a *MMC5Audio) pcmRead(value uint8) {
+	if value == 0 {
+		a.PCMIRQ = true
+		return
+	}
+	a.PCM = value
+}
+
+func (a *MMC5Audio) clock() {
+	if a.Odd {
+		a.Pulse[0].clockTimer()
+		a.Pulse[1].clockTimer()
+	}
+	a.Odd = !a.Odd
+
+	a.FrameTimer++
+	if a.FrameTimer >= mmc5FrameCycles {
+		a.FrameTimer = 0
+		for i := range a.Pulse {
+			a.Pulse[i].Envelope.clock()
+			a.Pulse[i].clockLength()
+		}
+	}
+}
+
+// The pulses mix like the APU's, the PCM channel at the level the DMC would play it
+func (a *MMC5Audio) output() float64 {
+	return pulseMixTable[a.Pulse[0].output()+a.Pulse[1].output()] + tndMixTable[a.PCM>>1]
+}
+
+// The MMC5's unsigned 8 by 8 bit multiplier, operands written and the product read at $5205-$5206
+type mmc5Multiplier struct {
+	A uint8
+	B uint8
+}
+
+func (mul *mmc5Multiplier) read(address uint16) uint8 {
+	product := uint16(mul.A) * uint16(mul.B)
+	if address == 0x5206 {
+		return uint8(product >> 8)
+	}
+	return uint8(product)
+}
+
+func (mul *mmc5Multiplier) write(address uint16, value uint8) {
+	if address == 0x5205 {
+		mul.A = value
+	} else {
+		mul.B = value
+	}
+}
+
+type mmc5Registers struct {
+	PRGMode uint8
+	CHRMode uint8
+	RAMBank uint8    // $5113, kept for when PRG RAM is banked
+	PRG     [4]uint8 // $5114-$5117, bit 7 selects ROM
+	// $5120-$512B with the upper bits from $5130, the last four are the background set
+	// the PPU uses with 8x16 sprites
+	CHR      [12]uint16
+	CHRUpper uint8
+
+	// $5104, modes 0 and 1 leave ExRAM to the PPU, which is not emulated
+	ExRAMMode uint8
+	// $5105 maps each nametable quadrant, 2 bits each: console RAM A or B, ExRAM or fill
+	Nametables    uint8
+	FillTile      uint8
+	FillAttribute uint8
+
+	// $5200-$5202, latched only
+	SplitControl uint8
+	SplitScroll  uint8
+	SplitBank    uint8
+
+	// $5203-$5204, the scanline IRQ needs a PPU to count scanlines
+	IRQScanline uint8
+	IRQEnabled  bool
+}
+
+/*
+MMC5 is Nintendo's mapper 5 with its four PRG banking modes, CHR banking, multiplier,
+PCM IRQ and sound. RAM banks selected into $8000-$DFFF use whatever memory holds
+there. The 1KB of ExRAM at $5C00 is CPU RAM in modes 2 and 3.
+
+Extended attributes, the vertical split screen, the fill nametable and the scanline
+IRQ are not implemented. They only change what the PPU draws or depend on it counting
+scanlines, and there is no PPU, so their registers are latched and saved but have no
+effect.
+*/
+type MMC5 struct {
+	Registers mmc5Registers
+	Sound     MMC5Audio
+	ExRAM     [0x400]uint8
+
+	multiplier mmc5Multiplier
+	prg        []uint8
+	chr        []uint8
+	cpu        *CPU
+	// 8KB banks of $8000-$DFFF that are mapped to RAM
+	ram [3]bool
+}
+
+func NewMMC5(prg []uint8, chr []uint8) *MMC5 {
+	m := &MMC5{prg: prg, chr: chr, Sound: newMMC5Audio()}
+	// Power on with the last ROM bank everywhere, so the CPU starts in ROM
+	m.Registers.PRGMode = 3
+	m.Registers.PRG = [4]uint8{0xFF, 0xFF, 0xFF, 0xFF}
+	m.Registers.CHRMode = 3
+	return m
+}
+
+func (m *MMC5) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+// Maps an 8KB or 16KB bank given in 8KB units, RAM banks leave memory alone
+func (m *MMC5) mapBank(address uint16, size int, bank uint8, rom bool) {
+	for i := 0; i < size; i += 0x2000 {
+		if slot := (int(address) + i - 0x8000) >> 13; slot < len(m.ram) {
+			m.ram[slot] = !rom
+		}
+	}
+	if rom {
+		m.cpu.mapPRG(m.prg, address, size, int(bank&0x7F)/(size/0x2000))
+	}
+}
+
+func (m *MMC5) mapBanks() {
+	r := &m.Registers
+	isROM := func(bank uint8) bool { return getBit(bank, 7) }
+	switch r.PRGMode {
+	case 0:
+		m.mapBank(0x8000, 0x8000, r.PRG[3], true)
+	case 1:
+		m.mapBank(0x8000, 0x4000, r.PRG[1], isROM(r.PRG[1]))
+		m.mapBank(0xC000, 0x4000, r.PRG[3], true)
+	case 2:
+		m.mapBank(0x8000, 0x4000, r.PRG[1], isROM(r.PRG[1]))
+		m.mapBank(0xC000, 0x2000, r.PRG[2], isROM(r.PRG[2]))
+		m.mapBank(0xE000, 0x2000, r.PRG[3], true)
+	case 3:
+		for i := 0; i < 3; i++ {
+			m.mapBank(0x8000+uint16(i)*0x2000, 0x2000, r.PRG[i], isROM(r.PRG[i]))
+		}
+		m.mapBank(0xE000, 0x2000, r.PRG[3], true)
+	}
+}
+
+func (m *MMC5) Read(address uint16) (uint8, bool) {
+	switch {
+	case address >= 0x8000 && address < 0xC000 && m.Sound.PCMReadMode:
+		value := m.cpu.memory[address]
+		m.Sound.pcmRead(value)
+		return value, true
+	case address >= 0x5000 && address <= 0x5015:
+		return m.Sound.read(address)
+	case address == 0x5204:
+		// Never in frame and never pending without a PPU
+		return 0, true
+	case address == 0x5205 || address == 0x5206:
+		return m.multiplier.read(address), true
+	case address >= 0x5C00 && address < 0x6000:
+		// ExRAM only reads back in modes 2 and 3
+		if m.Registers.ExRAMMode < 2 {
+			return 0, true
+		}
+		return m.ExRAM[address-0x5C00], true
+	}
+	return 0, false
+}
+
+func (m *MMC5) Write(address uint16, value uint8) bool {
+	r := &m.Registers
+	switch {
+	case address >= 0x5000 && address <= 0x5015:
+		m.Sound.write(address, value)
+	case address == 0x5100:
+		r.PRGMode = value & 3
+		m.mapBanks()
+	case address == 0x5101:
+		r.CHRMode = value & 3
+	case address == 0x5104:
+		r.ExRAMMode = value & 3
+	case address == 0x5105:
+		r.Nametables = value
+	case address == 0x5106:
+		r.FillTile = value
+	case address == 0x5107:
+		r.FillAttribute = value & 3
+	case address == 0x5113:
+		r.RAMBank = value & 7
+	case address >= 0x5114 && address <= 0x5117:
+		r.PRG[address-0x5114] = value
+		m.mapBanks()
+	case address >= 0x5120 && address <= 0x512B:
+		r.CHR[address-0x5120] = uint16(value) | uint16(r.CHRUpper)<<8
+	case address == 0x5130:
+		r.CHRUpper = value & 3
+	case address == 0x5200:
+		r.SplitControl = value
+	case address == 0x5201:
+		r.SplitScroll = value
+	case address == 0x5202:
+		r.SplitBank = value
+	case address == 0x5203:
+		r.IRQScanline = value
+	case address == 0x5204:
+		r.IRQEnabled = getBit(value, 7)
+	case address == 0x5205 || address == 0x5206:
+		m.multiplier.write(address, value)
+	case address >= 0x5C00 && address < 0x6000:
+		// Mode 3 makes ExRAM read only
+		if r.ExRAMMode != 3 {
+			m.ExRAM[address-0x5C00] = value
+		}
+	case address >= 0x8000 && address < 0xE000:
+		if m.ram[(address-0x8000)>>13] {
+			m.cpu.memory[address] = value
+		}
+	case address >= 0xE000:
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *MMC5) Clock() {
+	m.Sound.clock()
+}
+
+func (m *MMC5) IRQ() bool {
+	return m.Sound.PCMIRQ && m.Sound.PCMIRQEnabled
+}
+
+func (m *MMC5) Audio() ExpansionAudio {
+	return &m.Sound
+}
+
+/*
+CHR banks are 8KB, 4KB, 2KB or 1KB in modes 0 to 3, each taken from the last register
+of its group in $5120-$5127. This is the set sprites use, and backgrounds too unless
+sprites are 8x16.
+*/
+func (m *MMC5) fetchCHR(address uint16) int {
+	r := &m.Registers
+	size := 0x2000 >> r.CHRMode
+	slot := int(address&0x1FFF) / size
+	register := (slot+1)*(8>>r.CHRMode) - 1
+	return chrBank(m.chr, int(r.CHR[register]), size) + int(address)%size
+}
+
+func (m *MMC5) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.Sound, &m.ExRAM, &m.multiplier)
+}
+
+func (m *MMC5) loadState(r io.Reader) error {
+	registers, sound, exram, multiplier := m.Registers, m.Sound, m.ExRAM, m.multiplier
+	if err := readMapperState(r, &registers, &sound, &exram, &multiplier); err != nil {
+		return err
+	}
+	m.Registers, m.Sound, m.ExRAM, m.multiplier = registers, sound, exram, multiplier
+	m.mapBanks()
+	return nil
+}
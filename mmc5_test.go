@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestMMC5Multiplier(t *testing.T) {
+	tests := []struct {
+		a, b    uint8
+		product uint16
+	}{
+		{0, 0, 0},
+		{2, 3, 6},
+		{16, 16, 0x0100},
+		{0xFF, 0xFF, 0xFE01},
+		{0xFF, 1, 0x00FF},
+	}
+	m := NewMMC5(numberedBanks(8, 0x2000), nil)
+	newMapperCPU(m)
+	for _, test := range tests {
+		m.Write(0x5205, test.a)
+		m.Write(0x5206, test.b)
+		low, _ := m.Read(0x5205)
+		high, _ := m.Read(0x5206)
+		if product := uint16(high)<<8 | uint16(low); product != test.product {
+			t.Errorf("%d * %d = $%04X, want $%04X", test.a, test.b, product, test.product)
+		}
+	}
+}
+
+func TestMMC5CHRModes(t *testing.T) {
+	tests := []struct {
+		mode uint8
+		size int
+		// Address fetched and the 1KB bank it should come from
+		fetches map[uint16]uint8
+	}{
+		{0, 0x2000, map[uint16]uint8{0x0000: 17 * 8, 0x1FFF: 17*8 + 7}},
+		{1, 0x1000, map[uint16]uint8{0x0000: 13 * 4, 0x1000: 17 * 4}},
+		{2, 0x0800, map[uint16]uint8{0x0000: 11 * 2, 0x0800: 13 * 2, 0x1000: 15 * 2, 0x1800: 17 * 2}},
+		{3, 0x0400, map[uint16]uint8{0x0000: 10, 0x0400: 11, 0x1000: 14, 0x1C00: 17}},
+	}
+	for _, test := range tests {
+		chr := numberedBanks(256, 0x400)
+		m := NewMMC5(numberedBanks(8, 0x2000), chr)
+		newMapperCPU(m)
+		m.Write(0x5101, test.mode)
+		for i := uint16(0); i < 8; i++ {
+			m.Write(0x5120+i, 10+uint8(i))
+		}
+		for address, bank := range test.fetches {
+			offset := m.fetchCHR(address)
+			if chr[offset] != bank {
+				t.Errorf("mode %d: $%04X fetched from 1KB bank %d, want %d", test.mode, address, chr[offset], bank)
+			}
+			if offset%test.size != int(address)%test.size {
+				t.Errorf("mode %d: $%04X fetched from offset $%05X", test.mode, address, offset)
+			}
+		}
+	}
+}
+
+func TestMMC5ExRAM(t *testing.T) {
+	tests := []struct {
+		mode     uint8
+		readable bool
+		writable bool
+	}{
+		{0, false, true},
+		{1, false, true},
+		{2, true, true},
+		{3, true, false},
+	}
+	for _, test := range tests {
+		m := NewMMC5(numberedBanks(8, 0x2000), nil)
+		newMapperCPU(m)
+		m.ExRAM[0x123] = 0x11
+		m.Write(0x5104, test.mode)
+		m.Write(0x5D23, 0x22)
+
+		want := uint8(0x11)
+		if test.writable {
+			want = 0x22
+		}
+		if m.ExRAM[0x123] != want {
+			t.Errorf("mode %d: ExRAM holds $%02X after a write, want $%02X", test.mode, m.ExRAM[0x123], want)
+		}
+		value, ok := m.Read(0x5D23)
+		if !test.readable {
+			want = 0
+		}
+		if !ok || value != want {
+			t.Errorf("mode %d: reading ExRAM gave $%02X, want $%02X", test.mode, value, want)
+		}
+	}
+}
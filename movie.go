@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+)
+
+// Frames between the RAM hashes stored in a recording
+const movieCheckpointInterval = 60
+
+// Written next to the start state of a movie so other emulators' users know why it fails
+const movieStartStateNote = "the start state is a nes-emulator save state, FCEUX and BizHawk cannot load it"
+
+/*
+Movie is a per-frame log of controller input. It starts at power-on, or from
+StartState when one is set, and carries RAM hashes so playback can detect desyncs.
+
+StartState is a save state in this emulator's own format. FM2 and BK2 files written
+with one are a private extension: FCEUX and BizHawk play back power-on movies
+written here, but cannot load the start state of the others.
+*/
+type Movie struct {
+	// Controller 1 and 2 buttons for every frame
+	Input [][2]uint8
+
+	ROMName   string
+	MD5       [16]byte // ROM checksum as stored by FCEUX, zero when unknown
+	SHA1      [20]byte // ROM checksum as stored by BizHawk, zero when unknown
+	Rerecords int
+	PAL       bool
+
+	StartState  []byte
+	Checkpoints map[int]uint64
+}
+
+func NewMovie(cart *Cartridge, romName string) *Movie {
+	return &Movie{
+		ROMName:     romName,
+		MD5:         cart.MD5(),
+		SHA1:        cart.SHA1(),
+		Checkpoints: make(map[int]uint64),
+	}
+}
+
+// PRG and CHR ROM without the header, or the disk sides of an FDS image
+func (cart *Cartridge) romData() []uint8 {
+	data := append(append([]uint8{}, cart.PRG...), cart.CHR...)
+	for _, side := range cart.Disks {
+		data = append(data, side...)
+	}
+	return data
+}
+
+// Checksum of the ROM data without the header, as FCEUX computes it
+func (cart *Cartridge) MD5() [16]byte {
+	return md5.Sum(cart.romData())
+}
+
+// Checksum of the ROM data without the header, as BizHawk computes it
+func (cart *Cartridge) SHA1() [20]byte {
+	return sha1.Sum(cart.romData())
+}
+
+// Returns an error when the movie was recorded with a different ROM
+func (m *Movie) CheckROM(cart *Cartridge) error {
+	if m.MD5 != ([16]byte{}) && m.MD5 != cart.MD5() {
+		return fmt.Errorf("movie was recorded with a different ROM (MD5 mismatch)")
+	}
+	if m.SHA1 != ([20]byte{}) && m.SHA1 != cart.SHA1() {
+		return fmt.Errorf("movie was recorded with a different ROM (SHA-1 mismatch)")
+	}
+	return nil
+}
+
+func ramHash(cpu *CPU) uint64 {
+	h := fnv.New64a()
+	h.Write(cpu.memory[:0x800])
+	return h.Sum64()
+}
+
+// Loads an FCEUX .fm2 or BizHawk .bk2 movie, picked by extension
+func LoadMovieFile(filename string) (*Movie, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".fm2":
+		return readFM2File(filename)
+	case ".bk2":
+		return readBK2File(filename)
+	}
+	return nil, fmt.Errorf("unknown movie format: %s", filename)
+}
+
+func (m *Movie) WriteFile(filename string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".fm2":
+		return m.writeFM2File(filename)
+	case ".bk2":
+		return m.writeBK2File(filename)
+	}
+	return fmt.Errorf("unknown movie format: %s", filename)
+}
+
+/*
+Starts recording input into movie. Recording from power-on needs a runner that has
+not run yet, otherwise the current state becomes the movie's start state.
+*/
+func (r *Runner) StartRecording(movie *Movie, fromState bool) error {
+	if fromState {
+		movie.StartState = r.SaveState()
+	} else if r.Frame != 0 || r.frameCycles != 0 {
+		return fmt.Errorf("recording from power-on must start before the first frame")
+	}
+	movie.PAL = r.Region == regionPAL
+	r.Movie = movie
+	r.recording = true
+	r.movieStart = r.Frame
+	r.Desync = -1
+	return nil
+}
+
+// Starts replaying movie, restoring its start state if it has one
+func (r *Runner) StartPlayback(movie *Movie) error {
+	if movie.PAL != (r.Region == regionPAL) {
+		return fmt.Errorf("movie was recorded on a different region than %s", r.Region.Name)
+	}
+	if movie.StartState != nil {
+		if err := r.LoadState(movie.StartState); err != nil {
+			return err
+		}
+	} else if r.Frame != 0 || r.frameCycles != 0 {
+		return fmt.Errorf("movie starts at power-on, playback must start before the first frame")
+	}
+	r.Movie = movie
+	r.recording = false
+	r.movieStart = r.Frame
+	r.Desync = -1
+	r.applyMovieInput(0)
+	return nil
+}
+
+// Stops recording or playback and returns the movie
+func (r *Runner) StopMovie() *Movie {
+	movie := r.Movie
+	r.Movie = nil
+	return movie
+}
+
+func (r *Runner) applyMovieInput(index int) {
+	if index < 0 || index >= len(r.Movie.Input) {
+		return
+	}
+	r.cpu.Controllers[0].Buttons = r.Movie.Input[index][0]
+	r.cpu.Controllers[1].Buttons = r.Movie.Input[index][1]
+}
+
+// Playback has applied the input of every frame in the movie
+func (r *Runner) MovieFinished() bool {
+	return r.Movie != nil && !r.recording && r.Frame-r.movieStart >= len(r.Movie.Input)
+}
+
+/*
+Called at the end of every frame. Recording logs the input the frame ran with, playback
+compares RAM against the recorded hash and then applies the next frame's input. Frames
+replayed by a rewind never get here, their input comes from the rewind buffer.
+*/
+func (r *Runner) movieFrameEnd() {
+	movie := r.Movie
+	index := r.Frame - 1 - r.movieStart
+	if index < 0 {
+		return
+	}
+
+	if r.recording && index >= len(movie.Input) {
+		movie.Input = append(movie.Input, [2]uint8{r.cpu.Controllers[0].Buttons, r.cpu.Controllers[1].Buttons})
+		if (index+1)%movieCheckpointInterval == 0 {
+			movie.Checkpoints[index] = ramHash(r.cpu)
+		}
+		return
+	}
+
+	if hash, ok := movie.Checkpoints[index]; ok && r.Desync < 0 && hash != ramHash(r.cpu) {
+		r.Desync = index
+	}
+	r.applyMovieInput(index + 1)
+}
+
+// Drops recorded input from the current frame on, recording continues from here
+func (r *Runner) rerecord() {
+	index := r.Frame - r.movieStart
+	if !r.recording || index < 0 || index >= len(r.Movie.Input) {
+		return
+	}
+	r.Movie.Input = r.Movie.Input[:index]
+	for frame := range r.Movie.Checkpoints {
+		if frame >= index {
+			delete(r.Movie.Checkpoints, frame)
+		}
+	}
+	r.Movie.Rerecords++
+}
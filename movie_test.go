@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMovieRoundTrip(t *testing.T) {
+	movie := &Movie{
+		Input:       [][2]uint8{{0, 0}, {ButtonA | ButtonRight, 0}, {ButtonStart, ButtonSelect | ButtonUp}, {0xFF, 0x0F}},
+		ROMName:     "game.nes",
+		MD5:         [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SHA1:        [20]byte{0xDE, 0xAD, 0xBE, 0xEF, 19: 0x01},
+		Rerecords:   12,
+		PAL:         true,
+		StartState:  []byte("NESS state"),
+		Checkpoints: map[int]uint64{1: 0x0123456789ABCDEF, 3: 42},
+	}
+	tests := []struct {
+		file  string
+		clear func(m *Movie)
+	}{
+		// Each format keeps the checksum of its own emulator
+		{"movie.fm2", func(m *Movie) { m.SHA1 = [20]byte{} }},
+		{"movie.bk2", func(m *Movie) { m.MD5 = [16]byte{} }},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			if err := movie.WriteFile(path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadMovieFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := *movie
+			test.clear(&want)
+			if !reflect.DeepEqual(got, &want) {
+				t.Errorf("read back %+v\nwant %+v", got, &want)
+			}
+		})
+	}
+}
+
+// Files with a start state say that other emulators cannot load it, power-on movies do not
+func TestMovieStartStateNote(t *testing.T) {
+	for _, startState := range [][]byte{nil, []byte("NESS state")} {
+		movie := &Movie{Input: [][2]uint8{{0, 0}}, StartState: startState, Checkpoints: map[int]uint64{}}
+		dir := t.TempDir()
+
+		fm2 := filepath.Join(dir, "movie.fm2")
+		if err := movie.WriteFile(fm2); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(fm2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if noted := strings.Contains(string(data), "comment "+movieStartStateNote); noted != (startState != nil) {
+			t.Errorf("start state %q: FM2 note %v", startState, noted)
+		}
+
+		bk2 := filepath.Join(dir, "movie.bk2")
+		if err := movie.WriteFile(bk2); err != nil {
+			t.Fatal(err)
+		}
+		archive, err := zip.OpenReader(bk2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		noted := false
+		for _, f := range archive.File {
+			if f.Name == "Comments.txt" {
+				data, err := readZipFile(f)
+				noted = err == nil && strings.Contains(string(data), movieStartStateNote)
+			}
+		}
+		archive.Close()
+		if noted != (startState != nil) {
+			t.Errorf("start state %q: BK2 note %v", startState, noted)
+		}
+	}
+}
+
+func TestMovieDesync(t *testing.T) {
+	// INC $00, JMP $8000 so RAM changes every frame
+	program := testPRG(0xE6, 0x00, 0x4C, 0x00, 0x80)
+	r := newTestRunner(&NROM{prg: program})
+	movie := &Movie{Checkpoints: make(map[int]uint64)}
+	if err := r.StartRecording(movie, false); err != nil {
+		t.Fatal(err)
+	}
+	for r.Frame < 8 {
+		r.RunFrame()
+	}
+	r.StopMovie()
+
+	// RAM at the end of frame 4, hashed the way a recording checkpoints it
+	r = newTestRunner(&NROM{prg: program})
+	for r.Frame < 5 {
+		r.RunFrame()
+	}
+	hash := ramHash(r.cpu)
+
+	for _, test := range []struct {
+		hash uint64
+		want int
+	}{
+		{hash, -1},
+		{hash + 1, 4},
+	} {
+		movie.Checkpoints = map[int]uint64{4: test.hash}
+		r := newTestRunner(&NROM{prg: program})
+		if err := r.StartPlayback(movie); err != nil {
+			t.Fatal(err)
+		}
+		for !r.MovieFinished() {
+			r.RunFrame()
+		}
+		if r.Desync != test.want {
+			t.Errorf("checkpoint %016x: desync at %d, want %d", test.hash, r.Desync, test.want)
+		}
+	}
+}
+
+func TestReadFM2(t *testing.T) {
+	data := "version 3\nemuVersion 22020\nrerecordCount 5\npalFlag 0\nromFilename smb\n" +
+		"comment ramhash 1 00000000000000ff\n" +
+		"|0|R......A|........||\n" +
+		"|0|...UT...|.L......||\n"
+	path := filepath.Join(t.TempDir(), "smb.fm2")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	movie, err := LoadMovieFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]uint8{{ButtonRight | ButtonA, 0}, {ButtonUp | ButtonStart, ButtonLeft}}
+	if !reflect.DeepEqual(movie.Input, want) {
+		t.Errorf("input = %v, want %v", movie.Input, want)
+	}
+	if movie.Rerecords != 5 || movie.ROMName != "smb" || movie.Checkpoints[1] != 0xFF {
+		t.Errorf("header not read: %+v", movie)
+	}
+}
+
+func TestParseBK2Input(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		want [][2]uint8
+	}{
+		{
+			"standard",
+			"LogKey:#Reset|Power|#P1 Up|P1 Down|P1 Left|P1 Right|P1 Start|P1 Select|P1 B|P1 A|#P2 Up|P2 Down|P2 Left|P2 Right|P2 Start|P2 Select|P2 B|P2 A|\n" +
+				"|..|U......A|.....s..|\n",
+			[][2]uint8{{ButtonUp | ButtonA, ButtonSelect}},
+		},
+		{
+			"columns found by name",
+			"LogKey:#P1 A|P1 B|Unknown|P1 Start|\n|A.xS|\n|.B..|\n",
+			[][2]uint8{{ButtonA | ButtonStart, 0}, {ButtonB, 0}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var movie Movie
+			if err := movie.parseBK2Input([]byte(test.log)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(movie.Input, test.want) {
+				t.Errorf("input = %v, want %v", movie.Input, test.want)
+			}
+		})
+	}
+
+	var movie Movie
+	if err := movie.parseBK2Input([]byte("|..|U.......|\n")); err == nil {
+		t.Error("input without a LogKey did not fail")
+	}
+}
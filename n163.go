@@ -0,0 +1,206 @@
+package main
+
+import "io"
+
+// CPU cycles the N163 spends on each channel before moving to the next
+const n163ChannelCycles = 15
+
+/*
+N163Audio is the wavetable sound of the Namco 163. Its 128 bytes of RAM hold 4 bit
+samples and, from $40 up, 8 bytes of registers per channel with channel 7 at the top.
+Up to 8 channels are updated one at a time, which the chip outputs in turn; this
+averages them, as the RC filter on the cartridge does.
+*/
+type N163Audio struct {
+	RAM       [128]uint8
+	Address   uint8
+	Increment bool
+	Disabled  bool // $E000 bit 6
+
+	Timer   uint8
+	Channel uint8 // channel updated next, counting down from 7
+	Outputs [8]int8
+}
+
+// Number of channels in use, from $7F bits 4-6
+func (a *N163Audio) channels() int {
+	return int(a.RAM[0x7F]>>4&7) + 1
+}
+
+// $4800 reads and writes the RAM at the address set through $F800
+func (a *N163Audio) read() uint8 {
+	value := a.RAM[a.Address]
+	a.advance()
+	return value
+}
+
+func (a *N163Audio) write(value uint8) {
+	a.RAM[a.Address] = value
+	a.advance()
+}
+
+func (a *N163Audio) advance() {
+	if a.Increment {
+		a.Address = (a.Address + 1) & 0x7F
+	}
+}
+
+func (a *N163Audio) setAddress(value uint8) {
+	a.Address = value & 0x7F
+	a.Increment = getBit(value, 7)
+}
+
+func (a *N163Audio) clock() {
+	a.Timer++
+	if a.Timer < n163ChannelCycles {
+		return
+	}
+	a.Timer = 0
+
+	base := 0x40 + int(a.Channel)*8
+	regs := a.RAM[base : base+8]
+	frequency := uint32(regs[0]) | uint32(regs[2])<<8 | uint32(regs[4]&3)<<16
+	phase := uint32(regs[1]) | uint32(regs[3])<<8 | uint32(regs[5])<<16
+	length := (256 - uint32(regs[4]&0xFC)) << 16
+	phase = (phase + frequency) % length
+	regs[1], regs[3], regs[5] = uint8(phase), uint8(phase>>8), uint8(phase>>16)
+
+	sample := (uint32(phase>>16) + uint32(regs[6])) & 0xFF
+	nibble := a.RAM[sample>>1] >> (4 * (sample & 1)) & 0x0F
+	a.Outputs[a.Channel] = (int8(nibble) - 8) * int8(regs[7]&0x0F)
+
+	if int(a.Channel) <= 8-a.channels() {
+		a.Channel = 7
+	} else {
+		a.Channel--
+	}
+}
+
+/*
+The level depends on the cartridge's resistors, this is about twice an APU pulse for
+one channel at full volume
+*/
+func (a *N163Audio) output() float64 {
+	if a.Disabled {
+		return 0
+	}
+	count := a.channels()
+	var sum int
+	for ch := 8 - count; ch < 8; ch++ {
+		sum += int(a.Outputs[ch])
+	}
+	return float64(sum) / float64(count) / 120 * pulseMixTable[15]
+}
+
+type namco163Registers struct {
+	PRG        [3]uint8
+	CHR        [12]uint8 // kept for when there is a PPU
+	IRQCounter uint16
+	IRQ        bool
+}
+
+/*
+Namco163 is mapper 19: three switchable 8KB banks at $8000-$DFFF with the last fixed
+at $E000, a 15 bit IRQ counter that fires when it reaches $7FFF, and the sound chip.
+*/
+type Namco163 struct {
+	Registers namco163Registers
+	Sound     N163Audio
+
+	prg []uint8
+	cpu *CPU
+}
+
+func NewNamco163(prg []uint8) *Namco163 {
+	return &Namco163{prg: prg}
+}
+
+func (m *Namco163) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+func (m *Namco163) mapBanks() {
+	for i, bank := range m.Registers.PRG {
+		m.cpu.mapPRG(m.prg, 0x8000+uint16(i)*0x2000, 0x2000, int(bank))
+	}
+	m.cpu.mapPRG(m.prg, 0xE000, 0x2000, -1)
+}
+
+func (m *Namco163) Read(address uint16) (uint8, bool) {
+	r := &m.Registers
+	switch address & 0xF800 {
+	case 0x4800:
+		return m.Sound.read(), true
+	case 0x5000:
+		return uint8(r.IRQCounter), true
+	case 0x5800:
+		return uint8(r.IRQCounter >> 8), true
+	}
+	return 0, false
+}
+
+func (m *Namco163) Write(address uint16, value uint8) bool {
+	r := &m.Registers
+	switch address & 0xF800 {
+	case 0x4800:
+		m.Sound.write(value)
+	case 0x5000:
+		r.IRQCounter = r.IRQCounter&0xFF00 | uint16(value)
+		r.IRQ = false
+	case 0x5800:
+		r.IRQCounter = r.IRQCounter&0x00FF | uint16(value)<<8
+		r.IRQ = false
+	case 0x8000, 0x8800, 0x9000, 0x9800, 0xA000, 0xA800, 0xB000, 0xB800, 0xC000, 0xC800, 0xD000, 0xD800:
+		r.CHR[(address-0x8000)>>11] = value
+	case 0xE000:
+		r.PRG[0] = value & 0x3F
+		m.Sound.Disabled = getBit(value, 6)
+		m.mapBanks()
+	case 0xE800:
+		r.PRG[1] = value & 0x3F
+		m.mapBanks()
+	case 0xF000:
+		r.PRG[2] = value & 0x3F
+		m.mapBanks()
+	case 0xF800:
+		m.Sound.setAddress(value)
+	default:
+		return address >= 0x8000
+	}
+	return true
+}
+
+// Bit 15 of the counter enables it
+func (m *Namco163) Clock() {
+	r := &m.Registers
+	if r.IRQCounter&0x8000 != 0 && r.IRQCounter&0x7FFF != 0x7FFF {
+		r.IRQCounter++
+		if r.IRQCounter&0x7FFF == 0x7FFF {
+			r.IRQ = true
+		}
+	}
+	m.Sound.clock()
+}
+
+func (m *Namco163) IRQ() bool {
+	return m.Registers.IRQ
+}
+
+func (m *Namco163) Audio() ExpansionAudio {
+	return &m.Sound
+}
+
+func (m *Namco163) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.Sound)
+}
+
+func (m *Namco163) loadState(r io.Reader) error {
+	registers, sound := m.Registers, m.Sound
+	if err := readMapperState(r, &registers, &sound); err != nil {
+		return err
+	}
+	m.Registers, m.Sound = registers, sound
+	m.mapBanks()
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Runs the N163 until it has updated count channels and returns them in order
+func n163Updates(m *Namco163, count int) []uint8 {
+	var channels []uint8
+	for len(channels) < count {
+		channel, timer := m.Sound.Channel, m.Sound.Timer
+		m.Clock()
+		if m.Sound.Timer < timer {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+func TestN163ChannelCount(t *testing.T) {
+	tests := []struct {
+		channels uint8
+		want     []uint8
+	}{
+		{1, []uint8{7, 7, 7}},
+		{3, []uint8{7, 6, 5, 7, 6, 5}},
+		{8, []uint8{7, 6, 5, 4, 3, 2, 1, 0, 7}},
+	}
+	for _, test := range tests {
+		m := NewNamco163(numberedBanks(8, 0x2000))
+		newMapperCPU(m)
+		m.Sound.Channel = 7
+		m.Sound.RAM[0x7F] = (test.channels - 1) << 4
+		if got := m.Sound.channels(); got != int(test.channels) {
+			t.Errorf("$7F = $%02X: %d channels, want %d", m.Sound.RAM[0x7F], got, test.channels)
+		}
+		if got := n163Updates(m, len(test.want)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d channels: updated %v, want %v", test.channels, got, test.want)
+		}
+	}
+}
+
+func TestN163Wavetable(t *testing.T) {
+	m := NewNamco163(numberedBanks(8, 0x2000))
+	newMapperCPU(m)
+
+	// The samples 1, 2, 3, 4 at nibble $10 are bytes $08-$09, low nibble first
+	m.Write(0xF800, 0x80|0x08)
+	m.Write(0x4800, 0x21)
+	m.Write(0x4800, 0x43)
+	if m.Sound.RAM[0x08] != 0x21 || m.Sound.RAM[0x09] != 0x43 || m.Sound.Address != 0x0A {
+		t.Fatalf("auto increment wrote $%02X $%02X, address $%02X", m.Sound.RAM[0x08], m.Sound.RAM[0x09], m.Sound.Address)
+	}
+
+	// Channel 7 steps one sample per update through a 4 sample wave at $10, volume 1
+	m.Write(0xF800, 0x80|0x78)
+	for _, value := range []uint8{0x00, 0, 0x00, 0, 0xFC | 0x01, 0, 0x10, 0x01} {
+		m.Write(0x4800, value)
+	}
+	if m.Sound.Address != 0 {
+		t.Errorf("address $%02X after writing $7F, want it to wrap to 0", m.Sound.Address)
+	}
+	m.Sound.Channel = 7
+
+	var outputs []int8
+	for i := 0; i < 5; i++ {
+		n163Updates(m, 1)
+		outputs = append(outputs, m.Sound.Outputs[7])
+	}
+	// Samples 2, 3, 4, 1, 2 less the midpoint of 8
+	if want := []int8{-6, -5, -4, -7, -6}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("outputs %v, want %v", outputs, want)
+	}
+
+	m.Write(0xF800, 0x08)
+	m.Write(0x4800, 0x65)
+	if value, _ := m.Read(0x4800); m.Sound.RAM[0x08] != 0x65 || value != 0x65 || m.Sound.Address != 0x08 {
+		t.Errorf("without auto increment the address moved to $%02X", m.Sound.Address)
+	}
+}
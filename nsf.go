@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nsfMagic      = "NESM\x1A"
+	nsfeMagic     = "NSFE"
+	nsfHeaderSize = 0x80
+)
+
+// Expansion sound chips, as flagged in the NSF header
+const (
+	nsfVRC6 = 1 << iota
+	nsfVRC7
+	nsfFDS
+	nsfMMC5
+	nsfN163
+	nsfSunsoft5B
+)
+
+var nsfChipNames = []string{"VRC6", "VRC7", "FDS", "MMC5", "Namco 163", "Sunsoft 5B"}
+
+// Microseconds between PLAY calls when an NSFe file has no RATE chunk
+const (
+	nsfNTSCSpeed = 16639
+	nsfPALSpeed  = 19997
+)
+
+/*
+Addresses in the driver the player puts at $4100. It calls INIT and then idles in a
+JMP to itself, which the player points at the PLAY call whenever a frame is due. The
+PLAY call starts by writing to nsfAck, which points the idle JMP back at itself.
+*/
+const (
+	nsfDriver   = 0x4100
+	nsfIdle     = nsfDriver + 3
+	nsfPlayCall = nsfDriver + 6
+	nsfAck      = nsfDriver + 0x0F
+)
+
+// One song of an NSF, Length and Fade are in milliseconds and -1 when the file does not say
+type NSFTrack struct {
+	Title  string
+	Length int
+	Fade   int
+}
+
+/*
+NSF is a music file ripped from a game: the code and data of its sound engine with the
+addresses of the routines that start a song and play one frame of it. NSFe files hold
+the same in chunks, along with track names and lengths.
+*/
+type NSF struct {
+	Title     string
+	Artist    string
+	Copyright string
+	Ripper    string
+
+	Load uint16
+	Init uint16
+	Play uint16
+	// 4KB banks at $8000-$FFFF when a song starts, all zero when the file does not bank switch
+	Banks [8]uint8
+	// Microseconds between PLAY calls
+	NTSCSpeed uint16
+	PALSpeed  uint16
+	Region    *Region
+	Chips     uint8
+
+	Tracks     []NSFTrack
+	StartTrack int // counting from 0
+	// Order an NSFe file wants its tracks played in, nil when it has no preference
+	Playlist []int
+
+	Data []uint8
+}
+
+func isNSFImage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(nsfMagic)) || bytes.HasPrefix(data, []byte(nsfeMagic))
+}
+
+// Parses an NSF or NSFe file into a cartridge whose PRG is the file's data in 4KB banks
+func parseNSF(data []uint8) (*Cartridge, error) {
+	var nsf *NSF
+	var err error
+	if bytes.HasPrefix(data, []byte(nsfeMagic)) {
+		nsf, err = parseNSFe(data)
+	} else {
+		nsf, err = parseNSFHeader(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(nsf.Tracks) == 0:
+		return nil, fmt.Errorf("NSF file has no tracks")
+	case len(nsf.Data) == 0:
+		return nil, fmt.Errorf("NSF file has no data")
+	case nsf.Load < nsf.base():
+		return nil, fmt.Errorf("NSF load address $%04X is outside cartridge space", nsf.Load)
+	}
+	if nsf.StartTrack >= len(nsf.Tracks) {
+		nsf.StartTrack = 0
+	}
+	return &Cartridge{PRG: nsf.image(), Region: nsf.Region, Title: nsf.Title, NSF: nsf}, nil
+}
+
+func nsfString(data []uint8) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+// Only PAL files play at PAL speed, dual region files are played as NTSC
+func nsfRegion(flags uint8) *Region {
+	if flags&3 == 1 {
+		return regionPAL
+	}
+	return regionNTSC
+}
+
+func newNSFTracks(count int) []NSFTrack {
+	tracks := make([]NSFTrack, count)
+	for i := range tracks {
+		tracks[i] = NSFTrack{Length: -1, Fade: -1}
+	}
+	return tracks
+}
+
+/*
+Parses an NSF with its 128 byte header. Version 2 files can give the length of their
+data, in which case NSFe chunks with track names and lengths may follow it.
+*/
+func parseNSFHeader(data []uint8) (*NSF, error) {
+	if len(data) < nsfHeaderSize || string(data[:5]) != nsfMagic {
+		return nil, fmt.Errorf("not a valid NSF file")
+	}
+	nsf := &NSF{
+		Title:      nsfString(data[0x0E:0x2E]),
+		Artist:     nsfString(data[0x2E:0x4E]),
+		Copyright:  nsfString(data[0x4E:0x6E]),
+		Load:       binary.LittleEndian.Uint16(data[0x08:]),
+		Init:       binary.LittleEndian.Uint16(data[0x0A:]),
+		Play:       binary.LittleEndian.Uint16(data[0x0C:]),
+		NTSCSpeed:  binary.LittleEndian.Uint16(data[0x6E:]),
+		PALSpeed:   binary.LittleEndian.Uint16(data[0x78:]),
+		Region:     nsfRegion(data[0x7A]),
+		Chips:      data[0x7B],
+		Tracks:     newNSFTracks(int(data[6])),
+		StartTrack: max(int(data[7])-1, 0),
+		Data:       data[nsfHeaderSize:],
+	}
+	copy(nsf.Banks[:], data[0x70:0x78])
+
+	if data[5] >= 2 {
+		length := int(data[0x7D]) | int(data[0x7E])<<8 | int(data[0x7F])<<16
+		if length > 0 && length < len(nsf.Data) {
+			metadata := nsf.Data[length:]
+			nsf.Data = nsf.Data[:length]
+			if err := nsf.parseChunks(metadata); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nsf, nil
+}
+
+func parseNSFe(data []uint8) (*NSF, error) {
+	if len(data) < 4 || string(data[:4]) != nsfeMagic {
+		return nil, fmt.Errorf("not a valid NSFe file")
+	}
+	nsf := &NSF{NTSCSpeed: nsfNTSCSpeed, PALSpeed: nsfPALSpeed, Region: regionNTSC}
+	if err := nsf.parseChunks(data[4:]); err != nil {
+		return nil, err
+	}
+	return nsf, nil
+}
+
+/*
+Reads NSFe chunks, each a little endian length followed by a 4 character ID. Chunks
+with an upper case ID are needed to play the file, so unknown ones are an error, and
+unknown lower case ones are skipped. NEND ends the list.
+*/
+func (nsf *NSF) parseChunks(data []uint8) error {
+	var titles []string
+	var lengths, fades []int
+	readTimes := func(chunk []uint8) []int {
+		var times []int
+		for i := 0; i+4 <= len(chunk); i += 4 {
+			times = append(times, max(int(int32(binary.LittleEndian.Uint32(chunk[i:]))), -1))
+		}
+		return times
+	}
+
+	for offset := 0; offset < len(data); {
+		if offset+8 > len(data) {
+			return fmt.Errorf("NSFe chunk header at %d is truncated", offset)
+		}
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		id := string(data[offset+4 : offset+8])
+		offset += 8
+		if length < 0 || offset+length > len(data) {
+			return fmt.Errorf("NSFe chunk %s is truncated", id)
+		}
+		chunk := data[offset : offset+length]
+		offset += length
+
+		switch id {
+		case "INFO":
+			if length < 8 {
+				return fmt.Errorf("NSFe INFO chunk is too short")
+			}
+			nsf.Load = binary.LittleEndian.Uint16(chunk[0:])
+			nsf.Init = binary.LittleEndian.Uint16(chunk[2:])
+			nsf.Play = binary.LittleEndian.Uint16(chunk[4:])
+			nsf.Region = nsfRegion(chunk[6])
+			nsf.Chips = chunk[7]
+			nsf.Tracks = newNSFTracks(1)
+			if length > 8 {
+				nsf.Tracks = newNSFTracks(int(chunk[8]))
+			}
+			if length > 9 {
+				nsf.StartTrack = int(chunk[9])
+			}
+		case "DATA":
+			nsf.Data = chunk
+		case "BANK":
+			copy(nsf.Banks[:], chunk)
+		case "RATE":
+			if length >= 2 {
+				nsf.NTSCSpeed = binary.LittleEndian.Uint16(chunk[0:])
+			}
+			if length >= 4 {
+				nsf.PALSpeed = binary.LittleEndian.Uint16(chunk[2:])
+			}
+		case "auth":
+			fields := append(strings.Split(string(chunk), "\x00"), "", "", "", "")
+			nsf.Title, nsf.Artist, nsf.Copyright, nsf.Ripper = fields[0], fields[1], fields[2], fields[3]
+		case "tlbl":
+			titles = strings.Split(strings.TrimSuffix(string(chunk), "\x00"), "\x00")
+		case "time":
+			lengths = readTimes(chunk)
+		case "fade":
+			fades = readTimes(chunk)
+		case "plst":
+			nsf.Playlist = nil
+			for _, track := range chunk {
+				nsf.Playlist = append(nsf.Playlist, int(track))
+			}
+		case "NEND":
+			offset = len(data)
+		default:
+			if id[0] >= 'A' && id[0] <= 'Z' {
+				return fmt.Errorf("unsupported NSFe chunk %s", id)
+			}
+		}
+	}
+
+	for i := range nsf.Tracks {
+		track := &nsf.Tracks[i]
+		if i < len(titles) {
+			track.Title = titles[i]
+		}
+		if i < len(lengths) {
+			track.Length = lengths[i]
+		}
+		if i < len(fades) {
+			track.Fade = fades[i]
+		}
+	}
+	return nil
+}
+
+func (nsf *NSF) bankSwitched() bool {
+	return nsf.Banks != [8]uint8{}
+}
+
+// Start of the memory the file's data can be loaded to, the disk system has RAM from $6000
+func (nsf *NSF) base() uint16 {
+	if nsf.Chips&nsfFDS != 0 {
+		return 0x6000
+	}
+	return 0x8000
+}
+
+/*
+Returns the data laid out in 4KB banks. A bank switched file's data starts Load&$0FFF
+bytes into its first bank, other files are laid out as they sit in memory from $8000,
+or from $6000 with the disk system.
+*/
+func (nsf *NSF) image() []uint8 {
+	padding := int(nsf.Load & 0x0FFF)
+	size := padding + len(nsf.Data)
+	if !nsf.bankSwitched() {
+		padding = int(nsf.Load - nsf.base())
+		size = max(padding+len(nsf.Data), 0x10000-int(nsf.base()))
+	}
+	image := make([]uint8, (size+0x0FFF)&^0x0FFF)
+	copy(image[padding:], nsf.Data)
+	return image
+}
+
+// Banks at $6000-$FFFF when a song starts, $6000 and $7000 are only banked with the disk system
+func (nsf *NSF) startBanks() [10]uint8 {
+	var banks [10]uint8
+	switch {
+	case nsf.bankSwitched():
+		copy(banks[2:], nsf.Banks[:])
+		// The disk system gets the banks of $E000 and $F000 at $6000 and $7000 too
+		banks[0], banks[1] = nsf.Banks[6], nsf.Banks[7]
+	case nsf.Chips&nsfFDS != 0:
+		for i := range banks {
+			banks[i] = uint8(i)
+		}
+	default:
+		for i := 2; i < len(banks); i++ {
+			banks[i] = uint8(i - 2)
+		}
+	}
+	return banks
+}
+
+func formatTrackTime(ms int) string {
+	return fmt.Sprintf("%d:%02d", ms/60000, ms/1000%60)
+}
+
+// Prints the metadata and the track list
+func (nsf *NSF) describe(w io.Writer) {
+	for _, field := range []struct{ name, value string }{
+		{"Title", nsf.Title}, {"Artist", nsf.Artist}, {"Copyright", nsf.Copyright}, {"Ripper", nsf.Ripper},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(w, "%-10s %s\n", field.name+":", field.value)
+		}
+	}
+	var chips []string
+	for i, name := range nsfChipNames {
+		if nsf.Chips&(1<<i) != 0 {
+			chips = append(chips, name)
+		}
+	}
+	if chips != nil {
+		fmt.Fprintf(w, "%-10s %s\n", "Chips:", strings.Join(chips, ", "))
+	}
+	fmt.Fprintf(w, "%-10s %s\n", "Region:", nsf.Region.Name)
+
+	for i, track := range nsf.Tracks {
+		line := fmt.Sprintf("%3d", i+1)
+		if i == nsf.StartTrack {
+			line += " *"
+		} else {
+			line += "  "
+		}
+		if track.Length >= 0 {
+			line += " " + formatTrackTime(track.Length)
+		}
+		if track.Title != "" {
+			line += " " + track.Title
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	if nsf.Playlist != nil {
+		var order []string
+		for _, track := range nsf.Playlist {
+			order = append(order, fmt.Sprint(track+1))
+		}
+		fmt.Fprintf(w, "%-10s %s\n", "Playlist:", strings.Join(order, " "))
+	}
+}
+
+// Sound chips the player can mix
+type nsfChip interface {
+	clock()
+	output() float64
+}
+
+type nsfRegisters struct {
+	Banks [10]uint8 // $5FF6-$5FFF, 4KB banks at $6000-$FFFF
+	Track uint8
+	// CPU cycles until PLAY is next due
+	PlayTimer float64
+}
+
+/*
+NSFPlayer is the mapper NSF files play on. It maps the bank switching at $5FF6-$5FFF and
+the expansion chips the file asks for, and drives INIT and PLAY through the driver at
+$4100, so the music runs on the CPU like it would in the game.
+*/
+type NSFPlayer struct {
+	Registers nsfRegisters
+	NSF       *NSF
+
+	VRC6      VRC6Audio
+	VRC7      VRC7Audio
+	FDS       FDSAudio
+	MMC5      MMC5Audio
+	N163      N163Audio
+	Sunsoft5B Sunsoft5BAudio
+	// MMC5 files can use its multiplier
+	multiplier mmc5Multiplier
+
+	prg   []uint8
+	cpu   *CPU
+	chips []nsfChip
+}
+
+func NewNSFPlayer(nsf *NSF, prg []uint8) *NSFPlayer {
+	m := &NSFPlayer{NSF: nsf, prg: prg}
+	for i, chip := range []nsfChip{&m.VRC6, &m.VRC7, &m.FDS, &m.MMC5, &m.N163, &m.Sunsoft5B} {
+		if m.has(1 << i) {
+			m.chips = append(m.chips, chip)
+		}
+	}
+	return m
+}
+
+func (m *NSFPlayer) has(chip uint8) bool {
+	return m.NSF.Chips&chip != 0
+}
+
+func (m *NSFPlayer) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.Start(m.NSF.StartTrack)
+}
+
+// Track being played, counting from 0
+func (m *NSFPlayer) Track() int {
+	return int(m.Registers.Track)
+}
+
+/*
+Starts a track, counting from 0, from a clean console: RAM cleared, sound registers
+silenced and the driver about to call INIT with the track in A and 1 in X for PAL.
+*/
+func (m *NSFPlayer) Start(track int) error {
+	if track < 0 || track >= len(m.NSF.Tracks) {
+		return fmt.Errorf("track %d is out of range, the file has %d", track+1, len(m.NSF.Tracks))
+	}
+	cpu := m.cpu
+	clear(cpu.memory[:0x0800])
+	clear(cpu.memory[0x6000:])
+
+	// Reset in place, audio recorders and save states hold on to the APU
+	cpu.APU.reset()
+	for address := uint16(0x4000); address <= 0x4013; address++ {
+		cpu.write(address, 0)
+	}
+	cpu.write(0x4015, 0x0F)
+	cpu.write(0x4017, 0x40)
+
+	m.VRC6 = VRC6Audio{}
+	m.VRC7 = VRC7Audio{}
+	m.VRC7.reset()
+	m.FDS = FDSAudio{EnvelopeSpeed: 0xE8}
+	m.MMC5 = newMMC5Audio()
+	m.N163 = N163Audio{}
+	m.Sunsoft5B = newSunsoft5BAudio()
+	m.multiplier = mmc5Multiplier{}
+
+	m.Registers = nsfRegisters{Banks: m.NSF.startBanks(), Track: uint8(track)}
+	m.Registers.PlayTimer = m.playPeriod()
+	m.mapBanks()
+
+	initAddress, playAddress := m.NSF.Init, m.NSF.Play
+	copy(cpu.memory[nsfDriver:], []uint8{
+		0x20, uint8(initAddress), uint8(initAddress >> 8), // JSR INIT
+		0x4C, uint8(nsfIdle & 0xFF), uint8(nsfIdle >> 8), // JMP to itself until PLAY is due
+		0x8D, uint8(nsfAck & 0xFF), uint8(nsfAck >> 8), // STA to acknowledge
+		0x20, uint8(playAddress), uint8(playAddress >> 8), // JSR PLAY
+		0x4C, uint8(nsfIdle & 0xFF), uint8(nsfIdle >> 8), // back to idle
+	})
+
+	cpu.A = uint8(track)
+	cpu.X = 0
+	if cpu.APU.region != regionNTSC {
+		cpu.X = 1
+	}
+	cpu.Y = 0
+	cpu.SP = 0xFD
+	cpu.P = 0x24
+	cpu.PC = nsfDriver
+	return nil
+}
+
+// CPU cycles between PLAY calls, Dendy consoles play at the PAL speed like they run at 50Hz
+func (m *NSFPlayer) playPeriod() float64 {
+	region := m.cpu.APU.region
+	speed := m.NSF.NTSCSpeed
+	if region != regionNTSC {
+		speed = m.NSF.PALSpeed
+	}
+	if speed == 0 {
+		// Fall back to once a frame
+		return float64(region.CyclesPerFrame())
+	}
+	return float64(speed) * region.CPUClock() / 1e6
+}
+
+func (m *NSFPlayer) mapBanks() {
+	for slot := range m.Registers.Banks {
+		m.mapBank(slot)
+	}
+}
+
+// Maps the bank of a slot counting from $6000, which is RAM unless the file uses the disk system
+func (m *NSFPlayer) mapBank(slot int) {
+	if slot < 2 && !m.has(nsfFDS) {
+		return
+	}
+	m.cpu.mapPRG(m.prg, 0x6000+uint16(slot)*0x1000, 0x1000, int(m.Registers.Banks[slot]))
+}
+
+func (m *NSFPlayer) Read(address uint16) (uint8, bool) {
+	switch {
+	case m.has(nsfFDS) && address >= 0x4040 && address <= 0x4092:
+		return m.FDS.read(address)
+	case m.has(nsfN163) && address&0xF800 == 0x4800:
+		return m.N163.read(), true
+	case m.has(nsfMMC5) && address >= 0x5000 && address <= 0x5015:
+		return m.MMC5.read(address)
+	case m.has(nsfMMC5) && (address == 0x5205 || address == 0x5206):
+		return m.multiplier.read(address), true
+	}
+	return 0, false
+}
+
+func (m *NSFPlayer) Write(address uint16, value uint8) bool {
+	switch {
+	case address == nsfAck:
+		m.cpu.memory[nsfIdle+1] = uint8(nsfIdle & 0xFF)
+	case address >= 0x5FF6 && address <= 0x5FFF:
+		slot := int(address - 0x5FF6)
+		m.Registers.Banks[slot] = value
+		m.mapBank(slot)
+	case m.writeChips(address, value):
+	case address < 0x8000:
+		return false
+	case m.has(nsfFDS):
+		// The disk system's RAM reaches all the way up
+		m.cpu.memory[address] = value
+	}
+	return true
+}
+
+// Passes writes on to the expansion chips the file uses, false when none of them took it
+func (m *NSFPlayer) writeChips(address uint16, value uint8) bool {
+	switch {
+	case m.has(nsfFDS) && address >= 0x4040 && address <= 0x408A:
+		m.FDS.write(address, value)
+	case m.has(nsfN163) && address&0xF800 == 0x4800:
+		m.N163.write(value)
+	case m.has(nsfN163) && address&0xF800 == 0xF800:
+		m.N163.setAddress(value)
+	case m.has(nsfMMC5) && address >= 0x5000 && address <= 0x5015:
+		m.MMC5.write(address, value)
+	case m.has(nsfMMC5) && (address == 0x5205 || address == 0x5206):
+		m.multiplier.write(address, value)
+	case m.has(nsfVRC7) && (address == 0x9010 || address == 0x9030):
+		m.VRC7.write(address, value)
+	case m.has(nsfVRC6) && address >= 0x9000 && address <= 0xB002 && address&0x0FFC == 0:
+		m.VRC6.write(address, value)
+	case m.has(nsfSunsoft5B) && address >= 0xC000:
+		m.Sunsoft5B.write(address, value)
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *NSFPlayer) Clock() {
+	m.Registers.PlayTimer--
+	if m.Registers.PlayTimer <= 0 {
+		m.Registers.PlayTimer += m.playPeriod()
+		// Point the idle loop at the PLAY call
+		m.cpu.memory[nsfIdle+1] = uint8(nsfPlayCall & 0xFF)
+	}
+	for _, chip := range m.chips {
+		chip.clock()
+	}
+}
+
+func (m *NSFPlayer) IRQ() bool {
+	return false
+}
+
+func (m *NSFPlayer) Audio() ExpansionAudio {
+	return m
+}
+
+// The chips add together, each at the level its own mapper mixes it
+func (m *NSFPlayer) output() float64 {
+	var level float64
+	for _, chip := range m.chips {
+		level += chip.output()
+	}
+	return level
+}
+
+func (m *NSFPlayer) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.VRC6, &m.VRC7, &m.FDS, &m.MMC5, &m.N163, &m.Sunsoft5B, &m.multiplier)
+}
+
+func (m *NSFPlayer) loadState(r io.Reader) error {
+	registers, vrc6, vrc7, fds, mmc5, n163, sunsoft, multiplier := m.Registers, m.VRC6, m.VRC7, m.FDS, m.MMC5, m.N163, m.Sunsoft5B, m.multiplier
+	if err := readMapperState(r, &registers, &vrc6, &vrc7, &fds, &mmc5, &n163, &sunsoft, &multiplier); err != nil {
+		return err
+	}
+	m.Registers, m.VRC6, m.VRC7, m.FDS, m.MMC5, m.N163, m.Sunsoft5B, m.multiplier = registers, vrc6, vrc7, fds, mmc5, n163, sunsoft, multiplier
+	if !m.has(nsfFDS) {
+		// Disk system banks are RAM, which the save state already holds
+		m.mapBanks()
+	}
+	return nil
+}
+
+// The NSF player when an NSF is loaded, otherwise nil
+func (r *Runner) NSF() *NSFPlayer {
+	player, _ := r.cpu.Mapper.(*NSFPlayer)
+	return player
+}
+
+// Length of a track and its fade out in frames, defaultLength seconds when the file does not say
+func (r *Runner) nsfTrackFrames(track NSFTrack, defaultLength float64) (int, int) {
+	framesPerMs := r.Region.CPUClock() / float64(r.Region.CyclesPerFrame()) / 1000
+	length := defaultLength * 1000
+	if track.Length >= 0 {
+		length = float64(track.Length)
+	}
+	fade := float64(max(track.Fade, 0))
+	return int(length * framesPerMs), int(fade * framesPerMs)
+}
+
+// Volume of a frame of a track, fading out after length frames so the last of them is silent
+func nsfFadeVolume(frame, length, fade int) float64 {
+	if frame < length {
+		return 1
+	}
+	return max(1-float64(frame-length+1)/float64(fade), 0)
+}
+
+// What RenderNSF wrote for one track
+type NSFRender struct {
+	Track    int // zero based
+	Filename string
+	Frames   int
+	// The track ran into a BRK before its length and fade were up
+	Stopped bool
+}
+
+/*
+Plays tracks of the loaded NSF into WAV files with nothing else running, each for its
+length from the file or defaultLength seconds, and then fading out over its fade time.
+With several tracks the track number goes into each file name, e.g. music-03.wav.
+Returns the tracks written before any error.
+*/
+func (r *Runner) RenderNSF(tracks []int, filename string, rate int, stems bool, defaultLength float64) ([]NSFRender, error) {
+	player := r.NSF()
+	var renders []NSFRender
+	for _, track := range tracks {
+		name := filename
+		if len(tracks) > 1 {
+			ext := filepath.Ext(filename)
+			name = fmt.Sprintf("%s-%02d%s", strings.TrimSuffix(filename, ext), track+1, ext)
+		}
+		if err := player.Start(track); err != nil {
+			return renders, err
+		}
+		audio, err := NewAudioRecorder(name, rate, stems, r.Region)
+		if err != nil {
+			return renders, err
+		}
+		r.Audio = audio
+
+		render := NSFRender{Track: track, Filename: name}
+		length, fade := r.nsfTrackFrames(player.NSF.Tracks[track], defaultLength)
+		for ; render.Frames < length+fade; render.Frames++ {
+			audio.Volume = nsfFadeVolume(render.Frames, length, fade)
+			if !r.RunFrame() {
+				render.Stopped = true
+				break
+			}
+		}
+
+		r.Audio = nil
+		if err := audio.Close(); err != nil {
+			return renders, err
+		}
+		renders = append(renders, render)
+	}
+	return renders, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// An NSF header for tracks songs starting at the second, loading at $8000
+func testNSFHeader(version, tracks uint8) []uint8 {
+	header := make([]uint8, nsfHeaderSize)
+	copy(header, nsfMagic)
+	header[5] = version
+	header[6] = tracks
+	header[7] = 2
+	binary.LittleEndian.PutUint16(header[0x08:], 0x8000)
+	binary.LittleEndian.PutUint16(header[0x0A:], 0x8003)
+	binary.LittleEndian.PutUint16(header[0x0C:], 0x8006)
+	copy(header[0x0E:], "Title")
+	copy(header[0x2E:], "Artist")
+	copy(header[0x4E:], "1987")
+	binary.LittleEndian.PutUint16(header[0x6E:], nsfNTSCSpeed)
+	binary.LittleEndian.PutUint16(header[0x78:], nsfPALSpeed)
+	return header
+}
+
+func nsfChunk(id string, data ...uint8) []uint8 {
+	chunk := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	return append(append(chunk, id...), data...)
+}
+
+func nsfTimes(times ...int32) []uint8 {
+	var data []uint8
+	for _, time := range times {
+		data = binary.LittleEndian.AppendUint32(data, uint32(time))
+	}
+	return data
+}
+
+func TestParseNSF(t *testing.T) {
+	code := []uint8{0x60, 0x60, 0x60}
+	info := []uint8{0x00, 0x80, 0x03, 0x80, 0x06, 0x80, 0x01, nsfN163, 2, 1}
+
+	pal := testNSFHeader(1, 3)
+	pal[0x7A] = 1
+	pal[0x7B] = nsfVRC6
+	copy(pal[0x70:], []uint8{0, 1, 2, 3, 4, 5, 6, 7})
+
+	nsf2 := testNSFHeader(2, 2)
+	nsf2[0x7D] = uint8(len(code))
+
+	tests := []struct {
+		name string
+		data []uint8
+		want *NSF
+		err  string
+	}{
+		{
+			name: "nsf",
+			data: join(pal, code),
+			want: &NSF{
+				Title: "Title", Artist: "Artist", Copyright: "1987",
+				Load: 0x8000, Init: 0x8003, Play: 0x8006,
+				Banks:     [8]uint8{0, 1, 2, 3, 4, 5, 6, 7},
+				NTSCSpeed: nsfNTSCSpeed, PALSpeed: nsfPALSpeed,
+				Region: regionPAL, Chips: nsfVRC6,
+				Tracks: newNSFTracks(3), StartTrack: 1,
+				Data: code,
+			},
+		},
+		{
+			name: "nsf2 metadata",
+			data: join(nsf2, code,
+				nsfChunk("tlbl", []uint8("Intro\x00Boss\x00")...),
+				nsfChunk("time", nsfTimes(90000, -1)...),
+				nsfChunk("fade", nsfTimes(5000)...),
+				nsfChunk("NEND"),
+			),
+			want: &NSF{
+				Title: "Title", Artist: "Artist", Copyright: "1987",
+				Load: 0x8000, Init: 0x8003, Play: 0x8006,
+				NTSCSpeed: nsfNTSCSpeed, PALSpeed: nsfPALSpeed,
+				Region: regionNTSC,
+				Tracks: []NSFTrack{
+					{Title: "Intro", Length: 90000, Fade: 5000},
+					{Title: "Boss", Length: -1, Fade: -1},
+				},
+				StartTrack: 1,
+				Data:       code,
+			},
+		},
+		{
+			name: "nsfe",
+			data: join([]uint8(nsfeMagic),
+				nsfChunk("INFO", info...),
+				nsfChunk("DATA", code...),
+				nsfChunk("BANK", 3, 2, 1),
+				nsfChunk("RATE", 0x10, 0x27),
+				nsfChunk("auth", []uint8("Title\x00Artist\x00\x00Ripper")...),
+				nsfChunk("plst", 1, 0),
+				nsfChunk("xtra", 1, 2, 3),
+				nsfChunk("NEND"),
+				[]uint8("anything after NEND"),
+			),
+			want: &NSF{
+				Title: "Title", Artist: "Artist", Ripper: "Ripper",
+				Load: 0x8000, Init: 0x8003, Play: 0x8006,
+				Banks:     [8]uint8{3, 2, 1},
+				NTSCSpeed: 10000, PALSpeed: nsfPALSpeed,
+				Region: regionPAL, Chips: nsfN163,
+				Tracks: newNSFTracks(2), StartTrack: 1,
+				Playlist: []int{1, 0},
+				Data:     code,
+			},
+		},
+		{name: "bad magic", data: []uint8("NESM\x00"), err: "not a valid NSF"},
+		{name: "no tracks", data: join(testNSFHeader(1, 0), code), err: "no tracks"},
+		{name: "no data", data: testNSFHeader(1, 1), err: "no data"},
+		{
+			name: "load below cartridge",
+			data: join([]uint8(nsfeMagic), nsfChunk("INFO", 0x00, 0x60, 0, 0, 0, 0, 0, 0), nsfChunk("DATA", code...)),
+			err:  "outside cartridge space",
+		},
+		{
+			name: "unknown required chunk",
+			data: join([]uint8(nsfeMagic), nsfChunk("INFO", info...), nsfChunk("DATA", code...), nsfChunk("ABCD")),
+			err:  "unsupported NSFe chunk ABCD",
+		},
+		{
+			name: "truncated chunk",
+			data: join([]uint8(nsfeMagic), nsfChunk("INFO", info...)[:12]),
+			err:  "NSFe chunk INFO is truncated",
+		},
+		{name: "short info", data: join([]uint8(nsfeMagic), nsfChunk("INFO", 0, 0x80)), err: "INFO chunk is too short"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cart, err := parseNSF(test.data)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cart.NSF, test.want) {
+				t.Errorf("parsed\n%+v\nwant\n%+v", cart.NSF, test.want)
+			}
+			if cart.Region != test.want.Region || cart.Title != test.want.Title {
+				t.Errorf("cartridge region %s and title %q", cart.Region.Name, cart.Title)
+			}
+		})
+	}
+}
+
+func TestNSFImage(t *testing.T) {
+	code := []uint8{0xA9, 0x01, 0x60}
+	tests := []struct {
+		name   string
+		nsf    NSF
+		size   int
+		offset int
+	}{
+		{"unbanked", NSF{Load: 0x8123}, 0x8000, 0x0123},
+		{"banked", NSF{Load: 0x8123, Banks: [8]uint8{0, 1}}, 0x1000, 0x0123},
+		{"disk system", NSF{Load: 0x6010, Chips: nsfFDS}, 0xA000, 0x0010},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.nsf.Data = code
+			image := test.nsf.image()
+			if len(image) != test.size {
+				t.Errorf("image is $%X bytes, want $%X", len(image), test.size)
+			}
+			if !bytes.Equal(image[test.offset:test.offset+len(code)], code) {
+				t.Errorf("data is not at $%04X", test.offset)
+			}
+		})
+	}
+}
+
+func TestNSFFadeVolume(t *testing.T) {
+	const length, fade = 10, 4
+	want := []float64{1, 1, 0.75, 0.5, 0.25, 0}
+	for i, frame := range []int{0, length - 1, length, length + 1, length + 2, length + fade - 1} {
+		if got := nsfFadeVolume(frame, length, fade); got != want[i] {
+			t.Errorf("volume of frame %d = %v, want %v", frame, got, want[i])
+		}
+	}
+}
+
+func TestNSFStartKeepsAPU(t *testing.T) {
+	// INIT stores the track at $10, PLAY is an RTS
+	nsf := &NSF{
+		Load: 0x8000, Init: 0x8000, Play: 0x8003,
+		NTSCSpeed: nsfNTSCSpeed, Region: regionNTSC, Chips: nsfVRC6,
+		Tracks: newNSFTracks(2),
+		Data:   []uint8{0x85, 0x10, 0x60, 0x60},
+	}
+	player := NewNSFPlayer(nsf, nsf.image())
+	r := newTestRunner(player)
+	r.cpu.APU.Expansion = player.Audio()
+	apu := r.cpu.APU
+
+	player.Start(1)
+	runTo(t, r, nsfIdle, 10)
+	if r.cpu.memory[0x10] != 1 {
+		t.Fatalf("INIT stored track %d, want 1", r.cpu.memory[0x10])
+	}
+	r.RunFrame()
+	if apu.Noise.Shift == 1 {
+		t.Fatal("noise did not run")
+	}
+
+	if err := player.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	if r.cpu.APU != apu {
+		t.Fatal("Start replaced the APU")
+	}
+	if apu.Expansion != player.Audio() || apu.Noise.Shift != 1 || apu.Cycle != 0 {
+		t.Errorf("APU was not reset: expansion %v, noise shift %d, cycle %d", apu.Expansion, apu.Noise.Shift, apu.Cycle)
+	}
+	if err := player.Start(2); err == nil {
+		t.Error("starting a track past the end did not fail")
+	}
+}
+
+func TestRenderNSF(t *testing.T) {
+	// INIT shifts the track into carry and runs into a BRK for track 2, PLAY is an RTS
+	nsf := &NSF{
+		Load: 0x8000, Init: 0x8000, Play: 0x8005,
+		NTSCSpeed: nsfNTSCSpeed, Region: regionNTSC,
+		Tracks: newNSFTracks(3),
+		Data:   []uint8{0x4A, 0x90, 0x01, 0x00, 0x60, 0x60},
+	}
+	nsf.Tracks[0] = NSFTrack{Length: 100, Fade: 50}
+	player := NewNSFPlayer(nsf, nsf.image())
+	r := newTestRunner(player)
+
+	filename := filepath.Join(t.TempDir(), "music.wav")
+	renders, err := r.RenderNSF([]int{0, 1, 2}, filename, 44100, false, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(filename)
+	// 100ms and 50ms of fade from the file, then the 200ms default
+	want := []NSFRender{
+		{Track: 0, Filename: filepath.Join(dir, "music-01.wav"), Frames: 9},
+		{Track: 1, Filename: filepath.Join(dir, "music-02.wav"), Stopped: true},
+		{Track: 2, Filename: filepath.Join(dir, "music-03.wav"), Frames: 12},
+	}
+	if !reflect.DeepEqual(renders, want) {
+		t.Errorf("rendered %+v\nwant %+v", renders, want)
+	}
+	for _, render := range renders {
+		if _, err := os.Stat(render.Filename); err != nil {
+			t.Error(err)
+		}
+	}
+
+	renders, err = r.RenderNSF([]int{0, 5}, filename, 44100, false, 0.2)
+	if err == nil || len(renders) != 1 {
+		t.Errorf("rendering a missing track returned %d tracks and error %v", len(renders), err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// Composite samples per PPU dot, the signal has 12 phases per colour subcarrier cycle
+const (
+	ntscSamplesPerDot = 8
+	ntscLineSamples   = screenWidth * ntscSamplesPerDot
+)
+
+// Output columns per scale step, wider than the 256 pixels so the artifacts have room
+const ntscColumnsPerScale = 301
+
+/*
+NTSCFilter renders frames by generating the composite signal the PPU would output and
+decoding it the way a TV does, which gives dot crawl, colour fringing and blending
+between neighbouring pixels. It runs entirely on the CPU.
+*/
+type NTSCFilter struct {
+	// Hue is fixed when the filter is created
+	Params NTSCParams
+
+	// 0 keeps the luma filter a full colour cycle wide, 1 narrows it to a third of one
+	// for sharper edges and more chroma crawling into the luma
+	Sharpness float64
+	// 0 decodes colour from clean per-pixel values, 1 from the raw composite signal
+	Artifacts float64
+
+	// YIQ of each pixel decoded in isolation, used for the clean part of the mix
+	clean [512][3]float64
+	// Signal level of each pixel and the demodulating carrier at each phase
+	levels  [512][12]float64
+	carrier [12][2]float64
+}
+
+func NewNTSCFilter(params NTSCParams, sharpness float64, artifacts float64) *NTSCFilter {
+	f := &NTSCFilter{Params: params, Sharpness: sharpness, Artifacts: artifacts}
+	for pixel := range f.clean {
+		f.clean[pixel] = ntscDecode(uint16(pixel), params.Hue)
+		for phase := range f.levels[pixel] {
+			f.levels[pixel][phase] = ntscLevel(uint16(pixel), phase)
+		}
+	}
+	for phase := range f.carrier {
+		angle := ntscAngle(phase, params.Hue)
+		f.carrier[phase] = [2]float64{math.Cos(angle), math.Sin(angle)}
+	}
+	return f
+}
+
+/*
+Phase of the first sample of a scanline. Every scanline is 341 dots, which moves the
+subcarrier on by 4 phases, and the dot skipped on odd frames moves it back by 8,
+giving the two frame dot crawl.
+*/
+func ntscLinePhase(frame int, line int) int {
+	return (4*(frame&1) + 4*line) % 12
+}
+
+// Box filter of width samples centred on each sample, using prefix sums
+func boxFilter(in []float64, out []float64, width int) {
+	sums := make([]float64, len(in)+1)
+	for i, v := range in {
+		sums[i+1] = sums[i] + v
+	}
+	for i := range out {
+		lo := max(i-width/2, 0)
+		hi := min(i-width/2+width, len(in))
+		out[i] = (sums[hi] - sums[lo]) / float64(hi-lo)
+	}
+}
+
+// Renders the frame at 301 columns and 240 lines per scale step
+func (f *NTSCFilter) Image(fb *Framebuffer, frame int, scale int) *image.RGBA {
+	if scale < 1 {
+		scale = 1
+	}
+	width := ntscColumnsPerScale * scale
+	img := image.NewRGBA(image.Rect(0, 0, width, screenHeight*scale))
+
+	lumaWidth := int(math.Round(12 - 8*math.Max(0, math.Min(1, f.Sharpness))))
+	var raw, clean [3][ntscLineSamples]float64
+	var filtered [3][ntscLineSamples]float64
+	for line := 0; line < screenHeight; line++ {
+		phase0 := ntscLinePhase(frame, line)
+		for n := 0; n < ntscLineSamples; n++ {
+			pixel := fb.At(n/ntscSamplesPerDot, line) & 0x1FF
+			phase := (phase0 + n) % 12
+			s := f.levels[pixel][phase]
+			raw[0][n] = s
+			raw[1][n] = s * f.carrier[phase][0]
+			raw[2][n] = s * f.carrier[phase][1]
+			clean[0][n], clean[1][n], clean[2][n] = f.clean[pixel][0], f.clean[pixel][1], f.clean[pixel][2]
+		}
+
+		// Luma through the sharpness filter, chroma demodulated over a whole cycle
+		for c, w := range [3]int{lumaWidth, 12, 12} {
+			boxFilter(raw[c][:], filtered[c][:], w)
+			boxFilter(clean[c][:], clean[c][:], w)
+		}
+
+		for x := 0; x < width; x++ {
+			n := (2*x + 1) * ntscLineSamples / (2 * width)
+			var yiq [3]float64
+			for c := range yiq {
+				yiq[c] = clean[c][n] + f.Artifacts*(filtered[c][n]-clean[c][n])
+			}
+			rgb := f.Params.color(yiq)
+			for sy := 0; sy < scale; sy++ {
+				img.SetRGBA(x, line*scale+sy, rgb)
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestNTSCFilterSize(t *testing.T) {
+	f := NewNTSCFilter(defaultNTSCParams, 0, 1)
+	for _, scale := range []int{0, 1, 2} {
+		bounds := f.Image(&Framebuffer{}, 0, scale).Bounds()
+		size := max(scale, 1)
+		if bounds.Dx() != ntscColumnsPerScale*size || bounds.Dy() != screenHeight*size {
+			t.Errorf("scale %d: image is %dx%d, want %dx%d", scale, bounds.Dx(), bounds.Dy(), ntscColumnsPerScale*size, screenHeight*size)
+		}
+	}
+}
+
+/*
+A frame of one colour decodes to the palette colour whether or not the artifacts are
+on, as long as the luma filter spans a whole colour cycle
+*/
+func TestNTSCFilterFlatField(t *testing.T) {
+	palette := GenerateNTSCPalette(defaultNTSCParams)
+	for _, artifacts := range []float64{0, 1} {
+		f := NewNTSCFilter(defaultNTSCParams, 0, artifacts)
+		for _, pixel := range []uint16{0x0F, 0x00, 0x16, 0x12, 0x2A, 0x30, 0x40 | 0x21, 0x1C0 | 0x27} {
+			fb := &Framebuffer{}
+			for i := range fb.Pixels {
+				fb.Pixels[i] = pixel
+			}
+			for frame := 0; frame < 2; frame++ {
+				img := f.Image(fb, frame, 1)
+				want := palette[pixel]
+				// The edges of each line see less than a colour cycle of signal
+				for _, y := range []int{0, 1, 2, 120, 239} {
+					for x := 8; x < ntscColumnsPerScale-8; x += 7 {
+						c := img.RGBAAt(x, y)
+						if diff := max(absDiff(c.R, want.R), absDiff(c.G, want.G), absDiff(c.B, want.B)); diff > 4 {
+							t.Fatalf("artifacts %v, pixel $%03X, frame %d: %d,%d is %v, want %v", artifacts, pixel, frame, x, y, c, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// A sharper luma filter lets the chroma of a flat colour crawl into the luma
+func TestNTSCFilterSharpness(t *testing.T) {
+	fb := &Framebuffer{}
+	for i := range fb.Pixels {
+		fb.Pixels[i] = 0x16
+	}
+	img := NewNTSCFilter(defaultNTSCParams, 1, 1).Image(fb, 0, 1)
+	first := img.RGBAAt(100, 10)
+	for x := 101; x < 110; x++ {
+		if img.RGBAAt(x, 10) != first {
+			return
+		}
+	}
+	t.Error("a sharp luma filter gave a flat colour without artifacts")
+}
+
+func absDiff(a uint8, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Alternating pixels blend and fringe differently on odd and even frames with the artifacts on
+func TestNTSCFilterDotCrawl(t *testing.T) {
+	fb := &Framebuffer{}
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			fb.Set(x, y, uint16(0x30*(x&1)))
+		}
+	}
+	clean := NewNTSCFilter(defaultNTSCParams, 0, 0)
+	if clean.Image(fb, 0, 1).RGBAAt(150, 10) != clean.Image(fb, 1, 1).RGBAAt(150, 10) {
+		t.Error("without artifacts the output changed between frames")
+	}
+	composite := NewNTSCFilter(defaultNTSCParams, 0, 1)
+	even, odd := composite.Image(fb, 0, 1), composite.Image(fb, 1, 1)
+	changed := false
+	for x := 8; x < ntscColumnsPerScale-8; x++ {
+		if even.RGBAAt(x, 10) != odd.RGBAAt(x, 10) {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Error("with artifacts the odd frame matched the even one")
+	}
+
+	tests := []struct{ frame, line, phase int }{
+		{0, 0, 0}, {0, 1, 4}, {0, 3, 0}, {1, 0, 4}, {1, 2, 0},
+	}
+	for _, test := range tests {
+		if phase := ntscLinePhase(test.frame, test.line); phase != test.phase {
+			t.Errorf("frame %d line %d starts at phase %d, want %d", test.frame, test.line, phase, test.phase)
+		}
+	}
+}
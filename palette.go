@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+)
+
+/*
+Palette maps framebuffer pixels to RGB. The low 6 bits are the NES colour and bits
+6-8 the red, green and blue emphasis bits of $2001, so there are 8 sets of 64 colours.
+*/
+type Palette [512]color.RGBA
+
+// Emphasis attenuates the two colours that are not emphasized by roughly this much
+const emphasisAttenuation = 0.816
+
+func rgbPalette(values [64]uint32) *Palette {
+	var p Palette
+	for i, v := range values {
+		p[i] = color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xFF}
+	}
+	p.deriveEmphasis()
+	return &p
+}
+
+// Fills the emphasis sets from the first 64 colours, for palettes that do not have them
+func (p *Palette) deriveEmphasis() {
+	for emphasis := 1; emphasis < 8; emphasis++ {
+		scale := [3]float64{1, 1, 1}
+		for channel := 0; channel < 3; channel++ {
+			if emphasis&(1<<channel) == 0 {
+				continue
+			}
+			for other := range scale {
+				if other != channel {
+					scale[other] *= emphasisAttenuation
+				}
+			}
+		}
+		for i := 0; i < 64; i++ {
+			c := p[i]
+			p[emphasis<<6|i] = color.RGBA{
+				uint8(float64(c.R) * scale[0]),
+				uint8(float64(c.G) * scale[1]),
+				uint8(float64(c.B) * scale[2]),
+				0xFF,
+			}
+		}
+	}
+}
+
+// A typical 2C02 palette, used when no palette file is given
+var defaultPalette = rgbPalette([64]uint32{
+	0x666666, 0x002A88, 0x1412A7, 0x3B00A4, 0x5C007E, 0x6E0040, 0x6C0600, 0x561D00,
+	0x333500, 0x0B4800, 0x005200, 0x004F08, 0x00404D, 0x000000, 0x000000, 0x000000,
+	0xADADAD, 0x155FD9, 0x4240FF, 0x7527FE, 0xA01ACC, 0xB71E7B, 0xB53120, 0x994E00,
+	0x6B6D00, 0x388700, 0x0C9300, 0x008F32, 0x007C8D, 0x000000, 0x000000, 0x000000,
+	0xFFFEFF, 0x64B0FF, 0x9290FF, 0xC676FF, 0xF36AFF, 0xFE6ECC, 0xFE8170, 0xEA9E22,
+	0xBCBE00, 0x88D800, 0x5CE430, 0x45E082, 0x48CDDE, 0x4F4F4F, 0x000000, 0x000000,
+	0xFFFEFF, 0xC0DFFF, 0xD3D2FF, 0xE8C8FF, 0xFBC2FF, 0xFEC4EA, 0xFECCC5, 0xF7D8A5,
+	0xE4E594, 0xCFEF96, 0xBDF4AB, 0xB3F3CC, 0xB5EBF2, 0xB8B8B8, 0x000000, 0x000000,
+})
+
+/*
+Loads a .pal file of RGB triplets, either 64 colours or 512 with the emphasis sets in
+order of the emphasis bits. Emphasis is derived for 64 colour files.
+*/
+func LoadPaletteFile(filename string) (*Palette, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading palette: %w", err)
+	}
+	var p Palette
+	switch len(data) {
+	case 64 * 3, 512 * 3:
+	default:
+		return nil, fmt.Errorf("palette %s should be 192 or 1536 bytes, got %d", filename, len(data))
+	}
+	for i := 0; i < len(data)/3; i++ {
+		p[i] = color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 0xFF}
+	}
+	if len(data) == 64*3 {
+		p.deriveEmphasis()
+	}
+	return &p, nil
+}
+
+// Composite voltages of the 2C02 relative to sync, see the NESdev wiki NTSC video page
+const (
+	ntscBlack       = 0.518
+	ntscWhite       = 1.962
+	ntscAttenuation = 0.746
+)
+
+var ntscLevels = [8]float64{
+	0.350, 0.518, 0.962, 1.550, // low
+	1.094, 1.506, 1.962, 1.962, // high
+}
+
+/*
+Voltage the PPU outputs for pixel during one of the 12 phases of the colour
+subcarrier. Each colour is a square wave between a low and a high level, and the
+emphasis bits attenuate the parts of the wave in phase with red, green or blue.
+*/
+func ntscSignal(pixel uint16, phase int) float64 {
+	hue := int(pixel & 0x0F)
+	level := int(pixel >> 4 & 3)
+	emphasis := pixel >> 6 & 7
+	if hue > 13 {
+		level = 1
+	}
+
+	low := ntscLevels[level]
+	high := ntscLevels[4+level]
+	if hue == 0 {
+		low = high
+	}
+	if hue > 12 {
+		high = low
+	}
+
+	inPhase := func(hue int) bool {
+		return (hue+phase)%12 < 6
+	}
+	signal := low
+	if inPhase(hue) {
+		signal = high
+	}
+	if emphasis&1 != 0 && inPhase(0) || emphasis&2 != 0 && inPhase(4) || emphasis&4 != 0 && inPhase(8) {
+		signal *= ntscAttenuation
+	}
+	return signal
+}
+
+// NTSCParams are the TV controls used to decode the composite signal into a palette
+type NTSCParams struct {
+	Hue        float64 // degrees
+	Saturation float64
+	Contrast   float64
+	Brightness float64
+	Gamma      float64 // gamma of the TV being imitated, 2.2 displays the signal unchanged
+}
+
+var defaultNTSCParams = NTSCParams{Saturation: 1, Contrast: 1, Gamma: 2.2}
+
+// Converts YIQ to RGB with the gamma correction of the params applied
+func (params NTSCParams) rgb(y float64, i float64, q float64) color.RGBA {
+	channel := func(v float64) uint8 {
+		v = math.Max(0, math.Min(1, v))
+		return uint8(math.Pow(v, params.Gamma/2.2)*255 + 0.5)
+	}
+	return color.RGBA{
+		channel(y + 0.946882*i + 0.623557*q),
+		channel(y - 0.274788*i - 0.635691*q),
+		channel(y - 1.108545*i + 1.709007*q),
+		0xFF,
+	}
+}
+
+// Signal level between black at 0 and white at 1
+func ntscLevel(pixel uint16, phase int) float64 {
+	return (ntscSignal(pixel, phase) - ntscBlack) / (ntscWhite - ntscBlack)
+}
+
+// Subcarrier angle the decoder uses at phase, hue is the TV's hue control in degrees
+func ntscAngle(phase int, hue float64) float64 {
+	// Offset so colour 6 decodes as red and colour 2 as blue with the hue control centred
+	return math.Pi*(float64(phase)+4)/6 + hue*math.Pi/180
+}
+
+// Decodes one cycle of pixel's composite signal to YIQ
+func ntscDecode(pixel uint16, hue float64) [3]float64 {
+	var yiq [3]float64
+	for phase := 0; phase < 12; phase++ {
+		s := ntscLevel(pixel, phase)
+		angle := ntscAngle(phase, hue)
+		yiq[0] += s / 12
+		yiq[1] += s * math.Cos(angle) / 12
+		yiq[2] += s * math.Sin(angle) / 12
+	}
+	return yiq
+}
+
+// Applies the TV controls to a decoded colour
+func (params NTSCParams) color(yiq [3]float64) color.RGBA {
+	y := yiq[0]*params.Contrast + params.Brightness
+	i := yiq[1] * params.Saturation * params.Contrast
+	q := yiq[2] * params.Saturation * params.Contrast
+	return params.rgb(y, i, q)
+}
+
+// Generates all 512 colours by decoding one cycle of each colour's composite signal
+func GenerateNTSCPalette(params NTSCParams) *Palette {
+	var p Palette
+	for pixel := range p {
+		p[pixel] = params.color(ntscDecode(uint16(pixel), params.Hue))
+	}
+	return &p
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes a .pal file of colours entries where entry i is i, 2i, 3i
+func writePaletteFile(t *testing.T, colours int) string {
+	t.Helper()
+	data := make([]byte, colours*3)
+	for i := 0; i < colours; i++ {
+		data[i*3], data[i*3+1], data[i*3+2] = uint8(i), uint8(i*2), uint8(i*3)
+	}
+	path := filepath.Join(t.TempDir(), "test.pal")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPaletteFile(t *testing.T) {
+	p, err := LoadPaletteFile(writePaletteFile(t, 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range p {
+		if want := (color.RGBA{uint8(i), uint8(i * 2), uint8(i * 3), 0xFF}); c != want {
+			t.Fatalf("512 colour file: entry %d is %v, want %v from the file", i, c, want)
+		}
+	}
+
+	p, err = LoadPaletteFile(writePaletteFile(t, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 64; i++ {
+		if want := (color.RGBA{uint8(i), uint8(i * 2), uint8(i * 3), 0xFF}); p[i] != want {
+			t.Fatalf("64 colour file: entry %d is %v, want %v", i, p[i], want)
+		}
+	}
+	if p[0x1FF] == (color.RGBA{}) || p[0x40|0x3F] == p[0x3F] {
+		t.Error("64 colour file: the emphasis sets were not derived")
+	}
+
+	for _, colours := range []int{0, 63, 65, 511, 513} {
+		if _, err := LoadPaletteFile(writePaletteFile(t, colours)); err == nil || !strings.Contains(err.Error(), "192 or 1536") {
+			t.Errorf("%d colours: error %v, want a size error", colours, err)
+		}
+	}
+	if _, err := LoadPaletteFile(filepath.Join(t.TempDir(), "missing.pal")); err == nil {
+		t.Error("loading a missing palette succeeded")
+	}
+}
+
+func TestDeriveEmphasis(t *testing.T) {
+	var p Palette
+	for i := 0; i < 64; i++ {
+		p[i] = color.RGBA{200, 100, 50, 0xFF}
+	}
+	p.deriveEmphasis()
+
+	a := emphasisAttenuation
+	tests := []struct {
+		emphasis int
+		scale    [3]float64
+	}{
+		{1, [3]float64{1, a, a}},     // red
+		{2, [3]float64{a, 1, a}},     // green
+		{4, [3]float64{a, a, 1}},     // blue
+		{3, [3]float64{a, a, a * a}}, // red and green
+		{7, [3]float64{a * a, a * a, a * a}},
+	}
+	for _, test := range tests {
+		want := color.RGBA{uint8(200 * test.scale[0]), uint8(100 * test.scale[1]), uint8(50 * test.scale[2]), 0xFF}
+		for i := 0; i < 64; i++ {
+			if c := p[test.emphasis<<6|i]; c != want {
+				t.Fatalf("emphasis %d colour %d is %v, want %v", test.emphasis, i, c, want)
+			}
+		}
+	}
+	for i := 0x40; i < 0x200; i++ {
+		if p[i].A != 0xFF {
+			t.Fatalf("entry $%03X was not derived", i)
+		}
+	}
+}
+
+func TestPPUPixel(t *testing.T) {
+	for colour := uint8(0); colour < 0x40; colour++ {
+		if pixel := ppuPixel(colour, 0x00); pixel != uint16(colour) {
+			t.Errorf("colour $%02X became $%03X", colour, pixel)
+		}
+		// Greyscale keeps only the row, so every colour lands in column $x0
+		if pixel := ppuPixel(colour, 0x01); pixel != uint16(colour&0x30) {
+			t.Errorf("greyscale colour $%02X became $%03X, want $%02X", colour, pixel, colour&0x30)
+		}
+	}
+	if pixel := ppuPixel(0x16, 0xE1); pixel != 0x10|7<<6 {
+		t.Errorf("greyscale with all emphasis bits is $%03X, want $1D0", pixel)
+	}
+	if pixel := ppuPixel(0x16, 0x20); defaultPalette[pixel] != defaultPalette[0x40|0x16] {
+		t.Error("red emphasis did not select the red emphasis set")
+	}
+}
+
+func TestGenerateNTSCPalette(t *testing.T) {
+	p := GenerateNTSCPalette(defaultNTSCParams)
+	grey := func(c color.RGBA) bool {
+		return max(c.R, c.G, c.B)-min(c.R, c.G, c.B) <= 2
+	}
+	for _, colour := range []int{0x00, 0x10, 0x20, 0x30, 0x0D, 0x2D} {
+		if !grey(p[colour]) {
+			t.Errorf("colour $%02X is %v, want a grey", colour, p[colour])
+		}
+	}
+	if p[0x20] != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("colour $20 is %v, want white", p[0x20])
+	}
+	if p[0x0F] != p[0x1F] || p[0x0D].R >= p[0x00].R {
+		t.Error("$xF and $0D are not the blacks below $00")
+	}
+	if c := p[0x16]; c.R <= c.G || c.R <= c.B {
+		t.Errorf("colour $16 is %v, want red", c)
+	}
+	if c := p[0x12]; c.B <= c.R || c.B <= c.G {
+		t.Errorf("colour $12 is %v, want blue", c)
+	}
+	if c, e := p[0x20], p[0x40|0x20]; e.R < e.G || e.G >= c.G {
+		t.Errorf("red emphasis turned white into %v", e)
+	}
+
+	// The controls shift the decode, hue rotates the colours and saturation 0 is grey
+	if rotated := GenerateNTSCPalette(NTSCParams{Hue: 30, Saturation: 1, Contrast: 1, Gamma: 2.2}); rotated[0x16] == p[0x16] {
+		t.Error("the hue control did not change colour $16")
+	}
+	flat := GenerateNTSCPalette(NTSCParams{Contrast: 1, Gamma: 2.2})
+	for colour := 0; colour < 64; colour++ {
+		if !grey(flat[colour]) {
+			t.Fatalf("saturation 0: colour $%02X is %v", colour, flat[colour])
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Patch formats in the order they are looked for next to a ROM
+var patchExtensions = []string{".ips", ".ups", ".bps"}
+
+/*
+Returns the patch with the ROM's name and a patch extension, e.g. game.ips for
+game.nes, or an empty name when there is none
+*/
+func findPatch(romPath string) (string, error) {
+	base := strings.TrimSuffix(romPath, filepath.Ext(romPath))
+	for _, ext := range patchExtensions {
+		name := base + ext
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("error reading patch: %w", err)
+		}
+	}
+	return "", nil
+}
+
+// Applies an .ips, .ups or .bps patch to a ROM image, picked by the patch header
+func applyPatchFile(rom []byte, filename string) ([]byte, error) {
+	patch, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading patch: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(patch, []byte("PATCH")):
+		rom, err = applyIPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("UPS1")):
+		rom, err = applyUPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("BPS1")):
+		rom, err = applyBPS(rom, patch)
+	default:
+		return nil, fmt.Errorf("%s is not an IPS, UPS or BPS patch", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error applying %s: %w", filepath.Base(filename), err)
+	}
+	return rom, nil
+}
+
+/*
+IPS records are a 3 byte offset and a 2 byte length followed by the data, a zero
+length marks a run of one byte. An offset after "EOF" truncates the file.
+*/
+func applyIPS(rom []byte, patch []byte) ([]byte, error) {
+	out := append([]byte{}, rom...)
+	write := func(offset int, data []byte) {
+		if end := offset + len(data); end > len(out) {
+			out = append(out, make([]byte, end-len(out))...)
+		}
+		copy(out[offset:], data)
+	}
+
+	pos := 5
+	for {
+		if pos+3 > len(patch) {
+			return nil, fmt.Errorf("IPS patch is missing its EOF marker")
+		}
+		if string(patch[pos:pos+3]) == "EOF" {
+			pos += 3
+			break
+		}
+		if pos+5 > len(patch) {
+			return nil, fmt.Errorf("IPS record at %d is truncated", pos)
+		}
+		offset := int(patch[pos])<<16 | int(patch[pos+1])<<8 | int(patch[pos+2])
+		size := int(binary.BigEndian.Uint16(patch[pos+3:]))
+		pos += 5
+		if size == 0 {
+			if pos+3 > len(patch) {
+				return nil, fmt.Errorf("IPS run at %d is truncated", pos)
+			}
+			count := int(binary.BigEndian.Uint16(patch[pos:]))
+			write(offset, bytes.Repeat(patch[pos+2:pos+3], count))
+			pos += 3
+			continue
+		}
+		if pos+size > len(patch) {
+			return nil, fmt.Errorf("IPS record at %d is truncated", pos)
+		}
+		write(offset, patch[pos:pos+size])
+		pos += size
+	}
+
+	if pos+3 <= len(patch) {
+		if size := int(patch[pos])<<16 | int(patch[pos+1])<<8 | int(patch[pos+2]); size < len(out) {
+			out = out[:size]
+		}
+	}
+	return out, nil
+}
+
+// Reads the variable length numbers used by UPS and BPS
+func readPatchNumber(patch []byte, pos *int) (int, error) {
+	value, shift := 0, 1
+	for {
+		if *pos >= len(patch) {
+			return 0, fmt.Errorf("patch is truncated")
+		}
+		x := patch[*pos]
+		*pos++
+		value += int(x&0x7F) * shift
+		if x&0x80 != 0 {
+			return value, nil
+		}
+		shift <<= 7
+		value += shift
+	}
+}
+
+/*
+Checks the CRC32 footer shared by UPS and BPS: the source, the target and the patch
+itself up to the last checksum
+*/
+func checkPatchFooter(source []byte, target []byte, patch []byte) error {
+	footer := patch[len(patch)-12:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return fmt.Errorf("patch checksum mismatch, the patch is damaged")
+	}
+	if crc32.ChecksumIEEE(source) != binary.LittleEndian.Uint32(footer[0:]) {
+		return fmt.Errorf("source checksum mismatch, the patch is for a different ROM")
+	}
+	if target != nil && crc32.ChecksumIEEE(target) != binary.LittleEndian.Uint32(footer[4:]) {
+		return fmt.Errorf("target checksum mismatch")
+	}
+	return nil
+}
+
+// UPS hunks XOR the source with the patch, each hunk is a skip count and bytes up to a zero
+func applyUPS(rom []byte, patch []byte) ([]byte, error) {
+	if len(patch) < 4+12 {
+		return nil, fmt.Errorf("UPS patch is truncated")
+	}
+	if err := checkPatchFooter(rom, nil, patch); err != nil {
+		return nil, err
+	}
+
+	pos := 4
+	sourceSize, err := readPatchNumber(patch, &pos)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, err := readPatchNumber(patch, &pos)
+	if err != nil {
+		return nil, err
+	}
+	if sourceSize != len(rom) {
+		return nil, fmt.Errorf("patch expects a %d byte ROM, got %d bytes", sourceSize, len(rom))
+	}
+
+	out := make([]byte, targetSize)
+	copy(out, rom)
+	end := len(patch) - 12
+	offset := 0
+	for pos < end {
+		skip, err := readPatchNumber(patch, &pos)
+		if err != nil {
+			return nil, err
+		}
+		offset += skip
+		for ; pos < end && patch[pos] != 0; pos++ {
+			if offset < len(out) {
+				out[offset] ^= patch[pos]
+			}
+			offset++
+		}
+		pos++
+		offset++
+	}
+
+	if err := checkPatchFooter(rom, out, patch); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BPS builds the target from runs copied from the source, the patch or the target itself
+func applyBPS(rom []byte, patch []byte) ([]byte, error) {
+	if len(patch) < 4+12 {
+		return nil, fmt.Errorf("BPS patch is truncated")
+	}
+	if err := checkPatchFooter(rom, nil, patch); err != nil {
+		return nil, err
+	}
+
+	pos := 4
+	var sizes [3]int // source, target, metadata
+	for i := range sizes {
+		n, err := readPatchNumber(patch, &pos)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = n
+	}
+	if sizes[0] != len(rom) {
+		return nil, fmt.Errorf("patch expects a %d byte ROM, got %d bytes", sizes[0], len(rom))
+	}
+	pos += sizes[2]
+
+	out := make([]byte, sizes[1])
+	end := len(patch) - 12
+	offset, sourceOffset, targetOffset := 0, 0, 0
+	for pos < end {
+		data, err := readPatchNumber(patch, &pos)
+		if err != nil {
+			return nil, err
+		}
+		length := data>>2 + 1
+		if offset+length > len(out) {
+			return nil, fmt.Errorf("BPS action writes past the end of the target")
+		}
+
+		switch data & 3 {
+		case 0: // source read
+			if offset+length > len(rom) {
+				return nil, fmt.Errorf("BPS source read past the end of the ROM")
+			}
+			copy(out[offset:], rom[offset:offset+length])
+		case 1: // target read
+			if pos+length > end {
+				return nil, fmt.Errorf("BPS patch is truncated")
+			}
+			copy(out[offset:], patch[pos:pos+length])
+			pos += length
+		case 2, 3: // source copy, target copy
+			d, err := readPatchNumber(patch, &pos)
+			if err != nil {
+				return nil, err
+			}
+			relative := d >> 1
+			if d&1 != 0 {
+				relative = -relative
+			}
+			from, base := &sourceOffset, rom
+			if data&3 == 3 {
+				from, base = &targetOffset, out
+			}
+			*from += relative
+			if *from < 0 || *from+length > len(base) {
+				return nil, fmt.Errorf("BPS copy outside the buffer")
+			}
+			// Byte by byte, target copies may overlap the bytes being written
+			for i := 0; i < length; i++ {
+				out[offset+i] = base[*from+i]
+			}
+			*from += length
+		}
+		offset += length
+	}
+
+	if err := checkPatchFooter(rom, out, patch); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encodes a number the way readPatchNumber reads it
+func patchNumber(value int) []byte {
+	var out []byte
+	for {
+		x := byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(out, x|0x80)
+		}
+		out = append(out, x)
+		value--
+	}
+}
+
+// Appends the source, target and patch CRC32s of UPS and BPS
+func withPatchFooter(patch []byte, source []byte, target []byte) []byte {
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(source))
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(target))
+	return binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(patch))
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestApplyIPS(t *testing.T) {
+	rom := []byte("0123456789")
+	tests := []struct {
+		name  string
+		patch []byte
+		want  string
+	}{
+		{"record", join([]byte("PATCH"), []byte{0, 0, 2, 0, 3}, []byte("abc"), []byte("EOF")), "01abc56789"},
+		{"run", join([]byte("PATCH"), []byte{0, 0, 8, 0, 0, 0, 4, 'x'}, []byte("EOF")), "01234567xxxx"},
+		{"truncate", join([]byte("PATCH"), []byte{0, 0, 0, 0, 1, 'z'}, []byte("EOF"), []byte{0, 0, 4}), "z123"},
+	}
+	for _, test := range tests {
+		out, err := applyIPS(rom, test.patch)
+		if err != nil || string(out) != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, out, err, test.want)
+		}
+	}
+	if string(rom) != "0123456789" {
+		t.Error("applyIPS changed the source ROM")
+	}
+	if _, err := applyIPS(rom, []byte("PATCH\x00\x00\x01\x00\x05ab")); err == nil {
+		t.Error("truncated IPS record did not fail")
+	}
+}
+
+func TestApplyUPS(t *testing.T) {
+	source := []byte("0123456789")
+	target := []byte("01a3456789XY")
+	patch := join([]byte("UPS1"), patchNumber(len(source)), patchNumber(len(target)),
+		// Skip two bytes, XOR one, then from offset 10 write two new bytes
+		patchNumber(2), []byte{'2' ^ 'a', 0},
+		patchNumber(6), []byte{'X', 'Y', 0})
+	patch = withPatchFooter(patch, source, target)
+
+	out, err := applyUPS(source, patch)
+	if err != nil || !bytes.Equal(out, target) {
+		t.Fatalf("got %q, %v, want %q", out, err, target)
+	}
+
+	damaged := append([]byte{}, patch...)
+	damaged[5] ^= 1
+	tests := []struct {
+		name   string
+		source []byte
+		patch  []byte
+	}{
+		{"other ROM", []byte("9876543210"), patch},
+		{"damaged patch", source, damaged},
+		{"truncated", source, patch[:10]},
+	}
+	for _, test := range tests {
+		if _, err := applyUPS(test.source, test.patch); err == nil {
+			t.Errorf("%s: applyUPS did not fail", test.name)
+		}
+	}
+}
+
+func TestApplyBPS(t *testing.T) {
+	source := []byte("ABCDEFGH")
+	target := []byte("ABCDxyxyxyEF")
+	action := func(kind int, length int) []byte {
+		return patchNumber((length-1)<<2 | kind)
+	}
+	patch := join([]byte("BPS1"), patchNumber(len(source)), patchNumber(len(target)), patchNumber(0),
+		action(0, 4),               // source read "ABCD"
+		action(1, 2), []byte("xy"), // target read "xy"
+		action(3, 4), patchNumber(4<<1), // target copy from offset 4, overlapping itself
+		action(2, 2), patchNumber(4<<1), // source copy from offset 4 "EF"
+	)
+	patch = withPatchFooter(patch, source, target)
+
+	out, err := applyBPS(source, patch)
+	if err != nil || !bytes.Equal(out, target) {
+		t.Fatalf("got %q, %v, want %q", out, err, target)
+	}
+	if _, err := applyBPS([]byte("ABCDEFGX"), patch); err == nil {
+		t.Error("patching a different ROM did not fail")
+	}
+}
+
+func TestApplyPatchFile(t *testing.T) {
+	dir := t.TempDir()
+	rom := []byte("0123456789")
+	tests := []struct {
+		file  string
+		patch []byte
+		ok    bool
+	}{
+		{"game.ips", join([]byte("PATCH"), []byte{0, 0, 0, 0, 1, 'z'}, []byte("EOF")), true},
+		{"game.bin", []byte("not a patch"), false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := os.WriteFile(path, test.patch, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := applyPatchFile(rom, path)
+		if test.ok != (err == nil) || test.ok && string(out) != "z123456789" {
+			t.Errorf("%s: got %q, %v", test.file, out, err)
+		}
+	}
+
+	// A patch named after the ROM is found next to it
+	romPath := filepath.Join(dir, "game.nes")
+	if found, err := findPatch(romPath); err != nil || found != filepath.Join(dir, "game.ips") {
+		t.Errorf("findPatch = %q, %v", found, err)
+	}
+}
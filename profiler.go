@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// JSR nesting deeper than the hardware stack can hold means the call tree is lost
+const maxCallDepth = 128
+
+/*
+Profiler attributes CPU cycles to the instruction address that spent them and to the
+subroutines on the JSR/RTS call stack at the time. Only frames within
+[StartFrame, EndFrame] are counted, an EndFrame below zero means no end.
+*/
+type Profiler struct {
+	StartFrame int
+	EndFrame   int
+
+	pcCycles map[uint16]uint64
+	pcHits   map[uint16]uint64
+
+	// Self cycles are spent in the routine itself, total includes its callees
+	selfCycles  map[uint16]uint64
+	totalCycles map[uint16]uint64
+
+	stack  []uint16
+	stacks map[string]uint64
+	key    string
+	// Whether each stack entry is the outermost call of its routine, so recursion
+	// adds to totalCycles once, and how often each routine is on the stack
+	outermost []bool
+	onStack   map[uint16]int
+	// JSRs not pushed because the stack was full, their RTSs must not pop
+	dropped int
+}
+
+func NewProfiler(startFrame int, endFrame int) *Profiler {
+	return &Profiler{
+		StartFrame:  startFrame,
+		EndFrame:    endFrame,
+		pcCycles:    make(map[uint16]uint64),
+		pcHits:      make(map[uint16]uint64),
+		selfCycles:  make(map[uint16]uint64),
+		totalCycles: make(map[uint16]uint64),
+		stacks:      make(map[string]uint64),
+		onStack:     make(map[uint16]int),
+	}
+}
+
+func (p *Profiler) inRange(frame int) bool {
+	return frame >= p.StartFrame && (p.EndFrame < 0 || frame <= p.EndFrame)
+}
+
+/*
+Records an executed instruction, pc and opcode are as fetched and cycles is what the
+instruction took. The call stack is tracked outside the frame range too so that
+routines entered before StartFrame are still attributed correctly.
+*/
+func (p *Profiler) Record(cpu *CPU, frame int, pc uint16, opcode uint8, cycles int) {
+	// The first instruction seen is the root of the call tree
+	if len(p.stack) == 0 {
+		p.push(cpu, pc)
+	}
+
+	if p.inRange(frame) {
+		c := uint64(cycles)
+		p.pcCycles[pc] += c
+		p.pcHits[pc]++
+		p.selfCycles[p.stack[len(p.stack)-1]] += c
+		for i, routine := range p.stack {
+			if p.outermost[i] {
+				p.totalCycles[routine] += c
+			}
+		}
+		p.stacks[p.key] += c
+	}
+
+	switch opcode {
+	case 0x20: // JSR, the CPU is already at the subroutine
+		if len(p.stack) < maxCallDepth {
+			p.push(cpu, cpu.PC)
+		} else {
+			p.dropped++
+		}
+	case 0x60: // RTS, never pop the root
+		if p.dropped > 0 {
+			p.dropped--
+		} else if len(p.stack) > 1 {
+			p.pop()
+		}
+	}
+}
+
+func (p *Profiler) push(cpu *CPU, routine uint16) {
+	name := routineName(cpu, routine)
+	if len(p.stack) == 0 {
+		p.key = name
+	} else {
+		p.key += ";" + name
+	}
+	p.stack = append(p.stack, routine)
+	p.outermost = append(p.outermost, p.onStack[routine] == 0)
+	p.onStack[routine]++
+}
+
+func (p *Profiler) pop() {
+	routine := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	p.outermost = p.outermost[:len(p.outermost)-1]
+	p.onStack[routine]--
+	p.key = p.key[:strings.LastIndexByte(p.key, ';')]
+}
+
+// Routines are named by their label, falling back to the entry address
+func routineName(cpu *CPU, address uint16) string {
+	if name, ok := cpu.Symbols.Lookup(cpu, address); ok {
+		return name
+	}
+	return fmt.Sprintf("$%04X", address)
+}
+
+// Writes the call stacks in the folded format read by flamegraph.pl and speedscope
+func (p *Profiler) WriteFolded(w io.Writer) error {
+	keys := make([]string, 0, len(p.stacks))
+	for key := range p.stacks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "%s %d\n", key, p.stacks[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the keys of m ordered by descending value
+func sortedByCycles(m map[uint16]uint64) []uint16 {
+	addresses := make([]uint16, 0, len(m))
+	for address := range m {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		if m[addresses[i]] != m[addresses[j]] {
+			return m[addresses[i]] > m[addresses[j]]
+		}
+		return addresses[i] < addresses[j]
+	})
+	return addresses
+}
+
+/*
+Writes the limit hottest routines and instruction addresses, each address annotated with
+its disassembly. A limit of zero or less writes everything.
+*/
+func (p *Profiler) WriteReport(w io.Writer, cpu *CPU, limit int) error {
+	var all uint64
+	for _, c := range p.pcCycles {
+		all += c
+	}
+	if all == 0 {
+		_, err := fmt.Fprintln(w, "no cycles recorded")
+		return err
+	}
+	percent := func(c uint64) float64 {
+		return float64(c) * 100 / float64(all)
+	}
+
+	routines := sortedByCycles(p.totalCycles)
+	if limit > 0 && len(routines) > limit {
+		routines = routines[:limit]
+	}
+	fmt.Fprintf(w, "Routines (%d cycles)\n", all)
+	fmt.Fprintf(w, "%12s %7s %12s %7s  %s\n", "total", "%", "self", "%", "routine")
+	for _, routine := range routines {
+		total, self := p.totalCycles[routine], p.selfCycles[routine]
+		fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%%  %s\n",
+			total, percent(total), self, percent(self), routineName(cpu, routine))
+	}
+
+	addresses := sortedByCycles(p.pcCycles)
+	if limit > 0 && len(addresses) > limit {
+		addresses = addresses[:limit]
+	}
+	fmt.Fprintf(w, "\nHot addresses\n")
+	fmt.Fprintf(w, "%12s %7s %10s  %-24s %s\n", "cycles", "%", "hits", "address", "instruction")
+	for _, address := range addresses {
+		text, _ := cpu.Disassemble(address)
+		c := p.pcCycles[address]
+		if _, err := fmt.Fprintf(w, "%12d %6.2f%% %10d  %-24s %s\n",
+			c, percent(c), p.pcHits[address], cpu.addressName(address), text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the folded stacks and the report to their files, an empty path skips that output
+func writeProfile(p *Profiler, cpu *CPU, foldedPath string, reportPath string) error {
+	if foldedPath != "" {
+		file, err := os.Create(foldedPath)
+		if err != nil {
+			return fmt.Errorf("error creating profile: %w", err)
+		}
+		defer file.Close()
+		if err := p.WriteFolded(file); err != nil {
+			return fmt.Errorf("error writing profile: %w", err)
+		}
+	}
+	if reportPath != "" {
+		file, err := os.Create(reportPath)
+		if err != nil {
+			return fmt.Errorf("error creating profile report: %w", err)
+		}
+		defer file.Close()
+		if err := p.WriteReport(file, cpu, 50); err != nil {
+			return fmt.Errorf("error writing profile report: %w", err)
+		}
+	}
+	return nil
+}
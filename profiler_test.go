@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// One instruction fed to the profiler, pc is where it ran and next where the CPU went
+type profiledStep struct {
+	pc     uint16
+	opcode uint8
+	cycles int
+	next   uint16
+}
+
+func runProfile(p *Profiler, steps []profiledStep) {
+	cpu := &CPU{}
+	for _, step := range steps {
+		cpu.PC = step.next
+		p.Record(cpu, 0, step.pc, step.opcode, step.cycles)
+	}
+}
+
+func TestProfilerAttribution(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []profiledStep
+		total map[uint16]uint64
+		self  map[uint16]uint64
+	}{
+		{
+			name: "nested call",
+			steps: []profiledStep{
+				{0x8000, 0x20, 6, 0x9000}, // JSR $9000
+				{0x9000, 0xEA, 2, 0x9001},
+				{0x9001, 0x60, 6, 0x8003}, // RTS
+				{0x8003, 0xEA, 2, 0x8004},
+			},
+			total: map[uint16]uint64{0x8000: 16, 0x9000: 8},
+			self:  map[uint16]uint64{0x8000: 8, 0x9000: 8},
+		},
+		{
+			name: "recursion counts cycles once",
+			steps: []profiledStep{
+				{0x8000, 0x20, 6, 0x9000}, // JSR $9000
+				{0x9000, 0x20, 6, 0x9000}, // JSR $9000 again
+				{0x9000, 0xEA, 2, 0x9001},
+				{0x9001, 0x60, 6, 0x9003},
+				{0x9003, 0x60, 6, 0x8003},
+			},
+			total: map[uint16]uint64{0x8000: 26, 0x9000: 20},
+			self:  map[uint16]uint64{0x8000: 6, 0x9000: 20},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewProfiler(0, -1)
+			runProfile(p, test.steps)
+			for routine, want := range test.total {
+				if got := p.totalCycles[routine]; got != want {
+					t.Errorf("total cycles of $%04X = %d, want %d", routine, got, want)
+				}
+			}
+			for routine, want := range test.self {
+				if got := p.selfCycles[routine]; got != want {
+					t.Errorf("self cycles of $%04X = %d, want %d", routine, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProfilerOverflowingStack(t *testing.T) {
+	p := NewProfiler(0, -1)
+	var steps []profiledStep
+	// The root takes one slot, the rest are filled and ten more calls are dropped
+	for i := 0; i < maxCallDepth+9; i++ {
+		steps = append(steps, profiledStep{0x8000, 0x20, 6, 0x9000})
+	}
+	for i := 0; i < maxCallDepth+9; i++ {
+		steps = append(steps, profiledStep{0x9000, 0x60, 6, 0x8003})
+	}
+	runProfile(p, steps)
+	if len(p.stack) != 1 || p.dropped != 0 {
+		t.Fatalf("stack depth %d with %d dropped calls, want only the root", len(p.stack), p.dropped)
+	}
+
+	// Back at the root, its cycles are its own again
+	runProfile(p, []profiledStep{{0x8003, 0xEA, 2, 0x8004}})
+	if got := p.selfCycles[0x8000]; got != 8 {
+		t.Errorf("root self cycles = %d, want 8", got)
+	}
+	if strings.Contains(p.key, ";") {
+		t.Errorf("stack key %q still has callees", p.key)
+	}
+}
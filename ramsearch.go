@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Ways of narrowing a RAM search
+type SearchOp int
+
+const (
+	SearchEqual SearchOp = iota
+	SearchNotEqual
+	SearchGreater
+	SearchLess
+	SearchChanged
+	SearchUnchanged
+	// Changed by exactly the operand since the last search, negative for decreases
+	SearchChangedBy
+)
+
+// The memory a search looks through, internal RAM and the cartridge RAM at $6000
+var searchRegions = [][2]uint16{{0x0000, 0x0800}, {0x6000, 0x8000}}
+
+// Reads an 8 or 16 bit little endian value from memory without any bus side effects
+func (cpu *CPU) peekValue(address uint16, size int, signed bool) int {
+	value := int(cpu.memory[address])
+	if size == 2 {
+		value |= int(cpu.memory[address+1]) << 8
+		if signed {
+			return int(int16(value))
+		}
+		return value
+	}
+	if signed {
+		return int(int8(value))
+	}
+	return value
+}
+
+type SearchResult struct {
+	Address uint16
+	Value   int
+	// Value at the previous search and how often the value has changed since the start
+	Previous int
+	Changes  int
+}
+
+/*
+RAMSearch narrows down the addresses holding a value, the way cheat finders do: start
+with every address, let the game run, then keep only those whose value compares a
+certain way with the last search or with a given number. Values are 8 or 16 bits wide
+and signed or unsigned, 16 bit values are little endian.
+*/
+type RAMSearch struct {
+	Size   int
+	Signed bool
+
+	cpu        *CPU
+	candidates []SearchResult
+}
+
+func NewRAMSearch(cpu *CPU, size int, signed bool) (*RAMSearch, error) {
+	if size != 1 && size != 2 {
+		return nil, fmt.Errorf("invalid search size %d, it must be 1 or 2 bytes", size)
+	}
+	s := &RAMSearch{Size: size, Signed: signed, cpu: cpu}
+	s.Reset()
+	return s, nil
+}
+
+// Starts over with every address as a candidate and their current values as the snapshot
+func (s *RAMSearch) Reset() {
+	s.candidates = s.candidates[:0]
+	for _, region := range searchRegions {
+		for address := int(region[0]); address+s.Size <= int(region[1]); address++ {
+			value := s.cpu.peekValue(uint16(address), s.Size, s.Signed)
+			s.candidates = append(s.candidates, SearchResult{Address: uint16(address), Value: value, Previous: value})
+		}
+	}
+}
+
+// Reads the current values of the candidates, counting changes, without filtering them
+func (s *RAMSearch) Update() {
+	for i := range s.candidates {
+		c := &s.candidates[i]
+		value := s.cpu.peekValue(c.Address, s.Size, s.Signed)
+		if value != c.Value {
+			c.Changes++
+		}
+		c.Value = value
+	}
+}
+
+/*
+Keeps the candidates whose current value compares with op to the value at the last
+search, operand is only used by SearchChangedBy. The current values become the snapshot
+for the next search. Returns the number of candidates left.
+*/
+func (s *RAMSearch) Filter(op SearchOp, operand int) int {
+	return s.filter(op, func(c *SearchResult) int {
+		if op == SearchChangedBy {
+			return operand
+		}
+		return c.Previous
+	})
+}
+
+// Keeps the candidates whose current value compares with op to value
+func (s *RAMSearch) FilterValue(op SearchOp, value int) int {
+	return s.filter(op, func(*SearchResult) int {
+		return value
+	})
+}
+
+func (s *RAMSearch) filter(op SearchOp, operand func(*SearchResult) int) int {
+	s.Update()
+	kept := s.candidates[:0]
+	for _, c := range s.candidates {
+		other := operand(&c)
+		var keep bool
+		switch op {
+		case SearchEqual, SearchUnchanged:
+			keep = c.Value == other
+		case SearchNotEqual, SearchChanged:
+			keep = c.Value != other
+		case SearchGreater:
+			keep = c.Value > other
+		case SearchLess:
+			keep = c.Value < other
+		case SearchChangedBy:
+			keep = c.Value-c.Previous == other
+		}
+		if keep {
+			c.Previous = c.Value
+			kept = append(kept, c)
+		}
+	}
+	s.candidates = kept
+	return len(kept)
+}
+
+// The remaining candidates in address order
+func (s *RAMSearch) Results() []SearchResult {
+	return append([]SearchResult(nil), s.candidates...)
+}
+
+// An address to keep an eye on, saved in watch list files
+type Watch struct {
+	Name    string `json:"name"`
+	Address uint16 `json:"address"`
+	Size    int    `json:"size"`
+	Signed  bool   `json:"signed,omitempty"`
+	// Value when the list was last written, not read back
+	Value int `json:"value"`
+}
+
+/*
+WatchList is a set of named addresses that outlives a search, typically the ones a
+search found, and is kept as a JSON file between sessions.
+*/
+type WatchList struct {
+	Watches []Watch `json:"watches"`
+}
+
+// Adds a watch, or renames and resizes the one already at address
+func (l *WatchList) Add(name string, address uint16, size int, signed bool) {
+	watch := Watch{Name: name, Address: address, Size: size, Signed: signed}
+	for i := range l.Watches {
+		if l.Watches[i].Address == address {
+			l.Watches[i] = watch
+			return
+		}
+	}
+	l.Watches = append(l.Watches, watch)
+}
+
+func (l *WatchList) Remove(address uint16) {
+	for i := range l.Watches {
+		if l.Watches[i].Address == address {
+			l.Watches = append(l.Watches[:i], l.Watches[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reads the current value of every watch
+func (l *WatchList) Update(cpu *CPU) {
+	for i := range l.Watches {
+		w := &l.Watches[i]
+		w.Value = cpu.peekValue(w.Address, max(w.Size, 1), w.Signed)
+	}
+}
+
+func LoadWatchList(filename string) (*WatchList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading watch list: %w", err)
+	}
+	var list WatchList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error parsing watch list: %w", err)
+	}
+	return &list, nil
+}
+
+// Writes the list with the values the watches have in cpu
+func (l *WatchList) WriteFile(filename string, cpu *CPU) error {
+	l.Update(cpu)
+	data, err := json.MarshalIndent(l, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing watch list: %w", err)
+	}
+	return nil
+}
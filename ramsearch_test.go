@@ -0,0 +1,176 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Addresses of the search results, with the values they have
+func searchResults(s *RAMSearch) map[uint16]int {
+	results := make(map[uint16]int)
+	for _, result := range s.Results() {
+		results[result.Address] = result.Value
+	}
+	return results
+}
+
+func TestRAMSearchFilters(t *testing.T) {
+	before := map[uint16]uint8{0x10: 5, 0x11: 5, 0x12: 200, 0x400: 0xFF, 0x401: 0xFF, 0x6000: 7}
+	after := map[uint16]uint8{0x10: 6, 0x11: 4, 0x12: 10}
+
+	tests := []struct {
+		name     string
+		size     int
+		signed   bool
+		op       SearchOp
+		operand  int
+		useValue bool // compare with operand instead of the last search
+		want     map[uint16]int
+	}{
+		{"changed", 1, false, SearchChanged, 0, false, map[uint16]int{0x10: 6, 0x11: 4, 0x12: 10}},
+		{"not equal", 1, false, SearchNotEqual, 0, false, map[uint16]int{0x10: 6, 0x11: 4, 0x12: 10}},
+		{"greater", 1, false, SearchGreater, 0, false, map[uint16]int{0x10: 6}},
+		{"less", 1, false, SearchLess, 0, false, map[uint16]int{0x11: 4, 0x12: 10}},
+		{"signed greater", 1, true, SearchGreater, 0, false, map[uint16]int{0x10: 6, 0x12: 10}},
+		{"signed less", 1, true, SearchLess, 0, false, map[uint16]int{0x11: 4}},
+		{"changed by 1", 1, false, SearchChangedBy, 1, false, map[uint16]int{0x10: 6}},
+		{"changed by -1", 1, false, SearchChangedBy, -1, false, map[uint16]int{0x11: 4}},
+		{"changed by -190", 1, false, SearchChangedBy, -190, false, map[uint16]int{0x12: 10}},
+		{"signed changed by 66", 1, true, SearchChangedBy, 66, false, map[uint16]int{0x12: 10}},
+		{"equal to value", 1, false, SearchEqual, 7, true, map[uint16]int{0x6000: 7}},
+		{"greater than value", 1, false, SearchGreater, 6, true, map[uint16]int{0x12: 10, 0x400: 0xFF, 0x401: 0xFF, 0x6000: 7}},
+		{"signed less than value", 1, true, SearchLess, 0, true, map[uint16]int{0x400: -1, 0x401: -1}},
+		{"word changed", 2, false, SearchChanged, 0, false, map[uint16]int{0x0F: 0x0600, 0x10: 0x0406, 0x11: 0x0A04, 0x12: 0x000A}},
+		{"word equal to value", 2, false, SearchEqual, 0xFFFF, true, map[uint16]int{0x400: 0xFFFF}},
+		{"signed word equal to value", 2, true, SearchEqual, -1, true, map[uint16]int{0x400: -1}},
+		{"signed word less than value", 2, true, SearchLess, -255, true, map[uint16]int{0x3FF: -256}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := &CPU{}
+			for address, value := range before {
+				cpu.memory[address] = value
+			}
+			s, err := NewRAMSearch(cpu, test.size, test.signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for address, value := range after {
+				cpu.memory[address] = value
+			}
+
+			var count int
+			if test.useValue {
+				count = s.FilterValue(test.op, test.operand)
+			} else {
+				count = s.Filter(test.op, test.operand)
+			}
+			if got := searchResults(s); count != len(got) || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%d results %v, want %v", count, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRAMSearchNarrowing(t *testing.T) {
+	cpu := &CPU{}
+	s, err := NewRAMSearch(cpu, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Results()); n != 0x800+0x2000 {
+		t.Fatalf("search starts with %d addresses", n)
+	}
+
+	// $20 counts up every frame, $30 changes once
+	cpu.memory[0x20]++
+	cpu.memory[0x30] = 9
+	if n := s.Filter(SearchUnchanged, 0); n != 0x800+0x2000-2 {
+		t.Fatalf("%d unchanged addresses", n)
+	}
+	s.Reset()
+	cpu.memory[0x20]++
+	cpu.memory[0x30] = 9
+	s.Update()
+	cpu.memory[0x20]++
+	if n := s.Filter(SearchChanged, 0); n != 1 {
+		t.Fatalf("%d changed addresses, want 1", n)
+	}
+	cpu.memory[0x20]++
+	if n := s.Filter(SearchChangedBy, 1); n != 1 {
+		t.Fatalf("%d addresses changed by 1, want 1", n)
+	}
+	result := s.Results()[0]
+	want := SearchResult{Address: 0x20, Value: 4, Previous: 4, Changes: 3}
+	if result != want {
+		t.Errorf("result %+v, want %+v", result, want)
+	}
+
+	// Previous stays at the last search while Update counts changes
+	cpu.memory[0x20] = 0
+	s.Update()
+	if result := s.Results()[0]; result.Previous != 4 || result.Changes != 4 {
+		t.Errorf("after an update %+v", result)
+	}
+
+	if _, err := NewRAMSearch(cpu, 3, false); err == nil {
+		t.Error("a 3 byte search did not fail")
+	}
+}
+
+func TestRAMSearchRegionEnds(t *testing.T) {
+	s, err := NewRAMSearch(&CPU{}, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := searchResults(s)
+	for _, address := range []uint16{0x07FF, 0x7FFF} {
+		if _, ok := results[address]; ok {
+			t.Errorf("word at $%04X crosses the end of its region", address)
+		}
+	}
+	if len(results) != 0x7FF+0x1FFF {
+		t.Errorf("%d word candidates", len(results))
+	}
+}
+
+func TestWatchList(t *testing.T) {
+	cpu := &CPU{}
+	cpu.memory[0x75] = 3
+	cpu.memory[0x6000], cpu.memory[0x6001] = 0xFE, 0xFF
+
+	var list WatchList
+	list.Add("lives", 0x75, 1, false)
+	list.Add("speed", 0x6000, 2, true)
+	list.Add("score", 0x80, 2, false)
+	list.Add("hearts", 0x75, 1, false) // renames the watch at $75
+	list.Remove(0x80)
+	list.Remove(0x1234)
+
+	path := filepath.Join(t.TempDir(), "game.watch.json")
+	if err := list.WriteFile(path, cpu); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadWatchList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Watch{
+		{Name: "hearts", Address: 0x75, Size: 1, Value: 3},
+		{Name: "speed", Address: 0x6000, Size: 2, Signed: true, Value: -2},
+	}
+	if !reflect.DeepEqual(loaded.Watches, want) {
+		t.Errorf("loaded %+v, want %+v", loaded.Watches, want)
+	}
+
+	cpu.memory[0x75] = 2
+	loaded.Update(cpu)
+	if loaded.Watches[0].Value != 2 {
+		t.Errorf("updated value %d, want 2", loaded.Watches[0].Value)
+	}
+
+	if _, err := LoadWatchList(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loading a missing watch list did not fail")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PPU dots per scanline, the same in every region
+const dotsPerScanline = 341
+
+/*
+Region holds the timing that differs between NTSC, PAL and Dendy consoles. The master
+clock is divided down to the CPU and PPU clocks, and the APU tables are in CPU cycles
+so they change with the CPU clock.
+*/
+type Region struct {
+	Name string
+	// NES 2.0 timing value, also stored in save states
+	ID uint8
+
+	// Master clock in Hz as a fraction
+	MasterNum  int
+	MasterDen  int
+	CPUDivider int
+	PPUDivider int
+
+	Scanlines   int
+	VBlankStart int // scanline where vblank begins
+	VBlankLines int
+
+	NoiseTable  [16]uint16
+	DMCTable    [16]uint16
+	FrameSteps4 [4]uint16
+	FrameSteps5 [5]uint16
+}
+
+var regionNTSC = &Region{
+	Name: "NTSC", ID: 0,
+	MasterNum: 236250000, MasterDen: 11, CPUDivider: 12, PPUDivider: 4,
+	Scanlines: 262, VBlankStart: 241, VBlankLines: 20,
+	NoiseTable:  [16]uint16{4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068},
+	DMCTable:    [16]uint16{428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54},
+	FrameSteps4: [4]uint16{7457, 14913, 22371, 29829},
+	FrameSteps5: [5]uint16{7457, 14913, 22371, 29829, 37281},
+}
+
+var regionPAL = &Region{
+	Name: "PAL", ID: 1,
+	MasterNum: 26601712, MasterDen: 1, CPUDivider: 16, PPUDivider: 5,
+	Scanlines: 312, VBlankStart: 241, VBlankLines: 70,
+	NoiseTable:  [16]uint16{4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778},
+	DMCTable:    [16]uint16{398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50},
+	FrameSteps4: [4]uint16{8313, 16627, 24939, 33253},
+	FrameSteps5: [5]uint16{8313, 16627, 24939, 33253, 41565},
+}
+
+// Dendy clones pair the PAL frame with an NTSC style APU and a faster CPU
+var regionDendy = &Region{
+	Name: "Dendy", ID: 3,
+	MasterNum: 26601712, MasterDen: 1, CPUDivider: 15, PPUDivider: 5,
+	Scanlines: 312, VBlankStart: 291, VBlankLines: 20,
+	NoiseTable:  regionNTSC.NoiseTable,
+	DMCTable:    regionNTSC.DMCTable,
+	FrameSteps4: regionNTSC.FrameSteps4,
+	FrameSteps5: regionNTSC.FrameSteps5,
+}
+
+var regions = []*Region{regionNTSC, regionPAL, regionDendy}
+
+// Picks a region by name, "auto" or an empty name returns nil so the ROM header decides
+func regionByName(name string) (*Region, error) {
+	if name == "" || strings.EqualFold(name, "auto") {
+		return nil, nil
+	}
+	for _, region := range regions {
+		if strings.EqualFold(region.Name, name) {
+			return region, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown region %q, expected ntsc, pal or dendy", name)
+}
+
+func (r *Region) CPUClock() float64 {
+	return float64(r.MasterNum) / float64(r.MasterDen*r.CPUDivider)
+}
+
+// CPU cycles per frame, rounded up as the runner counts whole cycles
+func (r *Region) CyclesPerFrame() int {
+	dots := dotsPerScanline * r.Scanlines * r.PPUDivider
+	return (dots + r.CPUDivider - 1) / r.CPUDivider
+}
+
+// Frame rate as a fraction, for video containers
+func (r *Region) FrameRate() (int, int) {
+	return r.MasterNum, r.MasterDen * r.CPUDivider * r.CyclesPerFrame()
+}
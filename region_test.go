@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegionTiming(t *testing.T) {
+	tests := []struct {
+		region *Region
+		clock  float64 // CPU clock in Hz
+		cycles int     // CPU cycles per frame
+		rate   float64 // frames per second
+	}{
+		{regionNTSC, 1789772.73, 29781, 60.0978},
+		{regionPAL, 1662607.00, 33248, 50.0062},
+		{regionDendy, 1773447.47, 35464, 50.0070},
+	}
+	for _, test := range tests {
+		if clock := test.region.CPUClock(); math.Abs(clock-test.clock) > 0.01 {
+			t.Errorf("%s: CPU clock %.2f, want %.2f", test.region.Name, clock, test.clock)
+		}
+		if cycles := test.region.CyclesPerFrame(); cycles != test.cycles {
+			t.Errorf("%s: %d cycles per frame, want %d", test.region.Name, cycles, test.cycles)
+		}
+		num, den := test.region.FrameRate()
+		if rate := float64(num) / float64(den); math.Abs(rate-test.rate) > 0.0001 {
+			t.Errorf("%s: %.4f frames per second, want %.4f", test.region.Name, rate, test.rate)
+		}
+	}
+}
+
+func TestRegionAPUTables(t *testing.T) {
+	tests := []struct {
+		region    *Region
+		noise     [2]uint16 // shortest and longest noise period
+		dmc       [2]uint16 // slowest and fastest DMC rate
+		frame4    uint16    // last step of the 4-step sequence
+		frame5    uint16
+		irqCycles uint16 // cycles between 4-step frame IRQs
+	}{
+		{regionNTSC, [2]uint16{4, 4068}, [2]uint16{428, 54}, 29829, 37281, 29830},
+		{regionPAL, [2]uint16{4, 3778}, [2]uint16{398, 50}, 33253, 41565, 33254},
+		// Dendy keeps the NTSC APU
+		{regionDendy, [2]uint16{4, 4068}, [2]uint16{428, 54}, 29829, 37281, 29830},
+	}
+	for _, test := range tests {
+		r := test.region
+		if r.NoiseTable[0] != test.noise[0] || r.NoiseTable[15] != test.noise[1] {
+			t.Errorf("%s: noise periods %d-%d, want %d-%d", r.Name, r.NoiseTable[0], r.NoiseTable[15], test.noise[0], test.noise[1])
+		}
+		if r.DMCTable[0] != test.dmc[0] || r.DMCTable[15] != test.dmc[1] {
+			t.Errorf("%s: DMC rates %d-%d, want %d-%d", r.Name, r.DMCTable[0], r.DMCTable[15], test.dmc[0], test.dmc[1])
+		}
+		for i := 1; i < 16; i++ {
+			if r.NoiseTable[i] <= r.NoiseTable[i-1] || r.DMCTable[i] >= r.DMCTable[i-1] {
+				t.Errorf("%s: the tables are out of order at index %d", r.Name, i)
+			}
+		}
+		if r.FrameSteps4[3] != test.frame4 || r.FrameSteps5[4] != test.frame5 {
+			t.Errorf("%s: frame sequences end at %d and %d, want %d and %d", r.Name, r.FrameSteps4[3], r.FrameSteps5[4], test.frame4, test.frame5)
+		}
+
+		// The APU takes its periods and frame length from the region
+		apu := NewAPU(&CPU{}, r)
+		apu.write(0x400E, 0x0F)
+		apu.write(0x4010, 0x0F)
+		if apu.Noise.TimerPeriod != test.noise[1] || apu.DMC.TimerPeriod != test.dmc[1] {
+			t.Errorf("%s: APU noise period %d and DMC rate %d", r.Name, apu.Noise.TimerPeriod, apu.DMC.TimerPeriod)
+		}
+		apu.write(0x4017, 0x00)
+		for !apu.IRQ() {
+			apu.Clock()
+		}
+		apu.readStatus()
+		cycles := 0
+		for !apu.IRQ() {
+			apu.Clock()
+			cycles++
+		}
+		if cycles != int(test.irqCycles) {
+			t.Errorf("%s: frame IRQs %d cycles apart, want %d", r.Name, cycles, test.irqCycles)
+		}
+	}
+}
+
+func TestRegionByName(t *testing.T) {
+	tests := []struct {
+		name   string
+		region *Region
+		err    bool
+	}{
+		{"", nil, false},
+		{"auto", nil, false},
+		{"AUTO", nil, false},
+		{"ntsc", regionNTSC, false},
+		{"PAL", regionPAL, false},
+		{"Dendy", regionDendy, false},
+		{"secam", nil, true},
+	}
+	for _, test := range tests {
+		region, err := regionByName(test.name)
+		if region != test.region || (err != nil) != test.err {
+			t.Errorf("regionByName(%q) = %v, %v", test.name, region, err)
+		}
+	}
+}
+
+func TestRegionFromHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		flags7 uint8
+		flags9 uint8
+		timing uint8 // NES 2.0 byte 12
+		want   *Region
+	}{
+		{"iNES", 0x00, 0x00, 0, regionNTSC},
+		{"iNES PAL bit", 0x00, 0x01, 0, regionPAL},
+		{"NES 2.0 NTSC", 0x08, 0x00, 0, regionNTSC},
+		{"NES 2.0 PAL", 0x08, 0x00, 1, regionPAL},
+		{"NES 2.0 multiple region", 0x08, 0x00, 2, regionNTSC},
+		{"NES 2.0 Dendy", 0x08, 0x00, 3, regionDendy},
+		// Byte 9 is part of the ROM size in NES 2.0, so its low bit is not the PAL flag
+		{"NES 2.0 ignores the iNES bit", 0x08, 0x01, 0, regionNTSC},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		rom := make([]uint8, headerSize+0x8000)
+		copy(rom, "NES\x1A")
+		rom[4] = 2
+		rom[7], rom[9], rom[12] = test.flags7, test.flags9, test.timing
+		if test.flags7 == 0x08 {
+			// Keep the NES 2.0 PRG size in range
+			rom[9] &^= 0x0F
+		}
+		rom[headerSize+0x7FFC], rom[headerSize+0x7FFD] = 0x00, 0x80
+		cart, err := parseINES(rom)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if cart.Region != test.want {
+			t.Errorf("%s: header says %s, want %s", test.name, cart.Region.Name, test.want.Name)
+		}
+
+		// "auto" leaves the choice to the header, naming a region overrides it
+		path := filepath.Join(dir, "game.nes")
+		if err := os.WriteFile(path, rom, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, region := range []*Region{nil, regionDendy} {
+			runner, _, err := loadROM(path, "off", "", region, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			want := test.want
+			if region != nil {
+				want = region
+			}
+			if runner.Region != want || runner.cpu.APU.region != want {
+				t.Errorf("%s with region %v: runner is %s", test.name, region, runner.Region.Name)
+			}
+		}
+	}
+}
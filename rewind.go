@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+type rewindDelta struct {
+	frame int
+	data  []byte // compressed XOR of the snapshot at frame with the next newer snapshot
+}
+
+/*
+RewindBuffer keeps a snapshot every Interval frames. Only the newest snapshot is held
+in full, older ones are stored as compressed XOR deltas against their successor, and
+the oldest deltas are dropped once the buffer grows beyond Budget bytes. The input of
+every frame since the oldest snapshot is kept too, to replay the frames in between.
+*/
+type RewindBuffer struct {
+	Interval int
+	Budget   int
+
+	head      []byte
+	headFrame int
+	deltas    []rewindDelta // oldest first
+	size      int
+
+	// Controller buttons each frame from inputStart on ran with
+	inputs     [][2]uint8
+	inputStart int
+}
+
+func NewRewindBuffer(interval int, budget int) *RewindBuffer {
+	if interval < 1 {
+		interval = 1
+	}
+	return &RewindBuffer{Interval: interval, Budget: budget}
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// Adds the snapshot taken at the start of frame
+func (rb *RewindBuffer) Push(state []byte, frame int) {
+	if rb.head != nil && len(rb.head) == len(state) {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		w.Write(xorBytes(rb.head, state))
+		w.Close()
+		rb.deltas = append(rb.deltas, rewindDelta{frame: rb.headFrame, data: buf.Bytes()})
+		rb.size += buf.Len()
+	} else {
+		// The state layout changed, older deltas can no longer be applied
+		rb.deltas = nil
+		rb.size = 0
+	}
+	rb.head = state
+	rb.headFrame = frame
+
+	for len(rb.deltas) > 0 && rb.size+len(rb.head) > rb.Budget {
+		rb.size -= len(rb.deltas[0].data)
+		rb.deltas = rb.deltas[1:]
+	}
+}
+
+// Drops the newest snapshot and makes the one before it the head, false if there is none
+func (rb *RewindBuffer) Pop() bool {
+	if len(rb.deltas) == 0 {
+		return false
+	}
+	last := rb.deltas[len(rb.deltas)-1]
+	delta, err := io.ReadAll(flate.NewReader(bytes.NewReader(last.data)))
+	if err != nil || len(delta) != len(rb.head) {
+		return false
+	}
+	rb.head = xorBytes(rb.head, delta)
+	rb.headFrame = last.frame
+	rb.deltas = rb.deltas[:len(rb.deltas)-1]
+	rb.size -= len(last.data)
+	return true
+}
+
+/*
+Records the buttons held at the end of frame, which are taken as those the whole
+frame ran with. Recording an earlier frame than the
+last one drops the input after it, as rewinding does with the snapshots.
+*/
+func (rb *RewindBuffer) recordInput(frame int, buttons [2]uint8) {
+	if frame < rb.inputStart || frame > rb.inputStart+len(rb.inputs) {
+		rb.inputs = nil
+		rb.inputStart = frame
+	}
+	rb.inputs = append(rb.inputs[:frame-rb.inputStart], buttons)
+
+	// Input from before the oldest snapshot is never replayed
+	if drop := min(rb.OldestFrame()-rb.inputStart, len(rb.inputs)); drop > 0 {
+		rb.inputs = rb.inputs[drop:]
+		rb.inputStart += drop
+	}
+}
+
+// Returns the buttons frame ran with, false if they were not recorded
+func (rb *RewindBuffer) input(frame int) ([2]uint8, bool) {
+	if frame < rb.inputStart || frame >= rb.inputStart+len(rb.inputs) {
+		return [2]uint8{}, false
+	}
+	return rb.inputs[frame-rb.inputStart], true
+}
+
+// Returns the newest snapshot and the frame it was taken at
+func (rb *RewindBuffer) Head() ([]byte, int) {
+	return rb.head, rb.headFrame
+}
+
+// Returns the first frame that can still be rewound to
+func (rb *RewindBuffer) OldestFrame() int {
+	if len(rb.deltas) > 0 {
+		return rb.deltas[0].frame
+	}
+	return rb.headFrame
+}
+
+// Starts taking snapshots, the current state is the first one
+func (r *Runner) EnableRewind(interval int, budget int) {
+	r.Rewind = NewRewindBuffer(interval, budget)
+	r.Rewind.Push(r.SaveState(), r.Frame)
+}
+
+/*
+Returns to the start of frame by restoring the closest snapshot at or before it and
+running forward the remaining frames with the input recorded for them. Replayed
+frames are not seen by hooks, scripts, the profiler, the recorders or the movie.
+Snapshots after frame are discarded.
+*/
+func (r *Runner) RewindTo(frame int) error {
+	if r.Rewind == nil {
+		return fmt.Errorf("rewind is not enabled")
+	}
+	if frame < r.Rewind.OldestFrame() {
+		return fmt.Errorf("frame %d is no longer in the rewind buffer", frame)
+	}
+	for {
+		if _, headFrame := r.Rewind.Head(); headFrame <= frame || !r.Rewind.Pop() {
+			break
+		}
+	}
+
+	state, _ := r.Rewind.Head()
+	if err := r.LoadState(state); err != nil {
+		return err
+	}
+	hooks := r.cpu.hooks
+	r.cpu.hooks = nil
+	r.replaying = true
+	defer func() {
+		r.cpu.hooks = hooks
+		r.replaying = false
+	}()
+	for {
+		if buttons, ok := r.Rewind.input(r.Frame); ok {
+			r.cpu.Controllers[0].Buttons = buttons[0]
+			r.cpu.Controllers[1].Buttons = buttons[1]
+		}
+		if r.Frame >= frame {
+			break
+		}
+		if !r.RunFrame() {
+			return fmt.Errorf("BRK while replaying to frame %d", frame)
+		}
+	}
+	if r.Movie != nil {
+		r.rerecord()
+	}
+	return nil
+}
+
+// Steps back to the start of the previous frame
+func (r *Runner) StepBack() error {
+	return r.RewindTo(r.Frame - 1)
+}
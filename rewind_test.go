@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Counts the frames the A button of controller 1 is held in $10, a few times a frame
+var inputCounterProgram = []uint8{
+	0xA9, 0x01, // LDA #$01
+	0x8D, 0x16, 0x40, // STA $4016
+	0xA9, 0x00, // LDA #$00
+	0x8D, 0x16, 0x40, // STA $4016
+	0xAD, 0x16, 0x40, // LDA $4016
+	0x29, 0x01, // AND #$01
+	0xF0, 0x02, // BEQ +2
+	0xE6, 0x10, // INC $10
+	0x4C, 0x00, 0x80, // JMP $8000
+}
+
+func TestRewindBufferDeltas(t *testing.T) {
+	tests := []struct {
+		name      string
+		budget    int
+		snapshots int
+		oldest    int
+	}{
+		{"everything fits", 1 << 20, 6, 0},
+		{"budget drops the oldest", 64 + 16, 6, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rb := NewRewindBuffer(1, test.budget)
+			var states [][]byte
+			for frame := 0; frame < test.snapshots; frame++ {
+				state := bytes.Repeat([]byte{byte(frame)}, 64)
+				state[frame] = 0xFF
+				states = append(states, state)
+				rb.Push(state, frame)
+			}
+			if got := rb.OldestFrame(); got != test.oldest {
+				t.Fatalf("oldest frame = %d, want %d", got, test.oldest)
+			}
+			for frame := test.snapshots - 1; ; frame-- {
+				head, headFrame := rb.Head()
+				if headFrame != frame || !bytes.Equal(head, states[frame]) {
+					t.Fatalf("head is frame %d, want frame %d with its snapshot", headFrame, frame)
+				}
+				if !rb.Pop() {
+					break
+				}
+			}
+			if _, headFrame := rb.Head(); headFrame != test.oldest {
+				t.Errorf("popped back to frame %d, want %d", headFrame, test.oldest)
+			}
+		})
+	}
+}
+
+func TestRewindBufferInput(t *testing.T) {
+	rb := NewRewindBuffer(1, 1<<20)
+	rb.Push([]byte{0}, 0)
+	for frame := 0; frame < 5; frame++ {
+		rb.recordInput(frame, [2]uint8{uint8(frame), 0})
+	}
+	// Recording an earlier frame again replaces what came after it
+	rb.recordInput(2, [2]uint8{0x80, 0})
+	tests := []struct {
+		frame int
+		want  uint8
+		ok    bool
+	}{
+		{0, 0, true},
+		{1, 1, true},
+		{2, 0x80, true},
+		{3, 0, false},
+		{-1, 0, false},
+	}
+	for _, test := range tests {
+		buttons, ok := rb.input(test.frame)
+		if ok != test.ok || buttons[0] != test.want {
+			t.Errorf("input(%d) = %d, %v, want %d, %v", test.frame, buttons[0], ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestRewindReplaysInput(t *testing.T) {
+	r := newTestRunner(&NROM{prg: testPRG(inputCounterProgram...)})
+	r.EnableRewind(4, 1<<20)
+	executed := 0
+	r.OnExecute(AddressRange{0x8000, 0xFFFF}, func(uint16) { executed++ })
+
+	var states [][]byte
+	for frame := 0; frame < 10; frame++ {
+		// Hold A on every third frame, as a frontend sets input between frames
+		r.cpu.Controllers[0].Buttons = 0
+		if frame%3 == 0 {
+			r.cpu.Controllers[0].Buttons = ButtonA
+		}
+		states = append(states, r.SaveState())
+		if !r.RunFrame() {
+			t.Fatal("BRK")
+		}
+	}
+
+	for _, frame := range []int{9, 6, 5, 1} {
+		t.Run(fmt.Sprint(frame), func(t *testing.T) {
+			before := executed
+			r.cpu.Controllers[0].Buttons = ButtonA | ButtonB
+			if err := r.RewindTo(frame); err != nil {
+				t.Fatal(err)
+			}
+			if executed != before {
+				t.Errorf("hooks ran %d times while replaying", executed-before)
+			}
+			if !bytes.Equal(r.SaveState(), states[frame]) {
+				t.Errorf("state after rewinding to frame %d differs from the original", frame)
+			}
+		})
+	}
+
+	if err := r.RewindTo(-1); err == nil {
+		t.Error("rewinding before the oldest snapshot did not fail")
+	}
+}
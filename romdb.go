@@ -0,0 +1,134 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"strings"
+)
+
+//go:embed romdb.xml
+var embeddedROMDatabase []byte
+
+// One <game> of the NES 2.0 XML database, the title is kept in a comment
+type romDBGame struct {
+	Comment string `xml:",comment"`
+	ROM     struct {
+		CRC32 string `xml:"crc32,attr"`
+		SHA1  string `xml:"sha1,attr"`
+	} `xml:"rom"`
+	PCB struct {
+		Mapper    int    `xml:"mapper,attr"`
+		Mirroring string `xml:"mirroring,attr"`
+		Battery   int    `xml:"battery,attr"`
+	} `xml:"pcb"`
+	Console struct {
+		Region int `xml:"region,attr"`
+	} `xml:"console"`
+}
+
+// ROMDatabase finds games by the CRC32 or SHA-1 of their PRG and CHR ROM
+type ROMDatabase struct {
+	bySHA1  map[string]*romDBGame
+	byCRC32 map[string]*romDBGame
+}
+
+func parseROMDatabase(data []byte) (*ROMDatabase, error) {
+	var root struct {
+		Games []*romDBGame `xml:"game"`
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("error parsing ROM database: %w", err)
+	}
+	db := &ROMDatabase{bySHA1: make(map[string]*romDBGame), byCRC32: make(map[string]*romDBGame)}
+	for _, game := range root.Games {
+		if game.ROM.SHA1 != "" {
+			db.bySHA1[strings.ToUpper(game.ROM.SHA1)] = game
+		}
+		if game.ROM.CRC32 != "" {
+			db.byCRC32[strings.ToUpper(game.ROM.CRC32)] = game
+		}
+	}
+	return db, nil
+}
+
+// Loads a nes20db.xml file, an empty name gives the database built into the emulator
+func LoadROMDatabase(filename string) (*ROMDatabase, error) {
+	if filename == "" {
+		return parseROMDatabase(embeddedROMDatabase)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ROM database: %w", err)
+	}
+	return parseROMDatabase(data)
+}
+
+func (cart *Cartridge) CRC32() uint32 {
+	return crc32.ChecksumIEEE(cart.romData())
+}
+
+// Returns the entry for the cartridge, SHA-1 first as CRC32 can collide. A nil database has no games
+func (db *ROMDatabase) Lookup(cart *Cartridge) *romDBGame {
+	if db == nil {
+		return nil
+	}
+	sum := cart.SHA1()
+	if game, ok := db.bySHA1[strings.ToUpper(hex.EncodeToString(sum[:]))]; ok {
+		return game
+	}
+	return db.byCRC32[fmt.Sprintf("%08X", cart.CRC32())]
+}
+
+// The comment holds the file path the game was catalogued under, e.g. "\Title (USA).nes"
+func (game *romDBGame) title() string {
+	title := strings.TrimSpace(game.Comment)
+	title = path.Base(strings.ReplaceAll(title, "\\", "/"))
+	return strings.TrimSuffix(title, path.Ext(title))
+}
+
+/*
+Replaces the header fields of cart with the ones from the database and returns a
+warning for every field the header had wrong
+*/
+func (game *romDBGame) apply(cart *Cartridge) []string {
+	var warnings []string
+	cart.Title = game.title()
+
+	if game.PCB.Mapper > 0xFF {
+		warnings = append(warnings, fmt.Sprintf("mapper %d from the ROM database is not supported", game.PCB.Mapper))
+	} else if mapper := uint8(game.PCB.Mapper); mapper != cart.Mapper {
+		warnings = append(warnings, fmt.Sprintf("header says mapper %d, ROM database says %d", cart.Mapper, mapper))
+		cart.Mapper = mapper
+	}
+
+	mirroring, ok := map[string]uint8{"H": mirrorHorizontal, "V": mirrorVertical, "4": mirrorFourScreen}[game.PCB.Mirroring]
+	if ok && mirroring != cart.Mirroring {
+		warnings = append(warnings, fmt.Sprintf("header says %s mirroring, ROM database says %s",
+			mirroringNames[cart.Mirroring], mirroringNames[mirroring]))
+		cart.Mirroring = mirroring
+	}
+
+	if battery := game.PCB.Battery != 0; battery != cart.Battery {
+		warnings = append(warnings, fmt.Sprintf("header battery flag is %t, ROM database says %t", cart.Battery, battery))
+		cart.Battery = battery
+	}
+
+	// Multi-region games run on NTSC
+	region := regionNTSC
+	switch game.Console.Region {
+	case 1:
+		region = regionPAL
+	case 3:
+		region = regionDendy
+	}
+	if region != cart.Region {
+		warnings = append(warnings, fmt.Sprintf("header says %s, ROM database says %s", cart.Region.Name, region.Name))
+		cart.Region = region
+	}
+	return warnings
+}
@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestROMDatabaseLookup(t *testing.T) {
+	db, err := LoadROMDatabase("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart, err := readNESFile("nestest.nes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crc := cart.CRC32(); crc != 0x158B0388 {
+		t.Errorf("CRC32 = %08X, want 158B0388", crc)
+	}
+
+	crcOnly, err := parseROMDatabase([]byte(`<nes20db><game><!-- \dir\By CRC (Europe).nes -->` +
+		`<rom crc32="158b0388"/><pcb mapper="2" mirroring="V" battery="1"/><console region="1"/></game></nes20db>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := &Cartridge{PRG: []uint8{1, 2, 3}}
+
+	tests := []struct {
+		name  string
+		db    *ROMDatabase
+		cart  *Cartridge
+		title string
+	}{
+		{"by SHA-1", db, cart, "nestest"},
+		{"by CRC32", crcOnly, cart, "By CRC (Europe)"},
+		{"unknown", db, unknown, ""},
+		{"no database", nil, cart, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			game := test.db.Lookup(test.cart)
+			if test.title == "" {
+				if game != nil {
+					t.Errorf("found %q", game.title())
+				}
+				return
+			}
+			if game == nil || game.title() != test.title {
+				t.Fatalf("Lookup = %v, want %q", game, test.title)
+			}
+		})
+	}
+}
+
+func TestROMDatabaseApply(t *testing.T) {
+	db, err := parseROMDatabase([]byte(`<nes20db><game><!-- \Game (Europe).nes -->` +
+		`<rom crc32="00000000"/><pcb mapper="2" mirroring="V" battery="1"/><console region="1"/></game></nes20db>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	game := db.byCRC32["00000000"]
+
+	tests := []struct {
+		name     string
+		cart     Cartridge
+		warnings int
+	}{
+		{"header right", Cartridge{Mapper: 2, Mirroring: mirrorVertical, Battery: true, Region: regionPAL}, 0},
+		{"header wrong", Cartridge{Mapper: 0, Mirroring: mirrorHorizontal, Battery: false, Region: regionNTSC}, 4},
+		{"region only", Cartridge{Mapper: 2, Mirroring: mirrorVertical, Battery: true, Region: regionDendy}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cart := test.cart
+			warnings := game.apply(&cart)
+			if len(warnings) != test.warnings {
+				t.Errorf("warnings %q, want %d", warnings, test.warnings)
+			}
+			if cart.Mapper != 2 || cart.Mirroring != mirrorVertical || !cart.Battery || cart.Region != regionPAL {
+				t.Errorf("header not corrected: %+v", cart)
+			}
+			if cart.Title != "Game (Europe)" {
+				t.Errorf("title = %q", cart.Title)
+			}
+		})
+	}
+}
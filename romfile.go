@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File extensions of the ROM images looked for inside archives
+var romExtensions = map[string]bool{".nes": true, ".unf": true, ".unif": true, ".fds": true, ".nsf": true, ".nsfe": true}
+
+// Returns true when data starts like an iNES, UNIF or FDS image or an NSF file
+func isROMImage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("NES\x1A")) || bytes.HasPrefix(data, []byte(unifMagic)) || isFDSImage(data) || isNSFImage(data)
+}
+
+// Reads a ROM image, unpacking it from a .zip or .gz archive when the name says so
+func readROMFile(filename string) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".zip":
+		return readROMZip(filename)
+	case ".gz":
+		return readROMGzip(filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	return data, nil
+}
+
+/*
+Returns the first ROM image in a zip archive. Files with a ROM extension are tried
+first, then any file that starts with an iNES, UNIF or FDS header.
+*/
+func readROMZip(filename string) ([]byte, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer archive.Close()
+
+	for _, byExtension := range []bool{true, false} {
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() || romExtensions[strings.ToLower(filepath.Ext(f.Name))] != byExtension {
+				continue
+			}
+			data, err := readZipFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s from archive: %w", f.Name, err)
+			}
+			if isROMImage(data) {
+				return data, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no NES image found in %s", filename)
+}
+
+func readROMGzip(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive: %w", err)
+	}
+	if !isROMImage(data) {
+		return nil, fmt.Errorf("no NES image found in %s", filename)
+	}
+	return data, nil
+}
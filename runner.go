@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+/*
+Runner drives the CPU one instruction or one frame at a time. There is no PPU yet,
+so frames are counted in CPU cycles of the region rather than by vblank.
+*/
+type Runner struct {
+	cpu    *CPU
+	Region *Region
+
+	Frame       int
+	frameCycles int
+
+	// Output of the frame last drawn, nothing renders into it until there is a PPU
+	Framebuffer *Framebuffer
+	// Optional composite video filter used instead of the palette for images
+	Filter *NTSCFilter
+
+	Profiler *Profiler
+	Rewind   *RewindBuffer
+	// Optional WAV capture of the APU output and recording of every frame
+	Audio *AudioRecorder
+	Video *VideoRecorder
+
+	// Movie being recorded or played back, Desync is the first frame that failed its RAM check
+	Movie      *Movie
+	recording  bool
+	movieStart int
+	Desync     int
+
+	// Lua script driving the emulator, see LoadScript
+	Script *Script
+
+	// Set while RewindTo runs frames forward again
+	replaying bool
+}
+
+func NewRunner(cpu *CPU, region *Region) *Runner {
+	return &Runner{cpu: cpu, Region: region, Framebuffer: &Framebuffer{}}
+}
+
+/*
+Loads a ROM or disk image into a new CPU and returns a runner ready at the start of
+the program. Without a patch one named after the ROM is applied if it exists, "off"
+disables that. Header fields are corrected from db when it has the game, and a nil
+region uses the one from the header. Disk images boot the BIOS in bios, by default
+disksys.rom next to the image.
+*/
+func loadROM(filename string, patch string, bios string, region *Region, db *ROMDatabase) (*Runner, *Cartridge, error) {
+	var err error
+	switch patch {
+	case "off":
+		patch = ""
+	case "":
+		if patch, err = findPatch(filename); err != nil {
+			return nil, nil, err
+		}
+	}
+	if patch != "" {
+		fmt.Printf("applying patch %s\n", patch)
+	}
+
+	cart, err := readNESFile(filename, patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if game := db.Lookup(cart); game != nil {
+		for _, warning := range game.apply(cart) {
+			fmt.Printf("warning: %s\n", warning)
+		}
+	}
+	if region == nil {
+		region = cart.Region
+	}
+
+	if bios == "" {
+		bios = filepath.Join(filepath.Dir(filename), "disksys.rom")
+	}
+	mapper, err := newMapper(cart, bios)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cpu := &CPU{}
+	cpu.APU = NewAPU(cpu, region)
+	cpu.Mapper = mapper
+	if am, ok := mapper.(audioMapper); ok {
+		cpu.APU.Expansion = am.Audio()
+	}
+	cpu.P = 0x24
+	mapper.Reset(cpu)
+	switch {
+	case cart.Disks != nil:
+		// The BIOS starts from its reset vector
+		cpu.PC = uint16(cpu.memory[0xFFFD])<<8 | uint16(cpu.memory[0xFFFC])
+	case cart.NSF == nil:
+		// The NSF player has already started its driver
+		cpu.PC = 0x8000
+	}
+	return NewRunner(cpu, region), cart, nil
+}
+
+// The disk system for switching disk sides, nil when a cartridge is loaded
+func (r *Runner) Disk() *FDS {
+	fds, _ := r.cpu.Mapper.(*FDS)
+	return fds
+}
+
+/*
+Executes a single instruction, returns the opcode that was run. An IRQ from the APU
+or the cartridge is taken first when the I flag allows it, the line stays asserted
+until the handler acknowledges its source, and the instruction is the handler's first.
+*/
+func (r *Runner) Step() uint8 {
+	cpu := r.cpu
+	before := cpu.Cycles
+	if cpu.APU.IRQ() || cpu.Mapper.IRQ() {
+		cpu.IRQ()
+	}
+	if cpu.hooks != nil {
+		cpu.hooks.execute(cpu.PC)
+	}
+	pc := cpu.PC
+	opcode := cpu.fetch(pc)
+
+	cpu.ExecuteInstruction(opcode)
+
+	// Cycles is a uint16 so the subtraction stays correct across wraparound
+	elapsed := int(cpu.Cycles - before)
+	if r.Profiler != nil && !r.replaying {
+		r.Profiler.Record(cpu, r.Frame, pc, opcode, elapsed)
+	}
+
+	for i := 0; i < elapsed; i++ {
+		cpu.APU.Clock()
+		cpu.Mapper.Clock()
+		if r.Audio != nil && !r.replaying {
+			r.Audio.sample(cpu.APU)
+		}
+	}
+
+	r.frameCycles += elapsed
+	if cycles := r.Region.CyclesPerFrame(); r.frameCycles >= cycles {
+		r.frameCycles -= cycles
+		r.Frame++
+		r.endFrame()
+	}
+	return opcode
+}
+
+// Runs until the next frame boundary, stops early and returns false on BRK
+func (r *Runner) RunFrame() bool {
+	frame := r.Frame
+	for r.Frame == frame {
+		if r.Step() == 0x00 {
+			return false
+		}
+	}
+	return true
+}
+
+// Frame boundary work, called once the frame counter has advanced
+func (r *Runner) endFrame() {
+	if r.Rewind != nil && !r.replaying {
+		// Before the script or the movie set the input of the next frame
+		r.Rewind.recordInput(r.Frame-1, [2]uint8{r.cpu.Controllers[0].Buttons, r.cpu.Controllers[1].Buttons})
+	}
+	// Frozen RAM is part of the emulated state, so it is applied again when replaying
+	if r.cpu.Cheats != nil {
+		r.cpu.Cheats.freeze(r.cpu)
+	}
+	if r.replaying {
+		r.pushSnapshot()
+		return
+	}
+	if r.Script != nil && r.Script.Err == nil {
+		r.Script.endFrame()
+	}
+	if r.Audio != nil {
+		r.Audio.flush()
+	}
+	if r.Video != nil {
+		r.Video.writeFrame(r.frameImage(r.Video.Palette, r.Video.Scale))
+	}
+	if r.Movie != nil {
+		r.movieFrameEnd()
+	}
+	if r.Rewind != nil {
+		r.pushSnapshot()
+	}
+}
+
+func (r *Runner) pushSnapshot() {
+	if _, headFrame := r.Rewind.Head(); r.Frame-headFrame >= r.Rewind.Interval {
+		r.Rewind.Push(r.SaveState(), r.Frame)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	stateMagic   = "NESS"
+	stateVersion = 7
+)
+
+// Fixed size layout of a save state so snapshots can be diffed byte for byte
+type stateHeader struct {
+	Magic   [4]byte
+	Version uint32
+}
+
+type cpuState struct {
+	PC     uint16
+	SP     uint8
+	A      uint8
+	X      uint8
+	Y      uint8
+	P      uint8
+	Cycles uint16
+	Memory [65536]uint8
+}
+
+type controllerState struct {
+	Buttons uint8
+	Strobe  bool
+	Shift   uint8
+}
+
+type apuState struct {
+	Pulse    [2]Pulse
+	Triangle Triangle
+	Noise    Noise
+	DMC      DMC
+	Frame    FrameCounter
+	Cycle    uint64
+}
+
+type runnerState struct {
+	Region      uint8
+	Frame       int64
+	FrameCycles int64
+}
+
+// Serializes the CPU, APU, frame position and mapper, every state of a session has the same size
+func (r *Runner) SaveState() []byte {
+	cpu := r.cpu
+	var buf bytes.Buffer
+	header := stateHeader{Version: stateVersion}
+	copy(header.Magic[:], stateMagic)
+	binary.Write(&buf, binary.LittleEndian, &header)
+	binary.Write(&buf, binary.LittleEndian, &cpuState{
+		PC: cpu.PC, SP: cpu.SP, A: cpu.A, X: cpu.X, Y: cpu.Y, P: cpu.P,
+		Cycles: cpu.Cycles, Memory: cpu.memory,
+	})
+	for _, c := range cpu.Controllers {
+		binary.Write(&buf, binary.LittleEndian, &controllerState{c.Buttons, c.strobe, c.shift})
+	}
+	apu := cpu.APU
+	binary.Write(&buf, binary.LittleEndian, &apuState{
+		apu.Pulse, apu.Triangle, apu.Noise, apu.DMC, apu.Frame, apu.Cycle,
+	})
+	binary.Write(&buf, binary.LittleEndian, &runnerState{
+		Region:      r.Region.ID,
+		Frame:       int64(r.Frame),
+		FrameCycles: int64(r.frameCycles),
+	})
+	if ms, ok := cpu.Mapper.(mapperState); ok {
+		ms.saveState(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (r *Runner) LoadState(data []byte) error {
+	reader := bytes.NewReader(data)
+	var header stateHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("error reading save state: %w", err)
+	}
+	if string(header.Magic[:]) != stateMagic || header.Version != stateVersion {
+		return fmt.Errorf("not a valid save state")
+	}
+
+	var cs cpuState
+	var controllers [2]controllerState
+	var as apuState
+	var rs runnerState
+	if err := binary.Read(reader, binary.LittleEndian, &cs); err != nil {
+		return fmt.Errorf("error reading save state: %w", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &controllers); err != nil {
+		return fmt.Errorf("error reading save state: %w", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &as); err != nil {
+		return fmt.Errorf("error reading save state: %w", err)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &rs); err != nil {
+		return fmt.Errorf("error reading save state: %w", err)
+	}
+	if rs.Region != r.Region.ID {
+		return fmt.Errorf("save state is from a different region than %s", r.Region.Name)
+	}
+	if ms, ok := r.cpu.Mapper.(mapperState); ok {
+		if err := ms.loadState(reader); err != nil {
+			return err
+		}
+	}
+
+	cpu := r.cpu
+	cpu.PC, cpu.SP, cpu.A, cpu.X, cpu.Y, cpu.P = cs.PC, cs.SP, cs.A, cs.X, cs.Y, cs.P
+	cpu.Cycles = cs.Cycles
+	cpu.memory = cs.Memory
+	for i, c := range controllers {
+		cpu.Controllers[i] = Controller{Buttons: c.Buttons, strobe: c.Strobe, shift: c.Shift}
+	}
+	apu := cpu.APU
+	apu.Pulse, apu.Triangle, apu.Noise, apu.DMC, apu.Frame = as.Pulse, as.Triangle, as.Noise, as.DMC, as.Frame
+	apu.Cycle = as.Cycle
+	r.Frame = int(rs.Frame)
+	r.frameCycles = int(rs.FrameCycles)
+	return nil
+}
+
+func (r *Runner) SaveStateFile(filename string) error {
+	if err := os.WriteFile(filename, r.SaveState(), 0644); err != nil {
+		return fmt.Errorf("error writing save state: %w", err)
+	}
+	return nil
+}
+
+func (r *Runner) LoadStateFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("error reading save state: %w", err)
+	}
+	return r.LoadState(data)
+}
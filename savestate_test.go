@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	r := newTestRunner(NewMMC2(make([]uint8, 0x20000), make([]uint8, 0x20000), false))
+	cpu := r.cpu
+	cpu.write(0xA000, 0x03)
+	cpu.write(0xB000, 0x05)
+	cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.SP = 0x8123, 1, 2, 3, 0xF0
+	cpu.memory[0x0300] = 0x42
+	cpu.Controllers[1].Buttons = ButtonStart
+	cpu.APU.write(0x4000, 0xBF)
+	r.Frame = 17
+	state := r.SaveState()
+
+	cpu.write(0xA000, 0x00)
+	cpu.write(0xB000, 0x00)
+	cpu.PC, cpu.A = 0x8000, 0
+	cpu.memory[0x0300] = 0
+	cpu.Controllers[1].Buttons = 0
+	cpu.APU.write(0x4000, 0)
+	r.Frame = 0
+	if err := r.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.SaveState(), state) {
+		t.Error("state differs after loading it")
+	}
+	mmc2 := cpu.Mapper.(*MMC2)
+	if mmc2.Registers.PRG != 3 || mmc2.Registers.CHR[0] != 5 {
+		t.Errorf("mapper registers not restored: %+v", mmc2.Registers)
+	}
+	// The PRG bank is mapped again, not only its register restored
+	if offset, _ := cpu.prgOffset(0x8000); offset != 3*0x2000 {
+		t.Errorf("PRG offset of $8000 = $%X, want $6000", offset)
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	r := newTestRunner(&NROM{prg: testPRG()})
+	valid := r.SaveState()
+
+	pal := newTestRunner(&NROM{prg: testPRG()})
+	pal.Region = regionPAL
+	fromPAL := pal.SaveState()
+
+	tests := []struct {
+		name  string
+		state []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("XXXX"), valid[4:]...)},
+		{"other version", append(append([]byte{}, valid[:4]...), append([]byte{0xFF, 0, 0, 0}, valid[8:]...)...)},
+		{"truncated", valid[:100]},
+		{"other region", fromPAL},
+	}
+	for _, test := range tests {
+		if err := r.LoadState(test.state); err == nil {
+			t.Errorf("%s: LoadState did not fail", test.name)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Button names of joypad tables, in the bit order of Controller.Buttons
+var scriptButtons = [8]string{"A", "B", "select", "start", "up", "down", "left", "right"}
+
+// Named overlay colours and the palette entries drawn for them
+var scriptColours = map[string]uint16{
+	"white": 0x30, "black": 0x0F, "grey": 0x00, "gray": 0x00, "red": 0x16, "orange": 0x27,
+	"yellow": 0x28, "green": 0x2A, "blue": 0x12, "purple": 0x14, "pink": 0x25,
+}
+
+/*
+3x5 glyphs of the overlay font for characters $20-$5F, five rows of three bits from
+the top, lower case letters are drawn as upper case
+*/
+var scriptFont = [64]uint16{
+	0x0000, 0x2482, 0x5A00, 0x5F7D, 0x3C9E, 0x52A5, 0x2AAB, 0x2400,
+	0x1491, 0x4494, 0x0AA8, 0x05D0, 0x0014, 0x01C0, 0x0002, 0x12A4,
+	0x7B6F, 0x2C97, 0x62A7, 0x628E, 0x5BC9, 0x798E, 0x39EF, 0x7292,
+	0x7BEF, 0x7BCE, 0x0410, 0x0414, 0x1511, 0x0E38, 0x4454, 0x6282,
+	0x2BE3, 0x2BED, 0x6BAE, 0x3923, 0x6B6E, 0x79E7, 0x79E4, 0x396B,
+	0x5BED, 0x7497, 0x126A, 0x5BAD, 0x4927, 0x5FED, 0x5FFD, 0x2B6A,
+	0x6BA4, 0x2B7B, 0x6BAD, 0x388E, 0x7492, 0x5B6B, 0x5B52, 0x5BFD,
+	0x5AAD, 0x5A92, 0x72A7, 0x3493, 0x4889, 0x6496, 0x2A00, 0x0007,
+}
+
+type scriptHookKey struct {
+	kind    string
+	address int
+	size    int
+}
+
+// A save state made by savestate.create, kept in memory until the script drops it
+type scriptSavestate struct {
+	data []byte
+}
+
+/*
+Script runs a Lua script against a runner, with the FCEUX emu, memory, joypad, gui
+and savestate libraries and BizHawk's event callbacks. The main chunk runs on its own
+goroutine so emu.frameadvance can pause it until the end of the next frame, the
+runner and the script never run at the same time.
+*/
+type Script struct {
+	// First error the script raised, it stops running after one
+	Err error
+
+	lua    *luaState
+	runner *Runner
+
+	frameEnd  []luaValue
+	inputPoll []luaValue
+	// Runner hooks of the memory callbacks by the address and size they were registered with
+	hooks map[scriptHookKey]HookID
+	// Set while a callback runs so memory accesses it makes do not call back
+	inCallback bool
+
+	// The main chunk is waiting in emu.frameadvance
+	waiting bool
+	resume  chan struct{}
+	yield   chan error
+}
+
+// Loads a script file and runs its main chunk up to the first emu.frameadvance
+func (r *Runner) LoadScript(filename string) (*Script, error) {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading script: %w", err)
+	}
+	proto, err := parseLua(filename, string(source))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Script{
+		lua:    newLuaState(),
+		runner: r,
+		hooks:  make(map[scriptHookKey]HookID),
+		resume: make(chan struct{}),
+		yield:  make(chan error),
+	}
+	s.openLibraries()
+	r.Script = s
+
+	go func() {
+		_, err := s.lua.Call(&luaClosure{proto: proto}, nil)
+		s.waiting = false
+		s.yield <- err
+	}()
+	if err := <-s.yield; err != nil {
+		s.stop(err)
+		r.Script = nil
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stops the script after an error, the emulator carries on without it
+func (s *Script) stop(err error) {
+	if s.Err == nil {
+		s.Err = err
+	}
+	for key, id := range s.hooks {
+		s.runner.RemoveHook(id)
+		delete(s.hooks, key)
+	}
+}
+
+// Runs a callback, stopping the script if it raises an error
+func (s *Script) callback(fn luaValue, args ...luaValue) {
+	if s.Err != nil || s.inCallback {
+		return
+	}
+	s.inCallback = true
+	_, err := s.lua.Call(fn, args)
+	s.inCallback = false
+	if err != nil {
+		s.stop(err)
+	}
+}
+
+// Called by the runner at the end of every frame
+func (s *Script) endFrame() {
+	for _, fn := range s.frameEnd {
+		s.callback(fn)
+	}
+	if s.waiting && s.Err == nil {
+		s.resume <- struct{}{}
+		if err := <-s.yield; err != nil {
+			s.stop(err)
+		}
+	}
+}
+
+/*
+Sets the callback of a read, write or execute hook, replacing the one registered for
+the same address and size, a nil fn removes it. Callbacks get the address, the size
+and the value read, written or of the opcode.
+*/
+func (s *Script) setHook(kind string, address int, size int, fn luaValue) {
+	key := scriptHookKey{kind, address, size}
+	if id, ok := s.hooks[key]; ok {
+		s.runner.RemoveHook(id)
+		delete(s.hooks, key)
+	}
+	if fn == nil {
+		return
+	}
+	r := s.runner
+	addresses := AddressRange{uint16(address), uint16(min(address+max(size, 1)-1, 0xFFFF))}
+	switch kind {
+	case "read":
+		s.hooks[key] = r.OnRead(addresses, func(address uint16, value uint8) uint8 {
+			s.callback(fn, float64(address), 1.0, float64(value))
+			return value
+		})
+	case "write":
+		s.hooks[key] = r.OnWrite(addresses, func(address uint16, value uint8) {
+			s.callback(fn, float64(address), 1.0, float64(value))
+		})
+	case "execute":
+		s.hooks[key] = r.OnExecute(addresses, func(address uint16) {
+			s.callback(fn, float64(address), 1.0, float64(r.cpu.memory[address]))
+		})
+	}
+}
+
+// Parses memory.register* arguments, (address, [size,] fn)
+func (s *Script) registerMemory(kind string, name string) func(*luaState, []luaValue) []luaValue {
+	return func(l *luaState, args []luaValue) []luaValue {
+		address, size := l.checkInt(args, 0, name), 1
+		fnIndex := 1
+		if _, ok := l.arg(args, 1).(float64); ok {
+			size, fnIndex = l.checkInt(args, 1, name), 2
+		}
+		var fn luaValue
+		if l.arg(args, fnIndex) != nil {
+			fn = l.checkFunction(args, fnIndex, name)
+		}
+		s.setHook(kind, address, size, fn)
+		return nil
+	}
+}
+
+// BizHawk's event.onmemory*(fn, address)
+func (s *Script) registerEvent(kind string, name string) func(*luaState, []luaValue) []luaValue {
+	return func(l *luaState, args []luaValue) []luaValue {
+		fn := l.checkFunction(args, 0, name)
+		s.setHook(kind, l.checkInt(args, 1, name), 1, fn)
+		return nil
+	}
+}
+
+func (s *Script) openLibraries() {
+	l := s.lua
+	r := s.runner
+	cpu := r.cpu
+
+	l.register("emu", luaLibrary{
+		"frameadvance": func(l *luaState, args []luaValue) []luaValue {
+			if s.inCallback {
+				l.errorf("emu.frameadvance can only be called from the main chunk")
+			}
+			s.waiting = true
+			s.yield <- nil
+			<-s.resume
+			return nil
+		},
+		"framecount": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{float64(r.Frame)}
+		},
+		"registerafter": func(l *luaState, args []luaValue) []luaValue {
+			s.frameEnd = nil
+			if l.arg(args, 0) != nil {
+				s.frameEnd = append(s.frameEnd, l.checkFunction(args, 0, "registerafter"))
+			}
+			return nil
+		},
+		"print": func(l *luaState, args []luaValue) []luaValue {
+			fmt.Fprintln(l.output, luaJoin(args, "\t"))
+			return nil
+		},
+	})
+
+	l.register("event", luaLibrary{
+		"onframeend": func(l *luaState, args []luaValue) []luaValue {
+			s.frameEnd = append(s.frameEnd, l.checkFunction(args, 0, "onframeend"))
+			return nil
+		},
+		// Input is polled when the game strobes the controllers, before they latch the buttons
+		"oninputpoll": func(l *luaState, args []luaValue) []luaValue {
+			fn := l.checkFunction(args, 0, "oninputpoll")
+			key := scriptHookKey{kind: "input"}
+			if _, ok := s.hooks[key]; !ok {
+				s.hooks[key] = r.OnWrite(AddressRange{0x4016, 0x4016}, func(address uint16, value uint8) {
+					if getBit(value, 0) {
+						for _, fn := range s.inputPoll {
+							s.callback(fn)
+						}
+					}
+				})
+			}
+			s.inputPoll = append(s.inputPoll, fn)
+			return nil
+		},
+		"onmemoryread":    s.registerEvent("read", "onmemoryread"),
+		"onmemorywrite":   s.registerEvent("write", "onmemorywrite"),
+		"onmemoryexecute": s.registerEvent("execute", "onmemoryexecute"),
+	})
+
+	read := func(l *luaState, args []luaValue, name string) uint8 {
+		return cpu.memory[uint16(l.checkInt(args, 0, name))]
+	}
+	l.register("memory", luaLibrary{
+		"readbyte": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{float64(read(l, args, "readbyte"))}
+		},
+		"readbytesigned": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{float64(int8(read(l, args, "readbytesigned")))}
+		},
+		"readword": func(l *luaState, args []luaValue) []luaValue {
+			low := uint16(l.checkInt(args, 0, "readword"))
+			high := uint16(l.optInt(args, 1, "readword", int(low)+1))
+			return []luaValue{float64(uint16(cpu.memory[high])<<8 | uint16(cpu.memory[low]))}
+		},
+		"readbyterange": func(l *luaState, args []luaValue) []luaValue {
+			address, length := l.checkInt(args, 0, "readbyterange"), l.checkInt(args, 1, "readbyterange")
+			b := make([]byte, max(length, 0))
+			for i := range b {
+				b[i] = cpu.memory[uint16(address+i)]
+			}
+			return []luaValue{string(b)}
+		},
+		"writebyte": func(l *luaState, args []luaValue) []luaValue {
+			cpu.write(uint16(l.checkInt(args, 0, "writebyte")), uint8(l.checkInt(args, 1, "writebyte")))
+			return nil
+		},
+		"getregister": func(l *luaState, args []luaValue) []luaValue {
+			switch strings.ToLower(l.checkString(args, 0, "getregister")) {
+			case "a":
+				return []luaValue{float64(cpu.A)}
+			case "x":
+				return []luaValue{float64(cpu.X)}
+			case "y":
+				return []luaValue{float64(cpu.Y)}
+			case "s":
+				return []luaValue{float64(cpu.SP)}
+			case "p":
+				return []luaValue{float64(cpu.P)}
+			case "pc":
+				return []luaValue{float64(cpu.PC)}
+			}
+			l.argError(0, "getregister", "unknown register")
+			return nil
+		},
+		"setregister": func(l *luaState, args []luaValue) []luaValue {
+			value := l.checkInt(args, 1, "setregister")
+			switch strings.ToLower(l.checkString(args, 0, "setregister")) {
+			case "a":
+				cpu.A = uint8(value)
+			case "x":
+				cpu.X = uint8(value)
+			case "y":
+				cpu.Y = uint8(value)
+			case "s":
+				cpu.SP = uint8(value)
+			case "p":
+				cpu.P = uint8(value)
+			case "pc":
+				cpu.PC = uint16(value)
+			default:
+				l.argError(0, "setregister", "unknown register")
+			}
+			return nil
+		},
+		"registerread":    s.registerMemory("read", "registerread"),
+		"registerwrite":   s.registerMemory("write", "registerwrite"),
+		"registerexec":    s.registerMemory("execute", "registerexec"),
+		"registerexecute": s.registerMemory("execute", "registerexecute"),
+	})
+
+	port := func(l *luaState, args []luaValue, name string) *Controller {
+		n := l.optInt(args, 0, name, 1)
+		if n != 1 && n != 2 {
+			l.argError(0, name, "port must be 1 or 2")
+		}
+		return &cpu.Controllers[n-1]
+	}
+	get := func(l *luaState, args []luaValue) []luaValue {
+		c := port(l, args, "read")
+		t := newLuaTable()
+		for i, button := range scriptButtons {
+			t.set(button, c.Buttons>>i&1 != 0)
+		}
+		return []luaValue{t}
+	}
+	l.register("joypad", luaLibrary{
+		"read": get,
+		"get":  get,
+		// true presses a button, false releases it and missing buttons are left alone
+		"set": func(l *luaState, args []luaValue) []luaValue {
+			c := port(l, args, "set")
+			t := l.checkTable(args, 1, "set")
+			for i, button := range scriptButtons {
+				switch v := t.get(button); {
+				case v == nil:
+				case luaTruthy(v):
+					c.Buttons |= 1 << i
+				default:
+					c.Buttons &^= 1 << i
+				}
+			}
+			return nil
+		},
+	})
+
+	l.register("gui", luaLibrary{
+		"pixel": func(l *luaState, args []luaValue) []luaValue {
+			s.pixel(l.checkInt(args, 0, "pixel"), l.checkInt(args, 1, "pixel"), s.colour(l, args, 2, "pixel", "white"))
+			return nil
+		},
+		"line": func(l *luaState, args []luaValue) []luaValue {
+			x1, y1 := l.checkInt(args, 0, "line"), l.checkInt(args, 1, "line")
+			x2, y2 := l.checkInt(args, 2, "line"), l.checkInt(args, 3, "line")
+			s.line(x1, y1, x2, y2, s.colour(l, args, 4, "line", "white"))
+			return nil
+		},
+		"box": func(l *luaState, args []luaValue) []luaValue {
+			x1, y1 := l.checkInt(args, 0, "box"), l.checkInt(args, 1, "box")
+			x2, y2 := l.checkInt(args, 2, "box"), l.checkInt(args, 3, "box")
+			s.box(x1, y1, x2, y2, s.colour(l, args, 4, "box", "clear"), s.colour(l, args, 5, "box", "white"))
+			return nil
+		},
+		"text": func(l *luaState, args []luaValue) []luaValue {
+			x, y := l.checkInt(args, 0, "text"), l.checkInt(args, 1, "text")
+			text := luaToString(l.arg(args, 2))
+			s.text(x, y, text, s.colour(l, args, 3, "text", "white"), s.colour(l, args, 4, "text", "black"))
+			return nil
+		},
+	})
+
+	checkState := func(l *luaState, args []luaValue, name string) *scriptSavestate {
+		state, ok := l.arg(args, 0).(*scriptSavestate)
+		if !ok {
+			l.argError(0, name, "savestate expected, got "+luaTypeName(l.arg(args, 0)))
+		}
+		return state
+	}
+	l.register("savestate", luaLibrary{
+		"create": func(l *luaState, args []luaValue) []luaValue {
+			return []luaValue{&scriptSavestate{}}
+		},
+		"save": func(l *luaState, args []luaValue) []luaValue {
+			checkState(l, args, "save").data = r.SaveState()
+			return nil
+		},
+		"load": func(l *luaState, args []luaValue) []luaValue {
+			state := checkState(l, args, "load")
+			if state.data == nil {
+				l.errorf("savestate.load: the state has not been saved")
+			}
+			if err := r.LoadState(state.data); err != nil {
+				l.errorf("savestate.load: %s", err)
+			}
+			return nil
+		},
+	})
+}
+
+/*
+Converts a colour argument to a palette entry: a palette index, a colour name, an
+"#RRGGBB" string matched to the nearest palette colour, or "clear" for none, which
+is returned as -1
+*/
+func (s *Script) colour(l *luaState, args []luaValue, i int, name string, def string) int {
+	v := l.arg(args, i)
+	if v == nil {
+		v = def
+	}
+	switch c := v.(type) {
+	case float64:
+		return int(c) & 0x3F
+	case string:
+		c = strings.ToLower(c)
+		if c == "clear" {
+			return -1
+		}
+		if entry, ok := scriptColours[c]; ok {
+			return int(entry)
+		}
+		if rgb, err := strconv.ParseUint(strings.TrimPrefix(c, "#"), 16, 32); err == nil && strings.HasPrefix(c, "#") {
+			return nearestPaletteEntry(color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xFF})
+		}
+	}
+	l.argError(i, name, "invalid colour")
+	return -1
+}
+
+func nearestPaletteEntry(c color.RGBA) int {
+	best, bestDistance := 0, -1
+	for i := 0; i < 64; i++ {
+		p := defaultPalette[i]
+		dr, dg, db := int(p.R)-int(c.R), int(p.G)-int(c.G), int(p.B)-int(c.B)
+		if distance := dr*dr + dg*dg + db*db; bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return best
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Overlay drawing goes straight into the framebuffer, clipped to the screen
+
+func (s *Script) pixel(x int, y int, colour int) {
+	if colour < 0 || x < 0 || y < 0 || x >= screenWidth || y >= screenHeight {
+		return
+	}
+	s.runner.Framebuffer.Set(x, y, uint16(colour))
+}
+
+func (s *Script) line(x1 int, y1 int, x2 int, y2 int, colour int) {
+	dx, dy := abs(x2-x1), -abs(y2-y1)
+	sx, sy := 1, 1
+	if x1 > x2 {
+		sx = -1
+	}
+	if y1 > y2 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		s.pixel(x1, y1, colour)
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		if e2 := 2 * err; e2 >= dy {
+			err += dy
+			x1 += sx
+		} else {
+			err += dx
+			y1 += sy
+		}
+	}
+}
+
+func (s *Script) box(x1 int, y1 int, x2 int, y2 int, fill int, outline int) {
+	x1, x2 = min(x1, x2), max(x1, x2)
+	y1, y2 = min(y1, y2), max(y1, y2)
+	for y := y1; y <= y2; y++ {
+		for x := x1; x <= x2; x++ {
+			if x == x1 || x == x2 || y == y1 || y == y2 {
+				s.pixel(x, y, outline)
+			} else {
+				s.pixel(x, y, fill)
+			}
+		}
+	}
+}
+
+// Draws text in 4x6 cells on a background box, newlines start a new row
+func (s *Script) text(x int, y int, text string, colour int, background int) {
+	for row, line := range strings.Split(text, "\n") {
+		top := y + row*6
+		if len(line) > 0 {
+			s.box(x, top, x+len(line)*4, top+6, background, background)
+		}
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			if c < 0x20 || c >= 0x60 {
+				c = '?'
+			}
+			glyph := scriptFont[c-0x20]
+			for gy := 0; gy < 5; gy++ {
+				for gx := 0; gx < 3; gx++ {
+					if glyph>>(14-gy*3-gx)&1 != 0 {
+						s.pixel(x+1+i*4+gx, top+1+gy, colour)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestScript(t *testing.T, r *Runner, source string) (*Script, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.lua")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return r.LoadScript(path)
+}
+
+func TestScript(t *testing.T) {
+	// INC $10, STA $0300, JMP $8000
+	r := newTestRunner(&NROM{prg: testPRG(0xE6, 0x10, 0x8D, 0x00, 0x03, 0x4C, 0x00, 0x80)})
+	s, err := loadTestScript(t, r, `
+		local writes = 0
+		memory.registerwrite(0x0300, function(address, size, value) writes = writes + 1 end)
+		event.onframeend(function() memory.writebyte(0x20, emu.framecount()) end)
+		memory.writebyte(0x11, 0x42)
+		memory.setregister("a", 7)
+		emu.frameadvance()
+
+		memory.writebyte(0x21, writes > 0 and 1 or 0)
+		memory.registerwrite(0x0300, nil)
+		writes = 0
+		joypad.set(1, {A = true, start = true})
+		emu.frameadvance()
+
+		memory.writebyte(0x22, writes)
+		local pad = joypad.get(1)
+		memory.writebyte(0x23, (pad.A and 1 or 0) + (pad.B and 2 or 0))
+		local state = savestate.create()
+		savestate.save(state)
+		local saved = memory.readbyte(0x10)
+		emu.frameadvance()
+
+		savestate.load(state)
+		memory.writebyte(0x24, memory.readbyte(0x10) == saved and 1 or 0)
+		error("done")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := &r.cpu.memory
+	if memory[0x11] != 0x42 || r.cpu.A != 7 {
+		t.Fatalf("main chunk wrote $%02X and set A to %d before the first frame", memory[0x11], r.cpu.A)
+	}
+
+	r.RunFrame()
+	if memory[0x20] != 1 || memory[0x21] != 1 {
+		t.Errorf("after frame 1: frame end callback wrote %d, write hook ran %d", memory[0x20], memory[0x21])
+	}
+	if r.cpu.Controllers[0].Buttons != 0x09 {
+		t.Errorf("joypad.set pressed $%02X, want A and start", r.cpu.Controllers[0].Buttons)
+	}
+
+	r.RunFrame()
+	if memory[0x20] != 2 || memory[0x22] != 0 || memory[0x23] != 1 {
+		t.Errorf("after frame 2: frame %d, %d writes after removing the hook, joypad %d", memory[0x20], memory[0x22], memory[0x23])
+	}
+
+	r.RunFrame()
+	if memory[0x24] != 1 || memory[0x20] != 2 {
+		t.Errorf("savestate.load did not restore memory: $24 = %d, $20 = %d", memory[0x24], memory[0x20])
+	}
+	if s.Err == nil || !strings.Contains(s.Err.Error(), "test.lua:25: done") {
+		t.Errorf("script error %v, want the error at line 25", s.Err)
+	}
+
+	// A stopped script is left alone
+	r.RunFrame()
+	if memory[0x20] != 2 {
+		t.Error("frame end callback ran after the script stopped")
+	}
+}
+
+func TestScriptLoadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"syntax", "emu.frameadvance(", "test.lua:1:"},
+		{"runtime", "\nmemory.readbyte()", "test.lua:2: bad argument #1 to 'readbyte'"},
+		{"frameadvance in a callback", "event.onframeend(function() emu.frameadvance() end)\nerror('stop')", "test.lua:2: stop"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRunner(&NROM{prg: testPRG(0x4C, 0x00, 0x80)})
+			_, err := loadTestScript(t, r, test.source)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error %v, want %q", err, test.want)
+			}
+			if r.Script != nil {
+				t.Error("the runner kept a script that failed to load")
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Size of a PRG bank as numbered by FCEUX .nl files
+const nlBankSize = 0x4000
+
+/*
+SymbolTable maps addresses to names. Cartridge ROM labels are keyed by their PRG ROM
+offset so the same CPU address can carry a different name in every bank, everything
+else (RAM, registers, equates) is keyed by CPU address.
+*/
+type SymbolTable struct {
+	global map[uint16]string
+	prg    map[int]string
+
+	// Source lines from ld65 debug info, by where the code of each line starts
+	lines     map[codeLocation]SourceLine
+	locations map[SourceLine][]codeLocation
+}
+
+// A line of an assembly source file
+type SourceLine struct {
+	File string
+	Line int
+}
+
+/*
+Where a piece of code is, keyed like the labels: a PRG ROM offset for cartridge ROM so
+it is found in whichever bank is mapped, otherwise a CPU address
+*/
+type codeLocation struct {
+	prg     bool
+	address int
+}
+
+func (cpu *CPU) codeLocation(address uint16) codeLocation {
+	if offset, ok := cpu.prgOffset(address); ok {
+		return codeLocation{prg: true, address: offset}
+	}
+	return codeLocation{address: int(address)}
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{
+		global:    make(map[uint16]string),
+		prg:       make(map[int]string),
+		lines:     make(map[codeLocation]SourceLine),
+		locations: make(map[SourceLine][]codeLocation),
+	}
+}
+
+func (s *SymbolTable) addGlobal(address uint16, name string) {
+	if _, exists := s.global[address]; !exists {
+		s.global[address] = name
+	}
+}
+
+func (s *SymbolTable) addPRG(offset int, name string) {
+	if _, exists := s.prg[offset]; !exists {
+		s.prg[offset] = name
+	}
+}
+
+// Returns the name of address in the currently mapped PRG bank, a nil table has no names
+func (s *SymbolTable) Lookup(cpu *CPU, address uint16) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	if offset, ok := cpu.prgOffset(address); ok {
+		if name, ok := s.prg[offset]; ok {
+			return name, true
+		}
+	}
+	name, ok := s.global[address]
+	return name, ok
+}
+
+// Returns the source line whose code starts at address, a nil table has no lines
+func (s *SymbolTable) LineAt(cpu *CPU, address uint16) (SourceLine, bool) {
+	if s == nil {
+		return SourceLine{}, false
+	}
+	line, ok := s.lines[cpu.codeLocation(address)]
+	return line, ok
+}
+
+/*
+Returns where the code of a source line starts. The file is matched by its path and,
+failing that, by its name alone, as the paths in debug info are those the assembler
+was given.
+*/
+func (s *SymbolTable) LineLocations(file string, line int) []codeLocation {
+	if s == nil {
+		return nil
+	}
+	if locations, ok := s.locations[SourceLine{filepath.Clean(file), line}]; ok {
+		return locations
+	}
+	var locations []codeLocation
+	for source, found := range s.locations {
+		if source.Line == line && filepath.Base(source.File) == filepath.Base(file) {
+			locations = append(locations, found...)
+		}
+	}
+	return locations
+}
+
+func (s *SymbolTable) addLine(location codeLocation, line SourceLine) {
+	if _, exists := s.lines[location]; !exists {
+		s.lines[location] = line
+	}
+	s.locations[line] = append(s.locations[line], location)
+}
+
+/*
+Resolves a symbol name or a $hex address to CPU addresses. A PRG label is returned at
+every address its bank is currently mapped to, mirrored banks give more than one.
+The addresses are in ascending order so callers taking the first one always agree.
+*/
+func (s *SymbolTable) Resolve(cpu *CPU, text string) ([]uint16, error) {
+	if strings.HasPrefix(text, "$") || strings.HasPrefix(text, "0x") {
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(text, "$"), "0x"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", text, err)
+		}
+		return []uint16{uint16(value)}, nil
+	}
+	var addresses []uint16
+	if s != nil {
+		for address, name := range s.global {
+			if name == text {
+				addresses = append(addresses, address)
+			}
+		}
+		for address := 0x8000; address <= 0xFFFF; address++ {
+			if offset, ok := cpu.prgOffset(uint16(address)); ok && s.prg[offset] == text {
+				addresses = append(addresses, uint16(address))
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("unknown symbol %q", text)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	return addresses, nil
+}
+
+// Loads a label file, the format is picked from the extension (.dbg, .nl or .mlb)
+func (s *SymbolTable) LoadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening symbol file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".dbg":
+		dir, _ := filepath.Abs(filepath.Dir(filename))
+		err = s.loadCA65(scanner, dir)
+	case ".nl":
+		err = s.loadNL(scanner, nlBank(filename))
+	case ".mlb":
+		err = s.loadMLB(scanner)
+	default:
+		return fmt.Errorf("unknown symbol file format: %s", filename)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	return scanner.Err()
+}
+
+/*
+Returns the bank an FCEUX .nl file describes, game.nes.2.nl holds bank 2 and
+game.nes.ram.nl holds RAM which is returned as -1
+*/
+func nlBank(filename string) int {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	bank, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(name), "."))
+	if err != nil {
+		return -1
+	}
+	return bank
+}
+
+/*
+FCEUX name lists, one "$C0A4#NMI_handler#comment" per line. Arrays are written as
+"$0300/10#buffer#" and only their first address is named.
+*/
+func (s *SymbolTable) loadNL(scanner *bufio.Scanner, bank int) error {
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "$") {
+			continue
+		}
+		fields := strings.SplitN(line[1:], "#", 3)
+		if len(fields) < 2 || fields[1] == "" {
+			continue
+		}
+		addressText, _, _ := strings.Cut(fields[0], "/")
+		address, err := strconv.ParseUint(addressText, 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", fields[0])
+		}
+		if bank < 0 || address < 0x8000 {
+			s.addGlobal(uint16(address), fields[1])
+		} else {
+			s.addPRG(bank*nlBankSize+int(address)&(nlBankSize-1), fields[1])
+		}
+	}
+	return nil
+}
+
+/*
+Mesen label files, one "P:1A4:NMI_handler:comment" per line. The prefix names the
+memory type, P is a PRG ROM offset, R is internal RAM and G a register address.
+Save and work RAM (S, W) are mapped at $6000.
+*/
+func (s *SymbolTable) loadMLB(scanner *bufio.Scanner) error {
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 4)
+		if len(fields) < 3 || fields[2] == "" {
+			continue
+		}
+		addressText, _, _ := strings.Cut(fields[1], "-")
+		address, err := strconv.ParseUint(addressText, 16, 32)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", fields[1])
+		}
+		switch fields[0] {
+		case "P", "NesPrgRom":
+			s.addPRG(int(address), fields[2])
+		case "R", "G", "NesInternalRam", "NesMemory":
+			s.addGlobal(uint16(address), fields[2])
+		case "S", "W", "NesSaveRam", "NesWorkRam":
+			s.addGlobal(uint16(0x6000+address&0x1FFF), fields[2])
+		}
+	}
+	return nil
+}
+
+// Splits a ca65 debug record "sym id=0,name="x",val=0xC0A4" into its type and key/value pairs
+func parseDbgRecord(line string) (string, map[string]string, error) {
+	kind, rest, _ := strings.Cut(line, "\t")
+	if kind == line {
+		kind, rest, _ = strings.Cut(line, " ")
+	}
+	values := make(map[string]string)
+	for len(rest) > 0 {
+		key, value, _ := strings.Cut(rest, "=")
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`) + 1
+			if end == 0 {
+				return "", nil, fmt.Errorf("unterminated string in %q", line)
+			}
+			rest = strings.TrimPrefix(value[end+1:], ",")
+			value = value[1:end]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+		}
+		values[key] = value
+	}
+	return kind, values, nil
+}
+
+func parseDbgNumber(text string) (int, error) {
+	value, err := strconv.ParseInt(text, 0, 64)
+	return int(value), err
+}
+
+type dbgSegment struct {
+	start  int
+	offset int // offset in the output file, -1 when the segment is not stored in it
+}
+
+// Where the byte at offset in the segment ends up
+func (d dbgSegment) location(offset int) codeLocation {
+	address := d.start + offset
+	if d.offset >= headerSize && address >= 0x8000 {
+		return codeLocation{prg: true, address: d.offset - headerSize + offset}
+	}
+	return codeLocation{address: address & 0xFFFF}
+}
+
+/*
+ld65 debug files. Labels in segments written to the ROM are placed by their file
+offset, skipping the 16 byte iNES header, anything else is treated as a CPU address.
+Source lines are found through the spans of code they produced, source file names
+are relative to dir, the directory of the debug file.
+*/
+func (s *SymbolTable) loadCA65(scanner *bufio.Scanner, dir string) error {
+	segments := make(map[string]dbgSegment)
+	files := make(map[string]string)
+	spans := make(map[string]map[string]string)
+	var symbols, lines []map[string]string
+
+	for scanner.Scan() {
+		kind, values, err := parseDbgRecord(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case "seg":
+			start, err := parseDbgNumber(values["start"])
+			if err != nil {
+				return fmt.Errorf("invalid segment start %q", values["start"])
+			}
+			segment := dbgSegment{start: start, offset: -1}
+			if ooffs, ok := values["ooffs"]; ok {
+				if segment.offset, err = parseDbgNumber(ooffs); err != nil {
+					return fmt.Errorf("invalid segment offset %q", ooffs)
+				}
+			}
+			segments[values["id"]] = segment
+		case "sym":
+			symbols = append(symbols, values)
+		case "file":
+			name := values["name"]
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			files[values["id"]] = filepath.Clean(name)
+		case "span":
+			spans[values["id"]] = values
+		case "line":
+			lines = append(lines, values)
+		}
+	}
+
+	for _, line := range lines {
+		// Type 2 lines are macro expansions, which would point into the macro's definition
+		number, err := parseDbgNumber(line["line"])
+		if err != nil || line["type"] == "2" || line["span"] == "" {
+			continue
+		}
+		source := SourceLine{File: files[line["file"]], Line: number}
+		for _, id := range strings.Split(line["span"], "+") {
+			span, ok := spans[id]
+			if !ok {
+				continue
+			}
+			segment, ok := segments[span["seg"]]
+			start, err := parseDbgNumber(span["start"])
+			if !ok || err != nil || span["size"] == "0" {
+				continue
+			}
+			s.addLine(segment.location(start), source)
+		}
+	}
+
+	// Symbols may be listed before the segments they refer to
+	for _, sym := range symbols {
+		value, err := parseDbgNumber(sym["val"])
+		if err != nil || sym["name"] == "" {
+			continue
+		}
+		segment, ok := segments[sym["seg"]]
+		if ok && segment.offset >= headerSize && value >= 0x8000 {
+			s.addPRG(segment.offset-headerSize+value-segment.start, sym["name"])
+		} else {
+			s.addGlobal(uint16(value), sym["name"])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A CPU with 16KB of PRG ROM, mirrored at $8000 and $C000
+func newMirroredCPU() *CPU {
+	cpu := &CPU{}
+	cpu.LoadNESROM(make([]uint8, 0x4000))
+	return cpu
+}
+
+func TestSymbolFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		address uint16
+		want    string
+	}{
+		{"nl ram", "game.nes.ram.nl", "$0300/10#buffer#sprite data\n", 0x0300, "buffer"},
+		{"nl bank", "game.nes.0.nl", "$C0A4#NMI_handler#\n", 0xC0A4, "NMI_handler"},
+		{"nl bank mirror", "game.nes.0.nl", "$C0A4#NMI_handler#\n", 0x80A4, "NMI_handler"},
+		{"mlb prg", "game.mlb", "P:1A4:reset:entry point\n", 0x81A4, "reset"},
+		{"mlb ram", "game.mlb", "R:10:frameCounter\n", 0x0010, "frameCounter"},
+		{"mlb save ram", "game.mlb", "S:20:saveSlot\n", 0x6020, "saveSlot"},
+		{
+			"ca65",
+			"game.dbg",
+			"seg\tid=0,name=\"CODE\",start=0x008000,size=0x4000,type=ro,oname=\"game.nes\",ooffs=16\n" +
+				"sym\tid=0,name=\"main\",addrsize=absolute,scope=0,def=0,ref=1,val=0x8010,seg=0,type=lab\n",
+			0xC010,
+			"main",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			symbols := NewSymbolTable()
+			if err := symbols.LoadFile(path); err != nil {
+				t.Fatal(err)
+			}
+			name, ok := symbols.Lookup(newMirroredCPU(), test.address)
+			if !ok || name != test.want {
+				t.Errorf("Lookup($%04X) = %q, %v, want %q", test.address, name, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveIsSorted(t *testing.T) {
+	cpu := newMirroredCPU()
+	symbols := NewSymbolTable()
+	symbols.addPRG(0x10, "target")
+	symbols.addGlobal(0x0700, "target")
+	symbols.addGlobal(0x0200, "target")
+	want := []uint16{0x0200, 0x0700, 0x8010, 0xC010}
+
+	// Map order changes between runs, so resolve a few times
+	for i := 0; i < 20; i++ {
+		addresses, err := symbols.Resolve(cpu, "target")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(addresses, want) {
+			t.Fatalf("Resolve = %04X, want %04X", addresses, want)
+		}
+	}
+
+	if addresses, err := symbols.Resolve(cpu, "$C0A4"); err != nil || !reflect.DeepEqual(addresses, []uint16{0xC0A4}) {
+		t.Errorf("Resolve($C0A4) = %04X, %v", addresses, err)
+	}
+	if _, err := symbols.Resolve(cpu, "missing"); err == nil {
+		t.Error("Resolve of an unknown symbol did not fail")
+	}
+}
+
+func TestSymbolFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"unterminated string", "game.dbg", "sym\tid=0,name=\"main,val=0x8010\n"},
+		{"bad segment start", "game.dbg", "seg\tid=0,name=\"CODE\",start=zero\n"},
+		{"unknown format", "game.sym", "main = $8010\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := NewSymbolTable().LoadFile(path); err == nil {
+				t.Error("loading did not fail")
+			}
+		})
+	}
+}
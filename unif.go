@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	unifMagic      = "UNIF"
+	unifHeaderSize = 32
+)
+
+// Prefixes UNIF board names carry in front of the board itself
+var unifBoardPrefixes = []string{"NES-", "HVC-", "UNL-", "BTL-", "BMC-", "IREM-", "KONAMI-", "TAITO-"}
+
+// iNES mapper numbers of the common UNIF boards
+var unifBoards = map[string]uint8{
+	"NROM": 0, "NROM-128": 0, "NROM-256": 0, "RROM": 0, "RROM-128": 0,
+	"SAROM": 1, "SBROM": 1, "SCROM": 1, "SEROM": 1, "SFROM": 1, "SGROM": 1, "SKROM": 1,
+	"SLROM": 1, "SL1ROM": 1, "SNROM": 1, "SOROM": 1, "SUROM": 1, "SXROM": 1,
+	"UNROM": 2, "UOROM": 2,
+	"CNROM": 3,
+	"TBROM": 4, "TEROM": 4, "TFROM": 4, "TGROM": 4, "TKROM": 4, "TLROM": 4, "TR1ROM": 4, "TSROM": 4,
+	"EKROM": 5, "ELROM": 5, "ETROM": 5, "EWROM": 5,
+	"AMROM": 7, "ANROM": 7, "AOROM": 7,
+	"PNROM": 9,
+	"FJROM": 10, "FKROM": 10,
+	"GNROM": 66, "MHROM": 66,
+}
+
+// Board name without its manufacturer prefix, in upper case
+func unifBoardName(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for _, prefix := range unifBoardPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return name[len(prefix):]
+		}
+	}
+	return name
+}
+
+/*
+Parses a UNIF image. After the 32 byte header the file is a list of chunks, each a 4
+character ID and a little endian length. PRG0-PRGF and CHR0-CHRF are joined in order
+to form the ROMs, and the board named by MAPR picks the mapper.
+*/
+func parseUNIF(data []uint8) (*Cartridge, error) {
+	if len(data) < unifHeaderSize || string(data[:4]) != unifMagic {
+		return nil, fmt.Errorf("not a valid UNIF file")
+	}
+
+	var prg, chr [16][]uint8
+	cart := &Cartridge{Region: regionNTSC}
+	for offset := unifHeaderSize; offset < len(data); {
+		if offset+8 > len(data) {
+			return nil, fmt.Errorf("UNIF chunk header at %d is truncated", offset)
+		}
+		id := string(data[offset : offset+4])
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		offset += 8
+		if length < 0 || offset+length > len(data) {
+			return nil, fmt.Errorf("UNIF chunk %s is truncated", id)
+		}
+		chunk := data[offset : offset+length]
+		offset += length
+
+		// Text chunks are null terminated
+		text := string(chunk)
+		if i := bytes.IndexByte(chunk, 0); i >= 0 {
+			text = string(chunk[:i])
+		}
+
+		switch {
+		case id == "MAPR":
+			cart.Board = text
+		case id == "NAME":
+			cart.Title = text
+		case id == "MIRR" && length > 0:
+			switch chunk[0] {
+			case 1:
+				cart.Mirroring = mirrorVertical
+			case 2:
+				cart.Mirroring = mirrorSingleA
+			case 3:
+				cart.Mirroring = mirrorSingleB
+			case 4:
+				cart.Mirroring = mirrorFourScreen
+			}
+		case id == "BATR" && length > 0:
+			cart.Battery = chunk[0] != 0
+		case id == "TVCI" && length > 0:
+			if chunk[0] == 1 {
+				cart.Region = regionPAL
+			}
+		case strings.HasPrefix(id, "PRG") || strings.HasPrefix(id, "CHR"):
+			var bank int
+			if _, err := fmt.Sscanf(id[3:], "%X", &bank); err != nil {
+				continue
+			}
+			if id[:3] == "PRG" {
+				prg[bank] = chunk
+			} else {
+				chr[bank] = chunk
+			}
+		}
+	}
+
+	for i := range prg {
+		cart.PRG = append(cart.PRG, prg[i]...)
+		cart.CHR = append(cart.CHR, chr[i]...)
+	}
+	if len(cart.PRG) == 0 {
+		return nil, fmt.Errorf("UNIF file has no PRG ROM")
+	}
+	mapper, ok := unifBoards[unifBoardName(cart.Board)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported UNIF board %q", cart.Board)
+	}
+	cart.Mapper = mapper
+	return cart, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Builds a UNIF image from chunk IDs and their data
+func buildUNIF(chunks ...any) []uint8 {
+	data := make([]uint8, unifHeaderSize)
+	copy(data, unifMagic)
+	for i := 0; i < len(chunks); i += 2 {
+		chunk := []byte(chunks[i+1].(string))
+		data = append(data, chunks[i].(string)...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(chunk)))
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func TestParseUNIF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []uint8
+		want Cartridge
+	}{
+		{
+			"banks in order",
+			buildUNIF("MAPR", "NES-UNROM\x00", "PRG1", "BB", "PRG0", "AA", "CHR0", "CC"),
+			Cartridge{PRG: []uint8("AABB"), CHR: []uint8("CC"), Mapper: 2, Board: "NES-UNROM", Region: regionNTSC},
+		},
+		{
+			"header chunks",
+			buildUNIF("NAME", "Game\x00", "MAPR", "HVC-SKROM", "MIRR", "\x01", "BATR", "\x01", "TVCI", "\x01", "PRG0", "P"),
+			Cartridge{PRG: []uint8("P"), Mapper: 1, Board: "HVC-SKROM", Title: "Game", Mirroring: mirrorVertical, Battery: true, Region: regionPAL},
+		},
+		{
+			"unknown chunks are skipped",
+			buildUNIF("DINF", "dumper", "MAPR", "AOROM", "CTRL", "\x01", "PRG0", "P", "MIRR", "\x04"),
+			Cartridge{PRG: []uint8("P"), Mapper: 7, Board: "AOROM", Mirroring: mirrorFourScreen, Region: regionNTSC},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cart, err := parseUNIF(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*cart, test.want) {
+				t.Errorf("cartridge %+v, want %+v", *cart, test.want)
+			}
+		})
+	}
+}
+
+func TestParseUNIFErrors(t *testing.T) {
+	truncated := buildUNIF("MAPR", "NROM", "PRG0", "PRG")
+	tests := []struct {
+		name string
+		data []uint8
+	}{
+		{"no header", []uint8(unifMagic)},
+		{"truncated chunk", truncated[:len(truncated)-1]},
+		{"truncated chunk header", append(buildUNIF("PRG0", "P"), 'M', 'A')},
+		{"no PRG", buildUNIF("MAPR", "NROM")},
+		{"unknown board", buildUNIF("MAPR", "UNL-NOTABOARD", "PRG0", "P")},
+	}
+	for _, test := range tests {
+		if _, err := parseUNIF(test.data); err == nil {
+			t.Errorf("%s: parseUNIF did not fail", test.name)
+		}
+	}
+}
+
+func TestReadROMArchives(t *testing.T) {
+	rom, err := os.ReadFile("nestest.nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	var zipped bytes.Buffer
+	archive := zip.NewWriter(&zipped)
+	for name, data := range map[string][]byte{"readme.txt": []byte("hello"), "game/nestest.nes": rom} {
+		w, _ := archive.Create(name)
+		w.Write(data)
+	}
+	archive.Close()
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(rom)
+	gz.Close()
+
+	var notROM bytes.Buffer
+	gz = gzip.NewWriter(&notROM)
+	gz.Write([]byte("not a rom"))
+	gz.Close()
+
+	tests := []struct {
+		file string
+		data []byte
+		ok   bool
+	}{
+		{"game.zip", zipped.Bytes(), true},
+		{"game.nes.gz", gzipped.Bytes(), true},
+		{"GAME.NES", rom, true},
+		{"text.gz", notROM.Bytes(), false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := os.WriteFile(path, test.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		data, err := readROMFile(path)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: readROMFile did not fail", test.file)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(data, rom) {
+			t.Errorf("%s: read %d bytes, %v", test.file, len(data), err)
+		}
+	}
+}
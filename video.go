@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+)
+
+/*
+VideoRecorder writes every frame either as a YUV4MPEG2 stream or as raw RGBA to the
+standard input of an external command. Frames are written at frame boundaries, the
+same points where the audio recorder flushes, so the two stay in sync.
+*/
+type VideoRecorder struct {
+	Palette *Palette
+	Scale   int
+	Region  *Region
+
+	w      *bufio.Writer
+	file   *os.File
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	y4m    bool
+	frames int
+	err    error
+}
+
+// Starts a Y4M file with 4:4:4 chroma so no colour resolution is lost
+func NewY4MRecorder(filename string, palette *Palette, scale int, region *Region) (*VideoRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error creating video file: %w", err)
+	}
+	return &VideoRecorder{Palette: palette, Scale: max(scale, 1), Region: region, w: bufio.NewWriter(file), file: file, y4m: true}, nil
+}
+
+// Runs command through the shell and feeds it raw RGBA frames on standard input
+func NewPipeRecorder(command string, palette *Palette, scale int) (*VideoRecorder, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error starting video command: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting video command: %w", err)
+	}
+	return &VideoRecorder{Palette: palette, Scale: max(scale, 1), w: bufio.NewWriter(stdin), cmd: cmd, stdin: stdin}, nil
+}
+
+// BT.601 limited range conversion
+func rgbToYCbCr(r uint8, g uint8, b uint8) (uint8, uint8, uint8) {
+	rf, gf, bf := float64(r), float64(g), float64(b)
+	y := 16 + (65.481*rf+128.553*gf+24.966*bf)/255
+	cb := 128 + (-37.797*rf-74.203*gf+112.0*bf)/255
+	cr := 128 + (112.0*rf-93.786*gf-18.214*bf)/255
+	return uint8(y + 0.5), uint8(cb + 0.5), uint8(cr + 0.5)
+}
+
+// The stream header is written with the first frame, whose size depends on the filter
+func (vr *VideoRecorder) writeY4MFrame(img *image.RGBA) error {
+	bounds := img.Bounds()
+	if vr.frames == 0 {
+		num, den := vr.Region.FrameRate()
+		fmt.Fprintf(vr.w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C444\n", bounds.Dx(), bounds.Dy(), num, den)
+	}
+	n := bounds.Dx() * bounds.Dy()
+	planes := make([]byte, 3*n)
+	for i := 0; i < n; i++ {
+		p := img.Pix[i*4:]
+		planes[i], planes[n+i], planes[2*n+i] = rgbToYCbCr(p[0], p[1], p[2])
+	}
+	vr.w.WriteString("FRAME\n")
+	_, err := vr.w.Write(planes)
+	return err
+}
+
+// Called at every frame boundary with the frame that has just finished
+func (vr *VideoRecorder) writeFrame(img *image.RGBA) {
+	if vr.err != nil {
+		return
+	}
+	var err error
+	if vr.y4m {
+		err = vr.writeY4MFrame(img)
+	} else {
+		_, err = vr.w.Write(img.Pix)
+	}
+	if err != nil {
+		vr.err = fmt.Errorf("error writing video frame %d: %w", vr.frames, err)
+	}
+	vr.frames++
+}
+
+// Finishes the file, or closes the pipe and waits for the command to exit
+func (vr *VideoRecorder) Close() error {
+	if err := vr.w.Flush(); err != nil && vr.err == nil {
+		vr.err = fmt.Errorf("error writing video: %w", err)
+	}
+	if vr.file != nil {
+		if err := vr.file.Close(); err != nil && vr.err == nil {
+			vr.err = fmt.Errorf("error writing video: %w", err)
+		}
+	}
+	if vr.cmd != nil {
+		vr.stdin.Close()
+		if err := vr.cmd.Wait(); err != nil && vr.err == nil {
+			vr.err = fmt.Errorf("video command failed: %w", err)
+		}
+	}
+	return vr.err
+}
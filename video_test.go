@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs a JMP $8000 loop for two frames, the second with a white pixel at 0,0
+func recordTwoFrames(t *testing.T, vr *VideoRecorder) {
+	t.Helper()
+	r := newTestRunner(&NROM{prg: testPRG(0x4C, 0x00, 0x80)})
+	r.Video = vr
+	r.RunFrame()
+	r.Framebuffer.Set(0, 0, 0x30)
+	r.RunFrame()
+	if err := vr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestY4MRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.y4m")
+	vr, err := NewY4MRecorder(path, defaultPalette, 2, regionNTSC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordTwoFrames(t, vr)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	num, den := regionNTSC.FrameRate()
+	header := fmt.Sprintf("YUV4MPEG2 W512 H480 F%d:%d Ip A1:1 C444\n", num, den)
+	if !bytes.HasPrefix(data, []byte(header)) {
+		t.Fatalf("stream starts %q, want %q", data[:min(len(data), len(header))], header)
+	}
+	frameSize := len("FRAME\n") + 3*512*480
+	if len(data) != len(header)+2*frameSize {
+		t.Fatalf("%d bytes, want a header and two frames of %d", len(data), frameSize)
+	}
+
+	frames := data[len(header):]
+	for i := 0; i < 2; i++ {
+		frame := frames[i*frameSize : (i+1)*frameSize]
+		if !bytes.HasPrefix(frame, []byte("FRAME\n")) {
+			t.Fatalf("frame %d starts %q", i, frame[:6])
+		}
+		planes := frame[6:]
+		c := defaultPalette[0x00]
+		if i == 1 {
+			c = defaultPalette[0x30]
+		}
+		y, cb, cr := rgbToYCbCr(c.R, c.G, c.B)
+		// The pixel is scaled to a 2x2 block in each plane
+		n := 512 * 480
+		for _, offset := range []int{0, 1, 512, 513} {
+			if planes[offset] != y || planes[n+offset] != cb || planes[2*n+offset] != cr {
+				t.Errorf("frame %d: pixel %d is %d %d %d, want %d %d %d", i, offset,
+					planes[offset], planes[n+offset], planes[2*n+offset], y, cb, cr)
+			}
+		}
+	}
+}
+
+func TestPipeRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.rgba")
+	vr, err := NewPipeRecorder("cat > "+path, defaultPalette, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordTwoFrames(t, vr)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameSize := 256 * 240 * 4
+	if len(data) != 2*frameSize {
+		t.Fatalf("%d bytes, want two frames of %d", len(data), frameSize)
+	}
+	c := defaultPalette[0x30]
+	if pixel := data[frameSize : frameSize+4]; !bytes.Equal(pixel, []byte{c.R, c.G, c.B, 0xFF}) {
+		t.Errorf("second frame starts with %v, want %v", pixel, c)
+	}
+
+	vr, err = NewPipeRecorder("exit 3", defaultPalette, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vr.Close(); err == nil {
+		t.Error("a failing video command was not reported")
+	}
+}
+
+func TestRGBToYCbCr(t *testing.T) {
+	tests := []struct {
+		r, g, b   uint8
+		y, cb, cr uint8
+	}{
+		{0, 0, 0, 16, 128, 128},
+		{255, 255, 255, 235, 128, 128},
+		{255, 0, 0, 81, 90, 240},
+		{0, 0, 255, 41, 240, 110},
+	}
+	for _, test := range tests {
+		y, cb, cr := rgbToYCbCr(test.r, test.g, test.b)
+		if y != test.y || cb != test.cb || cr != test.cr {
+			t.Errorf("%d %d %d converted to %d %d %d, want %d %d %d", test.r, test.g, test.b, y, cb, cr, test.y, test.cb, test.cr)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import "io"
+
+type vrc4Registers struct {
+	PRG     [2]uint8
+	PRGSwap bool // $9002 bit 1, swaps the banks at $8000 and $C000
+	// 1KB banks of the pattern tables, written a nibble at a time
+	CHR       [8]uint16
+	Mirroring uint8
+}
+
+/*
+VRC4 is Konami's VRC2 and VRC4, mappers 21, 22, 23 and 25. Two switchable 8KB banks
+sit at $8000 and $A000 with the last two fixed, eight 1KB CHR banks are written in
+nibbles at $B000-$E003 and the VRC4 adds the PRG swap mode and the IRQ counter at
+$F000-$F003. The boards wire different address lines to the two register selects, so
+each mapper number decodes them its own way; mapper 22 is the VRC2a, whose CHR banks
+are in 2KB steps.
+*/
+type VRC4 struct {
+	Registers vrc4Registers
+	irq       vrcIRQ
+
+	mapper uint8
+	prg    []uint8
+	chr    []uint8
+	cpu    *CPU
+}
+
+func NewVRC4(mapper uint8, prg []uint8, chr []uint8) *VRC4 {
+	return &VRC4{mapper: mapper, prg: prg, chr: chr}
+}
+
+func (m *VRC4) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+func (m *VRC4) mapBanks() {
+	r := &m.Registers
+	low, high := int(r.PRG[0]), -2
+	if r.PRGSwap {
+		low, high = high, low
+	}
+	m.cpu.mapPRG(m.prg, 0x8000, 0x2000, low)
+	m.cpu.mapPRG(m.prg, 0xA000, 0x2000, int(r.PRG[1]))
+	m.cpu.mapPRG(m.prg, 0xC000, 0x2000, high)
+	m.cpu.mapPRG(m.prg, 0xE000, 0x2000, -1)
+}
+
+/*
+Register select from the address lines of each board. Mappers 21, 23 and 25 are
+shared by two VRC4 variants, one using A1/A2 or A0/A1 and the other A6/A7 or A2/A3,
+so both pairs are accepted.
+*/
+func (m *VRC4) register(address uint16) uint16 {
+	line := func(n uint) uint16 {
+		return address >> n & 1
+	}
+	switch m.mapper {
+	case 21:
+		return line(1) | line(6) | (line(2)|line(7))<<1
+	case 22:
+		return line(1) | line(0)<<1
+	case 23:
+		return line(0) | line(2) | (line(1)|line(3))<<1
+	}
+	return line(1) | line(3) | (line(0)|line(2))<<1
+}
+
+func (m *VRC4) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+func (m *VRC4) Write(address uint16, value uint8) bool {
+	if address < 0x8000 {
+		return false
+	}
+	r := &m.Registers
+	register := m.register(address)
+	vrc2 := m.mapper == 22
+	switch address & 0xF000 {
+	case 0x8000:
+		r.PRG[0] = value & 0x1F
+		m.mapBanks()
+	case 0x9000:
+		switch {
+		case vrc2:
+			r.Mirroring = mirrorVertical - value&1
+		case register == 0:
+			r.Mirroring = [4]uint8{mirrorVertical, mirrorHorizontal, mirrorSingleA, mirrorSingleB}[value&3]
+		case register == 2:
+			r.PRGSwap = getBit(value, 1)
+			m.mapBanks()
+		}
+	case 0xA000:
+		r.PRG[1] = value & 0x1F
+		m.mapBanks()
+	case 0xB000, 0xC000, 0xD000, 0xE000:
+		bank := &r.CHR[int(address-0xB000)>>12*2|int(register>>1)]
+		if register&1 == 0 {
+			*bank = *bank&0x1F0 | uint16(value&0x0F)
+		} else {
+			*bank = *bank&0x00F | uint16(value&0x1F)<<4
+		}
+	case 0xF000:
+		if vrc2 {
+			break
+		}
+		switch register {
+		case 0:
+			m.irq.Latch = m.irq.Latch&0xF0 | value&0x0F
+		case 1:
+			m.irq.Latch = m.irq.Latch&0x0F | value<<4
+		case 2:
+			m.irq.writeControl(value)
+		case 3:
+			m.irq.acknowledge()
+		}
+	}
+	return true
+}
+
+func (m *VRC4) Clock() {
+	m.irq.clock()
+}
+
+func (m *VRC4) IRQ() bool {
+	return m.irq.IRQ
+}
+
+func (m *VRC4) fetchCHR(address uint16) int {
+	bank := int(m.Registers.CHR[address>>10&7])
+	if m.mapper == 22 {
+		bank >>= 1
+	}
+	return chrBank(m.chr, bank, 0x400) + int(address&0x3FF)
+}
+
+func (m *VRC4) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.irq)
+}
+
+func (m *VRC4) loadState(r io.Reader) error {
+	registers, irq := m.Registers, m.irq
+	if err := readMapperState(r, &registers, &irq); err != nil {
+		return err
+	}
+	m.Registers, m.irq = registers, irq
+	m.mapBanks()
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import "testing"
+
+func TestVRC4RegisterSelect(t *testing.T) {
+	tests := []struct {
+		mapper    uint8
+		addresses [4][]uint16 // addresses selecting registers 0 to 3
+	}{
+		{21, [4][]uint16{{0x9000}, {0x9002, 0x9040}, {0x9004, 0x9080}, {0x9006, 0x90C0}}},
+		{22, [4][]uint16{{0x9000}, {0x9002}, {0x9001}, {0x9003}}},
+		{23, [4][]uint16{{0x9000}, {0x9001, 0x9004}, {0x9002, 0x9008}, {0x9003, 0x900C}}},
+		{25, [4][]uint16{{0x9000}, {0x9002, 0x9008}, {0x9001, 0x9004}, {0x9003, 0x900C}}},
+	}
+	for _, test := range tests {
+		m := NewVRC4(test.mapper, nil, nil)
+		for register, addresses := range test.addresses {
+			for _, address := range addresses {
+				if got := m.register(address); got != uint16(register) {
+					t.Errorf("mapper %d: $%04X selects register %d, want %d", test.mapper, address, got, register)
+				}
+			}
+		}
+	}
+}
+
+func TestVRC4PRGBanks(t *testing.T) {
+	m := NewVRC4(23, numberedBanks(32, 0x2000), nil)
+	cpu := newMapperCPU(m)
+	checkBanks(t, cpu, map[uint16]uint8{0x8000: 0, 0xA000: 0, 0xC000: 30, 0xE000: 31})
+
+	m.Write(0x8000, 4)
+	m.Write(0xA000, 7)
+	checkBanks(t, cpu, map[uint16]uint8{0x8000: 4, 0xA000: 7, 0xC000: 30, 0xE000: 31})
+
+	// Swap mode puts the second to last bank at $8000
+	m.Write(0x9002, 0x02)
+	checkBanks(t, cpu, map[uint16]uint8{0x8000: 30, 0xA000: 7, 0xC000: 4, 0xE000: 31})
+
+	m.Write(0x9000, 2)
+	if m.Registers.Mirroring != mirrorSingleA {
+		t.Errorf("mirroring %d after writing 2, want single screen A", m.Registers.Mirroring)
+	}
+}
+
+func TestVRC4CHRBanks(t *testing.T) {
+	chr := numberedBanks(64, 0x400)
+
+	vrc4 := NewVRC4(23, numberedBanks(4, 0x2000), chr)
+	newMapperCPU(vrc4)
+	for address, value := range map[uint16]uint8{0xB000: 0x5, 0xB001: 0x2, 0xB002: 0xA, 0xE002: 0xF, 0xE003: 0x3} {
+		vrc4.Write(address, value)
+	}
+	checkCHR(t, vrc4, chr, 0x400, 0x0000, 0x25)
+	checkCHR(t, vrc4, chr, 0x400, 0x07FF, 0x0A)
+	checkCHR(t, vrc4, chr, 0x400, 0x1C10, 0x3F)
+
+	// The VRC2a ignores the lowest bit of its banks
+	vrc2 := NewVRC4(22, numberedBanks(4, 0x2000), chr)
+	newMapperCPU(vrc2)
+	vrc2.Write(0xB000, 0xD)
+	checkCHR(t, vrc2, chr, 0x400, 0x0000, 6)
+}
+
+func TestVRC4IRQ(t *testing.T) {
+	tests := []struct {
+		name    string
+		control uint8
+		latch   uint8
+		cycles  int // clocks until the IRQ, counted from the control write
+		repeat  bool
+	}{
+		{"cycle mode", 0x06, 0xFC, 4, false},
+		{"cycle mode enabled after acknowledge", 0x07, 0xFC, 4, true},
+		{"scanline mode", 0x02, 0xFF, 114, false},
+		{"scanline mode two lines", 0x03, 0xFE, 228, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewVRC4(23, numberedBanks(4, 0x2000), nil)
+			newMapperCPU(m)
+			m.Write(0xF000, test.latch&0x0F)
+			m.Write(0xF001, test.latch>>4)
+			m.Write(0xF002, test.control)
+
+			for i := 0; i < test.cycles-1; i++ {
+				m.Clock()
+			}
+			if m.IRQ() {
+				t.Fatalf("IRQ after %d cycles, want %d", test.cycles-1, test.cycles)
+			}
+			m.Clock()
+			if !m.IRQ() {
+				t.Fatalf("no IRQ after %d cycles", test.cycles)
+			}
+
+			m.Write(0xF003, 0)
+			if m.IRQ() {
+				t.Fatal("acknowledging did not clear the IRQ")
+			}
+			for i := 0; i < test.cycles; i++ {
+				m.Clock()
+			}
+			if m.IRQ() != test.repeat {
+				t.Errorf("IRQ after acknowledging is %v, want %v", m.IRQ(), test.repeat)
+			}
+		})
+	}
+}
+
+func TestVRC4IRQReachesCPU(t *testing.T) {
+	prg := make([]uint8, 0x8000)
+	copy(prg, []uint8{
+		0xA9, 0x0C, 0x8D, 0x00, 0xF0, // latch $FC
+		0xA9, 0x0F, 0x8D, 0x01, 0xF0,
+		0xA9, 0x07, 0x8D, 0x02, 0xF0, // cycle mode, enabled after acknowledging
+		0x58,             // CLI
+		0x4C, 0x10, 0x80, // JMP $8010
+	})
+	// At $E100: STA $F003, INC $10, RTI
+	copy(prg[0x6100:], []uint8{0x8D, 0x03, 0xF0, 0xE6, 0x10, 0x40})
+	prg[0x7FFE], prg[0x7FFF] = 0x00, 0xE1
+
+	r := newTestRunner(NewVRC4(23, prg, nil))
+	runTo(t, r, 0x800F, 10)
+	if r.cpu.memory[0x10] != 0 {
+		t.Fatal("IRQ taken with the I flag set")
+	}
+	// The handler's first instruction runs in the step that takes the IRQ
+	runTo(t, r, 0xE103, 5)
+	if r.cpu.P&0x04 == 0 {
+		t.Error("I flag clear in the handler")
+	}
+	for i := 0; r.cpu.memory[0x10] < 3; i++ {
+		if i == 100 {
+			t.Fatalf("handler ran %d times in 100 instructions", r.cpu.memory[0x10])
+		}
+		r.Step()
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import "io"
+
+/*
+IRQ counter of the Konami VRC4, VRC6 and VRC7. In scanline mode a prescaler counts
+down 3 per CPU cycle from 341, which is one scanline in PPU dots, in cycle mode the
+counter ticks on every CPU cycle. The IRQ fires when the counter passes $FF.
+*/
+type vrcIRQ struct {
+	Latch          uint8
+	Counter        uint8
+	Prescaler      int16
+	Enabled        bool
+	EnableAfterAck bool
+	CycleMode      bool
+	IRQ            bool
+}
+
+func (v *vrcIRQ) writeControl(value uint8) {
+	v.EnableAfterAck = getBit(value, 0)
+	v.Enabled = getBit(value, 1)
+	v.CycleMode = getBit(value, 2)
+	if v.Enabled {
+		v.Counter = v.Latch
+		v.Prescaler = 341
+	}
+	v.IRQ = false
+}
+
+func (v *vrcIRQ) acknowledge() {
+	v.IRQ = false
+	v.Enabled = v.EnableAfterAck
+}
+
+func (v *vrcIRQ) clock() {
+	if !v.Enabled {
+		return
+	}
+	if !v.CycleMode {
+		v.Prescaler -= 3
+		if v.Prescaler > 0 {
+			return
+		}
+		v.Prescaler += 341
+	}
+	if v.Counter == 0xFF {
+		v.Counter = v.Latch
+		v.IRQ = true
+	} else {
+		v.Counter++
+	}
+}
+
+// VRC6 pulse, 16 steps with the first Duty+1 of them high
+type VRC6Pulse struct {
+	Enabled  bool
+	Constant bool // ignores the duty and outputs the volume
+	Duty     uint8
+	Volume   uint8
+	Period   uint16
+	Timer    uint16
+	Step     uint8
+}
+
+func (p *VRC6Pulse) write(register uint16, value uint8) {
+	switch register {
+	case 0:
+		p.Constant = getBit(value, 7)
+		p.Duty = value >> 4 & 7
+		p.Volume = value & 0x0F
+	case 1:
+		p.Period = p.Period&0x0F00 | uint16(value)
+	case 2:
+		p.Period = p.Period&0x00FF | uint16(value&0x0F)<<8
+		p.Enabled = getBit(value, 7)
+		if !p.Enabled {
+			p.Step = 15
+		}
+	}
+}
+
+func (p *VRC6Pulse) clock(shift uint8) {
+	if !p.Enabled {
+		return
+	}
+	if p.Timer > 0 {
+		p.Timer--
+		return
+	}
+	p.Timer = p.Period >> shift
+	p.Step = (p.Step + 1) & 0x0F
+}
+
+func (p *VRC6Pulse) output() uint8 {
+	if !p.Enabled || (!p.Constant && p.Step > p.Duty) {
+		return 0
+	}
+	return p.Volume
+}
+
+// VRC6 sawtooth, the accumulator adds Rate on every other of 14 steps and then resets
+type VRC6Saw struct {
+	Enabled     bool
+	Rate        uint8
+	Period      uint16
+	Timer       uint16
+	Step        uint8
+	Accumulator uint8
+}
+
+func (s *VRC6Saw) write(register uint16, value uint8) {
+	switch register {
+	case 0:
+		s.Rate = value & 0x3F
+	case 1:
+		s.Period = s.Period&0x0F00 | uint16(value)
+	case 2:
+		s.Period = s.Period&0x00FF | uint16(value&0x0F)<<8
+		s.Enabled = getBit(value, 7)
+		if !s.Enabled {
+			s.Step = 0
+			s.Accumulator = 0
+		}
+	}
+}
+
+func (s *VRC6Saw) clock(shift uint8) {
+	if !s.Enabled {
+		return
+	}
+	if s.Timer > 0 {
+		s.Timer--
+		return
+	}
+	s.Timer = s.Period >> shift
+	s.Step++
+	if s.Step == 14 {
+		s.Step = 0
+		s.Accumulator = 0
+	} else if s.Step&1 == 0 {
+		s.Accumulator += s.Rate
+	}
+}
+
+func (s *VRC6Saw) output() uint8 {
+	return s.Accumulator >> 3
+}
+
+// VRC6Audio is the two pulses and the sawtooth of the Konami VRC6
+type VRC6Audio struct {
+	Pulse [2]VRC6Pulse
+	Saw   VRC6Saw
+	// $9003 halts every channel or speeds them up 16 or 256 times
+	Halt  bool
+	Shift uint8
+}
+
+// Handles writes to $9000-$9003, $A000-$A002 and $B000-$B002
+func (a *VRC6Audio) write(address uint16, value uint8) {
+	register := address & 3
+	switch address & 0xF000 {
+	case 0x9000:
+		if register == 3 {
+			a.Halt = getBit(value, 0)
+			a.Shift = 0
+			if getBit(value, 2) {
+				a.Shift = 8
+			} else if getBit(value, 1) {
+				a.Shift = 4
+			}
+			return
+		}
+		a.Pulse[0].write(register, value)
+	case 0xA000:
+		a.Pulse[1].write(register, value)
+	case 0xB000:
+		a.Saw.write(register, value)
+	}
+}
+
+func (a *VRC6Audio) clock() {
+	if a.Halt {
+		return
+	}
+	a.Pulse[0].clock(a.Shift)
+	a.Pulse[1].clock(a.Shift)
+	a.Saw.clock(a.Shift)
+}
+
+// The outputs add linearly, one step of a VRC6 pulse is about one step of an APU pulse
+func (a *VRC6Audio) output() float64 {
+	level := int(a.Pulse[0].output()) + int(a.Pulse[1].output()) + int(a.Saw.output())
+	return float64(level) * pulseMixTable[15] / 15
+}
+
+type vrc6Registers struct {
+	PRG16     uint8
+	PRG8      uint8
+	CHR       [8]uint8 // kept for when there is a PPU
+	Mirroring uint8
+}
+
+/*
+VRC6 is Konami's mapper 24 and 26 with a switchable 16KB bank at $8000, an 8KB bank at
+$C000, the last 8KB fixed at $E000 and the sound chip. Mapper 26 boards swap the A0
+and A1 lines, so their register addresses are decoded the other way round.
+*/
+type VRC6 struct {
+	Registers vrc6Registers
+	irq       vrcIRQ
+	Sound     VRC6Audio
+
+	prg     []uint8
+	swapped bool
+	cpu     *CPU
+}
+
+func NewVRC6(prg []uint8, swapped bool) *VRC6 {
+	return &VRC6{prg: prg, swapped: swapped}
+}
+
+func (m *VRC6) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+func (m *VRC6) mapBanks() {
+	m.cpu.mapPRG(m.prg, 0x8000, 0x4000, int(m.Registers.PRG16))
+	m.cpu.mapPRG(m.prg, 0xC000, 0x2000, int(m.Registers.PRG8))
+	m.cpu.mapPRG(m.prg, 0xE000, 0x2000, -1)
+}
+
+func (m *VRC6) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+func (m *VRC6) Write(address uint16, value uint8) bool {
+	if address < 0x8000 {
+		return false
+	}
+	if m.swapped {
+		address = address&^3 | address>>1&1 | address<<1&2
+	}
+	address &= 0xF003
+	r := &m.Registers
+	switch {
+	case address < 0x9000:
+		r.PRG16 = value & 0x0F
+		m.mapBanks()
+	case address < 0xB003:
+		m.Sound.write(address, value)
+	case address == 0xB003:
+		r.Mirroring = value >> 2 & 3
+	case address < 0xD000:
+		r.PRG8 = value & 0x1F
+		m.mapBanks()
+	case address < 0xF000:
+		r.CHR[(address-0xD000)>>10|address&3] = value
+	case address == 0xF000:
+		m.irq.Latch = value
+	case address == 0xF001:
+		m.irq.writeControl(value)
+	case address == 0xF002:
+		m.irq.acknowledge()
+	}
+	return true
+}
+
+func (m *VRC6) Clock() {
+	m.irq.clock()
+	m.Sound.clock()
+}
+
+func (m *VRC6) IRQ() bool {
+	return m.irq.IRQ
+}
+
+func (m *VRC6) Audio() ExpansionAudio {
+	return &m.Sound
+}
+
+func (m *VRC6) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.irq, &m.Sound)
+}
+
+func (m *VRC6) loadState(r io.Reader) error {
+	registers, irq, sound := m.Registers, m.irq, m.Sound
+	if err := readMapperState(r, &registers, &irq, &sound); err != nil {
+		return err
+	}
+	m.Registers, m.irq, m.Sound = registers, irq, sound
+	m.mapBanks()
+	return nil
+}
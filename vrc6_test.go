@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVRC6Saw(t *testing.T) {
+	m := NewVRC6(numberedBanks(8, 0x4000), false)
+	newMapperCPU(m)
+	// Rate 42 with period 0, so every clock is a step
+	m.Write(0xB000, 42)
+	m.Write(0xB001, 0)
+	m.Write(0xB002, 0x80)
+
+	var accumulator []uint8
+	for i := 0; i < 15; i++ {
+		m.Clock()
+		accumulator = append(accumulator, m.Sound.Saw.Accumulator)
+	}
+	// Odd steps hold, even ones add the rate and the 14th resets
+	want := []uint8{0, 42, 42, 84, 84, 126, 126, 168, 168, 210, 210, 252, 252, 0, 0}
+	if !reflect.DeepEqual(accumulator, want) {
+		t.Errorf("accumulator %v, want %v", accumulator, want)
+	}
+	m.Sound.Saw.Accumulator = 252
+	if out := m.Sound.Saw.output(); out != 31 {
+		t.Errorf("output of 252 is %d, want the top 5 bits, 31", out)
+	}
+
+	m.Write(0xB002, 0)
+	if m.Sound.Saw.Accumulator != 0 || m.Sound.Saw.output() != 0 {
+		t.Error("disabling the saw did not clear the accumulator")
+	}
+}
+
+func TestVRC6PulseDuty(t *testing.T) {
+	for duty := uint8(0); duty < 8; duty++ {
+		m := NewVRC6(numberedBanks(8, 0x4000), false)
+		newMapperCPU(m)
+		m.Write(0x9000, duty<<4|0x0F)
+		m.Write(0x9001, 0)
+		m.Write(0x9002, 0x80)
+
+		high := 0
+		for i := 0; i < 16; i++ {
+			m.Clock()
+			switch m.Sound.Pulse[0].output() {
+			case 15:
+				high++
+			case 0:
+			default:
+				t.Fatalf("duty %d: output is not 0 or the volume", duty)
+			}
+		}
+		if high != int(duty)+1 {
+			t.Errorf("duty %d: high for %d of 16 steps, want %d", duty, high, duty+1)
+		}
+	}
+
+	t.Run("constant", func(t *testing.T) {
+		m := NewVRC6(numberedBanks(8, 0x4000), false)
+		newMapperCPU(m)
+		m.Write(0xA000, 0x87)
+		m.Write(0xA002, 0x80)
+		for i := 0; i < 16; i++ {
+			m.Clock()
+			if out := m.Sound.Pulse[1].output(); out != 7 {
+				t.Fatalf("step %d: output %d, want the volume 7", m.Sound.Pulse[1].Step, out)
+			}
+		}
+	})
+}
+
+func TestVRC6Frequency(t *testing.T) {
+	tests := []struct {
+		control uint8
+		steps   int // steps in 256 clocks at period 15
+	}{
+		{0x00, 16},
+		{0x02, 256}, // 16 times faster, period 0
+		{0x01, 0},   // halted
+	}
+	for _, test := range tests {
+		m := NewVRC6(numberedBanks(8, 0x4000), false)
+		newMapperCPU(m)
+		m.Write(0x9003, test.control)
+		m.Write(0x9001, 15)
+		m.Write(0x9002, 0x80)
+		steps := 0
+		for i := 0; i < 256; i++ {
+			step := m.Sound.Pulse[0].Step
+			m.Clock()
+			if m.Sound.Pulse[0].Step != step {
+				steps++
+			}
+		}
+		if steps != test.steps {
+			t.Errorf("$9003 = $%02X: %d steps, want %d", test.control, steps, test.steps)
+		}
+	}
+}
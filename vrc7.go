@@ -0,0 +1,418 @@
+package main
+
+import (
+	"io"
+	"math"
+)
+
+// Built in instruments 1-15 of the VRC7, instrument 0 is the custom one at $00-$07
+var vrc7Patches = [15][8]uint8{
+	{0x03, 0x21, 0x05, 0x06, 0xE8, 0x81, 0x42, 0x27},
+	{0x13, 0x41, 0x14, 0x0D, 0xD8, 0xF6, 0x23, 0x12},
+	{0x11, 0x11, 0x08, 0x08, 0xFA, 0xB2, 0x20, 0x12},
+	{0x31, 0x61, 0x0C, 0x07, 0xA8, 0x64, 0x61, 0x27},
+	{0x32, 0x21, 0x1E, 0x06, 0xE1, 0x76, 0x01, 0x28},
+	{0x02, 0x01, 0x06, 0x00, 0xA3, 0xE2, 0xF4, 0xF4},
+	{0x21, 0x61, 0x1D, 0x07, 0x82, 0x81, 0x11, 0x07},
+	{0x23, 0x21, 0x22, 0x17, 0xA2, 0x72, 0x01, 0x17},
+	{0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01},
+	{0xB5, 0x01, 0x0F, 0x0F, 0xA8, 0xA5, 0x51, 0x02},
+	{0x17, 0xC1, 0x24, 0x07, 0xF8, 0xF8, 0x22, 0x12},
+	{0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16},
+	{0x01, 0x02, 0xD3, 0x05, 0xC9, 0x95, 0x03, 0x02},
+	{0x61, 0x63, 0x0C, 0x00, 0x94, 0xC0, 0x33, 0xF6},
+	{0x21, 0x72, 0x0D, 0x00, 0xC1, 0xD5, 0x56, 0x06},
+}
+
+var opllMultipliers = [16]float64{0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 10, 12, 12, 15, 15}
+
+// Key scale attenuation in dB at block 7, by the top 4 bits of the F-number
+var opllKSL = [16]float64{0, 18, 24, 27.75, 30, 32.25, 33.75, 35.25, 36, 37.5, 38.25, 39, 39.75, 40.5, 41.25, 42}
+
+const (
+	// The VRC7 runs from a 3.58 MHz crystal and makes a sample every 72 of its cycles,
+	// which is close enough to every 36 CPU cycles on the Famicom
+	vrc7SampleRate   = 3579545.0 / 72
+	vrc7ClockDivider = 36
+	// Attenuation of a silent operator in dB
+	opllSilent = 96.0
+
+	// Time of a full attack and a full decay at rate 1, halving with every step of the rate
+	opllAttackMs = 2826.24
+	opllDecayMs  = 39280.64
+
+	// Tremolo of 4.8 dB at 3.7 Hz, vibrato of about 7 cents at 6.4 Hz
+	opllAMDepth  = 4.8
+	opllAMRate   = 3.7
+	opllVibDepth = 0.004
+	opllVibRate  = 6.4
+)
+
+// Envelope stages
+const (
+	opllAttack = iota
+	opllDecay
+	opllSustain
+	opllRelease
+)
+
+type OPLLOperator struct {
+	Phase       float64 // in cycles
+	Attenuation float64 // envelope in dB
+	Stage       uint8
+	// Last two outputs, the modulator feeds them back into itself
+	Output   float64
+	Previous float64
+}
+
+// Parameters of one operator unpacked from an instrument
+type opllPatch struct {
+	am, vib, sustained, ksr bool
+	mult                    float64
+	ksl                     uint8
+	rectify                 bool
+	attack, decay           uint8
+	sustainLevel, release   uint8
+}
+
+func opllOperatorPatch(instrument *[8]uint8, carrier int) opllPatch {
+	flags := instrument[carrier]
+	envelope := instrument[4+carrier]
+	levels := instrument[6+carrier]
+	return opllPatch{
+		am:           getBit(flags, 7),
+		vib:          getBit(flags, 6),
+		sustained:    getBit(flags, 5),
+		ksr:          getBit(flags, 4),
+		mult:         opllMultipliers[flags&0x0F],
+		ksl:          instrument[2+carrier] >> 6,
+		rectify:      getBit(instrument[3], uint8(3+carrier)),
+		attack:       envelope >> 4,
+		decay:        envelope & 0x0F,
+		sustainLevel: levels >> 4,
+		release:      levels & 0x0F,
+	}
+}
+
+type OPLLChannel struct {
+	FNumber    uint16
+	Block      uint8
+	KeyOn      bool
+	Sustain    bool
+	Instrument uint8
+	Volume     uint8
+
+	Modulator OPLLOperator
+	Carrier   OPLLOperator
+}
+
+/*
+VRC7Audio is the FM sound of the Konami VRC7, a cut down YM2413 (OPLL) with six two
+operator channels and no rhythm mode. This is a floating point model of the chip:
+envelopes, key scaling, feedback, tremolo and vibrato follow the datasheet but the
+output is not bit exact.
+*/
+type VRC7Audio struct {
+	Address  uint8
+	Custom   [8]uint8
+	Channels [6]OPLLChannel
+	// $E000 bit 6 holds the chip in reset
+	Silenced bool
+
+	Divider  uint8
+	AMPhase  float64
+	VibPhase float64
+	Output   float64
+}
+
+// Handles writes to $9010 and $9030
+func (a *VRC7Audio) write(address uint16, value uint8) {
+	if address&0x20 == 0 {
+		a.Address = value
+		return
+	}
+	register := a.Address
+	switch {
+	case register < 0x08:
+		a.Custom[register] = value
+	case register >= 0x10 && register < 0x36 && register&0x0F < 6:
+		ch := &a.Channels[register&0x0F]
+		switch register & 0xF0 {
+		case 0x10:
+			ch.FNumber = ch.FNumber&0x100 | uint16(value)
+		case 0x20:
+			ch.FNumber = ch.FNumber&0xFF | uint16(value&1)<<8
+			ch.Block = value >> 1 & 7
+			ch.Sustain = getBit(value, 5)
+			keyOn := getBit(value, 4)
+			if keyOn && !ch.KeyOn {
+				for _, op := range []*OPLLOperator{&ch.Modulator, &ch.Carrier} {
+					op.Stage = opllAttack
+					op.Phase = 0
+				}
+			} else if !keyOn && ch.KeyOn {
+				ch.Modulator.Stage = opllRelease
+				ch.Carrier.Stage = opllRelease
+			}
+			ch.KeyOn = keyOn
+		case 0x30:
+			ch.Instrument = value >> 4
+			ch.Volume = value & 0x0F
+		}
+	}
+}
+
+// Silences every operator, as at power on
+func (a *VRC7Audio) reset() {
+	for i := range a.Channels {
+		ch := &a.Channels[i]
+		*ch = OPLLChannel{}
+		for _, op := range []*OPLLOperator{&ch.Modulator, &ch.Carrier} {
+			op.Attenuation = opllSilent
+			op.Stage = opllRelease
+		}
+	}
+}
+
+func (a *VRC7Audio) instrument(ch *OPLLChannel) *[8]uint8 {
+	if ch.Instrument == 0 {
+		return &a.Custom
+	}
+	return &vrc7Patches[ch.Instrument-1]
+}
+
+// dB per sample for an envelope rate, rate 0 stops the envelope and 15 is immediate
+func opllRate(value uint8, ksr bool, ch *OPLLChannel, fullMs float64) float64 {
+	if value == 0 {
+		return 0
+	}
+	offset := int(ch.Block)<<1 | int(ch.FNumber>>8)
+	if !ksr {
+		offset >>= 2
+	}
+	effective := min(4*int(value)+offset, 63)
+	if effective >= 60 {
+		return opllSilent
+	}
+	ms := fullMs / math.Pow(2, float64(effective-4)/4)
+	return opllSilent / (ms / 1000 * vrc7SampleRate)
+}
+
+// Steps an operator's envelope by one sample
+func (op *OPLLOperator) clockEnvelope(p opllPatch, ch *OPLLChannel) {
+	switch op.Stage {
+	case opllAttack:
+		step := opllRate(p.attack, p.ksr, ch, opllAttackMs)
+		if step >= opllSilent {
+			op.Attenuation = 0
+		} else if step > 0 {
+			// The attack is exponential, the same rate covers the last dB as the first
+			op.Attenuation -= op.Attenuation * step / opllSilent * math.Log(opllSilent*10)
+		}
+		if op.Attenuation < 0.1 {
+			op.Attenuation = 0
+			op.Stage = opllDecay
+		}
+	case opllDecay:
+		op.Attenuation += opllRate(p.decay, p.ksr, ch, opllDecayMs)
+		if level := float64(p.sustainLevel) * 3; op.Attenuation >= level {
+			op.Attenuation = level
+			op.Stage = opllSustain
+		}
+	case opllSustain:
+		// Percussive instruments keep decaying at the release rate while the key is held
+		if !p.sustained {
+			op.Attenuation += opllRate(p.release, p.ksr, ch, opllDecayMs)
+		}
+	case opllRelease:
+		rate := p.release
+		switch {
+		case ch.Sustain:
+			rate = 5
+		case !p.sustained:
+			rate = 7
+		}
+		op.Attenuation += opllRate(rate, p.ksr, ch, opllDecayMs)
+	}
+	op.Attenuation = min(op.Attenuation, opllSilent)
+}
+
+// Steps the phase and returns the operator output for a phase offset in cycles
+func (op *OPLLOperator) clock(p opllPatch, ch *OPLLChannel, level float64, modulation float64, am float64, vib float64) float64 {
+	op.clockEnvelope(p, ch)
+
+	step := float64(uint32(ch.FNumber)<<ch.Block) * p.mult / (1 << 19)
+	if p.vib {
+		step *= 1 + vib
+	}
+	op.Phase = math.Mod(op.Phase+step, 1)
+
+	attenuation := op.Attenuation + level
+	if p.ksl > 0 {
+		ksl := max(opllKSL[ch.FNumber>>5]-6*float64(7-ch.Block), 0)
+		attenuation += ksl / float64(int(1)<<(3-p.ksl))
+	}
+	if p.am {
+		attenuation += am
+	}
+	if attenuation >= opllSilent {
+		op.Previous, op.Output = op.Output, 0
+		return 0
+	}
+
+	out := math.Sin(2 * math.Pi * (op.Phase + modulation))
+	if p.rectify && out < 0 {
+		out = 0
+	}
+	out *= math.Pow(10, -attenuation/20)
+	op.Previous, op.Output = op.Output, out
+	return out
+}
+
+// Produces a new sample every vrc7ClockDivider CPU cycles
+func (a *VRC7Audio) clock() {
+	a.Divider++
+	if a.Divider < vrc7ClockDivider {
+		return
+	}
+	a.Divider = 0
+	if a.Silenced {
+		a.reset()
+		a.Output = 0
+		return
+	}
+
+	a.AMPhase = math.Mod(a.AMPhase+opllAMRate/vrc7SampleRate, 1)
+	a.VibPhase = math.Mod(a.VibPhase+opllVibRate/vrc7SampleRate, 1)
+	am := (1 + math.Sin(2*math.Pi*a.AMPhase)) / 2 * opllAMDepth
+	vib := opllVibDepth * math.Sin(2*math.Pi*a.VibPhase)
+
+	a.Output = 0
+	for i := range a.Channels {
+		ch := &a.Channels[i]
+		instrument := a.instrument(ch)
+		mod := opllOperatorPatch(instrument, 0)
+		car := opllOperatorPatch(instrument, 1)
+
+		var feedback float64
+		if fb := instrument[3] & 7; fb > 0 {
+			feedback = (ch.Modulator.Output + ch.Modulator.Previous) / 2 * float64(int(1)<<fb) / 64
+		}
+		m := ch.Modulator.clock(mod, ch, float64(instrument[2]&0x3F)*0.75, feedback, am, vib)
+		// A full scale modulator moves the carrier phase by up to two cycles
+		a.Output += ch.Carrier.clock(car, ch, float64(ch.Volume)*3, m*2, am, vib)
+	}
+}
+
+// A channel at full volume is about as loud as an APU pulse at full volume
+func (a *VRC7Audio) output() float64 {
+	return a.Output * pulseMixTable[15] / 2
+}
+
+type vrc7Registers struct {
+	PRG     [3]uint8
+	CHR     [8]uint8 // kept for when there is a PPU
+	Control uint8
+}
+
+/*
+VRC7 is Konami's mapper 85, three switchable 8KB banks at $8000-$DFFF with the last
+one fixed at $E000, and the FM sound chip. Boards connect either A3 or A4 to the
+register select line, both are accepted.
+*/
+type VRC7 struct {
+	Registers vrc7Registers
+	irq       vrcIRQ
+	Sound     VRC7Audio
+
+	prg []uint8
+	cpu *CPU
+}
+
+func NewVRC7(prg []uint8) *VRC7 {
+	m := &VRC7{prg: prg}
+	m.Sound.reset()
+	return m
+}
+
+func (m *VRC7) Reset(cpu *CPU) {
+	m.cpu = cpu
+	m.mapBanks()
+}
+
+func (m *VRC7) mapBanks() {
+	for i, bank := range m.Registers.PRG {
+		m.cpu.mapPRG(m.prg, 0x8000+uint16(i)*0x2000, 0x2000, int(bank))
+	}
+	m.cpu.mapPRG(m.prg, 0xE000, 0x2000, -1)
+}
+
+func (m *VRC7) Read(address uint16) (uint8, bool) {
+	return 0, false
+}
+
+func (m *VRC7) Write(address uint16, value uint8) bool {
+	if address < 0x8000 {
+		return false
+	}
+	if address&0xF010 == 0x9010 {
+		m.Sound.write(address, value)
+		return true
+	}
+	high := 0
+	if address&0x18 != 0 {
+		high = 1
+	}
+	r := &m.Registers
+	switch address & 0xF000 {
+	case 0x8000:
+		r.PRG[high] = value & 0x3F
+		m.mapBanks()
+	case 0x9000:
+		r.PRG[2] = value & 0x3F
+		m.mapBanks()
+	case 0xA000, 0xB000, 0xC000, 0xD000:
+		r.CHR[int(address-0xA000)>>11|high] = value
+	case 0xE000:
+		if high == 1 {
+			m.irq.Latch = value
+			break
+		}
+		r.Control = value
+		m.Sound.Silenced = getBit(value, 6)
+	case 0xF000:
+		if high == 1 {
+			m.irq.acknowledge()
+		} else {
+			m.irq.writeControl(value)
+		}
+	}
+	return true
+}
+
+func (m *VRC7) Clock() {
+	m.irq.clock()
+	m.Sound.clock()
+}
+
+func (m *VRC7) IRQ() bool {
+	return m.irq.IRQ
+}
+
+func (m *VRC7) Audio() ExpansionAudio {
+	return &m.Sound
+}
+
+func (m *VRC7) saveState(w io.Writer) {
+	writeMapperState(w, &m.Registers, &m.irq, &m.Sound)
+}
+
+func (m *VRC7) loadState(r io.Reader) error {
+	registers, irq, sound := m.Registers, m.irq, m.Sound
+	if err := readMapperState(r, &registers, &irq, &sound); err != nil {
+		return err
+	}
+	m.Registers, m.irq, m.Sound = registers, irq, sound
+	m.mapBanks()
+	return nil
+}
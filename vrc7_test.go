@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+// Selects a VRC7 sound register and writes it
+func writeVRC7(m *VRC7, register uint8, value uint8) {
+	m.Write(0x9010, register)
+	m.Write(0x9030, value)
+}
+
+func TestVRC7Registers(t *testing.T) {
+	m := NewVRC7(numberedBanks(8, 0x2000))
+	newMapperCPU(m)
+
+	writeVRC7(m, 0x12, 0x34)
+	writeVRC7(m, 0x22, 0x3B) // sustain, key on, block 5, F-number bit 8
+	writeVRC7(m, 0x32, 0x7A)
+	ch := &m.Sound.Channels[2]
+	if ch.FNumber != 0x134 || ch.Block != 5 || !ch.KeyOn || !ch.Sustain || ch.Instrument != 7 || ch.Volume != 0x0A {
+		t.Errorf("channel 2 decoded as %+v", *ch)
+	}
+	if ch.Modulator.Stage != opllAttack || ch.Carrier.Stage != opllAttack {
+		t.Error("key on did not start the attack")
+	}
+	writeVRC7(m, 0x22, 0x0B)
+	if ch.KeyOn || ch.Modulator.Stage != opllRelease || ch.Carrier.Stage != opllRelease {
+		t.Error("key off did not start the release")
+	}
+
+	// Only six channels, $x6-$xF are not registers
+	channels, custom := m.Sound.Channels, m.Sound.Custom
+	writeVRC7(m, 0x16, 0xFF)
+	writeVRC7(m, 0x3F, 0xFF)
+	if m.Sound.Channels != channels || m.Sound.Custom != custom {
+		t.Error("writing a register past the sixth channel changed the chip")
+	}
+}
+
+func TestVRC7Instruments(t *testing.T) {
+	m := NewVRC7(numberedBanks(8, 0x2000))
+	newMapperCPU(m)
+	custom := [8]uint8{0xF5, 0x21, 0x85, 0x18, 0x12, 0x34, 0x56, 0x78}
+	for i, value := range custom {
+		writeVRC7(m, uint8(i), value)
+	}
+
+	ch := &m.Sound.Channels[0]
+	if instrument := m.Sound.instrument(ch); *instrument != custom {
+		t.Errorf("instrument 0 is %X, want the custom %X", *instrument, custom)
+	}
+	writeVRC7(m, 0x30, 0x30)
+	if instrument := m.Sound.instrument(ch); *instrument != vrc7Patches[2] {
+		t.Errorf("instrument 3 is %X, want built in patch 3", *instrument)
+	}
+
+	modulator := opllOperatorPatch(&custom, 0)
+	want := opllPatch{
+		am: true, vib: true, sustained: true, ksr: true, mult: 5,
+		ksl: 2, rectify: true, attack: 1, decay: 2, sustainLevel: 5, release: 6,
+	}
+	if modulator != want {
+		t.Errorf("modulator %+v, want %+v", modulator, want)
+	}
+	carrier := opllOperatorPatch(&custom, 1)
+	want = opllPatch{
+		sustained: true, mult: 1,
+		ksl: 0, rectify: true, attack: 3, decay: 4, sustainLevel: 7, release: 8,
+	}
+	if carrier != want {
+		t.Errorf("carrier %+v, want %+v", carrier, want)
+	}
+}
+
+func TestVRC7Silenced(t *testing.T) {
+	m := NewVRC7(numberedBanks(8, 0x2000))
+	newMapperCPU(m)
+	writeVRC7(m, 0x30, 0x30)
+	writeVRC7(m, 0x10, 0x80)
+	writeVRC7(m, 0x20, 0x18)
+	for i := 0; i < 100*vrc7ClockDivider; i++ {
+		m.Clock()
+	}
+	if m.Sound.output() == 0 {
+		t.Fatal("a keyed on channel is silent")
+	}
+
+	m.Write(0xE000, 0x40)
+	for i := 0; i < vrc7ClockDivider; i++ {
+		m.Clock()
+	}
+	if m.Sound.output() != 0 || m.Sound.Channels[0].KeyOn {
+		t.Error("$E000 bit 6 did not reset the chip")
+	}
+}
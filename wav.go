@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+/*
+wavWriter streams 16 bit mono PCM. The chunk sizes are left at zero until close, when
+they are patched in if the output can seek.
+*/
+type wavWriter struct {
+	out     io.Writer
+	w       *bufio.Writer
+	samples uint32
+}
+
+func newWAVWriter(out io.Writer, rate int) (*wavWriter, error) {
+	ww := &wavWriter{out: out, w: bufio.NewWriter(out)}
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, uint32(0), [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16),
+		uint16(1),        // PCM
+		uint16(1),        // channels
+		uint32(rate),     // sample rate
+		uint32(rate * 2), // byte rate
+		uint16(2),        // block align
+		uint16(16),       // bits per sample
+		[4]byte{'d', 'a', 't', 'a'}, uint32(0),
+	}
+	for _, field := range header {
+		if err := binary.Write(ww.w, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	return ww, nil
+}
+
+func (ww *wavWriter) write(samples []int16) error {
+	ww.samples += uint32(len(samples))
+	return binary.Write(ww.w, binary.LittleEndian, samples)
+}
+
+func (ww *wavWriter) close() error {
+	if err := ww.w.Flush(); err != nil {
+		return err
+	}
+	seeker, ok := ww.out.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	size := ww.samples * 2
+	for _, patch := range []struct {
+		offset int64
+		value  uint32
+	}{{4, 36 + size}, {40, size}} {
+		if _, err := seeker.Seek(patch.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(seeker, binary.LittleEndian, patch.value); err != nil {
+			return err
+		}
+	}
+	_, err := seeker.Seek(0, io.SeekEnd)
+	return err
+}
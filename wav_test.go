@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fields of a 44 byte WAV header that change with the file
+type wavHeader struct {
+	RIFF     [4]byte
+	Size     uint32
+	WAVE     [4]byte
+	Fmt      [4]byte
+	FmtSize  uint32
+	Format   uint16
+	Channels uint16
+	Rate     uint32
+	ByteRate uint32
+	Align    uint16
+	Bits     uint16
+	Data     [4]byte
+	DataSize uint32
+}
+
+func readWAVHeader(t *testing.T, data []byte) wavHeader {
+	t.Helper()
+	var header wavHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+		t.Fatalf("reading the WAV header: %v", err)
+	}
+	return header
+}
+
+func TestWAVWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ww, err := newWAVWriter(file, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := []int16{0, 1000, -1000, 32767, -32768}
+	for i := 0; i < 100; i++ {
+		if err := ww.write(samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ww.close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := readWAVHeader(t, data)
+	want := wavHeader{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + 1000, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, 16, 1, 1, 48000, 96000, 2, 16,
+		[4]byte{'d', 'a', 't', 'a'}, 1000,
+	}
+	if header != want {
+		t.Errorf("header %+v, want %+v", header, want)
+	}
+	if len(data) != 44+1000 {
+		t.Errorf("file is %d bytes, want %d", len(data), 44+1000)
+	}
+	if got := int16(binary.LittleEndian.Uint16(data[44+6:])); got != 32767 {
+		t.Errorf("fourth sample %d, want 32767", got)
+	}
+}
+
+// Without seeking the sizes cannot be patched and are left at zero
+func TestWAVWriterStream(t *testing.T) {
+	var out bytes.Buffer
+	ww, err := newWAVWriter(&out, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ww.write([]int16{1, 2, 3})
+	if err := ww.close(); err != nil {
+		t.Fatal(err)
+	}
+	header := readWAVHeader(t, out.Bytes())
+	if header.Size != 0 || header.DataSize != 0 || out.Len() != 44+6 {
+		t.Errorf("RIFF size %d, data size %d, %d bytes", header.Size, header.DataSize, out.Len())
+	}
+}